@@ -1,70 +1,166 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
 	"time"
 
 	hostmonitor "github.com/rickbau5/host-monitor"
-
-	"github.com/irai/packet"
 )
 
 var (
-	iface string
+	ifaceList  string
+	mode       string
+	interval   time.Duration
+	silentLoad bool
+
+	probeMethods  string
+	probeInterval time.Duration
 )
 
 func init() {
-	flag.StringVar(&iface, "i", "", "the name of the network interface to load the arp table for")
+	flag.StringVar(&ifaceList, "i", "", "comma separated names of the network interfaces to follow the neighbor table of")
+	flag.StringVar(&mode, "mode", "poll", "how the neighbor table is read: poll to load /proc/net/arp or ip to load the output of ip neigh every interval, netlink to follow the kernel's neighbor notifications (linux only)")
+	flag.DurationVar(&interval, "interval", 15*time.Second, "how often the neighbor table is loaded in the poll and ip modes")
+	flag.BoolVar(&silentLoad, "silent-load", false, "load the initial neighbor table without reporting its hosts as coming online, in the poll and ip modes")
+	flag.StringVar(&probeMethods, "probe", "", "comma separated methods used to probe hosts before reporting them offline in the poll and ip modes: arp and icmp, disabled if empty")
+	flag.DurationVar(&probeInterval, "probe-interval", 250*time.Millisecond, "minimum time between probes")
 }
 
 func main() {
 	flag.Parse()
-	if iface == "" {
+	if ifaceList == "" {
 		fmt.Println("argument -i is required")
 		os.Exit(1)
 	}
+	ifaces := strings.Split(ifaceList, ",")
+
+	switch mode {
+	case "netlink":
+		runNetlink(ifaces)
+	case "poll":
+		runPoll(ifaces, hostmonitor.LoadARPTable)
+	case "ip":
+		runPoll(ifaces, hostmonitor.LoadIPNeighbors)
+	default:
+		fmt.Println("argument -mode must be netlink, poll or ip")
+		os.Exit(1)
+	}
+}
+
+// newHostMaps creates a HostMap for each interface and logs their changes tagged with the interface.
+func newHostMaps(ifaces []string, opts func(iface string) []hostmonitor.HostMapOption) map[string]*hostmonitor.HostMap {
+	hostMaps := make(map[string]*hostmonitor.HostMap, len(ifaces))
+	for _, iface := range ifaces {
+		hosts := hostmonitor.NewHostMap(append(opts(iface), hostmonitor.InterfaceOption(iface))...)
+		hostMaps[iface] = hosts
+
+		go func() {
+			for change := range hosts.Notifications() {
+				log.Println("change detected:", change)
+			}
+		}()
+	}
+
+	return hostMaps
+}
+
+// runPoll loads the neighbor table of the interfaces every interval
+func runPoll(ifaces []string, load func(ifaces ...string) ([]hostmonitor.Neighbor, error)) {
+	hostMaps := newHostMaps(ifaces, func(iface string) []hostmonitor.HostMapOption {
+		if probeMethods == "" {
+			return nil
+		}
 
-	hosts := hostmonitor.NewHostMap()
+		prober, err := hostmonitor.NewProber(iface, strings.Split(probeMethods, ",")...)
+		if err != nil {
+			fmt.Println("failed creating prober:", err)
+			os.Exit(1)
+		}
+		return []hostmonitor.HostMapOption{hostmonitor.ProberOption(prober, probeInterval)}
+	})
 
-	addrs, err := packet.LoadLinuxARPTable(iface)
+	neighbors, err := load(ifaces...)
 	if err != nil {
 		fmt.Println("failed initial load:", err)
 		os.Exit(1)
 	}
-	hosts.UpdateAddresses(addrsToAddrs(addrs))
-
-	hosts.PrintTable()
-
-	go func() {
-		for change := range hosts.Notifications() {
-			log.Println("change detected:", change)
+	for iface, addrs := range addrsByInterface(ifaces, neighbors) {
+		if silentLoad {
+			hostMaps[iface].ResetAndLoad(addrs)
+		} else {
+			hostMaps[iface].UpdateAddresses(addrs)
 		}
-	}()
+	}
+
+	for _, iface := range ifaces {
+		hostMaps[iface].PrintTable()
+	}
 
-	ticks := time.Tick(15 * time.Second)
+	ticks := time.Tick(interval)
 	for range ticks {
-		addrs, err := packet.LoadLinuxARPTable(iface)
+		neighbors, err := load(ifaces...)
 		if err != nil {
-			log.Println("error loading linux arp table:", err)
+			log.Println("error loading neighbor table:", err)
 			continue
 		}
 
-		_ = hosts.UpdateAddresses(addrsToAddrs(addrs))
+		for iface, addrs := range addrsByInterface(ifaces, neighbors) {
+			_ = hostMaps[iface].UpdateAddresses(addrs)
+		}
 	}
 }
 
-func addrsToAddrs(addrs []packet.Addr) []hostmonitor.Addr {
-	hmAddrs := make([]hostmonitor.Addr, len(addrs))
-	for i, addr := range addrs {
-		hmAddrs[i] = hostmonitor.Addr{
-			MAC:  addr.MAC,
-			IP:   addr.IP,
-			Port: addr.Port,
+// addrsByInterface groups the addresses of the neighbors by interface, every interface has an entry even when it has
+// no neighbors so its hosts can still go offline.
+func addrsByInterface(ifaces []string, neighbors []hostmonitor.Neighbor) map[string][]hostmonitor.Addr {
+	addrs := make(map[string][]hostmonitor.Addr, len(ifaces))
+	for _, iface := range ifaces {
+		addrs[iface] = nil
+	}
+	for _, neighbor := range neighbors {
+		if _, ok := addrs[neighbor.Interface]; ok {
+			addrs[neighbor.Interface] = append(addrs[neighbor.Interface], neighbor.Addr)
 		}
 	}
 
-	return hmAddrs
+	return addrs
+}
+
+// runNetlink follows the neighbor table through rtnetlink, hosts go offline when the kernel fails to reach them. The
+// kernel probes stale entries itself so -probe isn't used.
+func runNetlink(ifaces []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	wg := &sync.WaitGroup{}
+	for _, iface := range ifaces {
+		neighbors, err := NewNeighborSource(iface)
+		if err != nil {
+			fmt.Println("failed creating neighbor source:", err)
+			os.Exit(1)
+		}
+
+		hosts := newHostMaps([]string{iface}, func(string) []hostmonitor.HostMapOption {
+			return []hostmonitor.HostMapOption{hostmonitor.ExpiryOption(neighbors.Expiry)}
+		})[iface]
+
+		wg.Add(1)
+		go func(iface string) {
+			defer wg.Done()
+			if err := neighbors.Run(ctx, hosts); err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("error following neighbor table of %s: %s", iface, err)
+				os.Exit(1)
+			}
+		}(iface)
+	}
+
+	wg.Wait()
 }
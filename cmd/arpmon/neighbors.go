@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// the expiry of addresses the kernel still has a neighbor entry for
+var neverExpires = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type neighborAction int
+
+const (
+	ignoreNeighbor neighborAction = iota
+	// the neighbor is in use, the host is online
+	updateNeighbor
+	// the kernel failed to resolve the neighbor or removed it, the host is offline
+	removeNeighbor
+)
+
+// neighborUpdate maps a neighbor notification to the address it's for and what to do with it. Neighbors on other
+// links, without a link-layer address yet or that aren't resolved with ARP/NDP are ignored.
+func neighborUpdate(update netlink.NeighUpdate, linkIndex int) (hostmonitor.Addr, neighborAction) {
+	neigh := update.Neigh
+	if neigh.LinkIndex != linkIndex || (neigh.Family != unix.AF_INET && neigh.Family != unix.AF_INET6) {
+		return hostmonitor.Addr{}, ignoreNeighbor
+	}
+
+	ip, ok := netip.AddrFromSlice(neigh.IP)
+	if !ok {
+		return hostmonitor.Addr{}, ignoreNeighbor
+	}
+	addr := hostmonitor.Addr{
+		MAC: neigh.HardwareAddr,
+		IP:  ip.Unmap(),
+	}
+
+	if update.Type == unix.RTM_DELNEIGH || neigh.State&netlink.NUD_FAILED != 0 {
+		// failed entries have no link-layer address, the host is found by ip
+		return addr, removeNeighbor
+	}
+
+	if len(neigh.HardwareAddr) == 0 {
+		return hostmonitor.Addr{}, ignoreNeighbor
+	}
+
+	switch {
+	case neigh.State&(netlink.NUD_REACHABLE|netlink.NUD_STALE|netlink.NUD_DELAY|netlink.NUD_PROBE|netlink.NUD_PERMANENT) != 0:
+		return addr, updateNeighbor
+	default:
+		// incomplete, noarp or none
+		return hostmonitor.Addr{}, ignoreNeighbor
+	}
+}
+
+// NeighborSource keeps a HostMap up to date with the neighbor table of an interface from the kernel's rtnetlink
+// notifications. Hosts stay online while the kernel has a usable entry for them and go offline when it marks the entry
+// FAILED or removes it, rather than after a fixed timeout.
+type NeighborSource struct {
+	hosts     *hostmonitor.HostMap
+	linkIndex int
+
+	// the addresses the kernel has a usable entry for
+	neighbors map[netip.Addr]net.HardwareAddr
+	mux       *sync.RWMutex
+}
+
+func NewNeighborSource(iface string) (*NeighborSource, error) {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("finding interface %s: %w", iface, err)
+	}
+
+	return &NeighborSource{
+		linkIndex: link.Attrs().Index,
+		neighbors: make(map[netip.Addr]net.HardwareAddr),
+		mux:       &sync.RWMutex{},
+	}, nil
+}
+
+// Expiry keeps addresses the kernel has a usable neighbor entry for from expiring, it's used with
+// hostmonitor.ExpiryOption.
+func (s *NeighborSource) Expiry(addr hostmonitor.Addr) time.Time {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if mac, ok := s.neighbors[addr.IP]; ok && mac.String() == addr.MAC.String() {
+		return neverExpires
+	}
+	return time.Time{}
+}
+
+// Run loads the current neighbor table into hosts then applies every change to it until the context is done.
+func (s *NeighborSource) Run(ctx context.Context, hosts *hostmonitor.HostMap) error {
+	s.hosts = hosts
+
+	updates := make(chan netlink.NeighUpdate, 64)
+	errs := make(chan error, 1)
+	err := netlink.NeighSubscribeWithOptions(updates, ctx.Done(), netlink.NeighSubscribeOptions{
+		ErrorCallback: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("subscribing to neighbor updates: %w", err)
+	}
+
+	// subscribed first so no changes are missed while listing
+	neighbors, err := netlink.NeighList(s.linkIndex, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("listing neighbors: %w", err)
+	}
+	for _, neigh := range neighbors {
+		s.apply(netlink.NeighUpdate{Type: unix.RTM_NEWNEIGH, Neigh: neigh})
+	}
+
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				select {
+				case err := <-errs:
+					return fmt.Errorf("receiving neighbor updates: %w", err)
+				default:
+					return fmt.Errorf("neighbor updates closed")
+				}
+			}
+			s.apply(update)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *NeighborSource) apply(update netlink.NeighUpdate) {
+	addr, action := neighborUpdate(update, s.linkIndex)
+	switch action {
+	case updateNeighbor:
+		s.mux.Lock()
+		s.neighbors[addr.IP] = addr.MAC
+		s.mux.Unlock()
+
+		s.hosts.UpdateAddresses([]hostmonitor.Addr{addr})
+
+	case removeNeighbor:
+		s.mux.Lock()
+		mac, ok := s.neighbors[addr.IP]
+		delete(s.neighbors, addr.IP)
+		s.mux.Unlock()
+
+		if len(addr.MAC) == 0 {
+			if !ok {
+				return
+			}
+			addr.MAC = mac
+		}
+		s.hosts.MarkOffline(addr)
+	}
+}
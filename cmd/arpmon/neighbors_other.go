@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+// NeighborSource follows the neighbor table of an interface through rtnetlink, which is only supported on linux.
+type NeighborSource struct{}
+
+func NewNeighborSource(iface string) (*NeighborSource, error) {
+	return nil, errors.New("the netlink mode is only supported on linux, use -mode poll or ip")
+}
+
+func (s *NeighborSource) Expiry(addr hostmonitor.Addr) time.Time {
+	return time.Time{}
+}
+
+func (s *NeighborSource) Run(ctx context.Context, hosts *hostmonitor.HostMap) error {
+	return errors.New("the netlink mode is only supported on linux")
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestNeighborUpdate(t *testing.T) {
+	mac := net.HardwareAddr{0x1a, 0x1a, 0x1a, 0x1a, 0x1a, 0x1a}
+	neigh := func(state int, mac net.HardwareAddr) netlink.Neigh {
+		return netlink.Neigh{
+			LinkIndex:    2,
+			Family:       unix.AF_INET,
+			State:        state,
+			IP:           net.ParseIP("192.168.1.10"),
+			HardwareAddr: mac,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		update netlink.NeighUpdate
+		action neighborAction
+	}{
+		{"reachable", netlink.NeighUpdate{Type: unix.RTM_NEWNEIGH, Neigh: neigh(netlink.NUD_REACHABLE, mac)}, updateNeighbor},
+		{"stale", netlink.NeighUpdate{Type: unix.RTM_NEWNEIGH, Neigh: neigh(netlink.NUD_STALE, mac)}, updateNeighbor},
+		{"permanent", netlink.NeighUpdate{Type: unix.RTM_NEWNEIGH, Neigh: neigh(netlink.NUD_PERMANENT, mac)}, updateNeighbor},
+		{"incomplete", netlink.NeighUpdate{Type: unix.RTM_NEWNEIGH, Neigh: neigh(netlink.NUD_INCOMPLETE, nil)}, ignoreNeighbor},
+		{"failed", netlink.NeighUpdate{Type: unix.RTM_NEWNEIGH, Neigh: neigh(netlink.NUD_FAILED, nil)}, removeNeighbor},
+		{"deleted", netlink.NeighUpdate{Type: unix.RTM_DELNEIGH, Neigh: neigh(netlink.NUD_STALE, mac)}, removeNeighbor},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, action := neighborUpdate(test.update, 2)
+			assert.Equal(t, test.action, action)
+			if action != ignoreNeighbor {
+				assert.Equal(t, netip.MustParseAddr("192.168.1.10"), addr.IP)
+			}
+		})
+	}
+
+	// other interfaces
+	_, action := neighborUpdate(netlink.NeighUpdate{Type: unix.RTM_NEWNEIGH, Neigh: neigh(netlink.NUD_REACHABLE, mac)}, 3)
+	assert.Equal(t, ignoreNeighbor, action)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+// arpLayers are the layers UpdateHostsFromARP looks at.
+var arpLayers = []gopacket.LayerType{
+	layers.LayerTypeEthernet,
+	layers.LayerTypeARP,
+}
+
+// UpdateHostsFromARP keeps the provided hosts up to date with the sender of every ARP request and reply. ARP is only
+// seen on the local segment so every sender is a host on the network, including quiet ones that send little else.
+// Probes (sender ip 0.0.0.0) don't tell us the address of the sender yet, only the ip it wants, which is tracked in
+// probes.
+func UpdateHostsFromARP(hosts *hostmonitor.HostMap, probes *AddressProbes) PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		layer := packet.Layer(layers.LayerTypeARP)
+		arp, ok := layer.(*layers.ARP)
+		if !ok {
+			// nothing to do - not an ARP packet
+			return nil
+		}
+
+		if arp.AddrType != layers.LinkTypeEthernet || arp.Protocol != layers.EthernetTypeIPv4 {
+			return nil
+		}
+
+		senderMAC := net.HardwareAddr(arp.SourceHwAddress)
+		senderIP, ok := netip.AddrFromSlice(arp.SourceProtAddress)
+		if !ok {
+			return nil
+		}
+		targetIP, _ := netip.AddrFromSlice(arp.DstProtAddress)
+		seen := packet.Metadata().Timestamp
+
+		if senderIP.IsUnspecified() {
+			// a host checking nobody else is using the address before taking it
+			if other, ok := probes.Probe(newAddr(packet, senderMAC, targetIP), seen); ok {
+				log.Printf("arp probe from %s for ip=(%s) already probed by %s", senderMAC, targetIP, other.MAC)
+			}
+			return nil
+		}
+
+		if senderIP == targetIP {
+			// gratuitous arp, the host is announcing it has taken the address
+			log.Printf("arp announcement from %s(ip=%s), manufacturer=(%s)",
+				senderMAC, senderIP, hostmonitor.FindManufacturer(senderMAC))
+		}
+
+		sender := newAddr(packet, senderMAC, senderIP)
+		if prober, ok := probes.Resolve(sender); ok {
+			log.Printf("arp from %s(ip=%s) defends address probed by %s", senderMAC, senderIP, prober.MAC)
+		}
+
+		hosts.UpdateAddresses([]hostmonitor.Addr{sender})
+
+		return nil
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func arpPacket(ts time.Time, op uint16, mac net.HardwareAddr, senderIP, targetIP string) testPacket {
+	return testPacket{
+		ts: ts,
+		layers: []gopacket.SerializableLayer{
+			&layers.Ethernet{SrcMAC: mac, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeARP},
+			&layers.ARP{
+				AddrType:          layers.LinkTypeEthernet,
+				Protocol:          layers.EthernetTypeIPv4,
+				HwAddressSize:     6,
+				ProtAddressSize:   4,
+				Operation:         op,
+				SourceHwAddress:   mac,
+				SourceProtAddress: net.ParseIP(senderIP).To4(),
+				DstHwAddress:      make([]byte, 6),
+				DstProtAddress:    net.ParseIP(targetIP).To4(),
+			},
+		},
+	}
+}
+
+func TestUpdateHostsFromARP(t *testing.T) {
+	hosts := hostmonitor.NewHostMap()
+	probes := NewAddressProbes()
+	handler := UpdateHostsFromARP(hosts, probes)
+
+	handle := func(p testPacket) {
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+
+	// probing doesn't add the host
+	handle(arpPacket(testStart, layers.ARPRequest, testMAC1, "0.0.0.0", "192.168.1.2"))
+	prober, ok := probes.Probing(hostmonitor.Addr{IP: netip.MustParseAddr("192.168.1.2")})
+	require.True(t, ok)
+	assert.Equal(t, testMAC1, prober.MAC)
+
+	// announcing does, and resolves the probe
+	handle(arpPacket(testStart.Add(time.Second), layers.ARPRequest, testMAC1, "192.168.1.2", "192.168.1.2"))
+	_, ok = probes.Probing(hostmonitor.Addr{IP: netip.MustParseAddr("192.168.1.2")})
+	assert.False(t, ok)
+
+	// regular requests and replies update the sender
+	handle(arpPacket(testStart.Add(2*time.Second), layers.ARPReply, testMAC2, "192.168.1.3", "192.168.1.2"))
+
+	changes := collectChanges(hosts)
+	require.Len(t, changes, 2)
+	assert.Equal(t, hostmonitor.Addr{MAC: testMAC1, IP: netip.MustParseAddr("192.168.1.2")}, changes[0].Addr)
+	assert.Equal(t, hostmonitor.Addr{MAC: testMAC2, IP: netip.MustParseAddr("192.168.1.3")}, changes[1].Addr)
+}
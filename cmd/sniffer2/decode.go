@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// frame is a packet as read from a packet source, before it's decoded
+type frame struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+// frameHandler is passed every frame read from a packet source
+type frameHandler func(ctx context.Context, f frame) error
+
+// layerSet returns the layer types of the handlers' declarations without duplicates.
+func layerSet(declared ...[]gopacket.LayerType) []gopacket.LayerType {
+	seen := make(map[gopacket.LayerType]bool)
+	var set []gopacket.LayerType
+	for _, layerTypes := range declared {
+		for _, layerType := range layerTypes {
+			if !seen[layerType] {
+				seen[layerType] = true
+				set = append(set, layerType)
+			}
+		}
+	}
+	return set
+}
+
+// LayerDecoder decodes frames with a gopacket.DecodingLayerParser into layers that are reused for every frame, so
+// decoding doesn't allocate. Only the layers it's created with are decoded, decoding stops at the first other layer.
+// The packets it returns are only valid until the next frame is decoded and it's not safe for concurrent use, every
+// worker has its own.
+type LayerDecoder struct {
+	linkType layers.LinkType
+	// nil when the link type isn't supported, frames are decoded with gopacket.NewPacket instead
+	parser *gopacket.DecodingLayerParser
+
+	layers map[gopacket.LayerType]gopacket.Layer
+	vlans  *vlanTags
+
+	decoded []gopacket.LayerType
+	packet  decodedPacket
+}
+
+// NewLayerDecoder returns a decoder of frames of the link type, decoding the given layers. VLAN tags are always
+// decoded.
+func NewLayerDecoder(linkType layers.LinkType, layerTypes ...gopacket.LayerType) *LayerDecoder {
+	d := &LayerDecoder{
+		linkType: linkType,
+		layers:   make(map[gopacket.LayerType]gopacket.Layer),
+		vlans:    &vlanTags{},
+	}
+
+	decoders := map[gopacket.LayerType]gopacket.DecodingLayer{
+		layers.LayerTypeEthernet:                    &layers.Ethernet{},
+		layers.LayerTypeARP:                         &layers.ARP{},
+		layers.LayerTypeIPv4:                        &layers.IPv4{},
+		layers.LayerTypeIPv6:                        &layers.IPv6{},
+		layers.LayerTypeTCP:                         &layers.TCP{},
+		layers.LayerTypeUDP:                         &layers.UDP{},
+		layers.LayerTypeICMPv4:                      &layers.ICMPv4{},
+		layers.LayerTypeICMPv6:                      &layers.ICMPv6{},
+		layers.LayerTypeICMPv6NeighborSolicitation:  &layers.ICMPv6NeighborSolicitation{},
+		layers.LayerTypeICMPv6NeighborAdvertisement: &layers.ICMPv6NeighborAdvertisement{},
+		layers.LayerTypeICMPv6RouterSolicitation:    &layers.ICMPv6RouterSolicitation{},
+		layers.LayerTypeICMPv6RouterAdvertisement:   &layers.ICMPv6RouterAdvertisement{},
+		layers.LayerTypeDNS:                         &layers.DNS{},
+		layers.LayerTypeDHCPv4:                      &layers.DHCPv4{},
+		layers.LayerTypeRadioTap:                    &layers.RadioTap{},
+		layers.LayerTypeDot11:                       &layers.Dot11{},
+		gopacket.LayerTypePayload:                   &gopacket.Payload{},
+	}
+	var first gopacket.LayerType
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		first = layers.LayerTypeEthernet
+	case layers.LinkTypeIPv4:
+		first = layers.LayerTypeIPv4
+	case layers.LinkTypeIPv6:
+		first = layers.LayerTypeIPv6
+	case layers.LinkTypeIEEE80211Radio:
+		first = layers.LayerTypeRadioTap
+	case layers.LinkTypeIEEE802_11:
+		first = layers.LayerTypeDot11
+	default:
+		return d
+	}
+
+	d.parser = gopacket.NewDecodingLayerParser(first, d.vlans)
+	d.parser.IgnoreUnsupported = true
+	for _, layerType := range append([]gopacket.LayerType{first}, layerTypes...) {
+		decoder, ok := decoders[layerType]
+		if !ok || d.layers[layerType] != nil {
+			continue
+		}
+		d.parser.AddDecodingLayer(decoder)
+		d.layers[layerType] = decoder.(gopacket.Layer)
+	}
+
+	return d
+}
+
+// Decode decodes the frame, the packet returned is reused for the next frame.
+func (d *LayerDecoder) Decode(f frame) gopacket.Packet {
+	if d.parser == nil {
+		packet := gopacket.NewPacket(f.data, d.linkType, gopacket.Default)
+		packet.Metadata().CaptureInfo = f.ci
+		return packet
+	}
+
+	d.vlans.n = 0
+	err := d.parser.DecodeLayers(f.data, &d.decoded)
+
+	p := &d.packet
+	*p = decodedPacket{
+		data:   f.data,
+		layers: p.layers[:0],
+		err:    err,
+	}
+	p.metadata.CaptureInfo = f.ci
+	p.metadata.Truncated = d.parser.Truncated
+
+	tags := 0
+	for _, layerType := range d.decoded {
+		var layer gopacket.Layer
+		if layerType == layers.LayerTypeDot1Q {
+			layer = &d.vlans.tags[tags]
+			tags++
+		} else {
+			layer = d.layers[layerType]
+		}
+		p.add(layer)
+	}
+
+	return p
+}
+
+// Handler decodes every frame and passes the packet to next.
+func (d *LayerDecoder) Handler(next PacketHandler) frameHandler {
+	return func(ctx context.Context, f frame) error {
+		return next(ctx, d.Decode(f))
+	}
+}
+
+// vlanTags decodes the VLAN tags of a frame into separate layers, a DecodingLayerParser only has one decoder per
+// layer type and would overwrite the outer tag of a QinQ frame with the inner one
+type vlanTags struct {
+	tags [maxVLANTags]layers.Dot1Q
+	n    int
+}
+
+func (v *vlanTags) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeDot1Q
+}
+
+func (v *vlanTags) NextLayerType() gopacket.LayerType {
+	return v.tags[v.n-1].NextLayerType()
+}
+
+func (v *vlanTags) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if v.n == len(v.tags) {
+		return fmt.Errorf("more than %d vlan tags", len(v.tags))
+	}
+	if err := v.tags[v.n].DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	v.n++
+	return nil
+}
+
+func (v *vlanTags) LayerPayload() []byte {
+	return v.tags[v.n-1].LayerPayload()
+}
+
+// decodedPacket is a gopacket.Packet of the layers decoded by a LayerDecoder.
+type decodedPacket struct {
+	data     []byte
+	metadata gopacket.PacketMetadata
+	layers   []gopacket.Layer
+	// the error decoding stopped with, if any
+	err error
+
+	link        gopacket.LinkLayer
+	network     gopacket.NetworkLayer
+	transport   gopacket.TransportLayer
+	application gopacket.ApplicationLayer
+}
+
+func (p *decodedPacket) add(layer gopacket.Layer) {
+	p.layers = append(p.layers, layer)
+	switch layer := layer.(type) {
+	case gopacket.LinkLayer:
+		if p.link == nil {
+			p.link = layer
+		}
+	case gopacket.NetworkLayer:
+		if p.network == nil {
+			p.network = layer
+		}
+	case gopacket.TransportLayer:
+		if p.transport == nil {
+			p.transport = layer
+		}
+	case gopacket.ApplicationLayer:
+		if p.application == nil {
+			p.application = layer
+		}
+	}
+}
+
+func (p *decodedPacket) String() string {
+	return p.dump(gopacket.LayerString)
+}
+
+func (p *decodedPacket) Dump() string {
+	return p.dump(gopacket.LayerDump)
+}
+
+func (p *decodedPacket) dump(layerString func(gopacket.Layer) string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "PACKET: %d bytes", len(p.data))
+	if p.metadata.Truncated {
+		b.WriteString(", truncated")
+	}
+	for i, layer := range p.layers {
+		fmt.Fprintf(&b, "\n- Layer %d (%02d bytes) = %s", i+1, len(layer.LayerContents()), layerString(layer))
+	}
+	if p.err != nil {
+		fmt.Fprintf(&b, "\n- Decoding failed: %s", p.err)
+	}
+	return b.String()
+}
+
+func (p *decodedPacket) Layers() []gopacket.Layer {
+	return p.layers
+}
+
+func (p *decodedPacket) Layer(layerType gopacket.LayerType) gopacket.Layer {
+	for _, layer := range p.layers {
+		if layer.LayerType() == layerType {
+			return layer
+		}
+	}
+	return nil
+}
+
+func (p *decodedPacket) LayerClass(class gopacket.LayerClass) gopacket.Layer {
+	for _, layer := range p.layers {
+		if class.Contains(layer.LayerType()) {
+			return layer
+		}
+	}
+	return nil
+}
+
+func (p *decodedPacket) LinkLayer() gopacket.LinkLayer {
+	return p.link
+}
+
+func (p *decodedPacket) NetworkLayer() gopacket.NetworkLayer {
+	return p.network
+}
+
+func (p *decodedPacket) TransportLayer() gopacket.TransportLayer {
+	return p.transport
+}
+
+func (p *decodedPacket) ApplicationLayer() gopacket.ApplicationLayer {
+	return p.application
+}
+
+// ErrorLayer is always nil, gopacket.DecodeFailure can't be built outside of gopacket. The error is part of the dump.
+func (p *decodedPacket) ErrorLayer() gopacket.ErrorLayer {
+	return nil
+}
+
+func (p *decodedPacket) Data() []byte {
+	return p.data
+}
+
+func (p *decodedPacket) Metadata() *gopacket.PacketMetadata {
+	return &p.metadata
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// allLayers are the layers of every handler
+var allLayers = layerSet(recorderLayers, hostLayers, flowLayers, arpLayers, ndpLayers, dhcpLayers, udpPayloadLayers,
+	dnsLayers, osFingerprintLayers)
+
+// decodeTestFrames are frames of the kinds the handlers look at
+func decodeTestFrames(t testing.TB) map[string]frame {
+	arp := testPacket{ts: testStart, layers: []gopacket.SerializableLayer{
+		&layers.Ethernet{SrcMAC: testMAC1, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+			Operation: layers.ARPRequest, SourceHwAddress: testMAC1, SourceProtAddress: net.IPv4(192, 168, 1, 10).To4(),
+			DstHwAddress: make([]byte, 6), DstProtAddress: net.IPv4(192, 168, 1, 1).To4(),
+		},
+	}}
+	dns := udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "192.168.1.1", 50000, dnsPort, dnsQuery(1, "example.com"))
+	syn := tcpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "93.184.216.34", 64,
+		&layers.TCP{SrcPort: 50000, DstPort: 443, SYN: true, Window: 64240, Options: synOptions(1460, "mss,sok,ts,nop,ws")})
+	ndp := ndpPacket(t, testStart, testMAC1, "2001:db8::1", "ff02::1:ff00:2", layers.ICMPv6TypeNeighborSolicitation,
+		&layers.ICMPv6NeighborSolicitation{
+			TargetAddress: net.ParseIP("2001:db8::2"),
+			Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptSourceAddress, Data: testMAC1}},
+		})
+
+	return map[string]frame{
+		"arp":  testFrame(t, arp),
+		"dns":  testFrame(t, dns),
+		"dhcp": testFrame(t, dhcpMessage(t, testStart, layers.DHCPMsgTypeRequest, "0.0.0.0", "", 0)),
+		"syn":  testFrame(t, syn),
+		"tls":  testFrame(t, tcpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "93.184.216.34", 64, &layers.TCP{SrcPort: 50000, DstPort: 443, ACK: true}, gopacket.Payload(goClientHello(t)))),
+		"ndp":  testFrame(t, ndp),
+		"qinq": testFrame(t, tagged(dns, 100, 10)),
+	}
+}
+
+func TestLayerDecoder(t *testing.T) {
+	declared := layerSet(allLayers, []gopacket.LayerType{layers.LayerTypeDot1Q})
+	decoder := NewLayerDecoder(layers.LinkTypeEthernet, declared...)
+	for name, f := range decodeTestFrames(t) {
+		want := gopacket.NewPacket(f.data, layers.LinkTypeEthernet, gopacket.Default)
+		got := decoder.Decode(f)
+
+		// the same layers as a gopacket.Packet decodes, up to the first that wasn't declared like the payload of TLS
+		wantLayers := want.Layers()
+		for i, layer := range wantLayers {
+			if !containsLayerType(declared, layer.LayerType()) {
+				wantLayers = wantLayers[:i]
+				break
+			}
+		}
+		require.Len(t, got.Layers(), len(wantLayers), name)
+		for i, layer := range wantLayers {
+			assert.Equal(t, gopacket.LayerString(layer), gopacket.LayerString(got.Layers()[i]), name)
+		}
+		assert.Equal(t, want.NetworkLayer() != nil, got.NetworkLayer() != nil, name)
+		assert.Equal(t, want.TransportLayer() != nil, got.TransportLayer() != nil, name)
+		assert.Equal(t, f.ci, got.Metadata().CaptureInfo, name)
+		assert.Equal(t, f.data, got.Data(), name)
+	}
+}
+
+func containsLayerType(layerTypes []gopacket.LayerType, layerType gopacket.LayerType) bool {
+	for _, l := range layerTypes {
+		if l == layerType {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLayerDecoder_QinQ(t *testing.T) {
+	decoder := NewLayerDecoder(layers.LinkTypeEthernet)
+	p := udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "192.168.1.1", 50000, dnsPort)
+
+	vlan, outer := packetVLANs(decoder.Decode(testFrame(t, tagged(p, 100, 10))))
+	assert.Equal(t, uint16(10), vlan)
+	assert.Equal(t, uint16(100), outer)
+	vlan, outer = packetVLANs(decoder.Decode(testFrame(t, p)))
+	assert.Equal(t, uint16(0), vlan, "tags of the previous frame are reset")
+	assert.Equal(t, uint16(0), outer)
+}
+
+func TestLayerDecoder_OnlyDeclaredLayers(t *testing.T) {
+	frames := decodeTestFrames(t)
+
+	decoder := NewLayerDecoder(layers.LinkTypeEthernet, hostLayers...)
+	packet := decoder.Decode(frames["dns"])
+	assert.NotNil(t, packet.Layer(layers.LayerTypeIPv4))
+	assert.Nil(t, packet.Layer(layers.LayerTypeUDP))
+	assert.Nil(t, packet.Layer(layers.LayerTypeDNS))
+
+	// decoding stops at the first layer that wasn't declared
+	decoder = NewLayerDecoder(layers.LinkTypeEthernet, layers.LayerTypeUDP)
+	packet = decoder.Decode(frames["dns"])
+	assert.NotNil(t, packet.Layer(layers.LayerTypeEthernet))
+	assert.Nil(t, packet.Layer(layers.LayerTypeUDP))
+}
+
+func TestLayerDecoder_UnsupportedLinkType(t *testing.T) {
+	// packet type, address type, address length, the address padded to 8 bytes and the ethernet type
+	sll := append([]byte{0, 0, 0, 1, 0, 6}, testMAC1...)
+	sll = append(sll, 0, 0, 0x08, 0x00)
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(192, 168, 1, 10), DstIP: net.IPv4(192, 168, 1, 1)}
+	udp := &layers.UDP{SrcPort: 50000, DstPort: 9}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+	sll = append(sll, serialize(t, ip, udp)...)
+
+	decoder := NewLayerDecoder(layers.LinkTypeLinuxSLL, hostLayers...)
+	packet := decoder.Decode(frame{data: sll, ci: gopacket.CaptureInfo{Timestamp: testStart}})
+	assert.NotNil(t, packet.Layer(layers.LayerTypeLinuxSLL))
+	assert.NotNil(t, packet.Layer(layers.LayerTypeUDP), "decoded in full by gopacket")
+	assert.Equal(t, testStart, packet.Metadata().Timestamp)
+}
+
+func TestLayerDecoder_Allocs(t *testing.T) {
+	decoder := NewLayerDecoder(layers.LinkTypeEthernet, allLayers...)
+	for name, f := range decodeTestFrames(t) {
+		if name == "dns" {
+			// names are decoded into a buffer that only grows
+			continue
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			decoder.Decode(f)
+		})
+		assert.Zero(t, allocs, name)
+	}
+}
+
+func TestShardMAC(t *testing.T) {
+	outbound := udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "8.8.8.8", 50000, dnsPort)
+	inbound := udpPacket(t, testStart, gatewayMAC, testMAC1, "8.8.8.8", "192.168.1.10", dnsPort, 50000)
+	lan := udpPacket(t, testStart, testMAC2, testMAC1, "192.168.1.11", "192.168.1.10", 50000, 9)
+
+	assert.Equal(t, []byte(testMAC1), shardMAC(testFrame(t, outbound).data))
+	assert.Equal(t, []byte(testMAC1), shardMAC(testFrame(t, inbound).data))
+	assert.Equal(t, []byte(testMAC1), shardMAC(testFrame(t, tagged(inbound, 100, 10)).data))
+	assert.Equal(t, []byte(testMAC2), shardMAC(testFrame(t, lan).data))
+	assert.Nil(t, shardMAC([]byte{1, 2, 3}))
+
+	// a local resolver's answers go to the worker of the client's queries
+	localQuery := udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "192.168.1.1", 50000, dnsPort)
+	localResponse := udpPacket(t, testStart, gatewayMAC, testMAC1, "192.168.1.1", "192.168.1.10", dnsPort, 50000)
+	assert.Equal(t, []byte(testMAC1), shardMAC(testFrame(t, localQuery).data))
+	assert.Equal(t, []byte(testMAC1), shardMAC(testFrame(t, localResponse).data))
+	assert.Equal(t, []byte(testMAC1), shardMAC(testFrame(t, tagged(localResponse, 10)).data))
+	// not to a multicast MAC
+	multicast := udpPacket(t, testStart, gatewayMAC, mdnsMAC, "192.168.1.1", "224.0.0.251", dnsPort, 50000)
+	assert.Equal(t, []byte(gatewayMAC), shardMAC(testFrame(t, multicast).data))
+}
+
+func benchmarkFrames(b *testing.B) []frame {
+	var frames []frame
+	for _, f := range decodeTestFrames(b) {
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+// BenchmarkDecode compares decoding the frames into a new gopacket.Packet each, as a gopacket.PacketSource does, with
+// a LayerDecoder.
+func BenchmarkDecode(b *testing.B) {
+	frames := benchmarkFrames(b)
+
+	b.Run("NewPacket", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f := frames[i%len(frames)]
+			gopacket.NewPacket(f.data, layers.LinkTypeEthernet, gopacket.Default)
+		}
+	})
+	b.Run("LayerDecoder", func(b *testing.B) {
+		decoder := NewLayerDecoder(layers.LinkTypeEthernet, allLayers...)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			decoder.Decode(frames[i%len(frames)])
+		}
+	})
+}
+
+// BenchmarkPipeline_Handle measures the handlers of a pipeline on the decoded frames.
+func BenchmarkPipeline_Handle(b *testing.B) {
+	frames := benchmarkFrames(b)
+	for i := range frames {
+		// spread the frames out so hosts aren't always seen at the same instant
+		frames[i].ci.Timestamp = testStart.Add(time.Duration(i) * time.Millisecond)
+	}
+
+	flows, err := NewFlowTable(FlowTableConfig{MaxFlows: 1024, IdleTimeout: time.Minute})
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := newPipeline("", nil, layers.LinkTypeEthernet, NewMacHostMap(),
+		fingerprintDBs{dhcp: DefaultFingerprints(), syn: DefaultSYNFingerprints(), tls: &TLSFingerprintDB{}}, flows, nil)
+	defer func() {
+		p.hosts.Close()
+		<-p.notificationsDone
+	}()
+
+	handler := p.handlers.Handler()
+	for _, decoded := range []struct {
+		name    string
+		handler frameHandler
+	}{
+		{"NewPacket", func(ctx context.Context, f frame) error {
+			// as a gopacket.PacketSource decodes
+			packet := gopacket.NewPacket(f.data, layers.LinkTypeEthernet, gopacket.Default)
+			packet.Metadata().CaptureInfo = f.ci
+			return handler(ctx, packet)
+		}},
+		{"LayerDecoder", NewLayerDecoder(layers.LinkTypeEthernet, p.handlers.Layers()...).Handler(handler)},
+	} {
+		b.Run(decoded.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = decoded.handler(context.Background(), frames[i%len(frames)])
+			}
+		})
+	}
+}
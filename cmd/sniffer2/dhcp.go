@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// DHCPMetadataKey is the HostMap metadata key the DHCP options sent by or for a host are stored under, as a DHCPInfo.
+const DHCPMetadataKey = "dhcp"
+
+// option 81, not known by gopacket
+const dhcpOptClientFQDN layers.DHCPOpt = 81
+
+// the client FQDN is in DNS wire format rather than ASCII
+const fqdnEncodedFlag = 0x04
+
+// DHCPInfo holds what a host has told us about itself over DHCP, merged from every message seen for it.
+type DHCPInfo struct {
+	MessageType layers.DHCPMsgType
+	HostName    string
+	ClientFQDN  string
+	VendorClass string
+	ClientID    string
+	RequestedIP netip.Addr
+	// ParameterRequestList is the options the client asked for, in order, the basis of its fingerprint.
+	ParameterRequestList []byte
+	Fingerprint          string
+	// Device is the device type guessed from the fingerprint, empty if unknown.
+	Device string
+	// LeaseTime is the lease granted by the server.
+	LeaseTime time.Duration
+}
+
+// decodeDHCPOptions returns the options in the message that describe the client.
+func decodeDHCPOptions(dhcp *layers.DHCPv4) DHCPInfo {
+	var info DHCPInfo
+	for _, opt := range dhcp.Options {
+		switch opt.Type {
+		case layers.DHCPOptMessageType:
+			if len(opt.Data) == 1 {
+				info.MessageType = layers.DHCPMsgType(opt.Data[0])
+			}
+		case layers.DHCPOptHostname:
+			info.HostName = string(opt.Data)
+		case dhcpOptClientFQDN:
+			info.ClientFQDN = decodeClientFQDN(opt.Data)
+		case layers.DHCPOptClassID:
+			info.VendorClass = string(opt.Data)
+		case layers.DHCPOptClientID:
+			info.ClientID = net.HardwareAddr(opt.Data).String()
+		case layers.DHCPOptRequestIP:
+			info.RequestedIP, _ = netip.AddrFromSlice(opt.Data)
+		case layers.DHCPOptParamsRequest:
+			info.ParameterRequestList = append([]byte(nil), opt.Data...)
+			info.Fingerprint = dhcpFingerprint(opt.Data)
+		case layers.DHCPOptLeaseTime:
+			if len(opt.Data) == 4 {
+				info.LeaseTime = time.Duration(binary.BigEndian.Uint32(opt.Data)) * time.Second
+			}
+		}
+	}
+
+	return info
+}
+
+// merge overlays the options decoded from a newer message onto what's already known, messages don't always repeat
+// every option.
+func (info DHCPInfo) merge(newer DHCPInfo) DHCPInfo {
+	if newer.MessageType != 0 {
+		info.MessageType = newer.MessageType
+	}
+	if newer.HostName != "" {
+		info.HostName = newer.HostName
+	}
+	if newer.ClientFQDN != "" {
+		info.ClientFQDN = newer.ClientFQDN
+	}
+	if newer.VendorClass != "" {
+		info.VendorClass = newer.VendorClass
+	}
+	if newer.ClientID != "" {
+		info.ClientID = newer.ClientID
+	}
+	if newer.RequestedIP.IsValid() {
+		info.RequestedIP = newer.RequestedIP
+	}
+	if newer.ParameterRequestList != nil {
+		info.ParameterRequestList = newer.ParameterRequestList
+		info.Fingerprint = newer.Fingerprint
+	}
+	if newer.LeaseTime != 0 {
+		info.LeaseTime = newer.LeaseTime
+	}
+
+	return info
+}
+
+// decodeClientFQDN returns the domain name of a client FQDN option: flags, two deprecated rcodes then the name.
+func decodeClientFQDN(data []byte) string {
+	if len(data) < 3 {
+		return ""
+	}
+
+	name := data[3:]
+	if data[0]&fqdnEncodedFlag == 0 {
+		return strings.TrimSuffix(string(name), ".")
+	}
+
+	var labels []string
+	for len(name) > 0 && name[0] != 0 {
+		length := int(name[0])
+		if len(name) < 1+length {
+			break
+		}
+		labels = append(labels, string(name[1:1+length]))
+		name = name[1+length:]
+	}
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateHostNames_Options(t *testing.T) {
+	hosts := hostmonitor.NewHostMap()
+	hostNames := NewMacHostMap()
+	handler := UpdateHostNames(hosts, hostNames, DefaultFingerprints())
+
+	handle := func(msg *layers.DHCPv4) {
+		var p testPacket
+		if msg.Operation == layers.DHCPOpRequest {
+			p = udpPacket(t, testStart, testMAC1, layers.EthernetBroadcast, "0.0.0.0", "255.255.255.255", 68, 67, msg)
+		} else {
+			p = udpPacket(t, testStart, gatewayMAC, testMAC1, "192.168.1.1", "192.168.1.10", 67, 68, msg)
+		}
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+
+	handle(&layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		ClientHWAddr: testMAC1,
+		Options: layers.DHCPOptions{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeRequest)}),
+			layers.NewDHCPOption(layers.DHCPOptClientID, append([]byte{1}, testMAC1...)),
+			layers.NewDHCPOption(layers.DHCPOptRequestIP, []byte{192, 168, 1, 10}),
+			layers.NewDHCPOption(layers.DHCPOptHostname, []byte("DESKTOP-1234")),
+			// encoded name with the server updating the A record
+			layers.NewDHCPOption(dhcpOptClientFQDN, []byte{0x05, 0, 0, 12, 'D', 'E', 'S', 'K', 'T', 'O', 'P', '-', '1', '2', '3', '4', 4, 'c', 'o', 'r', 'p', 0}),
+			layers.NewDHCPOption(layers.DHCPOptClassID, []byte("MSFT 5.0")),
+			layers.NewDHCPOption(layers.DHCPOptParamsRequest, []byte{1, 3, 6, 15, 31, 33, 43, 44, 46, 47, 119, 121, 249, 252}),
+		},
+	})
+	handle(&layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: layers.LinkTypeEthernet,
+		ClientHWAddr: testMAC1,
+		Options: layers.DHCPOptions{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeAck)}),
+			layers.NewDHCPOption(layers.DHCPOptLeaseTime, []byte{0, 0, 0x0e, 0x10}),
+		},
+	})
+
+	assert.Equal(t, "DESKTOP-1234", hostNames.Get(hostmonitor.Addr{MAC: testMAC1}))
+
+	value, ok := hosts.Metadata(hostmonitor.Addr{MAC: testMAC1}, DHCPMetadataKey)
+	require.True(t, ok)
+	info := value.(DHCPInfo)
+	assert.Equal(t, layers.DHCPMsgTypeAck, info.MessageType)
+	assert.Equal(t, "DESKTOP-1234", info.HostName)
+	assert.Equal(t, "DESKTOP-1234.corp", info.ClientFQDN)
+	assert.Equal(t, "MSFT 5.0", info.VendorClass)
+	assert.Equal(t, "01:1a:1a:1a:1a:1a:1a", info.ClientID)
+	assert.Equal(t, netip.MustParseAddr("192.168.1.10"), info.RequestedIP)
+	assert.Equal(t, "1,3,6,15,31,33,43,44,46,47,119,121,249,252", info.Fingerprint)
+	assert.Equal(t, "Windows 10/11", info.Device)
+	assert.Equal(t, time.Hour, info.LeaseTime)
+}
+
+func TestDecodeClientFQDN(t *testing.T) {
+	assert.Equal(t, "laptop.example.com", decodeClientFQDN([]byte("\x01\x00\x00laptop.example.com.")))
+	assert.Equal(t, "laptop.example.com", decodeClientFQDN([]byte("\x04\x00\x00\x06laptop\x07example\x03com\x00")))
+	assert.Equal(t, "", decodeClientFQDN([]byte{0x04}))
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+const dnsPort = 53
+
+// limits of the dns log
+const (
+	// maxDomainsPerHost is the number of domains kept per host, the least recently queried are dropped beyond it
+	maxDomainsPerHost = 1024
+	// dnsWatchRepeat is how long a host must not have queried a watched domain before it's reported again
+	dnsWatchRepeat = time.Hour
+)
+
+// DomainStats is what's known about the lookups of a domain by a host.
+type DomainStats struct {
+	Name    string
+	Queries int
+
+	FirstSeen time.Time
+	LastSeen  time.Time
+
+	// Addrs are the addresses the domain resolved to in the last response seen.
+	Addrs []netip.Addr
+
+	// answered is unset while a query is waiting for its response
+	answered bool
+}
+
+func (s DomainStats) String() string {
+	return fmt.Sprintf("%s queries=(%d) firstSeen=(%s) addrs=(%v)",
+		s.Name, s.Queries, s.FirstSeen.Format(time.RFC3339), s.Addrs)
+}
+
+// DNSLog keeps the domains each host looks up, a MAC on each VLAN is a separate host, and reports lookups of domains
+// on the watch list through the notifications of the HostMap.
+type DNSLog struct {
+	hosts *hostmonitor.HostMap
+	watch []string
+
+	domains map[string]map[string]*DomainStats
+	mux     *sync.Mutex
+}
+
+// NewDNSLog creates a log for the hosts. A lookup of a watched domain, or any of its subdomains, emits a
+// hostmonitor.WatchedDomainChange.
+func NewDNSLog(hosts *hostmonitor.HostMap, watch ...string) *DNSLog {
+	l := &DNSLog{
+		hosts:   hosts,
+		domains: make(map[string]map[string]*DomainStats),
+		mux:     &sync.Mutex{},
+	}
+	for _, domain := range watch {
+		if domain = normalizeDomain(domain); domain != "" {
+			l.watch = append(l.watch, domain)
+		}
+	}
+
+	return l
+}
+
+// Query records a lookup of the domain by the host, returning true if the host hadn't looked it up before.
+func (l *DNSLog) Query(addr hostmonitor.Addr, domain string, seen time.Time) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	stats, first := l.query(addr, domain, seen)
+	if stats == nil {
+		return false
+	}
+	stats.answered = false
+	return first
+}
+
+// Answer records the addresses the domain resolved to for the host. A response to a query that wasn't seen, e.g.
+// because only one direction of the traffic is captured, counts as the query.
+func (l *DNSLog) Answer(addr hostmonitor.Addr, domain string, addrs []netip.Addr, seen time.Time) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	var first bool
+	stats, ok := l.domains[addr.HostKey()][normalizeDomain(domain)]
+	if !ok || stats.answered {
+		if stats, first = l.query(addr, domain, seen); stats == nil {
+			return false
+		}
+	}
+
+	stats.answered = true
+	if len(addrs) > 0 {
+		stats.Addrs = addrs
+	}
+	return first
+}
+
+// TopDomains returns the n domains the host of addr, its MAC on its VLAN, looked up most, all of them if n isn't
+// positive.
+func (l *DNSLog) TopDomains(addr hostmonitor.Addr, n int) []DomainStats {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return l.top(addr.HostKey(), n)
+}
+
+// top returns the n domains the host looked up most. The lock must be held.
+func (l *DNSLog) top(host string, n int) []DomainStats {
+	domains := l.list(host)
+	sort.SliceStable(domains, func(i, j int) bool {
+		return domains[i].Queries > domains[j].Queries
+	})
+	if n > 0 && len(domains) > n {
+		domains = domains[:n]
+	}
+
+	return domains
+}
+
+// NewDomains returns the domains the host of addr, its MAC on its VLAN, first looked up at or after since, oldest first.
+func (l *DNSLog) NewDomains(addr hostmonitor.Addr, since time.Time) []DomainStats {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	var domains []DomainStats
+	for _, stats := range l.list(addr.HostKey()) {
+		if !stats.FirstSeen.Before(since) {
+			domains = append(domains, stats)
+		}
+	}
+	sort.SliceStable(domains, func(i, j int) bool {
+		return domains[i].FirstSeen.Before(domains[j].FirstSeen)
+	})
+
+	return domains
+}
+
+// PrintTopDomains logs the n domains each host looked up most, hosts on a VLAN as mac@vlan.
+func (l *DNSLog) PrintTopDomains(n int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	hosts := make([]string, 0, len(l.domains))
+	for host := range l.domains {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		for _, stats := range l.top(host, n) {
+			log.Printf("dns %s: %s", host, stats)
+		}
+	}
+}
+
+// query counts a lookup of the domain, reporting it if it's watched. The lock must be held.
+func (l *DNSLog) query(addr hostmonitor.Addr, domain string, seen time.Time) (*DomainStats, bool) {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return nil, false
+	}
+
+	host := addr.HostKey()
+	domains, ok := l.domains[host]
+	if !ok {
+		domains = make(map[string]*DomainStats)
+		l.domains[host] = domains
+	}
+
+	stats, known := domains[domain]
+	if !known {
+		if len(domains) >= maxDomainsPerHost {
+			evictDomain(domains)
+		}
+		stats = &DomainStats{Name: domain, FirstSeen: seen}
+		domains[domain] = stats
+	}
+
+	if watched, ok := l.watched(domain); ok && (!known || seen.Sub(stats.LastSeen) >= dnsWatchRepeat) {
+		l.hosts.Emit(hostmonitor.Change{
+			ChangeType: hostmonitor.WatchedDomainChange,
+			Addr:       addr,
+			Online:     true,
+			LastSeen:   seen,
+			Detail:     fmt.Sprintf("domain=(%s) watched=(%s)", domain, watched),
+		})
+	}
+
+	stats.Queries++
+	if seen.After(stats.LastSeen) {
+		stats.LastSeen = seen
+	}
+	return stats, !known
+}
+
+// watched returns the entry of the watch list matching the domain.
+func (l *DNSLog) watched(domain string) (string, bool) {
+	for _, watched := range l.watch {
+		if domain == watched || strings.HasSuffix(domain, "."+watched) {
+			return watched, true
+		}
+	}
+	return "", false
+}
+
+// list returns a copy of the domains of the host. The lock must be held.
+func (l *DNSLog) list(host string) []DomainStats {
+	domains := make([]DomainStats, 0, len(l.domains[host]))
+	for _, stats := range l.domains[host] {
+		domains = append(domains, *stats)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Name < domains[j].Name
+	})
+
+	return domains
+}
+
+// evictDomain drops the least recently queried domain.
+func evictDomain(domains map[string]*DomainStats) {
+	var oldest *DomainStats
+	for _, stats := range domains {
+		if oldest == nil || stats.LastSeen.Before(oldest.LastSeen) {
+			oldest = stats
+		}
+	}
+	if oldest != nil {
+		delete(domains, oldest.Name)
+	}
+}
+
+// normalizeDomain lower cases the domain and drops the trailing dot.
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
+
+// dnsLayers are the layers LogDNSQueries looks at.
+var dnsLayers = []gopacket.LayerType{
+	layers.LayerTypeEthernet,
+	layers.LayerTypeIPv4,
+	layers.LayerTypeIPv6,
+	layers.LayerTypeUDP,
+	layers.LayerTypeDNS,
+}
+
+// LogDNSQueries builds the passive DNS log from the queries hosts send and the responses they get. Queries are
+// attributed to the host sending them and responses to the host receiving them, found by ip in the HostMap so
+// lookups forwarded by a local resolver are still attributed to the right host where it can be seen. New domains are
+// logged the first time each host looks them up.
+func LogDNSQueries(hosts *hostmonitor.HostMap, dnsLog *DNSLog) PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		msg, ok := packet.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		if !ok || packet.Layer(layers.LayerTypeUDP) == nil || len(msg.Questions) == 0 {
+			// nothing to do - not a DNS lookup over udp
+			return nil
+		}
+		eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		if !ok {
+			return nil
+		}
+		src, dst, ok := packetIPs(packet)
+		if !ok {
+			return nil
+		}
+
+		seen := packet.Metadata().Timestamp
+		if !msg.QR {
+			client := clientAddr(hosts, packet, eth.SrcMAC, src)
+			for _, question := range msg.Questions {
+				if dnsLog.Query(client, string(question.Name), seen) {
+					log.Printf("dns query from %s(ip=%s), new domain=(%s)", client.MAC, client.IP, question.Name)
+				}
+			}
+			return nil
+		}
+
+		if msg.ResponseCode != layers.DNSResponseCodeNoErr {
+			return nil
+		}
+
+		// the answers may go through CNAMEs, the addresses are those of the name asked for
+		var addrs []netip.Addr
+		for _, rr := range msg.Answers {
+			if rr.Type != layers.DNSTypeA && rr.Type != layers.DNSTypeAAAA {
+				continue
+			}
+			if ip, ok := netip.AddrFromSlice(rr.IP); ok {
+				addrs = append(addrs, ip.Unmap())
+			}
+		}
+
+		client := clientAddr(hosts, packet, eth.DstMAC, dst)
+		name := string(msg.Questions[0].Name)
+		if dnsLog.Answer(client, name, addrs, seen) {
+			log.Printf("dns response to %s(ip=%s), new domain=(%s)", client.MAC, client.IP, name)
+		}
+
+		return nil
+	}
+}
+
+// clientAddr returns the address of the host with the ip from the HostMap, falling back on the MAC of the frame.
+func clientAddr(hosts *hostmonitor.HostMap, packet gopacket.Packet, mac net.HardwareAddr, ip netip.Addr) hostmonitor.Addr {
+	if addr, ok := hosts.FindByIP(newAddr(packet, nil, ip)); ok {
+		return addr
+	}
+	return newAddr(packet, mac, ip)
+}
+
+// packetIPs returns the source and destination ip of an ip packet.
+func packetIPs(packet gopacket.Packet) (netip.Addr, netip.Addr, bool) {
+	var src, dst netip.Addr
+	switch network := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src, _ = netip.AddrFromSlice(network.SrcIP)
+		dst, _ = netip.AddrFromSlice(network.DstIP)
+	case *layers.IPv6:
+		src, _ = netip.AddrFromSlice(network.SrcIP)
+		dst, _ = netip.AddrFromSlice(network.DstIP)
+	default:
+		return netip.Addr{}, netip.Addr{}, false
+	}
+
+	return src.Unmap(), dst.Unmap(), true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dnsQuery(id uint16, name string) *layers.DNS {
+	return &layers.DNS{
+		ID:        id,
+		RD:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+	}
+}
+
+func dnsResponse(id uint16, name string, ips ...string) *layers.DNS {
+	msg := dnsQuery(id, name)
+	msg.QR, msg.RA = true, true
+	for _, ip := range ips {
+		msg.Answers = append(msg.Answers, layers.DNSResourceRecord{
+			Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 300, IP: net.ParseIP(ip).To4(),
+		})
+	}
+	return msg
+}
+
+func TestLogDNSQueries(t *testing.T) {
+	hosts := hostmonitor.NewHostMap()
+	dnsLog := NewDNSLog(hosts, "Tracker.Example.")
+	handler := LogDNSQueries(hosts, dnsLog)
+	handle := func(ts time.Time, src, dst net.HardwareAddr, srcIP, dstIP string, srcPort, dstPort uint16, msg *layers.DNS) {
+		p := udpPacket(t, ts, src, dst, srcIP, dstIP, srcPort, dstPort, msg)
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+	query := func(ts time.Time, id uint16, name string) {
+		handle(ts, testMAC1, gatewayMAC, "192.168.1.10", "192.168.1.1", 50000, dnsPort, dnsQuery(id, name))
+	}
+	response := func(ts time.Time, id uint16, name string, ips ...string) {
+		handle(ts, gatewayMAC, testMAC1, "192.168.1.1", "192.168.1.10", dnsPort, 50000, dnsResponse(id, name, ips...))
+	}
+
+	query(testStart, 1, "example.com")
+	response(testStart, 1, "example.com", "93.184.216.34")
+	query(testStart.Add(time.Second), 2, "example.com")
+	response(testStart.Add(time.Second), 2, "example.com", "93.184.216.34")
+	// the query wasn't seen, the response counts for it
+	response(testStart.Add(2*time.Second), 3, "Example.COM", "93.184.216.35")
+	query(testStart.Add(3*time.Second), 4, "www.tracker.example")
+	query(testStart.Add(4*time.Second), 5, "ads.tracker.example")
+	// looked up again too soon to be reported
+	query(testStart.Add(5*time.Second), 6, "www.tracker.example")
+	query(testStart.Add(dnsWatchRepeat+5*time.Second), 7, "www.tracker.example")
+	query(testStart.Add(dnsWatchRepeat+6*time.Second), 8, "tracker.example.org")
+
+	top := dnsLog.TopDomains(hostmonitor.Addr{MAC: testMAC1}, 2)
+	require.Len(t, top, 2)
+	assert.Equal(t, "example.com", top[0].Name)
+	assert.Equal(t, 3, top[0].Queries)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("93.184.216.35")}, top[0].Addrs)
+	assert.Equal(t, testStart, top[0].FirstSeen)
+	assert.Equal(t, testStart.Add(2*time.Second), top[0].LastSeen)
+	assert.Equal(t, "www.tracker.example", top[1].Name)
+	assert.Equal(t, 3, top[1].Queries)
+
+	var names []string
+	for _, stats := range dnsLog.NewDomains(hostmonitor.Addr{MAC: testMAC1}, testStart.Add(time.Second)) {
+		names = append(names, stats.Name)
+	}
+	assert.Equal(t, []string{"www.tracker.example", "ads.tracker.example", "tracker.example.org"}, names)
+	assert.Empty(t, dnsLog.TopDomains(hostmonitor.Addr{MAC: gatewayMAC}, 0), "responses are attributed to the host receiving them")
+
+	var details []string
+	for _, change := range collectChanges(hosts) {
+		require.Equal(t, hostmonitor.WatchedDomainChange, change.ChangeType)
+		assert.Equal(t, testMAC1, change.Addr.MAC)
+		details = append(details, change.Detail)
+	}
+	assert.Equal(t, []string{
+		"domain=(www.tracker.example) watched=(tracker.example)",
+		"domain=(ads.tracker.example) watched=(tracker.example)",
+		"domain=(www.tracker.example) watched=(tracker.example)",
+	}, details)
+}
+
+func TestLogDNSQueries_KnownHost(t *testing.T) {
+	hosts := hostmonitor.NewHostMap()
+	dnsLog := NewDNSLog(hosts)
+	handler := LogDNSQueries(hosts, dnsLog)
+
+	// a local resolver forwarding the lookup of a host it knows the address of
+	hosts.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC2, IP: netip.MustParseAddr("192.168.1.11")}})
+	p := udpPacket(t, testStart, gatewayMAC, gatewayMAC, "192.168.1.1", "192.168.1.11", dnsPort, 50000,
+		dnsResponse(1, "example.com", "93.184.216.34"))
+	require.NoError(t, handler(context.Background(), decode(t, p)))
+
+	assert.Len(t, dnsLog.TopDomains(hostmonitor.Addr{MAC: testMAC2}, 0), 1)
+	assert.Empty(t, dnsLog.TopDomains(hostmonitor.Addr{MAC: gatewayMAC}, 0))
+
+	// not a lookup
+	p = udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "192.168.1.1", 50000, dnsPort, gopacket.Payload("garbage"))
+	require.NoError(t, handler(context.Background(), decode(t, p)))
+	assert.Empty(t, dnsLog.TopDomains(hostmonitor.Addr{MAC: testMAC1}, 0))
+}
@@ -0,0 +1,852 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// Filters are compiled to classic BPF in Go so the same program can be attached to every capture backend, including
+// pcapgo which has no access to libpcap's compiler. Only a subset of the tcpdump filter syntax is supported:
+//
+//	arp, ip, ip6, tcp, udp, icmp, icmp6
+//	[src|dst] host <ipv4|ipv6>
+//	[src|dst] net <ipv4 cidr>
+//	[tcp|udp] [src|dst] port <port>
+//	ether [src|dst] host <mac>
+//	ether proto <ethertype>
+//
+// Primitives can be combined with and (&&), or (||), not (!) and parentheses. Frames with one 802.1Q tag or two (QinQ)
+// are matched the same as untagged ones, and can be limited to a set of VLANs. A Linux packet socket strips the
+// outermost tag before the filter runs, its VLAN is checked with the ancillary loads of the kernel instead.
+
+const (
+	ethHeaderLen  = 14
+	vlanTagLen    = 4
+	maxVLANTags   = 2
+	ipv6HeaderLen = 40
+	// room left after the ip header when only headers are captured, enough for a tcp header with options
+	transportHeaderLen = 60
+)
+
+// fullCaptureUDPPorts are the udp ports the default filter captures entire packets for, everything else is truncated
+// to the headers.
+var fullCaptureUDPPorts = []uint16{
+	dnsPort,
+	67, 68, // dhcp
+	mdnsPort,
+	netbiosNSPort,
+	llmnrPort,
+	ssdpPort,
+}
+
+// vlanTagMode is where the filter finds the vlan tags of the frames it runs on.
+type vlanTagMode int
+
+const (
+	// inlineVLANTags are part of the frame, as in capture files and libpcap captures
+	inlineVLANTags vlanTagMode = iota
+	// strippedVLANTags have the outermost tag stripped by the kernel, which passes its TCI along with the frame. Only
+	// the tags inside it are still part of the frame.
+	strippedVLANTags
+)
+
+// BuildFilter compiles the filter expression, or returns the default filter if the expression is empty, for frames
+// with the given tag mode. If vlans are given only frames tagged with one of them are captured, see compileRules.
+func BuildFilter(expr string, mode vlanTagMode, vlans ...uint16) ([]bpf.Instruction, error) {
+	if strings.TrimSpace(expr) == "" {
+		return compileRules(mode, vlans, defaultRules())
+	}
+	rules, err := parseFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	return compileRules(mode, vlans, rules)
+}
+
+// DefaultFilter captures ARP, DNS, DHCP, mDNS, NetBIOS, LLMNR, SSDP and NDP packets, TLS ClientHellos and HTTP requests
+// in full, and only the headers of all other IP packets. Segments sent to port 443 are captured in full too: the rest of
+// a ClientHello too big for one segment doesn't start with a record header, and can't be told apart from other data.
+// What's downloaded over https is still only captured up to the headers.
+func DefaultFilter(vlans ...uint16) ([]bpf.Instruction, error) {
+	return compileRules(inlineVLANTags, vlans, defaultRules())
+}
+
+func defaultRules() []filterRule {
+	return []filterRule{
+		{node: etherTypeNode(etherTypeARP), snap: snapFull},
+		{node: portNode([]uint8{protoUDP}, "", fullCaptureUDPPorts...), snap: snapFull},
+		{node: ndpNode(), snap: snapFull},
+		{node: orNode{tlsClientHelloNode(), httpRequestNode()}, snap: snapFull},
+		{node: tlsClientSegmentNode(), snap: snapFull},
+		{node: orNodes(etherTypeNode(etherTypeIPv4), etherTypeNode(etherTypeIPv6)), snap: snapHeaders},
+	}
+}
+
+// CompileFilter compiles a filter expression, see the supported syntax above. Matching packets are captured in full.
+func CompileFilter(expr string, vlans ...uint16) ([]bpf.Instruction, error) {
+	rules, err := parseFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	return compileRules(inlineVLANTags, vlans, rules)
+}
+
+func parseFilter(expr string) ([]filterRule, error) {
+	p := &filterParser{tokens: tokenizeFilter(expr)}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("unexpected %q in filter", tok)
+	}
+
+	return []filterRule{{node: node, snap: snapFull}}, nil
+}
+
+// AssembleFilter assembles the instructions into the raw form used by the capture backends.
+func AssembleFilter(filter []bpf.Instruction) ([]bpf.RawInstruction, error) {
+	return bpf.Assemble(filter)
+}
+
+const (
+	etherTypeARP  = 0x0806
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+
+	tcpFlagACK = 0x10
+	httpsPort  = 443
+)
+
+type snapAction int
+
+const (
+	// snapFull captures the entire packet
+	snapFull snapAction = iota
+	// snapHeaders captures the ethernet, ip and transport headers
+	snapHeaders
+)
+
+// filterRule captures packets that match node with the given snap action. Rules are evaluated in order, packets not
+// matching any rule are dropped.
+type filterRule struct {
+	node filterNode
+	snap snapAction
+}
+
+// compileRules generates the rules for untagged frames, then again for frames with one and two VLAN tags with the
+// offsets past the ethernet header shifted by the tags. If vlans are given tagged frames must have one of them as either
+// tag, and untagged frames are only captured if 0 is one of them. With stripped tags the number of tags is that of
+// the tags left in the frame.
+func compileRules(mode vlanTagMode, vlans []uint16, rules []filterRule) ([]bpf.Instruction, error) {
+	p := &program{}
+	drop := p.newLabel()
+
+	for tags := 0; tags <= maxVLANTags; tags++ {
+		guard, ok := vlanGuard(mode, tags, vlans)
+		if !ok {
+			continue
+		}
+		p.tags = uint32(tags)
+
+		for _, rule := range rules {
+			accept, next := p.newLabel(), p.newLabel()
+			andNode{guard, rule.node}.gen(p, accept, next)
+
+			p.place(accept)
+			switch rule.snap {
+			case snapFull:
+				p.emit(bpf.RetConstant{Val: snapLen})
+			case snapHeaders:
+				// ipv4 headers are variable length
+				ipv4, ipv6 := p.newLabel(), p.newLabel()
+				etherTypeNode(etherTypeIPv4).gen(p, ipv4, ipv6)
+				p.place(ipv4)
+				p.emit(bpf.LoadMemShift{Off: p.linkLen()})
+				p.emit(bpf.TXA{})
+				p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: p.linkLen() + transportHeaderLen})
+				p.emit(bpf.RetA{})
+				p.place(ipv6)
+				p.emit(bpf.RetConstant{Val: p.linkLen() + ipv6HeaderLen + transportHeaderLen})
+			}
+
+			p.place(next)
+		}
+	}
+
+	p.place(drop)
+	p.emit(bpf.RetConstant{Val: 0})
+
+	return p.resolve()
+}
+
+// vlanGuard matches frames with the number of tags on one of the vlans, returning false if no such frame is captured.
+func vlanGuard(mode vlanTagMode, tags int, vlans []uint16) (filterNode, bool) {
+	var ids filterNode
+	untagged := len(vlans) == 0
+	for _, vlan := range vlans {
+		if vlan == 0 {
+			untagged = true
+			continue
+		}
+		if mode == strippedVLANTags {
+			ids = orNodes(ids, andNode{
+				extensionNode{ext: bpf.ExtVLANTagPresent, cond: bpf.JumpNotEqual},
+				extensionNode{ext: bpf.ExtVLANTag, mask: 0x0fff, val: uint32(vlan)},
+			})
+		}
+		for tag := 0; tag < tags; tag++ {
+			offset := uint32(ethHeaderLen + tag*vlanTagLen)
+			ids = orNodes(ids, matchNode{size: 2, offset: offset, fixed: true, mask: 0x0fff, val: uint32(vlan)})
+		}
+	}
+
+	// the tag type of the outer tag can be either, inner tags are always 802.1Q
+	tagged := func(tag int) filterNode {
+		offset := uint32(12 + tag*vlanTagLen)
+		if tag == 0 {
+			return orNode{
+				matchNode{size: 2, offset: offset, fixed: true, val: etherTypeVLAN},
+				matchNode{size: 2, offset: offset, fixed: true, val: etherTypeQinQ},
+			}
+		}
+		return matchNode{size: 2, offset: offset, fixed: true, val: etherTypeVLAN}
+	}
+
+	var guard filterNode
+	for tag := 0; tag < tags; tag++ {
+		guard = andNodes(guard, tagged(tag))
+	}
+	if tags < maxVLANTags {
+		// no further tags, otherwise negated rules would match frames with more
+		guard = andNodes(guard, notNode{tagged(tags)})
+	}
+
+	if mode == strippedVLANTags && len(vlans) > 0 {
+		// a frame without tags left may have had its only tag stripped
+		if tags == 0 && untagged {
+			ids = orNodes(ids, notNode{extensionNode{ext: bpf.ExtVLANTagPresent, cond: bpf.JumpNotEqual}})
+		}
+		if ids == nil {
+			return nil, false
+		}
+		return andNode{guard, ids}, true
+	}
+
+	switch {
+	case tags == 0 && !untagged:
+		return nil, false
+	case tags > 0 && len(vlans) > 0:
+		if ids == nil {
+			// only untagged frames
+			return nil, false
+		}
+		guard = andNode{guard, ids}
+	}
+	return guard, true
+}
+
+// program assembles instructions with conditional jumps to labels that are resolved once the program is complete.
+type program struct {
+	insts  []bpf.Instruction
+	jumps  []pendingJump
+	labels []int
+
+	// the number of vlan tags of the frames the instructions are generated for
+	tags uint32
+}
+
+type label int
+
+type pendingJump struct {
+	index     int
+	cond      bpf.JumpTest
+	val       uint32
+	jumpTrue  label
+	jumpFalse label
+}
+
+// linkLen is the length of the ethernet header including the vlan tags.
+func (p *program) linkLen() uint32 {
+	return ethHeaderLen + p.tags*vlanTagLen
+}
+
+func (p *program) newLabel() label {
+	p.labels = append(p.labels, -1)
+	return label(len(p.labels) - 1)
+}
+
+func (p *program) place(l label) {
+	p.labels[l] = len(p.insts)
+}
+
+func (p *program) emit(inst bpf.Instruction) {
+	p.insts = append(p.insts, inst)
+}
+
+func (p *program) jump(cond bpf.JumpTest, val uint32, jumpTrue, jumpFalse label) {
+	p.jumps = append(p.jumps, pendingJump{index: len(p.insts), cond: cond, val: val, jumpTrue: jumpTrue, jumpFalse: jumpFalse})
+	// placeholder until resolved
+	p.emit(bpf.JumpIf{})
+}
+
+func (p *program) resolve() ([]bpf.Instruction, error) {
+	for _, j := range p.jumps {
+		skipTrue, err := p.skip(j.index, j.jumpTrue)
+		if err != nil {
+			return nil, err
+		}
+		skipFalse, err := p.skip(j.index, j.jumpFalse)
+		if err != nil {
+			return nil, err
+		}
+
+		p.insts[j.index] = bpf.JumpIf{Cond: j.cond, Val: j.val, SkipTrue: skipTrue, SkipFalse: skipFalse}
+	}
+
+	return p.insts, nil
+}
+
+func (p *program) skip(from int, to label) (uint8, error) {
+	pos := p.labels[to]
+	if pos < 0 {
+		return 0, errors.New("filter jumps to an unplaced label")
+	}
+
+	skip := pos - from - 1
+	if skip < 0 || skip > 255 {
+		return 0, errors.New("filter is too large")
+	}
+
+	return uint8(skip), nil
+}
+
+// filterNode generates instructions that jump to jumpTrue if the packet matches, otherwise jumpFalse.
+type filterNode interface {
+	gen(p *program, jumpTrue, jumpFalse label)
+}
+
+type andNode struct{ a, b filterNode }
+
+func (n andNode) gen(p *program, jumpTrue, jumpFalse label) {
+	next := p.newLabel()
+	n.a.gen(p, next, jumpFalse)
+	p.place(next)
+	n.b.gen(p, jumpTrue, jumpFalse)
+}
+
+type orNode struct{ a, b filterNode }
+
+func (n orNode) gen(p *program, jumpTrue, jumpFalse label) {
+	next := p.newLabel()
+	n.a.gen(p, jumpTrue, next)
+	p.place(next)
+	n.b.gen(p, jumpTrue, jumpFalse)
+}
+
+type notNode struct{ a filterNode }
+
+func (n notNode) gen(p *program, jumpTrue, jumpFalse label) {
+	n.a.gen(p, jumpFalse, jumpTrue)
+}
+
+// matchNode compares size bytes at offset with val. When indirect is set the offset is relative to the end of the
+// ipv4 header. Offsets from the ethertype on are those of an untagged frame and are shifted past the vlan tags of the
+// frames being generated for, unless fixed is set.
+type matchNode struct {
+	size     int
+	offset   uint32
+	indirect bool
+	fixed    bool
+	mask     uint32
+	cond     bpf.JumpTest
+	val      uint32
+}
+
+func (n matchNode) gen(p *program, jumpTrue, jumpFalse label) {
+	switch {
+	case n.indirect:
+		p.emit(bpf.LoadMemShift{Off: p.linkLen()})
+		p.emit(bpf.LoadIndirect{Off: p.linkLen() + n.offset, Size: n.size})
+	case n.fixed || n.offset < 12:
+		p.emit(bpf.LoadAbsolute{Off: n.offset, Size: n.size})
+	default:
+		p.emit(bpf.LoadAbsolute{Off: n.offset + p.tags*vlanTagLen, Size: n.size})
+	}
+
+	if n.mask != 0 {
+		p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: n.mask})
+	}
+
+	p.jump(n.cond, n.val, jumpTrue, jumpFalse)
+}
+
+// extensionNode compares the value of a Linux ancillary load with val, such as the vlan of the tag stripped from the
+// frame by the kernel.
+type extensionNode struct {
+	ext  bpf.Extension
+	mask uint32
+	cond bpf.JumpTest
+	val  uint32
+}
+
+func (n extensionNode) gen(p *program, jumpTrue, jumpFalse label) {
+	p.emit(bpf.LoadExtension{Num: n.ext})
+	if n.mask != 0 {
+		p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: n.mask})
+	}
+	p.jump(n.cond, n.val, jumpTrue, jumpFalse)
+}
+
+func andNodes(a, b filterNode) filterNode {
+	if a == nil {
+		return b
+	}
+	return andNode{a, b}
+}
+
+func orNodes(a, b filterNode) filterNode {
+	if a == nil {
+		return b
+	}
+	return orNode{a, b}
+}
+
+// bytesNode matches a sequence of bytes at an absolute offset, in chunks of up to 4 bytes.
+func bytesNode(offset uint32, b []byte) filterNode {
+	var node filterNode
+	for len(b) > 0 {
+		size := 4
+		if len(b) < 4 {
+			size = 2
+		}
+
+		var val uint32
+		if size == 4 {
+			val = binary.BigEndian.Uint32(b)
+		} else {
+			val = uint32(binary.BigEndian.Uint16(b))
+		}
+		node = andNodes(node, matchNode{size: size, offset: offset, val: val})
+
+		b = b[size:]
+		offset += uint32(size)
+	}
+
+	return node
+}
+
+func etherTypeNode(etherType uint32) filterNode {
+	return matchNode{size: 2, offset: 12, val: etherType}
+}
+
+func ipv4ProtoNode(proto uint8) filterNode {
+	return andNode{etherTypeNode(etherTypeIPv4), matchNode{size: 1, offset: ethHeaderLen + 9, val: uint32(proto)}}
+}
+
+func ipv6NextHeaderNode(proto uint8) filterNode {
+	return andNode{etherTypeNode(etherTypeIPv6), matchNode{size: 1, offset: ethHeaderLen + 6, val: uint32(proto)}}
+}
+
+func protoNode(proto uint8) filterNode {
+	return orNode{ipv4ProtoNode(proto), ipv6NextHeaderNode(proto)}
+}
+
+// ndpNode matches router/neighbor solicitations and advertisements and redirects
+func ndpNode() filterNode {
+	icmpType := uint32(ethHeaderLen + ipv6HeaderLen)
+	return andNode{
+		ipv6NextHeaderNode(protoICMPv6),
+		andNode{
+			matchNode{size: 1, offset: icmpType, cond: bpf.JumpGreaterOrEqual, val: 133},
+			matchNode{size: 1, offset: icmpType, cond: bpf.JumpLessOrEqual, val: 137},
+		},
+	}
+}
+
+// portNode matches any of the ports of any of the protocols in the given direction, empty for either direction
+func portNode(protos []uint8, dir string, ports ...uint16) filterNode {
+	portMatch := func(offset uint32, indirect bool) filterNode {
+		var node filterNode
+		for _, port := range ports {
+			src := matchNode{size: 2, offset: offset, indirect: indirect, val: uint32(port)}
+			dst := matchNode{size: 2, offset: offset + 2, indirect: indirect, val: uint32(port)}
+			switch dir {
+			case "src":
+				node = orNodes(node, src)
+			case "dst":
+				node = orNodes(node, dst)
+			default:
+				node = orNodes(node, orNode{src, dst})
+			}
+		}
+		return node
+	}
+
+	var v4Protos, v6Protos filterNode
+	for _, proto := range protos {
+		v4Protos = orNodes(v4Protos, ipv4ProtoNode(proto))
+		v6Protos = orNodes(v6Protos, ipv6NextHeaderNode(proto))
+	}
+
+	v4 := andNode{v4Protos, andNode{notFragmentNode(), portMatch(0, true)}}
+	v6 := andNode{v6Protos, portMatch(ethHeaderLen+ipv6HeaderLen, false)}
+
+	return orNode{v4, v6}
+}
+
+// notFragmentNode matches ipv4 packets that aren't fragments after the first, which don't carry the transport header
+func notFragmentNode() filterNode {
+	return notNode{matchNode{size: 2, offset: ethHeaderLen + 6, cond: bpf.JumpBitsSet, val: 0x1fff}}
+}
+
+// tcpPayloadNode matches tcp segments over ipv4 and ipv6 whose payload matches the node generated for the ip version
+func tcpPayloadNode(match func(ipv6 bool) filterNode) filterNode {
+	v4 := andNode{ipv4ProtoNode(protoTCP), andNode{notFragmentNode(), match(false)}}
+	v6 := andNode{ipv6NextHeaderNode(protoTCP), match(true)}
+	return orNode{v4, v6}
+}
+
+// tlsClientHelloNode matches tcp segments starting with a tls handshake record carrying a ClientHello
+func tlsClientHelloNode() filterNode {
+	return tcpPayloadNode(func(ipv6 bool) filterNode {
+		return andNode{
+			payloadMatchNode{ipv6: ipv6, size: 2, offset: 0, val: tlsRecordHandshake<<8 | 3},
+			payloadMatchNode{ipv6: ipv6, size: 1, offset: tlsRecordHeaderLen, val: tlsClientHello},
+		}
+	})
+}
+
+// tlsClientSegmentNode matches tcp segments of established connections sent to the https port, which carry the rest
+// of split ClientHellos
+func tlsClientSegmentNode() filterNode {
+	ack := func(offset uint32, indirect bool) filterNode {
+		return matchNode{size: 1, offset: offset + 13, indirect: indirect, cond: bpf.JumpBitsSet, val: tcpFlagACK}
+	}
+	v4 := andNode{ipv4ProtoNode(protoTCP), andNode{notFragmentNode(), andNode{
+		matchNode{size: 2, offset: 2, indirect: true, val: httpsPort},
+		ack(0, true),
+	}}}
+	v6 := andNode{ipv6NextHeaderNode(protoTCP), andNode{
+		matchNode{size: 2, offset: ethHeaderLen + ipv6HeaderLen + 2, val: httpsPort},
+		ack(ethHeaderLen+ipv6HeaderLen, false),
+	}}
+	return orNode{v4, v6}
+}
+
+// httpRequestNode matches tcp segments starting with an http request
+func httpRequestNode() filterNode {
+	return tcpPayloadNode(func(ipv6 bool) filterNode {
+		var node filterNode
+		for _, method := range httpMethods {
+			node = orNodes(node, payloadMatchNode{ipv6: ipv6, size: 4, val: binary.BigEndian.Uint32([]byte(method))})
+		}
+		return node
+	})
+}
+
+// payloadMatchNode compares size bytes at offset into the payload of a tcp segment with val. Segments too short to
+// hold them don't match, rather than failing the whole filter on a load past the end of the packet.
+type payloadMatchNode struct {
+	ipv6   bool
+	size   int
+	offset uint32
+	val    uint32
+}
+
+func (n payloadMatchNode) gen(p *program, jumpTrue, jumpFalse label) {
+	// X is the length of the ip and tcp headers, the data offset is the high nibble of byte 12 in 32 bit words
+	if n.ipv6 {
+		p.emit(bpf.LoadAbsolute{Off: p.linkLen() + ipv6HeaderLen + 12, Size: 1})
+		p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0})
+		p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 2})
+		p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: ipv6HeaderLen})
+	} else {
+		p.emit(bpf.LoadMemShift{Off: p.linkLen()})
+		p.emit(bpf.LoadIndirect{Off: p.linkLen() + 12, Size: 1})
+		p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0})
+		p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 2})
+		p.emit(bpf.ALUOpX{Op: bpf.ALUOpAdd})
+	}
+	p.emit(bpf.TAX{})
+
+	// what's left of the packet after the headers must hold the bytes, a bogus data offset wraps around
+	p.emit(bpf.LoadExtension{Num: bpf.ExtLen})
+	p.emit(bpf.ALUOpX{Op: bpf.ALUOpSub})
+	notWrapped, inBounds := p.newLabel(), p.newLabel()
+	p.jump(bpf.JumpGreaterThan, snapLen, jumpFalse, notWrapped)
+	p.place(notWrapped)
+	p.jump(bpf.JumpGreaterOrEqual, p.linkLen()+n.offset+uint32(n.size), inBounds, jumpFalse)
+	p.place(inBounds)
+
+	p.emit(bpf.LoadIndirect{Off: p.linkLen() + n.offset, Size: n.size})
+	p.jump(bpf.JumpEqual, n.val, jumpTrue, jumpFalse)
+}
+
+func hostNode(dir string, addr netip.Addr) filterNode {
+	pick := func(src, dst filterNode) filterNode {
+		switch dir {
+		case "src":
+			return src
+		case "dst":
+			return dst
+		default:
+			return orNode{src, dst}
+		}
+	}
+
+	if addr.Is4() {
+		b := addr.As4()
+		ip := andNode{etherTypeNode(etherTypeIPv4), pick(bytesNode(ethHeaderLen+12, b[:]), bytesNode(ethHeaderLen+16, b[:]))}
+		arp := andNode{etherTypeNode(etherTypeARP), pick(bytesNode(ethHeaderLen+14, b[:]), bytesNode(ethHeaderLen+24, b[:]))}
+		return orNode{ip, arp}
+	}
+
+	b := addr.As16()
+	return andNode{etherTypeNode(etherTypeIPv6), pick(bytesNode(ethHeaderLen+8, b[:]), bytesNode(ethHeaderLen+24, b[:]))}
+}
+
+func netNode(dir string, prefix netip.Prefix) filterNode {
+	if prefix.Bits() == 0 {
+		// every address is in the network
+		return etherTypeNode(etherTypeIPv4)
+	}
+
+	b := prefix.Masked().Addr().As4()
+	mask := ^uint32(0) << (32 - prefix.Bits())
+	match := func(offset uint32) filterNode {
+		return matchNode{size: 4, offset: offset, mask: mask, val: binary.BigEndian.Uint32(b[:])}
+	}
+
+	var node filterNode
+	switch dir {
+	case "src":
+		node = match(ethHeaderLen + 12)
+	case "dst":
+		node = match(ethHeaderLen + 16)
+	default:
+		node = orNode{match(ethHeaderLen + 12), match(ethHeaderLen + 16)}
+	}
+
+	return andNode{etherTypeNode(etherTypeIPv4), node}
+}
+
+func etherHostNode(dir string, mac net.HardwareAddr) filterNode {
+	switch dir {
+	case "src":
+		return bytesNode(6, mac)
+	case "dst":
+		return bytesNode(0, mac)
+	default:
+		return orNode{bytesNode(6, mac), bytesNode(0, mac)}
+	}
+}
+
+func tokenizeFilter(expr string) []string {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ", "&&", " and ", "||", " or ").Replace(expr)
+	return strings.Fields(expr)
+}
+
+type filterParser struct {
+	tokens []string
+}
+
+func (p *filterParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *filterParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.tokens = p.tokens[1:]
+	}
+	return tok
+}
+
+func (p *filterParser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		return fmt.Errorf("expected %q in filter, got %q", tok, got)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "or" {
+		p.next()
+		other, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		node = orNode{node, other}
+	}
+
+	return node, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	node, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "and" {
+		p.next()
+		other, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		node = andNode{node, other}
+	}
+
+	return node, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node}, nil
+	case "(":
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	default:
+		return p.parsePrimitive()
+	}
+}
+
+func (p *filterParser) parsePrimitive() (filterNode, error) {
+	tok := p.next()
+	switch tok {
+	case "":
+		return nil, errors.New("unexpected end of filter")
+	case "arp":
+		return etherTypeNode(etherTypeARP), nil
+	case "ip":
+		return etherTypeNode(etherTypeIPv4), nil
+	case "ip6":
+		return etherTypeNode(etherTypeIPv6), nil
+	case "icmp":
+		return ipv4ProtoNode(protoICMP), nil
+	case "icmp6":
+		return ipv6NextHeaderNode(protoICMPv6), nil
+	case "tcp", "udp":
+		proto := uint8(protoTCP)
+		if tok == "udp" {
+			proto = protoUDP
+		}
+
+		switch p.peek() {
+		case "src", "dst", "port":
+			return p.parseDirected([]uint8{proto})
+		}
+		return protoNode(proto), nil
+	case "src", "dst", "host", "net", "port":
+		p.tokens = append([]string{tok}, p.tokens...)
+		return p.parseDirected([]uint8{protoTCP, protoUDP})
+	case "ether":
+		return p.parseEther()
+	default:
+		return nil, fmt.Errorf("unsupported filter primitive %q", tok)
+	}
+}
+
+// parseDirected parses [src|dst] host|net|port <value>
+func (p *filterParser) parseDirected(protos []uint8) (filterNode, error) {
+	var dir string
+	if tok := p.peek(); tok == "src" || tok == "dst" {
+		dir = p.next()
+	}
+
+	kind, value := p.next(), p.next()
+	if value == "" {
+		return nil, fmt.Errorf("missing value for %q in filter", kind)
+	}
+
+	switch kind {
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q in filter", value)
+		}
+		return portNode(protos, dir, uint16(port)), nil
+	case "host":
+		if len(protos) == 1 {
+			break
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %q in filter", value)
+		}
+		return hostNode(dir, addr), nil
+	case "net":
+		if len(protos) == 1 {
+			break
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil || !prefix.Addr().Is4() {
+			return nil, fmt.Errorf("invalid ipv4 net %q in filter", value)
+		}
+		return netNode(dir, prefix), nil
+	}
+
+	return nil, fmt.Errorf("unexpected %q in filter", kind)
+}
+
+// parseEther parses ether [src|dst] host <mac> and ether proto <ethertype>
+func (p *filterParser) parseEther() (filterNode, error) {
+	if p.peek() == "proto" {
+		p.next()
+		value := p.next()
+		etherType, err := strconv.ParseUint(value, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ether proto %q in filter", value)
+		}
+		return etherTypeNode(uint32(etherType)), nil
+	}
+
+	var dir string
+	if tok := p.peek(); tok == "src" || tok == "dst" {
+		dir = p.next()
+	}
+	if err := p.expect("host"); err != nil {
+		return nil, err
+	}
+
+	value := p.next()
+	mac, err := net.ParseMAC(value)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("invalid ether host %q in filter", value)
+	}
+
+	return etherHostNode(dir, mac), nil
+}
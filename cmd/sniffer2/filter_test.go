@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/bpf"
+)
+
+func serialize(t testing.TB, l ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, l...))
+	return buf.Bytes()
+}
+
+func filterTestPackets(t *testing.T) map[string][]byte {
+	payload := gopacket.Payload(make([]byte, 200))
+
+	eth := func(etherType layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{SrcMAC: testMAC1, DstMAC: gatewayMAC, EthernetType: etherType}
+	}
+	ipv4 := func(proto layers.IPProtocol) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: net.IP{192, 168, 1, 2}, DstIP: net.IP{8, 8, 8, 8}}
+	}
+	ipv6 := func(next layers.IPProtocol) *layers.IPv6 {
+		return &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: next, SrcIP: net.ParseIP("fe80::1"), DstIP: net.ParseIP("ff02::1")}
+	}
+	udp := func(ip gopacket.NetworkLayer, src, dst uint16) *layers.UDP {
+		udp := &layers.UDP{SrcPort: layers.UDPPort(src), DstPort: layers.UDPPort(dst)}
+		require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+		return udp
+	}
+
+	v4, v6 := ipv4(layers.IPProtocolUDP), ipv6(layers.IPProtocolUDP)
+	dhcpIP, dnsIP, tcpIP := ipv4(layers.IPProtocolUDP), ipv4(layers.IPProtocolUDP), ipv4(layers.IPProtocolTCP)
+	tcp := &layers.TCP{SrcPort: 50000, DstPort: 443, SYN: true, Window: 1024}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(tcpIP))
+	icmpIP := ipv6(layers.IPProtocolICMPv6)
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0)}
+	require.NoError(t, icmp.SetNetworkLayerForChecksum(icmpIP))
+
+	return map[string][]byte{
+		"arp": serialize(t, eth(layers.EthernetTypeARP), &layers.ARP{
+			AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+			Operation: layers.ARPRequest, SourceHwAddress: testMAC1, SourceProtAddress: []byte{192, 168, 1, 2},
+			DstHwAddress: make([]byte, 6), DstProtAddress: []byte{192, 168, 1, 1},
+		}),
+		"dhcp":  serialize(t, eth(layers.EthernetTypeIPv4), dhcpIP, udp(dhcpIP, 68, 67), payload),
+		"dns":   serialize(t, eth(layers.EthernetTypeIPv4), dnsIP, udp(dnsIP, 50000, 53), payload),
+		"udp":   serialize(t, eth(layers.EthernetTypeIPv4), v4, udp(v4, 50000, 1234), payload),
+		"tcp":   serialize(t, eth(layers.EthernetTypeIPv4), tcpIP, tcp, payload),
+		"ndp":   serialize(t, eth(layers.EthernetTypeIPv6), icmpIP, icmp, payload),
+		"udp6":  serialize(t, eth(layers.EthernetTypeIPv6), v6, udp(v6, 50000, 1234), payload),
+		"other": serialize(t, eth(layers.EthernetType(0x88cc)), payload),
+	}
+}
+
+func runFilter(t *testing.T, filter []bpf.Instruction, data []byte) int {
+	// the kernel must accept the program too
+	_, err := bpf.Assemble(filter)
+	require.NoError(t, err)
+
+	vm, err := bpf.NewVM(filter)
+	require.NoError(t, err)
+
+	n, err := vm.Run(data)
+	require.NoError(t, err)
+	return n
+}
+
+func TestDefaultFilter(t *testing.T) {
+	filter, err := DefaultFilter()
+	require.NoError(t, err)
+
+	packets := filterTestPackets(t)
+	expected := map[string]int{
+		"arp":   snapLen,
+		"dhcp":  snapLen,
+		"dns":   snapLen,
+		"udp":   ethHeaderLen + 20 + transportHeaderLen,
+		"tcp":   ethHeaderLen + 20 + transportHeaderLen,
+		"ndp":   snapLen,
+		"udp6":  ethHeaderLen + ipv6HeaderLen + transportHeaderLen,
+		"other": 0,
+	}
+
+	for name, data := range packets {
+		assert.Equalf(t, expected[name], runFilter(t, filter, data), "packet %s", name)
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	packets := filterTestPackets(t)
+
+	testCases := []struct {
+		expr    string
+		matches []string
+	}{
+		{expr: "arp", matches: []string{"arp"}},
+		{expr: "not ip and not ip6", matches: []string{"arp", "other"}},
+		{expr: "udp port 53 or port 67", matches: []string{"dhcp", "dns"}},
+		{expr: "tcp and dst port 443", matches: []string{"tcp"}},
+		{expr: "udp src port 443", matches: nil},
+		{expr: "icmp6 || (ip6 && udp)", matches: []string{"ndp", "udp6"}},
+		{expr: "host 192.168.1.1", matches: []string{"arp"}},
+		{expr: "src host 192.168.1.2 and !tcp", matches: []string{"arp", "dhcp", "dns", "udp"}},
+		{expr: "dst net 8.8.0.0/16", matches: []string{"dhcp", "dns", "udp", "tcp"}},
+		{expr: "host ff02::1", matches: []string{"ndp", "udp6"}},
+		{expr: "ether src host 1a:1a:1a:1a:1a:1a and ether proto 0x88cc", matches: []string{"other"}},
+		{expr: "ether dst host 1a:1a:1a:1a:1a:1a", matches: nil},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.expr, func(t *testing.T) {
+			filter, err := CompileFilter(tc.expr)
+			require.NoError(t, err)
+
+			var matches []string
+			for _, name := range []string{"arp", "dhcp", "dns", "udp", "tcp", "ndp", "udp6", "other"} {
+				if runFilter(t, filter, packets[name]) > 0 {
+					matches = append(matches, name)
+				}
+			}
+			assert.Equal(t, tc.matches, matches)
+		})
+	}
+}
+
+func TestCompileFilter_Errors(t *testing.T) {
+	for _, expr := range []string{"", "port", "port http", "udp host 192.168.1.1", "bogus", "(arp", "arp)", "ether host nope", "net 192.168.1.1"} {
+		_, err := CompileFilter(expr)
+		assert.Errorf(t, err, "expected error for %q", expr)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The default database of DHCP fingerprints, see the file for the format.
+//
+//go:embed dhcp-fingerprints.txt
+var defaultFingerprintsFile []byte
+
+// any fingerprint or vendor class
+const fingerprintWildcard = "*"
+
+type fingerprintEntry struct {
+	fingerprint string
+	vendorClass string
+	device      string
+}
+
+// FingerprintDB guesses the type of device from the DHCP options it sends.
+type FingerprintDB struct {
+	entries []fingerprintEntry
+}
+
+// DefaultFingerprints returns the database built into sniffer2.
+func DefaultFingerprints() *FingerprintDB {
+	db, err := ParseFingerprints(bytes.NewReader(defaultFingerprintsFile))
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// LoadFingerprints loads a fingerprint database from a file, or returns the default database if path is empty.
+func LoadFingerprints(path string) (*FingerprintDB, error) {
+	if path == "" {
+		return DefaultFingerprints(), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseFingerprints(f)
+}
+
+// ParseFingerprints reads a fingerprint database, one "fingerprint | vendor class | device" entry per line.
+func ParseFingerprints(r io.Reader) (*FingerprintDB, error) {
+	db := &FingerprintDB{}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(text, "|")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected 3 fields, got %d", line, len(fields))
+		}
+
+		entry := fingerprintEntry{
+			fingerprint: strings.TrimSpace(fields[0]),
+			vendorClass: strings.TrimSpace(fields[1]),
+			device:      strings.TrimSpace(fields[2]),
+		}
+		if entry.fingerprint != fingerprintWildcard {
+			for _, code := range strings.Split(entry.fingerprint, ",") {
+				if _, err := strconv.ParseUint(code, 10, 8); err != nil {
+					return nil, fmt.Errorf("line %d: invalid option code %q", line, code)
+				}
+			}
+		}
+		if entry.device == "" {
+			return nil, fmt.Errorf("line %d: missing device", line)
+		}
+
+		db.entries = append(db.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Match returns the device with the fingerprint and vendor class, or an empty string if it's not in the database.
+func (db *FingerprintDB) Match(fingerprint, vendorClass string) string {
+	var (
+		best      string
+		bestScore = -1
+	)
+	for _, entry := range db.entries {
+		score := 0
+		switch entry.fingerprint {
+		case fingerprint:
+			// a fingerprint always beats a vendor class alone
+			score += 1 << 16
+		case fingerprintWildcard:
+		default:
+			continue
+		}
+
+		switch {
+		case entry.vendorClass == fingerprintWildcard:
+			if entry.fingerprint == fingerprintWildcard {
+				// matches everything
+				continue
+			}
+		case strings.HasPrefix(vendorClass, entry.vendorClass):
+			score += 1 + len(entry.vendorClass)
+		default:
+			continue
+		}
+
+		if score > bestScore {
+			best, bestScore = entry.device, score
+		}
+	}
+
+	return best
+}
+
+// dhcpFingerprint formats a parameter request list as a fingerprint, e.g. "1,3,6,15".
+func dhcpFingerprint(params []byte) string {
+	codes := make([]string, len(params))
+	for i, code := range params {
+		codes[i] = strconv.Itoa(int(code))
+	}
+	return strings.Join(codes, ",")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprintDB_Match(t *testing.T) {
+	db, err := ParseFingerprints(strings.NewReader(`
+# comment
+1,3,6 | * | Generic
+1,3,6 | acme-v2 | Acme v2
+1,3,6 | acme- | Acme
+*     | acme- | Acme (vendor)
+*     | acme-v | Acme v (vendor)
+`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		fingerprint, vendorClass, want string
+	}{
+		{"1,3,6", "", "Generic"},
+		{"1,3,6", "acme-v1", "Acme"},
+		{"1,3,6", "acme-v2", "Acme v2"},
+		{"1,3,6,15", "acme-v1", "Acme v (vendor)"},
+		{"1,3,6,15", "other", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, db.Match(test.fingerprint, test.vendorClass), "%s %s", test.fingerprint, test.vendorClass)
+	}
+}
+
+func TestParseFingerprints_Errors(t *testing.T) {
+	for _, db := range []string{
+		"1,3,6 | Generic",
+		"1,3,six | * | Generic",
+		"1,3,6 | * | ",
+	} {
+		_, err := ParseFingerprints(strings.NewReader(db))
+		assert.Error(t, err, db)
+	}
+}
+
+func TestDefaultFingerprints(t *testing.T) {
+	db := DefaultFingerprints()
+	assert.Equal(t, "Android", db.Match("1,3,6,15,26,28,51,58,59,43", "android-dhcp-13"))
+	assert.Equal(t, "Windows", db.Match("1,2,3", "MSFT 5.0"))
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// how long a TCP flow that was closed or reset is kept for the segments that follow the FIN or RST
+	flowCloseLinger = 5 * time.Second
+	// how often expired flows are looked for, in packet time
+	flowSweepInterval = time.Second
+)
+
+// TCPFlags are the flags seen on the segments of a TCP flow.
+type TCPFlags uint8
+
+const (
+	TCPFlagFIN TCPFlags = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+	TCPFlagECE
+	TCPFlagCWR
+)
+
+func tcpFlags(tcp *layers.TCP) TCPFlags {
+	var flags TCPFlags
+	for i, set := range [...]bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR} {
+		if set {
+			flags |= 1 << i
+		}
+	}
+	return flags
+}
+
+// String lists the flags tcpdump style, e.g. "FSPA"
+func (f TCPFlags) String() string {
+	var s []byte
+	for i, c := range []byte("FSRPAUEC") {
+		if f&(1<<i) != 0 {
+			s = append(s, c)
+		}
+	}
+	return string(s)
+}
+
+// FlowState is how far along a TCP flow is. Flows of other protocols are always active.
+type FlowState int
+
+const (
+	FlowActive FlowState = iota
+	FlowSYNSent
+	FlowEstablished
+	// FlowClosing is a flow one side has sent a FIN on.
+	FlowClosing
+	FlowClosed
+	FlowReset
+)
+
+func (s FlowState) String() string {
+	switch s {
+	case FlowActive:
+		return "active"
+	case FlowSYNSent:
+		return "syn-sent"
+	case FlowEstablished:
+		return "established"
+	case FlowClosing:
+		return "closing"
+	case FlowClosed:
+		return "closed"
+	case FlowReset:
+		return "reset"
+	default:
+		return "unknown"
+	}
+}
+
+// FlowEndReason is why a flow-end record was exported.
+type FlowEndReason int
+
+const (
+	// FlowNotEnded is the reason of flows still in the table.
+	FlowNotEnded FlowEndReason = iota
+	FlowIdleTimeout
+	// FlowActiveTimeout ends long lived flows periodically, the flow carries on with a new record.
+	FlowActiveTimeout
+	// FlowFinished is a TCP flow that was closed or reset.
+	FlowFinished
+	// FlowEvicted is the least recently seen flow, ended to make room when the table is full.
+	FlowEvicted
+	// FlowFlushed is a flow still in the table when it was flushed.
+	FlowFlushed
+)
+
+func (r FlowEndReason) String() string {
+	switch r {
+	case FlowNotEnded:
+		return ""
+	case FlowIdleTimeout:
+		return "idle"
+	case FlowActiveTimeout:
+		return "active"
+	case FlowFinished:
+		return "finished"
+	case FlowEvicted:
+		return "evicted"
+	case FlowFlushed:
+		return "flushed"
+	default:
+		return "unknown"
+	}
+}
+
+// Flow is the traffic between two endpoints over a transport protocol in both directions. Src is the endpoint that
+// started the flow, or the one the flow was first seen from if that's unknown.
+type Flow struct {
+	Protocol layers.IPProtocol
+	Src, Dst netip.AddrPort
+	// SrcMAC and DstMAC are the MACs of Src and Dst on the local segment, the gateway's for remote endpoints
+	SrcMAC, DstMAC net.HardwareAddr
+	// SrcLocal and DstLocal are whether the endpoints are on the private network, the flow is attributed to them.
+	SrcLocal, DstLocal bool
+
+	Start, End time.Time
+	// bytes and packets sent by Src and by Dst
+	SrcBytes, DstBytes     uint64
+	SrcPackets, DstPackets uint64
+
+	TCPFlags  TCPFlags
+	State     FlowState
+	EndReason FlowEndReason
+}
+
+// Involves returns whether the flow is attributed to the host with mac.
+func (f Flow) Involves(mac net.HardwareAddr) bool {
+	return (f.SrcLocal && macsEqual(f.SrcMAC, mac)) || (f.DstLocal && macsEqual(f.DstMAC, mac))
+}
+
+func (f Flow) String() string {
+	return fmt.Sprintf("%s %s -> %s state=(%s) bytes=(%d/%d) packets=(%d/%d) flags=(%s) duration=(%s)",
+		f.Protocol, f.Src, f.Dst, f.State, f.SrcBytes, f.DstBytes, f.SrcPackets, f.DstPackets, f.TCPFlags,
+		f.End.Sub(f.Start))
+}
+
+func macsEqual(a, b net.HardwareAddr) bool {
+	return string(a) == string(b)
+}
+
+// flowKey identifies the flow of a packet in either direction, the endpoints are ordered so both directions have the
+// same key
+type flowKey struct {
+	protocol layers.IPProtocol
+	a, b     netip.AddrPort
+}
+
+func newFlowKey(protocol layers.IPProtocol, src, dst netip.AddrPort) flowKey {
+	if dst.Addr().Less(src.Addr()) || (dst.Addr() == src.Addr() && dst.Port() < src.Port()) {
+		src, dst = dst, src
+	}
+	return flowKey{protocol: protocol, a: src, b: dst}
+}
+
+// FlowExporter is passed every flow-end record.
+type FlowExporter func(Flow)
+
+// FlowTableConfig configures the limits of a FlowTable.
+type FlowTableConfig struct {
+	// MaxFlows is the number of flows tracked at once, the least recently seen flow is ended when exceeded.
+	MaxFlows int
+	// IdleTimeout ends flows nothing was seen on for this long.
+	IdleTimeout time.Duration
+	// ActiveTimeout ends flows that have lasted this long, the flow carries on with a new record. Disabled if 0.
+	ActiveTimeout time.Duration
+	// Export is passed the flow-end records, if not nil.
+	Export FlowExporter
+}
+
+// FlowTable keeps track of the flows of the hosts on the private network. Timeouts follow the time of the packets so
+// flows end the same when replaying a capture.
+type FlowTable struct {
+	config FlowTableConfig
+
+	flows map[flowKey]*list.Element
+	// flows from the most to the least recently seen
+	recent    *list.List
+	lastSweep time.Time
+	mux       *sync.Mutex
+}
+
+func NewFlowTable(config FlowTableConfig) (*FlowTable, error) {
+	if config.MaxFlows <= 0 {
+		return nil, fmt.Errorf("max flows must be positive, got %d", config.MaxFlows)
+	}
+	if config.IdleTimeout <= 0 {
+		return nil, fmt.Errorf("idle timeout must be positive, got %s", config.IdleTimeout)
+	}
+
+	return &FlowTable{
+		config: config,
+		flows:  make(map[flowKey]*list.Element),
+		recent: list.New(),
+		mux:    &sync.Mutex{},
+	}, nil
+}
+
+// flowPacket is what the table is told about a packet
+type flowPacket struct {
+	protocol       layers.IPProtocol
+	src, dst       netip.AddrPort
+	srcMAC, dstMAC net.HardwareAddr
+	length         int
+	seen           time.Time
+	tcp            *layers.TCP
+}
+
+// Add counts the packet against its flow, starting a new one if it isn't tracked yet.
+func (t *FlowTable) Add(p flowPacket) {
+	ended := t.add(p)
+	t.export(ended)
+}
+
+func (t *FlowTable) add(p flowPacket) []Flow {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	var ended []Flow
+	if p.seen.Sub(t.lastSweep) >= flowSweepInterval {
+		ended = t.expire(p.seen)
+		t.lastSweep = p.seen
+	}
+
+	key := newFlowKey(p.protocol, p.src, p.dst)
+	elem, ok := t.flows[key]
+	if ok && p.tcp != nil && p.tcp.SYN && !p.tcp.ACK {
+		if state := elem.Value.(*Flow).State; state == FlowClosed || state == FlowReset {
+			// the same ports were reused for a new connection while the closed one lingers
+			ended = append(ended, t.remove(elem, FlowFinished))
+			ok = false
+		}
+	}
+	if ok && t.config.ActiveTimeout > 0 && p.seen.Sub(elem.Value.(*Flow).Start) >= t.config.ActiveTimeout {
+		// carry on with a new record of the same flow
+		flow := t.remove(elem, FlowActiveTimeout)
+		ended = append(ended, flow)
+
+		next := &Flow{
+			Protocol: flow.Protocol, Src: flow.Src, Dst: flow.Dst, SrcMAC: flow.SrcMAC, DstMAC: flow.DstMAC,
+			SrcLocal: flow.SrcLocal, DstLocal: flow.DstLocal, Start: p.seen, State: flow.State,
+		}
+		elem, ok = t.recent.PushFront(next), true
+		t.flows[key] = elem
+	}
+	if !ok {
+		if len(t.flows) >= t.config.MaxFlows {
+			ended = append(ended, t.remove(t.recent.Back(), FlowEvicted))
+		}
+		elem = t.recent.PushFront(newFlow(p))
+		t.flows[key] = elem
+	}
+	t.recent.MoveToFront(elem)
+
+	flow := elem.Value.(*Flow)
+	flow.End = p.seen
+	if p.src == flow.Src {
+		flow.SrcBytes += uint64(p.length)
+		flow.SrcPackets++
+	} else {
+		flow.DstBytes += uint64(p.length)
+		flow.DstPackets++
+	}
+	if p.tcp != nil {
+		flow.TCPFlags |= tcpFlags(p.tcp)
+		flow.State = nextFlowState(flow.State, p.tcp)
+	}
+
+	return ended
+}
+
+func newFlow(p flowPacket) *Flow {
+	flow := &Flow{
+		Protocol: p.protocol,
+		Src:      p.src, Dst: p.dst,
+		SrcMAC: append(net.HardwareAddr(nil), p.srcMAC...), DstMAC: append(net.HardwareAddr(nil), p.dstMAC...),
+		SrcLocal: isLocalAddr(p.src.Addr()), DstLocal: isLocalAddr(p.dst.Addr()),
+		Start: p.seen,
+	}
+	if p.tcp != nil && p.tcp.SYN && p.tcp.ACK {
+		// the reply to a SYN that wasn't seen, the destination started the flow
+		flow.Src, flow.Dst = flow.Dst, flow.Src
+		flow.SrcMAC, flow.DstMAC = flow.DstMAC, flow.SrcMAC
+		flow.SrcLocal, flow.DstLocal = flow.DstLocal, flow.SrcLocal
+	}
+	return flow
+}
+
+func nextFlowState(state FlowState, tcp *layers.TCP) FlowState {
+	switch {
+	case tcp.RST:
+		return FlowReset
+	case state == FlowReset || state == FlowClosed:
+		return state
+	case tcp.FIN && state == FlowClosing:
+		return FlowClosed
+	case tcp.FIN:
+		return FlowClosing
+	case tcp.SYN && !tcp.ACK && state == FlowActive:
+		return FlowSYNSent
+	case tcp.ACK && (state == FlowSYNSent || state == FlowActive):
+		// a flow already underway when first seen is assumed to be established
+		return FlowEstablished
+	default:
+		return state
+	}
+}
+
+// Expire ends the flows that timed out by now.
+func (t *FlowTable) Expire(now time.Time) {
+	t.mux.Lock()
+	ended := t.expire(now)
+	t.mux.Unlock()
+
+	t.export(ended)
+}
+
+func (t *FlowTable) expire(now time.Time) []Flow {
+	var ended []Flow
+	// only flows idle for longer than the shortest timeout can have expired
+	for elem := t.recent.Back(); elem != nil; {
+		flow := elem.Value.(*Flow)
+		idle := now.Sub(flow.End)
+		if idle < flowCloseLinger && idle < t.config.IdleTimeout {
+			break
+		}
+
+		prev := elem.Prev()
+		if (flow.State == FlowClosed || flow.State == FlowReset) && idle >= flowCloseLinger {
+			ended = append(ended, t.remove(elem, FlowFinished))
+		} else if idle >= t.config.IdleTimeout {
+			ended = append(ended, t.remove(elem, FlowIdleTimeout))
+		}
+		elem = prev
+	}
+	return ended
+}
+
+// Flush ends every flow in the table.
+func (t *FlowTable) Flush() {
+	t.mux.Lock()
+	var ended []Flow
+	for elem := t.recent.Back(); elem != nil; elem = t.recent.Back() {
+		ended = append(ended, t.remove(elem, FlowFlushed))
+	}
+	t.mux.Unlock()
+
+	t.export(ended)
+}
+
+// Flows returns the flows in the table attributed to the host with mac, the most recently seen first.
+func (t *FlowTable) Flows(mac net.HardwareAddr) []Flow {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	var flows []Flow
+	for elem := t.recent.Front(); elem != nil; elem = elem.Next() {
+		if flow := elem.Value.(*Flow); flow.Involves(mac) {
+			flows = append(flows, *flow)
+		}
+	}
+	return flows
+}
+
+// Len returns the number of flows in the table.
+func (t *FlowTable) Len() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return len(t.flows)
+}
+
+// remove takes the flow out of the table and returns its flow-end record. The lock must be held.
+func (t *FlowTable) remove(elem *list.Element, reason FlowEndReason) Flow {
+	flow := t.recent.Remove(elem).(*Flow)
+	delete(t.flows, newFlowKey(flow.Protocol, flow.Src, flow.Dst))
+
+	flow.EndReason = reason
+	return *flow
+}
+
+// export passes the flow-end records to the exporter, without holding the lock
+func (t *FlowTable) export(ended []Flow) {
+	if t.config.Export == nil {
+		return
+	}
+	for _, flow := range ended {
+		t.config.Export(flow)
+	}
+}
+
+// isLocalAddr returns whether the address belongs to a host on the private network
+func isLocalAddr(addr netip.Addr) bool {
+	return addr.IsPrivate() || addr.IsLinkLocalUnicast()
+}
+
+// flowLayers are the layers TrackFlows looks at.
+var flowLayers = []gopacket.LayerType{
+	layers.LayerTypeEthernet,
+	layers.LayerTypeIPv4,
+	layers.LayerTypeIPv6,
+	layers.LayerTypeTCP,
+	layers.LayerTypeUDP,
+}
+
+// TrackFlows adds every IP packet to or from a host on the private network to the flows. Transit traffic between two
+// remote endpoints isn't tracked.
+func TrackFlows(flows *FlowTable) PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		srcIP, dstIP, ok := packetIPs(packet)
+		if !ok || !(isLocalAddr(srcIP) || isLocalAddr(dstIP)) {
+			return nil
+		}
+
+		layer := packet.Layer(layers.LayerTypeEthernet)
+		eth, ok := layer.(*layers.Ethernet)
+		if !ok {
+			return nil
+		}
+
+		p := flowPacket{
+			srcMAC: eth.SrcMAC,
+			dstMAC: eth.DstMAC,
+			length: packet.Metadata().Length,
+			seen:   packet.Metadata().Timestamp,
+		}
+		var srcPort, dstPort uint16
+		switch transport := packet.TransportLayer().(type) {
+		case *layers.TCP:
+			p.protocol, p.tcp = layers.IPProtocolTCP, transport
+			srcPort, dstPort = uint16(transport.SrcPort), uint16(transport.DstPort)
+		case *layers.UDP:
+			p.protocol = layers.IPProtocolUDP
+			srcPort, dstPort = uint16(transport.SrcPort), uint16(transport.DstPort)
+		default:
+			// icmp and other protocols without ports are a flow per pair of addresses
+			switch network := packet.NetworkLayer().(type) {
+			case *layers.IPv4:
+				p.protocol = network.Protocol
+			case *layers.IPv6:
+				p.protocol = network.NextHeader
+			}
+		}
+		p.src = netip.AddrPortFrom(srcIP, srcPort)
+		p.dst = netip.AddrPortFrom(dstIP, dstPort)
+
+		flows.Add(p)
+		return nil
+	}
+}
+
+// flowRecord is how a flow-end record is written to a FlowLog
+type flowRecord struct {
+	Protocol   string    `json:"protocol"`
+	Src        string    `json:"src"`
+	Dst        string    `json:"dst"`
+	SrcMAC     string    `json:"src_mac"`
+	DstMAC     string    `json:"dst_mac"`
+	SrcLocal   bool      `json:"src_local"`
+	DstLocal   bool      `json:"dst_local"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	SrcBytes   uint64    `json:"src_bytes"`
+	DstBytes   uint64    `json:"dst_bytes"`
+	SrcPackets uint64    `json:"src_packets"`
+	DstPackets uint64    `json:"dst_packets"`
+	TCPFlags   string    `json:"tcp_flags,omitempty"`
+	State      string    `json:"state"`
+	EndReason  string    `json:"end_reason"`
+}
+
+// FlowLog writes flow-end records to a file as JSON lines.
+type FlowLog struct {
+	f   *os.File
+	enc *json.Encoder
+	mux *sync.Mutex
+}
+
+// NewFlowLog appends flow-end records to the file at path, creating it if needed.
+func NewFlowLog(path string) (*FlowLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening flow log: %w", err)
+	}
+
+	return &FlowLog{
+		f:   f,
+		enc: json.NewEncoder(f),
+		mux: &sync.Mutex{},
+	}, nil
+}
+
+// Export writes the flow-end record, it's a FlowExporter.
+func (l *FlowLog) Export(flow Flow) {
+	record := flowRecord{
+		Protocol:   flow.Protocol.String(),
+		Src:        flow.Src.String(),
+		Dst:        flow.Dst.String(),
+		SrcMAC:     flow.SrcMAC.String(),
+		DstMAC:     flow.DstMAC.String(),
+		SrcLocal:   flow.SrcLocal,
+		DstLocal:   flow.DstLocal,
+		Start:      flow.Start.UTC(),
+		End:        flow.End.UTC(),
+		SrcBytes:   flow.SrcBytes,
+		DstBytes:   flow.DstBytes,
+		SrcPackets: flow.SrcPackets,
+		DstPackets: flow.DstPackets,
+		TCPFlags:   flow.TCPFlags.String(),
+		State:      flow.State.String(),
+		EndReason:  flow.EndReason.String(),
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if err := l.enc.Encode(record); err != nil {
+		log.Println("error writing flow log:", err)
+	}
+}
+
+func (l *FlowLog) Close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFlowTable(t *testing.T, config FlowTableConfig) (*FlowTable, *[]Flow) {
+	var ended []Flow
+	config.Export = func(flow Flow) {
+		ended = append(ended, flow)
+	}
+	if config.MaxFlows == 0 {
+		config.MaxFlows = 16
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = time.Minute
+	}
+
+	flows, err := NewFlowTable(config)
+	require.NoError(t, err)
+	return flows, &ended
+}
+
+func TestTrackFlows_TCP(t *testing.T) {
+	flows, ended := newTestFlowTable(t, FlowTableConfig{})
+	handler := TrackFlows(flows)
+	handle := func(ts time.Duration, outbound bool, tcp *layers.TCP, payload ...gopacket.SerializableLayer) {
+		var p testPacket
+		if outbound {
+			tcp.SrcPort, tcp.DstPort = 50000, 443
+			p = tcpPacket(t, testStart.Add(ts), testMAC1, gatewayMAC, "192.168.1.2", "93.184.216.34", 64, tcp, payload...)
+		} else {
+			tcp.SrcPort, tcp.DstPort = 443, 50000
+			p = tcpPacket(t, testStart.Add(ts), gatewayMAC, testMAC1, "93.184.216.34", "192.168.1.2", 64, tcp, payload...)
+		}
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+
+	handle(0, true, &layers.TCP{SYN: true})
+	handle(10*time.Millisecond, false, &layers.TCP{SYN: true, ACK: true})
+	handle(20*time.Millisecond, true, &layers.TCP{ACK: true}, gopacket.Payload(make([]byte, 100)))
+
+	current := flows.Flows(testMAC1)
+	require.Len(t, current, 1)
+	flow := current[0]
+	assert.Equal(t, "192.168.1.2:50000", flow.Src.String())
+	assert.Equal(t, "93.184.216.34:443", flow.Dst.String())
+	assert.True(t, flow.SrcLocal)
+	assert.False(t, flow.DstLocal)
+	assert.Equal(t, FlowEstablished, flow.State)
+	assert.Equal(t, "SA", flow.TCPFlags.String())
+	assert.Equal(t, uint64(2), flow.SrcPackets)
+	assert.Equal(t, uint64(1), flow.DstPackets)
+	assert.Empty(t, flows.Flows(gatewayMAC), "remote endpoints aren't attributed flows")
+
+	handle(time.Second, true, &layers.TCP{FIN: true, ACK: true})
+	handle(time.Second+10*time.Millisecond, false, &layers.TCP{FIN: true, ACK: true})
+	handle(time.Second+20*time.Millisecond, true, &layers.TCP{ACK: true})
+	assert.Equal(t, FlowClosed, flows.Flows(testMAC1)[0].State)
+	assert.Empty(t, *ended, "kept for the segments following the fin")
+
+	flows.Expire(testStart.Add(10 * time.Second))
+	require.Len(t, *ended, 1)
+	assert.Equal(t, FlowFinished, (*ended)[0].EndReason)
+	assert.Equal(t, testStart, (*ended)[0].Start)
+	assert.Equal(t, testStart.Add(time.Second+20*time.Millisecond), (*ended)[0].End)
+	assert.Equal(t, "FSA", (*ended)[0].TCPFlags.String())
+	assert.Equal(t, 0, flows.Len())
+}
+
+func TestTrackFlows_PortReused(t *testing.T) {
+	flows, ended := newTestFlowTable(t, FlowTableConfig{})
+	handler := TrackFlows(flows)
+	handle := func(ts time.Duration, tcp *layers.TCP) {
+		tcp.SrcPort, tcp.DstPort = 50000, 443
+		p := tcpPacket(t, testStart.Add(ts), testMAC1, gatewayMAC, "192.168.1.2", "93.184.216.34", 64, tcp)
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+
+	handle(0, &layers.TCP{SYN: true})
+	handle(10*time.Millisecond, &layers.TCP{RST: true})
+	assert.Empty(t, *ended)
+
+	// a new connection from the same port while the reset one lingers ends it
+	handle(20*time.Millisecond, &layers.TCP{SYN: true})
+	require.Len(t, *ended, 1)
+	assert.Equal(t, FlowFinished, (*ended)[0].EndReason)
+	assert.Equal(t, FlowReset, (*ended)[0].State)
+	assert.Equal(t, uint64(2), (*ended)[0].SrcPackets)
+
+	current := flows.Flows(testMAC1)
+	require.Len(t, current, 1)
+	assert.Equal(t, FlowSYNSent, current[0].State)
+	assert.Equal(t, testStart.Add(20*time.Millisecond), current[0].Start)
+	assert.Equal(t, uint64(1), current[0].SrcPackets)
+}
+
+func TestTrackFlows_Timeouts(t *testing.T) {
+	flows, ended := newTestFlowTable(t, FlowTableConfig{IdleTimeout: time.Minute, ActiveTimeout: 10 * time.Minute})
+	handler := TrackFlows(flows)
+	handle := func(ts time.Duration, srcIP, dstIP string, srcPort, dstPort uint16) {
+		p := udpPacket(t, testStart.Add(ts), testMAC1, testMAC2, srcIP, dstIP, srcPort, dstPort)
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+
+	// a flow seen every 30 seconds is ended by the active timeout and carries on
+	for ts := time.Duration(0); ts <= 10*time.Minute; ts += 30 * time.Second {
+		handle(ts, "192.168.1.2", "192.168.1.3", 5353, 5000)
+	}
+	require.Len(t, *ended, 1)
+	assert.Equal(t, FlowActiveTimeout, (*ended)[0].EndReason)
+	assert.Equal(t, uint64(20), (*ended)[0].SrcPackets)
+	assert.Equal(t, 1, flows.Len())
+	assert.Len(t, flows.Flows(testMAC2), 1, "both local hosts are attributed the flow")
+
+	// transit traffic isn't tracked
+	handle(10*time.Minute, "8.8.8.8", "1.1.1.1", 53, 53)
+	assert.Equal(t, 1, flows.Len())
+
+	// the next packet sweeps the idle flow
+	handle(12*time.Minute, "192.168.1.2", "192.168.1.4", 5353, 5000)
+	require.Len(t, *ended, 2)
+	assert.Equal(t, FlowIdleTimeout, (*ended)[1].EndReason)
+	assert.Equal(t, uint64(1), (*ended)[1].SrcPackets)
+	assert.Equal(t, 1, flows.Len())
+}
+
+func TestFlowTable_Evicts(t *testing.T) {
+	flows, ended := newTestFlowTable(t, FlowTableConfig{MaxFlows: 2})
+	handler := TrackFlows(flows)
+	for i, port := range []uint16{1000, 1001, 1000, 1002} {
+		p := udpPacket(t, testStart.Add(time.Duration(i)*time.Millisecond), testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", port, 53)
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+
+	require.Len(t, *ended, 1)
+	assert.Equal(t, FlowEvicted, (*ended)[0].EndReason)
+	assert.Equal(t, uint16(1001), (*ended)[0].Src.Port(), "the least recently seen flow")
+	assert.Equal(t, 2, flows.Len())
+
+	flows.Flush()
+	assert.Len(t, *ended, 3)
+	assert.Equal(t, FlowFlushed, (*ended)[2].EndReason)
+	assert.Equal(t, 0, flows.Len())
+}
+
+func TestFlowLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.jsonl")
+	flowLog, err := NewFlowLog(path)
+	require.NoError(t, err)
+
+	flows, err := NewFlowTable(FlowTableConfig{MaxFlows: 16, IdleTimeout: time.Minute, Export: flowLog.Export})
+	require.NoError(t, err)
+	p := udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 53)
+	require.NoError(t, TrackFlows(flows)(context.Background(), decode(t, p)))
+	flows.Flush()
+	require.NoError(t, flowLog.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	require.True(t, scanner.Scan())
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+	assert.Equal(t, "UDP", record["protocol"])
+	assert.Equal(t, "192.168.1.2:50000", record["src"])
+	assert.Equal(t, "8.8.8.8:53", record["dst"])
+	assert.Equal(t, testMAC1.String(), record["src_mac"])
+	assert.Equal(t, "flushed", record["end_reason"])
+	assert.Equal(t, "active", record["state"])
+	assert.NotContains(t, record, "tcp_flags")
+	assert.False(t, scanner.Scan())
+}
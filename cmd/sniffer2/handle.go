@@ -1,7 +1,29 @@
 package main
 
-import "github.com/google/gopacket"
+import (
+	"errors"
+	"os"
+	"syscall"
 
-func NewHandle(iface string) (gopacket.PacketDataSource, func(), error) {
-	return newHandle(iface)
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// NewHandle opens a live capture on the interface with the filter attached.
+func NewHandle(iface string, filter []bpf.RawInstruction) (gopacket.PacketDataSource, func(), error) {
+	return newHandle(iface, filter)
+}
+
+// NewMonitorHandle opens a live capture of the 802.11 frames of a wireless interface in monitor mode, returning the
+// link type of the frames.
+func NewMonitorHandle(iface string) (gopacket.PacketDataSource, layers.LinkType, func(), error) {
+	return newMonitorHandle(iface)
+}
+
+// isTemporaryReadError returns whether reading from a packet source can go on after the error, like a read that timed
+// out or was interrupted. Any other error stops the capture.
+func isTemporaryReadError(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) ||
+		isTemporaryHandleError(err)
 }
@@ -1,26 +1,100 @@
-//go:build arm
-// +build arm
+//go:build linux
+// +build linux
 
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
 )
 
-func newHandle(iface string) (gopacket.PacketDataSource, func(), error) {
+// the kernel strips the outermost vlan tag of the frames read from a packet socket, pcapgo passes its TCI in the
+// ancillary data of the frame
+const captureVLANTags = strippedVLANTags
+
+func newHandle(iface string, filter []bpf.RawInstruction) (gopacket.PacketDataSource, func(), error) {
 	handle, err := pcapgo.NewEthernetHandle(iface)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	if err = handle.SetCaptureLength(snapLen); err != nil {
+		handle.Close()
 		return nil, nil, err
 	} else if err = handle.SetPromiscuous(true); err != nil {
+		handle.Close()
+		return nil, nil, err
+	} else if err = handle.SetBPF(filter); err != nil {
+		handle.Close()
 		return nil, nil, err
 	}
 
-	// setup BPF filter
-
 	return handle, handle.Close, nil
 }
+
+// pcapgo formats the errno of a failed read into its error rather than wrapping it
+func isTemporaryHandleError(err error) bool {
+	msg := err.Error()
+	return strings.HasSuffix(msg, syscall.EAGAIN.Error()) || strings.HasSuffix(msg, syscall.EINTR.Error())
+}
+
+// the interface must already be in monitor mode (iw dev <iface> set type monitor), its frames are then read with
+// the header of its link type
+func newMonitorHandle(iface string) (gopacket.PacketDataSource, layers.LinkType, func(), error) {
+	arphrd, err := os.ReadFile(filepath.Join("/sys/class/net", iface, "type"))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	linkType, err := monitorLinkType(iface, string(arphrd))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	handle, err := pcapgo.NewEthernetHandle(iface)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if err = handle.SetCaptureLength(snapLen); err != nil {
+		handle.Close()
+		return nil, 0, nil, err
+	}
+
+	return handle, linkType, handle.Close, nil
+}
+
+// ARPHRD types of interfaces in monitor mode, from linux/if_arp.h
+const (
+	arphrdIEEE80211         = 801
+	arphrdIEEE80211Prism    = 802
+	arphrdIEEE80211Radiotap = 803
+)
+
+// monitorLinkType returns the link type of the frames read from an interface with the given ARPHRD type, as found in
+// /sys/class/net/<iface>/type. Only 802.11 frames with or without a radiotap header are supported.
+func monitorLinkType(iface, arphrd string) (layers.LinkType, error) {
+	hwType, err := strconv.Atoi(strings.TrimSpace(arphrd))
+	if err != nil {
+		return 0, fmt.Errorf("invalid type of interface %s: %w", iface, err)
+	}
+
+	switch hwType {
+	case arphrdIEEE80211:
+		return layers.LinkTypeIEEE802_11, nil
+	case arphrdIEEE80211Radiotap:
+		return layers.LinkTypeIEEE80211Radio, nil
+	case arphrdIEEE80211Prism:
+		return 0, fmt.Errorf("interface %s has prism headers, only radiotap or plain 802.11 is supported", iface)
+	default:
+		return 0, fmt.Errorf("interface %s is not in monitor mode (type %d), see iw dev %s set type monitor", iface, hwType, iface)
+	}
+}
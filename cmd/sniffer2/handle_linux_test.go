@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitorLinkType(t *testing.T) {
+	linkType, err := monitorLinkType("wlan0mon", "803\n")
+	require.NoError(t, err)
+	assert.Equal(t, layers.LinkTypeIEEE80211Radio, linkType)
+
+	linkType, err = monitorLinkType("wlan0mon", "801\n")
+	require.NoError(t, err)
+	assert.Equal(t, layers.LinkTypeIEEE802_11, linkType)
+
+	for _, arphrd := range []string{"802\n", "1\n", ""} {
+		_, err = monitorLinkType("wlan0", arphrd)
+		assert.Error(t, err, arphrd)
+	}
+}
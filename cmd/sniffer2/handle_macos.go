@@ -4,14 +4,20 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
 )
 
-func newHandle(iface string) (gopacket.PacketDataSource, func(), error) {
+// bpf devices read frames with their vlan tags
+const captureVLANTags = inlineVLANTags
+
+func newHandle(iface string, filter []bpf.RawInstruction) (gopacket.PacketDataSource, func(), error) {
 	inactive, err := pcap.NewInactiveHandle(iface)
 	if err != nil {
 		log.Fatalf("could not create: %v", err)
@@ -30,10 +36,43 @@ func newHandle(iface string) (gopacket.PacketDataSource, func(), error) {
 		log.Fatal("PCAP Activate error:", err)
 	}
 
-	// set our filter for port 68 - dhcp packets
-	if err = handle.SetBPFFilter("udp port 68"); err != nil {
+	// the filter is compiled by us rather than libpcap so it matches the other backends
+	instructions := make([]pcap.BPFInstruction, len(filter))
+	for i, raw := range filter {
+		instructions[i] = pcap.BPFInstruction{Code: raw.Op, Jt: raw.Jt, Jf: raw.Jf, K: raw.K}
+	}
+	if err = handle.SetBPFInstructionFilter(instructions); err != nil {
 		log.Fatal("BPF filter error:", err)
 	}
 
 	return handle, handle.Close, nil
 }
+
+// libpcap returns from a read once the timeout of the handle expires
+func isTemporaryHandleError(err error) bool {
+	return errors.Is(err, pcap.NextErrorTimeoutExpired)
+}
+
+func newMonitorHandle(iface string) (gopacket.PacketDataSource, layers.LinkType, func(), error) {
+	inactive, err := pcap.NewInactiveHandle(iface)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer inactive.CleanUp()
+	if err = inactive.SetSnapLen(snapLen); err != nil {
+		return nil, 0, nil, err
+	} else if err = inactive.SetRFMon(true); err != nil {
+		return nil, 0, nil, err
+	} else if err = inactive.SetTimeout(time.Second); err != nil {
+		return nil, 0, nil, err
+	}
+
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	// prefer radiotap headers for the signal strength, the default may be plain 802.11
+	_ = handle.SetLinkType(layers.LinkTypeIEEE80211Radio)
+
+	return handle, handle.LinkType(), handle.Close, nil
+}
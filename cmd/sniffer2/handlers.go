@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Middleware wraps a PacketHandler, e.g. to only pass it some of the packets.
+type Middleware func(next PacketHandler) PacketHandler
+
+// HandlerConfig turns off handlers of a HandlerRegistry and wraps them with middleware.
+type HandlerConfig struct {
+	// Disabled are the names of the handlers that are turned off.
+	Disabled []string
+	// Sample passes only one in every n packets to the named handlers.
+	Sample map[string]int
+	// MACs limits every handler to the packets sent or received by these MACs, all packets are handled if empty.
+	MACs []net.HardwareAddr
+}
+
+// HandlerStats are the packets a handler was passed, the errors it returned and the time it spent handling them.
+type HandlerStats struct {
+	Name    string
+	Packets uint64
+	Errors  uint64
+	Time    time.Duration
+}
+
+func (s HandlerStats) String() string {
+	var avg time.Duration
+	if s.Packets > 0 {
+		avg = s.Time / time.Duration(s.Packets)
+	}
+	return fmt.Sprintf("handler=(%s) packets=(%d) errors=(%d) time=(%s) avg=(%s)", s.Name, s.Packets, s.Errors, s.Time, avg)
+}
+
+type registeredHandler struct {
+	name       string
+	layers     []gopacket.LayerType
+	handler    PacketHandler
+	middleware []Middleware
+	disabled   bool
+
+	// updated atomically, the handler runs on every worker
+	packets uint64
+	errors  uint64
+	nanos   int64
+}
+
+// HandlerRegistry composes the handlers of a pipeline. Every handler declares the layers it looks at so only those are
+// decoded, can be turned off or wrapped with middleware, and has its packets, errors and time counted. An error of one
+// handler doesn't stop the packet from being passed to the others.
+//
+// Handlers are registered and configured before the composed handler is built with Handler.
+type HandlerRegistry struct {
+	handlers []*registeredHandler
+	byName   map[string]*registeredHandler
+	// wraps every handler
+	middleware []Middleware
+}
+
+func NewHandlerRegistry() *HandlerRegistry {
+	return &HandlerRegistry{
+		byName: make(map[string]*registeredHandler),
+	}
+}
+
+// Register adds the handler under name, it's passed packets after the handlers registered before it. Registering a
+// name twice panics.
+func (r *HandlerRegistry) Register(name string, layerTypes []gopacket.LayerType, handler PacketHandler) {
+	if _, ok := r.byName[name]; ok {
+		panic(fmt.Sprintf("handler %q registered twice", name))
+	}
+
+	h := &registeredHandler{name: name, layers: layerTypes, handler: handler}
+	r.handlers = append(r.handlers, h)
+	r.byName[name] = h
+}
+
+// Names returns the names of the registered handlers in the order they're passed packets.
+func (r *HandlerRegistry) Names() []string {
+	names := make([]string, 0, len(r.handlers))
+	for _, h := range r.handlers {
+		names = append(names, h.name)
+	}
+	return names
+}
+
+func (r *HandlerRegistry) lookup(name string) (*registeredHandler, error) {
+	h, ok := r.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown handler %q, expected one of %s", name, strings.Join(r.Names(), ","))
+	}
+	return h, nil
+}
+
+// Use wraps every handler with the middleware, the first is the outermost. Middleware of every handler wraps the
+// middleware of a single handler.
+func (r *HandlerRegistry) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Wrap wraps the named handler with the middleware, the first is the outermost.
+func (r *HandlerRegistry) Wrap(name string, middleware ...Middleware) error {
+	h, err := r.lookup(name)
+	if err != nil {
+		return err
+	}
+	h.middleware = append(h.middleware, middleware...)
+	return nil
+}
+
+// Disable turns off the named handlers, they aren't passed packets and their layers aren't decoded unless another
+// handler looks at them.
+func (r *HandlerRegistry) Disable(names ...string) error {
+	for _, name := range names {
+		h, err := r.lookup(name)
+		if err != nil {
+			return err
+		}
+		h.disabled = true
+	}
+	return nil
+}
+
+// Configure applies the config to the registered handlers.
+func (r *HandlerRegistry) Configure(config HandlerConfig) error {
+	if err := r.Disable(config.Disabled...); err != nil {
+		return err
+	}
+
+	// wrapped in a stable order, map iteration isn't
+	names := make([]string, 0, len(config.Sample))
+	for name := range config.Sample {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n := config.Sample[name]
+		if n <= 0 {
+			return fmt.Errorf("sample rate of handler %q must be positive, got %d", name, n)
+		}
+		if err := r.Wrap(name, Sample(n)); err != nil {
+			return err
+		}
+	}
+
+	if len(config.MACs) > 0 {
+		r.Use(FilterMACs(config.MACs...))
+	}
+	return nil
+}
+
+// Layers returns the layers the enabled handlers look at.
+func (r *HandlerRegistry) Layers() []gopacket.LayerType {
+	var declared [][]gopacket.LayerType
+	for _, h := range r.handlers {
+		if !h.disabled {
+			declared = append(declared, h.layers)
+		}
+	}
+	return layerSet(declared...)
+}
+
+// Handler returns a handler passing every packet to the enabled handlers in the order they were registered. Errors are
+// logged and counted against the handler returning them.
+func (r *HandlerRegistry) Handler() PacketHandler {
+	type wrappedHandler struct {
+		*registeredHandler
+		wrapped PacketHandler
+	}
+
+	var handlers []wrappedHandler
+	for _, h := range r.handlers {
+		if h.disabled {
+			continue
+		}
+
+		// only the packets actually passed to the handler count towards its stats
+		wrapped := h.measure()
+		for i := len(h.middleware) - 1; i >= 0; i-- {
+			wrapped = h.middleware[i](wrapped)
+		}
+		for i := len(r.middleware) - 1; i >= 0; i-- {
+			wrapped = r.middleware[i](wrapped)
+		}
+		handlers = append(handlers, wrappedHandler{registeredHandler: h, wrapped: wrapped})
+	}
+
+	return func(ctx context.Context, packet gopacket.Packet) error {
+		for _, h := range handlers {
+			if err := h.wrapped(ctx, packet); err != nil {
+				atomic.AddUint64(&h.errors, 1)
+				log.Printf("error in handler %s: %v", h.name, err)
+			}
+		}
+
+		return nil
+	}
+}
+
+// measure counts the packets passed to the handler and the time it takes
+func (h *registeredHandler) measure() PacketHandler {
+	return func(ctx context.Context, packet gopacket.Packet) error {
+		start := time.Now()
+		err := h.handler(ctx, packet)
+		atomic.AddInt64(&h.nanos, int64(time.Since(start)))
+		atomic.AddUint64(&h.packets, 1)
+		return err
+	}
+}
+
+// Stats returns the stats of the enabled handlers in the order they were registered.
+func (r *HandlerRegistry) Stats() []HandlerStats {
+	var stats []HandlerStats
+	for _, h := range r.handlers {
+		if h.disabled {
+			continue
+		}
+		stats = append(stats, HandlerStats{
+			Name:    h.name,
+			Packets: atomic.LoadUint64(&h.packets),
+			Errors:  atomic.LoadUint64(&h.errors),
+			Time:    time.Duration(atomic.LoadInt64(&h.nanos)),
+		})
+	}
+	return stats
+}
+
+// PrintStats logs the stats of every enabled handler.
+func (r *HandlerRegistry) PrintStats() {
+	for _, stats := range r.Stats() {
+		log.Println(stats)
+	}
+}
+
+// RecoverPanics returns the panic of a handler as an error with the stack it panicked at, so a bug in one handler
+// doesn't take down the process.
+func RecoverPanics() Middleware {
+	return func(next PacketHandler) PacketHandler {
+		return func(ctx context.Context, packet gopacket.Packet) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+				}
+			}()
+
+			return next(ctx, packet)
+		}
+	}
+}
+
+// Sample passes only the first of every n packets to the handler. Handlers keeping state across packets, like the flow
+// table, only see part of the traffic when sampled.
+func Sample(n int) Middleware {
+	return func(next PacketHandler) PacketHandler {
+		var seen uint64
+		return func(ctx context.Context, packet gopacket.Packet) error {
+			if (atomic.AddUint64(&seen, 1)-1)%uint64(n) != 0 {
+				return nil
+			}
+
+			return next(ctx, packet)
+		}
+	}
+}
+
+// FilterMACs passes only the ethernet frames sent or received by one of the MACs to the handler.
+func FilterMACs(macs ...net.HardwareAddr) Middleware {
+	allowed := make(map[string]bool, len(macs))
+	for _, mac := range macs {
+		allowed[string(mac)] = true
+	}
+
+	return func(next PacketHandler) PacketHandler {
+		return func(ctx context.Context, packet gopacket.Packet) error {
+			eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+			// indexing with the raw bytes doesn't allocate
+			if !ok || !allowed[string(eth.SrcMAC)] && !allowed[string(eth.DstMAC)] {
+				return nil
+			}
+
+			return next(ctx, packet)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countPackets returns a handler counting the packets it's passed
+func countPackets(count *int, err error) PacketHandler {
+	return func(context.Context, gopacket.Packet) error {
+		*count++
+		return err
+	}
+}
+
+func TestHandlerRegistry(t *testing.T) {
+	registry := NewHandlerRegistry()
+	var order []string
+	registry.Register("first", hostLayers, func(context.Context, gopacket.Packet) error {
+		order = append(order, "first")
+		return errors.New("failed")
+	})
+	registry.Register("second", dnsLayers, func(context.Context, gopacket.Packet) error {
+		order = append(order, "second")
+		return nil
+	})
+	assert.Equal(t, []string{"first", "second"}, registry.Names())
+	assert.Panics(t, func() { registry.Register("first", nil, nil) })
+
+	handler := registry.Handler()
+	packet := decode(t, udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "192.168.1.1", 50000, dnsPort))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, handler(context.Background(), packet))
+	}
+
+	// an error doesn't stop the packet from reaching the next handler
+	assert.Equal(t, []string{"first", "second", "first", "second", "first", "second"}, order)
+	stats := registry.Stats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, "first", stats[0].Name)
+	assert.Equal(t, uint64(3), stats[0].Packets)
+	assert.Equal(t, uint64(3), stats[0].Errors)
+	assert.Equal(t, uint64(3), stats[1].Packets)
+	assert.Equal(t, uint64(0), stats[1].Errors)
+	assert.Equal(t, layerSet(hostLayers, dnsLayers), registry.Layers())
+}
+
+func TestHandlerRegistry_Disable(t *testing.T) {
+	registry := NewHandlerRegistry()
+	var hosts, dns int
+	registry.Register("hosts", hostLayers, countPackets(&hosts, nil))
+	registry.Register("dns", dnsLayers, countPackets(&dns, nil))
+
+	assert.Error(t, registry.Disable("unknown"))
+	require.NoError(t, registry.Disable("dns"))
+	// only the layers of the enabled handlers are decoded
+	assert.Equal(t, hostLayers, registry.Layers())
+
+	packet := decode(t, udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "192.168.1.1", 50000, dnsPort))
+	require.NoError(t, registry.Handler()(context.Background(), packet))
+	assert.Equal(t, 1, hosts)
+	assert.Equal(t, 0, dns)
+	require.Len(t, registry.Stats(), 1)
+}
+
+func TestHandlerRegistry_Configure(t *testing.T) {
+	registry := NewHandlerRegistry()
+	var hosts, dns, flows int
+	registry.Register("hosts", hostLayers, countPackets(&hosts, nil))
+	registry.Register("dns", dnsLayers, countPackets(&dns, nil))
+	registry.Register("flows", flowLayers, countPackets(&flows, nil))
+	require.NoError(t, registry.Configure(HandlerConfig{
+		Disabled: []string{"flows"},
+		Sample:   map[string]int{"dns": 2},
+		MACs:     []net.HardwareAddr{testMAC1},
+	}))
+
+	handler := registry.Handler()
+	for i := 0; i < 4; i++ {
+		packet := udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "192.168.1.1", 50000, dnsPort)
+		require.NoError(t, handler(context.Background(), decode(t, packet)))
+		// the reply is sent to the MAC
+		packet = udpPacket(t, testStart, gatewayMAC, testMAC1, "192.168.1.1", "192.168.1.10", dnsPort, 50000)
+		require.NoError(t, handler(context.Background(), decode(t, packet)))
+		// not sent or received by the MAC
+		packet = udpPacket(t, testStart, testMAC2, gatewayMAC, "192.168.1.11", "192.168.1.1", 50000, dnsPort)
+		require.NoError(t, handler(context.Background(), decode(t, packet)))
+	}
+
+	assert.Equal(t, 8, hosts)
+	assert.Equal(t, 4, dns, "every other packet")
+	assert.Equal(t, 0, flows)
+	stats := registry.Stats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, uint64(4), stats[1].Packets, "only the packets passed to the handler are counted")
+
+	assert.Error(t, NewHandlerRegistry().Configure(HandlerConfig{Sample: map[string]int{"unknown": 2}}))
+	assert.Error(t, registry.Configure(HandlerConfig{Sample: map[string]int{"dns": 0}}))
+}
+
+func TestRecoverPanics(t *testing.T) {
+	registry := NewHandlerRegistry()
+	registry.Use(RecoverPanics())
+	var after int
+	registry.Register("panics", nil, func(_ context.Context, packet gopacket.Packet) error {
+		// a nil pointer on packets without a TCP layer
+		_ = packet.Layer(layers.LayerTypeTCP).(*layers.TCP).SrcPort
+		return nil
+	})
+	registry.Register("after", nil, countPackets(&after, nil))
+
+	packet := decode(t, udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "192.168.1.1", 50000, dnsPort))
+	assert.NotPanics(t, func() {
+		require.NoError(t, registry.Handler()(context.Background(), packet))
+	})
+	assert.Equal(t, 1, after)
+	assert.Equal(t, uint64(1), registry.Stats()[0].Errors)
+}
+
+func TestParseSampleRates(t *testing.T) {
+	rates, err := parseSampleRates("flows=10, dns=2")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"flows": 10, "dns": 2}, rates)
+
+	for _, list := range []string{"flows", "flows=0", "flows=x"} {
+		_, err := parseSampleRates(list)
+		assert.Error(t, err, list)
+	}
+}
+
+func TestParseMACs(t *testing.T) {
+	macs, err := parseMACs("1a:1a:1a:1a:1a:1a,")
+	require.NoError(t, err)
+	assert.Equal(t, []net.HardwareAddr{testMAC1}, macs)
+
+	_, err = parseMACs("not-a-mac")
+	assert.Error(t, err)
+}
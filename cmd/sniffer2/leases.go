@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+type LeaseState int
+
+const (
+	// LeaseOffered is a lease a server has offered but the client hasn't taken yet.
+	LeaseOffered LeaseState = iota
+	// LeaseBound is a lease acknowledged by the server, the client is using the address.
+	LeaseBound
+)
+
+func (s LeaseState) String() string {
+	switch s {
+	case LeaseOffered:
+		return "offered"
+	case LeaseBound:
+		return "bound"
+	default:
+		return "unknown"
+	}
+}
+
+// Lease is an address handed out to a host by a DHCP server.
+type Lease struct {
+	MAC net.HardwareAddr
+	IP  netip.Addr
+	// VLAN and OuterVLAN are those of the messages of the lease, each VLAN has its own DHCP server and leases.
+	VLAN      uint16
+	OuterVLAN uint16
+	State     LeaseState
+	Start     time.Time
+	Expires   time.Time
+}
+
+func (l Lease) String() string {
+	return fmt.Sprintf("%s state=(%s) start=(%s) expires=(%s)",
+		l.Addr(), l.State, l.Start.Format(time.RFC3339), l.Expires.Format(time.RFC3339))
+}
+
+// Addr returns the address leased to the host.
+func (l Lease) Addr() hostmonitor.Addr {
+	return hostmonitor.Addr{MAC: l.MAC, IP: l.IP, VLAN: l.VLAN, OuterVLAN: l.OuterVLAN}
+}
+
+// LeaseTable keeps track of the DHCP leases of each host, as seen from the messages between clients and servers. A MAC
+// on each VLAN is a separate host.
+type LeaseTable struct {
+	leases map[string]*Lease
+	mux    *sync.RWMutex
+}
+
+func NewLeaseTable() *LeaseTable {
+	return &LeaseTable{
+		leases: make(map[string]*Lease),
+		mux:    &sync.RWMutex{},
+	}
+}
+
+// Offer records a lease offered to a host, unless the host holds a bound lease: only an ACK replaces that.
+func (t *LeaseTable) Offer(lease Lease) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.expire(lease.Start)
+	host := lease.Addr().HostKey()
+	if existing, ok := t.leases[host]; ok && existing.State == LeaseBound {
+		return
+	}
+
+	lease.State = LeaseOffered
+	t.leases[host] = &lease
+}
+
+// Bind records a lease acknowledged by the server, returning true if the host didn't already hold a lease for the
+// address (renewals extend the existing lease).
+func (t *LeaseTable) Bind(lease Lease) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.expire(lease.Start)
+	host := lease.Addr().HostKey()
+	existing, ok := t.leases[host]
+	renewed := ok && existing.State == LeaseBound && existing.IP == lease.IP
+
+	lease.State = LeaseBound
+	t.leases[host] = &lease
+
+	return !renewed
+}
+
+// Expire drops the leases that expired by now.
+func (t *LeaseTable) Expire(now time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.expire(now)
+}
+
+// expire drops the leases that expired by now. The lock must be held.
+func (t *LeaseTable) expire(now time.Time) {
+	for host, lease := range t.leases {
+		if !lease.Expires.After(now) {
+			delete(t.leases, host)
+		}
+	}
+}
+
+// Remove deletes the lease of the host of addr, its MAC on its VLAN, returning it if there was one.
+func (t *LeaseTable) Remove(addr hostmonitor.Addr) (Lease, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	lease, ok := t.leases[addr.HostKey()]
+	if !ok {
+		return Lease{}, false
+	}
+
+	delete(t.leases, addr.HostKey())
+	return *lease, true
+}
+
+// Lease returns the lease of the host of addr, its MAC on its VLAN.
+func (t *LeaseTable) Lease(addr hostmonitor.Addr) (Lease, bool) {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	lease, ok := t.leases[addr.HostKey()]
+	if !ok {
+		return Lease{}, false
+	}
+	return *lease, true
+}
+
+// Leases returns all leases ordered by MAC and VLAN.
+func (t *LeaseTable) Leases() []Lease {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	leases := make([]Lease, 0, len(t.leases))
+	for _, lease := range t.leases {
+		leases = append(leases, *lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].Addr().HostKey() < leases[j].Addr().HostKey()
+	})
+
+	return leases
+}
+
+// Expiry returns when the bound lease for the address expires, or the zero time if there isn't one. It's used with
+// hostmonitor.ExpiryOption so silent hosts stay online until their lease runs out.
+func (t *LeaseTable) Expiry(addr hostmonitor.Addr) time.Time {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	lease, ok := t.leases[addr.HostKey()]
+	if !ok || lease.State != LeaseBound || lease.IP != addr.IP {
+		return time.Time{}
+	}
+	return lease.Expires
+}
+
+// TrackLeases builds the lease table from the DHCP messages between clients and servers. An ACK binds the lease and
+// updates the hosts with the address, a NAK or DECLINE drops it and a RELEASE drops it and takes the address offline
+// straight away.
+func TrackLeases(hosts *hostmonitor.HostMap, leases *LeaseTable) PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		dhcp, ok := packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+		if !ok {
+			// nothing to do - not a DHCPv4 Packet
+			return nil
+		}
+
+		info := decodeDHCPOptions(dhcp)
+		mac := append(net.HardwareAddr(nil), dhcp.ClientHWAddr...)
+		client := newAddr(packet, mac, netip.Addr{})
+		seen := packet.Metadata().Timestamp
+		lease := Lease{
+			MAC:       mac,
+			VLAN:      client.VLAN,
+			OuterVLAN: client.OuterVLAN,
+			Start:     seen,
+			Expires:   seen.Add(info.LeaseTime),
+		}
+
+		switch info.MessageType {
+		case layers.DHCPMsgTypeOffer:
+			lease.IP, _ = netip.AddrFromSlice(dhcp.YourClientIP.To4())
+			if lease.IP.IsValid() && !lease.IP.IsUnspecified() {
+				leases.Offer(lease)
+			}
+
+		case layers.DHCPMsgTypeAck:
+			lease.IP, _ = netip.AddrFromSlice(dhcp.YourClientIP.To4())
+			if !lease.IP.IsValid() || lease.IP.IsUnspecified() || info.LeaseTime == 0 {
+				// acknowledging an INFORM, no address was leased
+				return nil
+			}
+
+			if leases.Bind(lease) {
+				log.Printf("dhcp lease bound %s", lease)
+			}
+			hosts.UpdateAddresses([]hostmonitor.Addr{newAddr(packet, mac, lease.IP)})
+
+		case layers.DHCPMsgTypeNak, layers.DHCPMsgTypeDecline:
+			if existing, ok := leases.Remove(client); ok {
+				log.Printf("dhcp lease dropped (%s) %s", info.MessageType, existing)
+			}
+
+		case layers.DHCPMsgTypeRelease:
+			ip, _ := netip.AddrFromSlice(dhcp.ClientIP.To4())
+			if existing, ok := leases.Remove(client); ok {
+				log.Printf("dhcp lease released %s", existing)
+				if !ip.IsValid() || ip.IsUnspecified() {
+					ip = existing.IP
+				}
+			}
+
+			if ip.IsValid() && !ip.IsUnspecified() {
+				hosts.MarkOffline(newAddr(packet, mac, ip))
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dhcpMessage builds a dhcp message of the type for testMAC1, from the server if it's a reply
+func dhcpMessage(t testing.TB, ts time.Time, msgType layers.DHCPMsgType, clientIP, yourIP string, leaseTime time.Duration) testPacket {
+	msg := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		ClientHWAddr: testMAC1,
+		ClientIP:     net.ParseIP(clientIP).To4(),
+		YourClientIP: net.ParseIP(yourIP).To4(),
+		Options: layers.DHCPOptions{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)}),
+		},
+	}
+	if leaseTime > 0 {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(leaseTime/time.Second))
+		msg.Options = append(msg.Options, layers.NewDHCPOption(layers.DHCPOptLeaseTime, data))
+	}
+
+	switch msgType {
+	case layers.DHCPMsgTypeOffer, layers.DHCPMsgTypeAck, layers.DHCPMsgTypeNak:
+		msg.Operation = layers.DHCPOpReply
+		return udpPacket(t, ts, gatewayMAC, testMAC1, "192.168.1.1", "192.168.1.10", 67, 68, msg)
+	default:
+		return udpPacket(t, ts, testMAC1, gatewayMAC, "0.0.0.0", "192.168.1.1", 68, 67, msg)
+	}
+}
+
+func TestTrackLeases(t *testing.T) {
+	now := testStart
+	leases := NewLeaseTable()
+	hosts := hostmonitor.NewHostMap(
+		hostmonitor.ClockOption(func() time.Time { return now }),
+		hostmonitor.ExpiryOption(leases.Expiry),
+	)
+	handler := TrackLeases(hosts, leases)
+
+	handle := func(p testPacket) {
+		now = p.ts
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+
+	handle(dhcpMessage(t, testStart, layers.DHCPMsgTypeOffer, "0.0.0.0", "192.168.1.10", time.Hour))
+	lease, ok := leases.Lease(hostmonitor.Addr{MAC: testMAC1})
+	require.True(t, ok)
+	assert.Equal(t, LeaseOffered, lease.State)
+	assert.True(t, leases.Expiry(hostmonitor.Addr{MAC: testMAC1, IP: lease.IP}).IsZero(), "offers don't expire hosts")
+
+	handle(dhcpMessage(t, testStart.Add(time.Second), layers.DHCPMsgTypeAck, "0.0.0.0", "192.168.1.10", time.Hour))
+	lease, ok = leases.Lease(hostmonitor.Addr{MAC: testMAC1})
+	require.True(t, ok)
+	assert.Equal(t, LeaseBound, lease.State)
+	assert.Equal(t, netip.MustParseAddr("192.168.1.10"), lease.IP)
+	assert.Equal(t, testStart.Add(time.Second+time.Hour), lease.Expires)
+	_, ok = hosts.FindByIP(lease.Addr())
+	assert.True(t, ok, "acks update the hosts")
+
+	// silent for longer than the offline timeout, but the lease hasn't expired
+	now = testStart.Add(30 * time.Minute)
+	hosts.UpdateAddresses(nil)
+	_, ok = hosts.FindByIP(lease.Addr())
+	assert.True(t, ok)
+
+	handle(dhcpMessage(t, testStart.Add(31*time.Minute), layers.DHCPMsgTypeRelease, "192.168.1.10", "0.0.0.0", 0))
+	_, ok = leases.Lease(hostmonitor.Addr{MAC: testMAC1})
+	assert.False(t, ok)
+	_, ok = hosts.FindByIP(lease.Addr())
+	assert.False(t, ok, "releases take the host offline")
+
+	changes := collectChanges(hosts)
+	require.Len(t, changes, 2)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[0].ChangeType)
+	assert.Equal(t, hostmonitor.OfflineChange, changes[1].ChangeType)
+	assert.Equal(t, netip.MustParseAddr("192.168.1.10"), changes[1].Addr.IP)
+}
+
+func TestTrackLeases_Nak(t *testing.T) {
+	leases := NewLeaseTable()
+	hosts := hostmonitor.NewHostMap()
+	handler := TrackLeases(hosts, leases)
+
+	require.NoError(t, handler(context.Background(), decode(t, dhcpMessage(t, testStart, layers.DHCPMsgTypeAck, "0.0.0.0", "192.168.1.10", time.Hour))))
+	require.NoError(t, handler(context.Background(), decode(t, dhcpMessage(t, testStart.Add(time.Hour), layers.DHCPMsgTypeNak, "0.0.0.0", "0.0.0.0", 0))))
+
+	_, ok := leases.Lease(hostmonitor.Addr{MAC: testMAC1})
+	assert.False(t, ok)
+	assert.Empty(t, leases.Leases())
+}
+
+func TestLeaseTable_OfferAndExpire(t *testing.T) {
+	leases := NewLeaseTable()
+	host := hostmonitor.Addr{MAC: testMAC1, IP: netip.MustParseAddr("192.168.1.10")}
+	bound := Lease{MAC: testMAC1, IP: host.IP, Start: testStart, Expires: testStart.Add(time.Hour)}
+	assert.True(t, leases.Bind(bound))
+
+	// another server offering the host a different address doesn't replace the lease it holds
+	leases.Offer(Lease{MAC: testMAC1, IP: netip.MustParseAddr("192.168.1.20"), Start: testStart.Add(time.Minute),
+		Expires: testStart.Add(time.Minute + time.Hour)})
+	lease, ok := leases.Lease(host)
+	require.True(t, ok)
+	assert.Equal(t, LeaseBound, lease.State)
+	assert.Equal(t, testStart.Add(time.Hour), leases.Expiry(host))
+
+	leases.Expire(testStart.Add(59 * time.Minute))
+	assert.Len(t, leases.Leases(), 1)
+	leases.Expire(testStart.Add(time.Hour))
+	assert.Empty(t, leases.Leases(), "expired leases are dropped")
+	assert.True(t, leases.Expiry(host).IsZero())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+const llmnrPort = 5355
+
+// UpdateHostNamesFromLLMNR watches for link-local multicast name resolution answers, the name windows hosts answer to
+// when there's no DNS for them. Responses are unicast to the querier so they're only seen when sniffer2 can see the
+// traffic of other hosts, e.g. from a mirrored port.
+func UpdateHostNamesFromLLMNR(hosts *hostmonitor.HostMap, hostNames *MacHostMap) PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		msg, eth, srcIP, ok := decodeDNS(packet, llmnrPort)
+		if !ok || !msg.QR || msg.ResponseCode != layers.DNSResponseCodeNoErr {
+			// nothing to do - not an LLMNR answer
+			return nil
+		}
+
+		for _, rr := range msg.Answers {
+			if rr.Type != layers.DNSTypeA && rr.Type != layers.DNSTypeAAAA {
+				continue
+			}
+
+			// LLMNR names are single labels
+			hostName := strings.TrimSuffix(string(rr.Name), ".")
+			if hostName == "" || strings.Contains(hostName, ".") {
+				continue
+			}
+
+			ip, _ := netip.AddrFromSlice(rr.IP)
+			owner, ok := ownerOf(hosts, packet, eth.SrcMAC, srcIP, ip.Unmap())
+			if !ok {
+				continue
+			}
+			mac := owner.MAC
+
+			if hostNames.Set(owner, LLMNRNameSource, hostName) {
+				log.Printf("llmnr from %s(ip=%s), hostname=(%s), manufacturer=(%s)",
+					mac, ip, hostName, hostmonitor.FindManufacturer(mac))
+			}
+		}
+
+		return nil
+	}
+}
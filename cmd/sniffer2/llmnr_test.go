@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateHostNamesFromLLMNR(t *testing.T) {
+	hosts := hostmonitor.NewHostMap()
+	hostNames := NewMacHostMap()
+	handler := UpdateHostNamesFromLLMNR(hosts, hostNames)
+
+	handle := func(msg *layers.DNS) {
+		p := udpPacket(t, testStart, testMAC1, testMAC2, "192.168.1.10", "192.168.1.11", llmnrPort, 50000, msg)
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+	answer := func(name, ip string) *layers.DNS {
+		return &layers.DNS{
+			QR:        true,
+			Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+			Answers: []layers.DNSResourceRecord{
+				{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 30, IP: net.ParseIP(ip).To4()},
+			},
+		}
+	}
+
+	// not for an address we know the owner of
+	handle(answer("printer", "192.168.1.50"))
+	assert.Equal(t, "", hostNames.Get(hostmonitor.Addr{MAC: testMAC1}))
+
+	handle(answer("DESKTOP-1234", "192.168.1.10"))
+	name, source := hostNames.Lookup(hostmonitor.Addr{MAC: testMAC1})
+	assert.Equal(t, "DESKTOP-1234", name)
+	assert.Equal(t, LLMNRNameSource, source)
+
+	// netbios names take precedence
+	hostNames.Set(hostmonitor.Addr{MAC: testMAC1}, NetBIOSNameSource, "DESKTOP")
+	assert.Equal(t, "DESKTOP", hostNames.Get(hostmonitor.Addr{MAC: testMAC1}))
+
+	hosts.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC2, IP: netip.MustParseAddr("192.168.1.11")}})
+	handle(answer("fileserver.corp.example.com", "192.168.1.11"))
+	assert.Equal(t, "", hostNames.Get(hostmonitor.Addr{MAC: testMAC2}), "only single label names")
+}
@@ -1,30 +1,104 @@
 package main
 
 import (
-	"net"
+	"fmt"
+	"strings"
 	"sync"
+
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+// NameSource identifies where a host name was learned from.
+type NameSource string
+
+const (
+	DHCPNameSource    NameSource = "dhcp"
+	MDNSNameSource    NameSource = "mdns"
+	NetBIOSNameSource NameSource = "netbios"
+	LLMNRNameSource   NameSource = "llmnr"
 )
 
-func NewMacHostMap() *MacHostMap {
+// DefaultNamePrecedence prefers the name a host asked for over DHCP to the ones it advertises over mDNS, NetBIOS and
+// LLMNR.
+var DefaultNamePrecedence = []NameSource{DHCPNameSource, MDNSNameSource, NetBIOSNameSource, LLMNRNameSource}
+
+// ParseNamePrecedence parses a comma separated list of name sources, highest precedence first.
+func ParseNamePrecedence(list string) ([]NameSource, error) {
+	known := make(map[NameSource]bool, len(DefaultNamePrecedence))
+	for _, source := range DefaultNamePrecedence {
+		known[source] = true
+	}
+
+	var precedence []NameSource
+	for _, name := range strings.Split(list, ",") {
+		source := NameSource(strings.TrimSpace(name))
+		if source == "" {
+			continue
+		}
+		if !known[source] {
+			return nil, fmt.Errorf("unknown name source %q", source)
+		}
+		precedence = append(precedence, source)
+	}
+
+	return precedence, nil
+}
+
+func NewMacHostMap(precedence ...NameSource) *MacHostMap {
+	if len(precedence) == 0 {
+		precedence = DefaultNamePrecedence
+	}
+
 	return &MacHostMap{
-		m:   make(map[string]string),
-		mux: &sync.RWMutex{},
+		m:          make(map[string]map[NameSource]string),
+		precedence: precedence,
+		mux:        &sync.RWMutex{},
 	}
 }
 
+// MacHostMap keeps the host names learned for each host, a MAC on a VLAN, from each source. When a host has names from
+// several sources the source with the highest precedence wins.
 type MacHostMap struct {
-	m   map[string]string
-	mux *sync.RWMutex
+	m          map[string]map[NameSource]string
+	precedence []NameSource
+	mux        *sync.RWMutex
 }
 
-func (m *MacHostMap) Set(mac net.HardwareAddr, hostName string) {
+// Set records the host name learned from source for the host of addr, returning true if it's different to what the
+// source previously reported.
+func (m *MacHostMap) Set(addr hostmonitor.Addr, source NameSource, hostName string) bool {
 	m.mux.Lock()
-	m.m[mac.String()] = hostName
 	defer m.mux.Unlock()
+
+	host := addr.HostKey()
+	names, ok := m.m[host]
+	if !ok {
+		names = make(map[NameSource]string)
+		m.m[host] = names
+	}
+
+	previous, ok := names[source]
+	names[source] = hostName
+	return !ok || previous != hostName
 }
 
-func (m *MacHostMap) Get(mac net.HardwareAddr) string {
+// Get returns the host name with the highest precedence for the host of addr, or an empty string if there are none.
+func (m *MacHostMap) Get(addr hostmonitor.Addr) string {
+	name, _ := m.Lookup(addr)
+	return name
+}
+
+// Lookup returns the host name with the highest precedence for the host of addr along with its source.
+func (m *MacHostMap) Lookup(addr hostmonitor.Addr) (string, NameSource) {
 	m.mux.RLock()
 	defer m.mux.RUnlock()
-	return m.m[mac.String()]
+
+	names := m.m[addr.HostKey()]
+	for _, source := range m.precedence {
+		if name, ok := names[source]; ok {
+			return name, source
+		}
+	}
+
+	return "", ""
 }
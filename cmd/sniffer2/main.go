@@ -4,14 +4,18 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/netip"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/go-logr/stdr"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	hostmonitor "github.com/rickbau5/host-monitor"
@@ -22,15 +26,54 @@ import (
 const (
 	snapLen            = 65536
 	defaultOfflineTime = 5 * time.Minute
+	// number of domains printed per host at the end of a replay
+	topDomains = 5
 )
 
-var iface = flag.String("i", "", "Name of the interface to read packets from")
+var ifaceList = flag.String("i", "", "Comma separated names of the interfaces to read packets from, each is captured concurrently")
+var wifiList = flag.String("wifi", "", "Comma separated names of wireless interfaces in monitor mode to track nearby devices from by their probe requests, association requests and data frames. They're kept apart from the hosts of the LAN")
 var offlineTime = flag.Duration("offline-timeout", defaultOfflineTime, "Amount of time that must elapse before a host is considered inactive")
+var readFile = flag.String("r", "", "Replay packets from a pcap or pcapng file instead of reading from an interface")
+var speed = flag.Float64("speed", 0, "Replay speed when reading from a file: 0 is as fast as possible, 1 is real time")
+var vlanList = flag.String("vlans", "", "Comma separated 802.1Q VLAN IDs to monitor, frames tagged with other VLANs are dropped and untagged frames are only kept if 0 is listed. All frames are monitored if empty")
+var bpfExpr = flag.String("bpf", "", "Capture filter applied to every packet source, supports a subset of the tcpdump syntax. Defaults to ARP, DNS, DHCP, mDNS, NetBIOS, LLMNR, SSDP and NDP packets, TLS ClientHellos and HTTP requests plus the headers of all other IP packets")
+var namePrecedence = flag.String("hostname-precedence", "dhcp,mdns,netbios,llmnr", "Comma separated list of host name sources, the name from the first source a host has one from is used")
+var fingerprintsFile = flag.String("dhcp-fingerprints", "", "File of DHCP fingerprints used to guess the device type of hosts, the built in database is used if empty")
+var synFingerprintsFile = flag.String("syn-fingerprints", "", "File of TCP SYN fingerprints used to guess the operating system of hosts, the built in database is used if empty")
+var tlsFingerprintsFile = flag.String("tls-fingerprints", "", "File of JA3 and JA4 fingerprints of known TLS clients and their operating system, TLS fingerprints are only recorded if empty")
+var probeMethods = flag.String("probe", "", "Comma separated methods used to probe silent hosts before reporting them offline: arp and icmp, disabled if empty. Not used when replaying")
+var probeInterval = flag.Duration("probe-interval", 250*time.Millisecond, "Minimum time between probes")
+var ssdpFetch = flag.Bool("ssdp-fetch-descriptions", false, "Fetch the UPnP device descriptions hosts announce over SSDP for their friendly name, model and manufacturer. Only fetched from the announcing host")
+var dnsWatch = flag.String("dns-watch", "", "Comma separated domains to watch for, a host looking up one of them or any of its subdomains emits a watched-domain change")
+var topTalkers = flag.Int("top-talkers", 5, "Number of hosts with the most traffic reported over each of the 1m, 5m and 1h windows")
+var trafficReport = flag.Duration("traffic-report", 0, "How often the --top-talkers are logged, disabled if 0. The top talkers are always logged at the end of a replay")
+var flowLogFile = flag.String("flow-log", "", "File the flow-end records of the flows of hosts are appended to as JSON lines, disabled if empty")
+var flowMax = flag.Int("flow-max", 65536, "Number of flows tracked per interface, the least recently seen flow is ended when exceeded")
+var flowIdleTimeout = flag.Duration("flow-idle-timeout", time.Minute, "Amount of time without packets after which a flow is ended")
+var flowActiveTimeout = flag.Duration("flow-active-timeout", 30*time.Minute, "Amount of time after which a long lived flow is ended and carries on with a new record, disabled if 0")
+var workers = flag.Int("workers", runtime.NumCPU(), "Number of goroutines handling the packets of each interface, the packets of a host are always handled by the same one. A capture file is replayed on one unless given")
+var workerQueue = flag.Int("worker-queue", 1024, "Number of packets queued for each worker, packets are dropped when the queue is full. Not used when replaying")
+var disableHandlers = flag.String("disable-handlers", "", "Comma separated names of packet handlers to turn off: record, hosts, flows, arp, ndp, dhcp, leases, mdns, mdns-services, netbios, llmnr, ssdp, dns, os-fingerprint and wifi")
+var sampleHandlers = flag.String("sample-handlers", "", "Comma separated name=n pairs, the named packet handler is only passed one in every n packets")
+var handlerMACs = flag.String("handler-macs", "", "Comma separated MACs, packet handlers are only passed the frames sent or received by one of them. All frames are handled if empty")
+var handlerStats = flag.Duration("handler-stats", 0, "How often the packets, errors and time of each packet handler are logged, disabled if 0. The stats are always logged at the end of a replay")
+var leaseFile = flag.String("lease-file", "", "Lease file of a DHCP server running on this machine to watch for hosts, disabled if empty")
+var leaseFormat = flag.String("lease-format", "dnsmasq", "Format of the --lease-file: dnsmasq or dhcpd")
+var recordDir = flag.String("record-dir", "", "Directory to write pcapng recordings of hosts to when a change in --record-on is emitted, disabled if empty")
+var recordOn = flag.String("record-on", "online,ip-conflict", "Comma separated list of change types that trigger a recording")
+var recordPackets = flag.Int("record-packets", 64, "Number of recent packets kept per host for recordings")
+var recordMaxHosts = flag.Int("record-max-hosts", 1024, "Number of hosts recent packets are kept for, those of the least recently seen host are dropped when exceeded")
+var recordWindow = flag.Duration("record-window", 2*time.Minute, "How far back from the triggering change a recording reaches")
+var recordMaxBytes = flag.Int("record-max-bytes", 1<<20, "Maximum amount of packet data written to a single recording")
+var recordMaxFiles = flag.Int("record-max-files", 50, "Number of recordings to keep before the oldest are removed")
+
+// errPacketsClosed is returned by readPackets when the packet source has no more packets
+var errPacketsClosed = errors.New("packet chan closed")
 
 func main() {
 	flag.Parse()
-	if *iface == "" {
-		log.Fatal("--i required")
+	if *ifaceList == "" && *wifiList == "" && *readFile == "" {
+		log.Fatal("--i, --wifi or --r required")
 	}
 
 	if *offlineTime < 0 {
@@ -40,71 +83,290 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	handle, closeFunc, err := NewHandle(*iface)
+	vlans, err := parseVLANs(*vlanList)
 	if err != nil {
-		log.Fatal("failed creating handle:", err)
+		log.Fatal("invalid --vlans:", err)
 	}
-	defer closeFunc()
 
-	source := gopacket.NewPacketSource(handle, layers.LayerTypeEthernet)
+	filter, err := BuildFilter(*bpfExpr, inlineVLANTags, vlans...)
+	if err != nil {
+		log.Fatal("invalid --bpf filter:", err)
+	}
 
-	// keep track of MAC -> IP addresses
-	hosts := hostmonitor.NewHostMap(
-		hostmonitor.LoggerOption(stdr.New(log.New(os.Stdout, "", log.LstdFlags))),
-		hostmonitor.HostOfflineTimeoutOption(*offlineTime),
-	)
-	// keep track of MAC -> Host Names from DHCP
-	hostNames := NewMacHostMap()
+	// keep track of MAC -> Host Names from DHCP, mDNS, NetBIOS and LLMNR, a host has the same names on every interface
+	precedence, err := ParseNamePrecedence(*namePrecedence)
+	if err != nil {
+		log.Fatal("invalid --hostname-precedence:", err)
+	}
+	hostNames := NewMacHostMap(precedence...)
 
-	go func() {
-		// notifications are emitted when a host changes
-		//  * new IP
-		//  * host comes online
-		//  * host goes offline
-		for notification := range hosts.Notifications() {
-			hostName := hostNames.Get(notification.Addr.MAC)
-			log.Printf("host '%s' changed: %s", hostName, notification)
+	var fingerprints fingerprintDBs
+	if fingerprints.dhcp, err = LoadFingerprints(*fingerprintsFile); err != nil {
+		log.Fatal("failed loading --dhcp-fingerprints:", err)
+	}
+	if fingerprints.syn, err = LoadSYNFingerprints(*synFingerprintsFile); err != nil {
+		log.Fatal("failed loading --syn-fingerprints:", err)
+	}
+	if fingerprints.tls, err = LoadTLSFingerprints(*tlsFingerprintsFile); err != nil {
+		log.Fatal("failed loading --tls-fingerprints:", err)
+	}
+
+	var exportFlow FlowExporter
+	if *flowLogFile != "" {
+		flowLog, err := NewFlowLog(*flowLogFile)
+		if err != nil {
+			log.Fatal("failed opening --flow-log:", err)
 		}
-	}()
+		defer flowLog.Close()
+		exportFlow = flowLog.Export
+	}
 
-	// composes the two separate handlers for handling host updates and hostname updates into a single handler
-	var (
-		updateHosts     = UpdateHosts(hosts)
-		updateHostNames = UpdateHostNames(hostNames)
-	)
-	packetHandler := PacketHandler(func(ctx context.Context, packet gopacket.Packet) error {
-		if err := updateHosts(ctx, packet); err != nil {
-			return err
+	var handlerConfig HandlerConfig
+	handlerConfig.Disabled = splitList(*disableHandlers)
+	if handlerConfig.Sample, err = parseSampleRates(*sampleHandlers); err != nil {
+		log.Fatal("invalid --sample-handlers:", err)
+	}
+	if handlerConfig.MACs, err = parseMACs(*handlerMACs); err != nil {
+		log.Fatal("invalid --handler-macs:", err)
+	}
+
+	var triggers []hostmonitor.ChangeType
+	if *recordDir != "" {
+		triggers, err = parseChangeTypes(*recordOn)
+		if err != nil {
+			log.Fatal("invalid --record-on:", err)
 		}
+	}
 
-		return updateHostNames(ctx, packet)
-	})
+	// a pipeline per packet source, each interface has its own hosts so the same MAC on two segments is handled
+	// separately
+	var pipelines []*pipeline
+	addPipeline := func(iface string, source gopacket.PacketDataSource, linkType layers.LinkType, options ...hostmonitor.HostMapOption) *pipeline {
+		var recorder *Recorder
+		if *recordDir != "" {
+			var err error
+			recorder, err = NewRecorder(RecorderConfig{
+				Dir:            *recordDir,
+				Triggers:       triggers,
+				PacketsPerHost: *recordPackets,
+				MaxHosts:       *recordMaxHosts,
+				Window:         *recordWindow,
+				MaxFileBytes:   *recordMaxBytes,
+				MaxFiles:       *recordMaxFiles,
+			}, linkType)
+			if err != nil {
+				log.Fatal("failed creating recorder:", err)
+			}
+		}
+
+		flows, err := NewFlowTable(FlowTableConfig{
+			MaxFlows:      *flowMax,
+			IdleTimeout:   *flowIdleTimeout,
+			ActiveTimeout: *flowActiveTimeout,
+			Export:        exportFlow,
+		})
+		if err != nil {
+			log.Fatal("invalid flow settings:", err)
+		}
+
+		p := newPipeline(iface, source, linkType, hostNames, fingerprints, flows, recorder, options...)
+		if err := p.handlers.Configure(handlerConfig); err != nil {
+			log.Fatal("invalid handler settings:", err)
+		}
+		// a capture file waits for the workers rather than dropping packets
+		p.workers = WorkerPoolConfig{Workers: pipelineWorkers(), QueueLen: *workerQueue, Block: *readFile != "", LinkType: linkType}
+		pipelines = append(pipelines, p)
+		return p
+	}
+
+	var clock *packetClock
+	if *readFile != "" {
+		handle, linkType, closeFunc, err := NewReplayHandle(*readFile, *speed, filter)
+		if err != nil {
+			log.Fatal("failed opening capture file:", err)
+		}
+		defer closeFunc()
+
+		// drive the host map with the time of the packets rather than the wall clock
+		clock = &packetClock{}
+		p := addPipeline("", handle, linkType, hostmonitor.ClockOption(clock.Now))
+		p.clock = clock
+	} else {
+		// a live capture may not see the vlan tags where a capture file has them
+		captureFilter, err := BuildFilter(*bpfExpr, captureVLANTags, vlans...)
+		if err != nil {
+			log.Fatal("invalid --bpf filter:", err)
+		}
+		rawFilter, err := AssembleFilter(captureFilter)
+		if err != nil {
+			log.Fatal("failed assembling filter:", err)
+		}
+
+		for _, iface := range splitList(*ifaceList) {
+			handle, closeFunc, err := NewHandle(iface, rawFilter)
+			if err != nil {
+				log.Fatalf("failed creating handle for %s: %s", iface, err)
+			}
+			defer closeFunc()
+
+			var options []hostmonitor.HostMapOption
+			if *probeMethods != "" {
+				// the prober sends from its own socket, the capture handle only reads
+				prober, err := hostmonitor.NewProber(iface, strings.Split(*probeMethods, ",")...)
+				if err != nil {
+					log.Fatal("failed creating --probe prober:", err)
+				}
+				options = append(options, hostmonitor.ProberOption(prober, *probeInterval))
+			}
+
+			addPipeline(iface, handle, layers.LinkTypeEthernet, options...)
+		}
+
+		for _, iface := range splitList(*wifiList) {
+			// the capture filter only matches ethernet frames, every 802.11 frame is read
+			handle, linkType, closeFunc, err := NewMonitorHandle(iface)
+			if err != nil {
+				log.Fatalf("failed creating monitor mode handle for %s: %s", iface, err)
+			}
+			defer closeFunc()
+
+			addPipeline(iface, handle, linkType)
+		}
+	}
+
+	if *leaseFile != "" {
+		format, err := hostmonitor.ParseLeaseFileFormat(*leaseFormat)
+		if err != nil {
+			log.Fatal("invalid --lease-format:", err)
+		}
+
+		for _, p := range pipelines {
+			if isWirelessLinkType(p.linkType) {
+				continue
+			}
+
+			// each interface follows the leases of its own subnets, a replay all of them
+			var prefixes []netip.Prefix
+			if p.iface != "" {
+				prefixes, err = interfacePrefixes(p.iface)
+				if err != nil {
+					log.Fatal("failed listing addresses for --lease-file:", err)
+				}
+				if len(prefixes) == 0 {
+					log.Printf("interface %s has no addresses, not following --lease-file on it", p.iface)
+					continue
+				}
+			}
+
+			p.leaseFileSource = hostmonitor.NewLeaseFileSource(*leaseFile, format, p.hosts, prefixes...)
+			if err := p.leaseFileSource.Load(); err != nil {
+				log.Fatal("failed loading --lease-file:", err)
+			}
+			go func(source *hostmonitor.LeaseFileSource) {
+				if err := source.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+					log.Println("stopped watching lease file:", err)
+				}
+			}(p.leaseFileSource)
+		}
+	}
 
 	log.Println("ready to read packets")
-	err = readPackets(ctx, source.Packets(), packetHandler)
-	if err != nil {
-		log.Fatal("error reading packets:", err)
+	type result struct {
+		p   *pipeline
+		err error
+	}
+	results := make(chan result, len(pipelines))
+	for _, p := range pipelines {
+		go func(p *pipeline) {
+			results <- result{p: p, err: p.run(ctx)}
+		}(p)
+		if clock == nil {
+			go p.expire(ctx, time.Second)
+			if *trafficReport > 0 {
+				go p.reportTraffic(ctx, *trafficReport)
+			}
+			if *handlerStats > 0 {
+				go p.reportHandlerStats(ctx, *handlerStats)
+			}
+		}
+	}
+	for range pipelines {
+		r := <-results
+		if clock != nil && errors.Is(r.err, errPacketsClosed) {
+			// reached the end of the capture, print everything that was collected
+			r.p.printSummary()
+		} else if r.err != nil {
+			log.Fatal("error reading packets:", r.err)
+		}
 	}
 
 	log.Println("exiting...")
 }
 
-func readPackets(ctx context.Context, packets <-chan gopacket.Packet, handler PacketHandler) error {
+// pipelineWorkers returns the number of workers of each pipeline. A capture file is replayed on a single worker unless
+// -workers is given: the host map follows the time of the latest packet any worker handled, so with several workers a
+// replay isn't deterministic.
+func pipelineWorkers() int {
+	if *readFile == "" {
+		return *workers
+	}
+
+	n := 1
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "workers" {
+			n = *workers
+		}
+	})
+	return n
+}
+
+// readFrames reads the frames of the source on a separate goroutine until the source is exhausted or fails or the
+// context is done, the channel is closed once it is.
+func readFrames(ctx context.Context, source gopacket.PacketDataSource) <-chan frame {
+	frames := make(chan frame, 1000)
+	go func() {
+		defer close(frames)
+		for ctx.Err() == nil {
+			data, ci, err := source.ReadPacketData()
+			if err == nil {
+				select {
+				case frames <- frame{data: data, ci: ci}:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			// retry reads that timed out or were interrupted, anything else can't be told apart from a closed or
+			// broken source
+			if isTemporaryReadError(err) {
+				continue
+			}
+			if !errors.Is(err, io.EOF) {
+				log.Println("stopped reading packets:", err)
+			}
+			return
+		}
+	}()
+	return frames
+}
+
+func readPackets(ctx context.Context, frames <-chan frame, handler frameHandler) error {
 	for {
 		var (
-			packet gopacket.Packet
-			ok     bool
+			f  frame
+			ok bool
 		)
 		select {
-		case packet, ok = <-packets:
+		case f, ok = <-frames:
 			if !ok {
-				return errors.New("packet chan closed")
+				return errPacketsClosed
 			}
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 
-		if err := handler(ctx, packet); err != nil {
+		if err := handler(ctx, f); err != nil {
 			log.Println("error handling packet:", err)
 		}
 	}
@@ -112,9 +374,133 @@ func readPackets(ctx context.Context, packets <-chan gopacket.Packet, handler Pa
 
 type PacketHandler func(ctx context.Context, packet gopacket.Packet) error
 
+// describeName includes the source of the name in log messages, e.g. "foo (mdns)"
+func describeName(hostName string, source NameSource) string {
+	if hostName == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s (%s)", hostName, source)
+}
+
+// parseChangeTypes parses a comma separated list of change type names
+func parseChangeTypes(list string) ([]hostmonitor.ChangeType, error) {
+	var changeTypes []hostmonitor.ChangeType
+	for _, name := range strings.Split(list, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+
+		ct, err := hostmonitor.ParseChangeType(name)
+		if err != nil {
+			return nil, err
+		}
+		changeTypes = append(changeTypes, ct)
+	}
+
+	return changeTypes, nil
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// interfacePrefixes returns the subnets of the addresses of the interface
+func interfacePrefixes(name string) ([]netip.Prefix, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("listing addresses of %s: %w", name, err)
+	}
+
+	var prefixes []netip.Prefix
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		ones, _ := ipNet.Mask.Size()
+		if prefix, err := ip.Unmap().Prefix(ones); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// parseSampleRates parses a comma separated list of handler=n pairs
+func parseSampleRates(list string) (map[string]int, error) {
+	rates := make(map[string]int)
+	for _, pair := range splitList(list) {
+		name, rate, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected handler=n, got %q", pair)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(rate))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid sample rate %q of handler %q", rate, name)
+		}
+		rates[strings.TrimSpace(name)] = n
+	}
+
+	return rates, nil
+}
+
+// parseMACs parses a comma separated list of MACs
+func parseMACs(list string) ([]net.HardwareAddr, error) {
+	var macs []net.HardwareAddr
+	for _, item := range splitList(list) {
+		mac, err := net.ParseMAC(item)
+		if err != nil {
+			return nil, err
+		}
+		macs = append(macs, mac)
+	}
+
+	return macs, nil
+}
+
+// parseVLANs parses a comma separated list of VLAN IDs
+func parseVLANs(list string) ([]uint16, error) {
+	var vlans []uint16
+	for _, id := range strings.Split(list, ",") {
+		if strings.TrimSpace(id) == "" {
+			continue
+		}
+
+		vlan, err := strconv.ParseUint(strings.TrimSpace(id), 10, 12)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vlan id %q", id)
+		}
+		vlans = append(vlans, uint16(vlan))
+	}
+
+	return vlans, nil
+}
+
+// hostLayers are the layers UpdateHosts looks at.
+var hostLayers = []gopacket.LayerType{
+	layers.LayerTypeEthernet,
+	layers.LayerTypeIPv4,
+	layers.LayerTypeIPv6,
+}
+
 // UpdateHosts keeps the provided hosts up to date with the addresses of hosts on private network.
 // It's assumed we're running on a private a network like 192.168.0.0 or 10.0.0.0
-func UpdateHosts(hosts *hostmonitor.HostMap) PacketHandler {
+// When traffic isn't nil every frame is counted against the hosts sending or receiving it, see countTraffic.
+func UpdateHosts(hosts *hostmonitor.HostMap, traffic *TrafficTable) PacketHandler {
 	return func(_ context.Context, packet gopacket.Packet) error {
 
 		var sourceMac, dstMac net.HardwareAddr
@@ -126,6 +512,10 @@ func UpdateHosts(hosts *hostmonitor.HostMap) PacketHandler {
 			dstMac = eth.DstMAC
 		}
 
+		if traffic != nil {
+			countTraffic(traffic, packet, sourceMac, dstMac)
+		}
+
 		if layer := packet.Layer(layers.LayerTypeIPv4); layer != nil {
 			ipv4, _ := layer.(*layers.IPv4)
 
@@ -136,7 +526,7 @@ func UpdateHosts(hosts *hostmonitor.HostMap) PacketHandler {
 				} else if ipv4.DstIP.IsPrivate() {
 					// packet coming in from outside network
 					ipInNetwork = ipv4.DstIP
-					sourceMac, dstMac = dstMac, sourceMac
+					sourceMac = dstMac
 				}
 			}
 		}
@@ -154,20 +544,69 @@ func UpdateHosts(hosts *hostmonitor.HostMap) PacketHandler {
 		}
 
 		ip, _ := netip.AddrFromSlice(ipInNetwork)
-		hosts.UpdateAddresses([]hostmonitor.Addr{
-			{
-				MAC: sourceMac,
-				IP:  ip,
-			},
-		})
+		hosts.UpdateAddresses([]hostmonitor.Addr{newAddr(packet, sourceMac, ip)})
 
 		return nil
 	}
 }
 
+// countTraffic counts the frame against the hosts sending and receiving it. Frames between two local addresses, private,
+// unique local or link-local, and frames that aren't IP are LAN traffic of both hosts. Frames to or from the internet
+// are only counted against the local end. A global IPv6 address of a host on the LAN can't be told apart from one on
+// the internet, frames between two global addresses are outbound for the sender and inbound for the receiver.
+func countTraffic(traffic *TrafficTable, packet gopacket.Packet, srcMAC, dstMAC net.HardwareAddr) {
+	if len(srcMAC) == 0 {
+		return
+	}
+
+	var srcIP, dstIP netip.Addr
+	switch network := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		srcIP, _ = netip.AddrFromSlice(network.SrcIP.To4())
+		dstIP, _ = netip.AddrFromSlice(network.DstIP.To4())
+	case *layers.IPv6:
+		srcIP, _ = netip.AddrFromSlice(network.SrcIP)
+		dstIP, _ = netip.AddrFromSlice(network.DstIP)
+	}
+
+	// broadcasts and multicasts don't leave the LAN, and only count for the sender
+	group := len(dstMAC) == 0 || dstMAC[0]&1 != 0
+
+	srcDirection, dstDirection := LANTraffic, LANTraffic
+	srcCounted, dstCounted := true, !group
+	if srcIP.IsValid() && dstIP.IsValid() && !group {
+		srcLocal, dstLocal := isLocalAddr(srcIP), isLocalAddr(dstIP)
+		switch {
+		case srcLocal && !dstLocal:
+			srcDirection, dstCounted = OutboundTraffic, false
+		case !srcLocal && dstLocal:
+			dstDirection, srcCounted = InboundTraffic, false
+		case !srcLocal && !dstLocal:
+			srcDirection, dstDirection = OutboundTraffic, InboundTraffic
+		}
+	}
+
+	metadata := packet.Metadata()
+	if srcCounted {
+		traffic.Add(srcMAC, srcDirection, metadata.Length, metadata.Timestamp)
+	}
+	if dstCounted {
+		traffic.Add(dstMAC, dstDirection, metadata.Length, metadata.Timestamp)
+	}
+}
+
+// dhcpLayers are the layers UpdateHostNames and TrackLeases look at.
+var dhcpLayers = []gopacket.LayerType{
+	layers.LayerTypeEthernet,
+	layers.LayerTypeIPv4,
+	layers.LayerTypeUDP,
+	layers.LayerTypeDHCPv4,
+}
+
 // UpdateHostNames watches for dhcpv4 packets and updates the MacHostMap with this names, if set.
-// This also logs the dhcp packet info
-func UpdateHostNames(hostNames *MacHostMap) PacketHandler {
+// The options describing the client are stored in the HostMap metadata along with the device type guessed from its
+// fingerprint. This also logs the dhcp packet info
+func UpdateHostNames(hosts *hostmonitor.HostMap, hostNames *MacHostMap, fingerprints *FingerprintDB) PacketHandler {
 	return func(_ context.Context, packet gopacket.Packet) error {
 		// extract dhcp4 for host
 		layer := packet.Layer(layers.LayerTypeDHCPv4)
@@ -178,25 +617,30 @@ func UpdateHostNames(hostNames *MacHostMap) PacketHandler {
 		}
 
 		manufacturer := hostmonitor.FindManufacturer(dhcp.ClientHWAddr)
-		var hostName string
-		for _, opt := range dhcp.Options {
-			if opt.Type != layers.DHCPOptHostname {
-				continue
-			}
+		decoded := decodeDHCPOptions(dhcp)
 
-			hostName = string(opt.Data)
+		client := newAddr(packet, append(net.HardwareAddr(nil), dhcp.ClientHWAddr...), netip.Addr{})
+		info := decoded
+		if existing, ok := hosts.Metadata(client, DHCPMetadataKey); ok {
+			info = existing.(DHCPInfo).merge(decoded)
+		}
+		if info.Fingerprint != "" || info.VendorClass != "" {
+			info.Device = fingerprints.Match(info.Fingerprint, info.VendorClass)
 		}
+		hosts.SetMetadata(client, DHCPMetadataKey, info)
 
+		hostName := decoded.HostName
 		if hostName != "" {
-			hostNames.Set(dhcp.ClientHWAddr, hostName)
+			hostNames.Set(client, DHCPNameSource, hostName)
 		} else {
 			hostName = "<unknown>"
 		}
 
 		// see http://www.tcpipguide.com/free/t_DHCPMessageFormat.htm
 		// not always set
-		log.Printf("dhcp(%d) from %s(ip=%s), hostname=(%s), manufacturer=(%s)",
-			dhcp.Operation, dhcp.ClientHWAddr, dhcp.YourClientIP, hostName, manufacturer)
+		log.Printf("dhcp(%d) from %s(ip=%s), hostname=(%s), manufacturer=(%s), fingerprint=(%s), vendor=(%s), device=(%s)",
+			dhcp.Operation, dhcp.ClientHWAddr, dhcp.YourClientIP, hostName, manufacturer,
+			info.Fingerprint, info.VendorClass, info.Device)
 
 		return nil
 	}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+const (
+	mdnsPort    = 5353
+	localDomain = ".local"
+)
+
+// UpdateHostNamesFromMDNS watches for multicast DNS responses and updates the MacHostMap with the .local names hosts
+// advertise. Address records name the host that owns the address, which is usually the responder, but a sleep proxy
+// can answer on behalf of a sleeping host so the owner is found in hosts if the address isn't the source of the
+// packet. Reverse pointer records are handled the same way.
+func UpdateHostNamesFromMDNS(hosts *hostmonitor.HostMap, hostNames *MacHostMap) PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		msg, eth, srcIP, ok := decodeDNS(packet, mdnsPort)
+		if !ok || !msg.QR {
+			// nothing to do - not an mDNS response
+			return nil
+		}
+
+		for _, rr := range append(msg.Answers, msg.Additionals...) {
+			var (
+				name string
+				ip   netip.Addr
+			)
+			switch rr.Type {
+			case layers.DNSTypeA, layers.DNSTypeAAAA:
+				name = string(rr.Name)
+				ip, _ = netip.AddrFromSlice(rr.IP)
+				ip = ip.Unmap()
+			case layers.DNSTypePTR:
+				name = string(rr.PTR)
+				ip, _ = parseReverseName(string(rr.Name))
+			default:
+				continue
+			}
+
+			hostName, ok := localHostName(name)
+			if !ok || !ip.IsValid() {
+				continue
+			}
+
+			owner, ok := ownerOf(hosts, packet, eth.SrcMAC, srcIP, ip)
+			if !ok {
+				continue
+			}
+			mac := owner.MAC
+
+			if hostNames.Set(owner, MDNSNameSource, hostName) {
+				log.Printf("mdns from %s(ip=%s), hostname=(%s), manufacturer=(%s)",
+					mac, ip, hostName, hostmonitor.FindManufacturer(mac))
+			}
+		}
+
+		return nil
+	}
+}
+
+// ownerOf returns the address of the host using ip on the VLAN of the packet. Hosts usually answer for themselves, so
+// that's the sender of the packet if ip is its source, otherwise it's looked up in hosts.
+func ownerOf(hosts *hostmonitor.HostMap, packet gopacket.Packet, srcMAC net.HardwareAddr, srcIP, ip netip.Addr) (hostmonitor.Addr, bool) {
+	if ip == srcIP {
+		return newAddr(packet, srcMAC, ip), true
+	}
+	return hosts.FindByIP(newAddr(packet, nil, ip))
+}
+
+// decodeDNS returns the DNS message sent from the udp port by the packet along with its ethernet layer and source ip.
+// gopacket only decodes DNS on port 53, so multicast DNS and LLMNR have to be decoded here.
+func decodeDNS(packet gopacket.Packet, port layers.UDPPort) (*layers.DNS, *layers.Ethernet, netip.Addr, bool) {
+	payload, eth, srcIP, ok := udpPayload(packet, port)
+	if !ok {
+		return nil, nil, netip.Addr{}, false
+	}
+
+	msg := &layers.DNS{}
+	if err := msg.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+		return nil, nil, netip.Addr{}, false
+	}
+
+	return msg, eth, srcIP, true
+}
+
+// udpPayloadLayers are the layers the handlers of udp payloads look at, mDNS, NetBIOS, LLMNR and SSDP payloads are
+// parsed by the handlers.
+var udpPayloadLayers = []gopacket.LayerType{
+	layers.LayerTypeEthernet,
+	layers.LayerTypeIPv4,
+	layers.LayerTypeIPv6,
+	layers.LayerTypeUDP,
+}
+
+// udpPayload returns the payload of a udp datagram sent from the port along with its ethernet layer and source ip.
+func udpPayload(packet gopacket.Packet, port layers.UDPPort) ([]byte, *layers.Ethernet, netip.Addr, bool) {
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || udp.SrcPort != port {
+		return nil, nil, netip.Addr{}, false
+	}
+	eth, srcIP, ok := packetSource(packet)
+	if !ok {
+		return nil, nil, netip.Addr{}, false
+	}
+
+	return udp.Payload, eth, srcIP, true
+}
+
+// packetSource returns the ethernet layer and source ip of an ip packet.
+func packetSource(packet gopacket.Packet) (*layers.Ethernet, netip.Addr, bool) {
+	eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok {
+		return nil, netip.Addr{}, false
+	}
+
+	srcIP, _, ok := packetIPs(packet)
+	if !ok {
+		return nil, netip.Addr{}, false
+	}
+
+	return eth, srcIP, true
+}
+
+// localHostName returns the host name of a name in the .local domain, e.g. "foo" for "foo.local".
+func localHostName(name string) (string, bool) {
+	name = strings.TrimSuffix(name, ".")
+	if !strings.HasSuffix(strings.ToLower(name), localDomain) {
+		return "", false
+	}
+
+	hostName := name[:len(name)-len(localDomain)]
+	if hostName == "" || strings.Contains(hostName, ".") {
+		// service instances and subdomains aren't host names
+		return "", false
+	}
+
+	return hostName, true
+}
+
+// parseReverseName returns the address of a reverse lookup name, e.g. 192.168.1.2 for 2.1.168.192.in-addr.arpa.
+func parseReverseName(name string) (netip.Addr, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if labels, ok := reverseLabels(name, ".in-addr.arpa", 4); ok {
+		var ip [4]byte
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			ip[3-i] = byte(octet)
+		}
+		return netip.AddrFrom4(ip), true
+	}
+
+	if labels, ok := reverseLabels(name, ".ip6.arpa", 32); ok {
+		var ip [16]byte
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return netip.Addr{}, false
+			}
+			// the least significant nibble is first
+			pos := 31 - i
+			ip[pos/2] |= byte(nibble) << (4 * (1 - pos%2))
+		}
+		return netip.AddrFrom16(ip), true
+	}
+
+	return netip.Addr{}, false
+}
+
+func reverseLabels(name, suffix string, count int) ([]string, bool) {
+	if !strings.HasSuffix(name, suffix) {
+		return nil, false
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, suffix), ".")
+	return labels, len(labels) == count
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var mdnsMAC = net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfb}
+
+func TestUpdateHostNamesFromMDNS(t *testing.T) {
+	hosts := hostmonitor.NewHostMap()
+	hostNames := NewMacHostMap()
+	handler := UpdateHostNamesFromMDNS(hosts, hostNames)
+
+	hosts.UpdateAddresses([]hostmonitor.Addr{
+		{MAC: testMAC2, IP: netip.MustParseAddr("192.168.1.11")},
+	})
+
+	handle := func(srcMAC net.HardwareAddr, srcIP string, msg *layers.DNS) {
+		p := udpPacket(t, testStart, srcMAC, mdnsMAC, srcIP, "224.0.0.251", mdnsPort, mdnsPort, msg)
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+
+	// queries are ignored
+	handle(testMAC1, "192.168.1.10", &layers.DNS{
+		Questions: []layers.DNSQuestion{{Name: []byte("foo.local"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+	})
+	assert.Equal(t, "", hostNames.Get(hostmonitor.Addr{MAC: testMAC1}))
+
+	// a host answering for its own address
+	handle(testMAC1, "192.168.1.10", &layers.DNS{
+		QR: true,
+		AA: true,
+		Answers: []layers.DNSResourceRecord{
+			{Name: []byte("foo.local"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 120, IP: net.ParseIP("192.168.1.10").To4()},
+			{Name: []byte("10.1.168.192.in-addr.arpa"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: 120, PTR: []byte("foo.local")},
+			{Name: []byte("_http._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: 120, PTR: []byte("Foo Web._http._tcp.local")},
+		},
+	})
+	assert.Equal(t, "foo", hostNames.Get(hostmonitor.Addr{MAC: testMAC1}))
+
+	// a sleep proxy answering for another host
+	handle(gatewayMAC, "192.168.1.1", &layers.DNS{
+		QR: true,
+		AA: true,
+		Additionals: []layers.DNSResourceRecord{
+			{Name: []byte("bar.local"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 120, IP: net.ParseIP("192.168.1.11").To4()},
+			{Name: []byte("unknown.local"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 120, IP: net.ParseIP("192.168.1.12").To4()},
+		},
+	})
+	assert.Equal(t, "bar", hostNames.Get(hostmonitor.Addr{MAC: testMAC2}))
+	assert.Equal(t, "", hostNames.Get(hostmonitor.Addr{MAC: gatewayMAC}))
+
+	// dhcp names take precedence by default
+	hostNames.Set(hostmonitor.Addr{MAC: testMAC1}, DHCPNameSource, "foo-laptop")
+	name, source := hostNames.Lookup(hostmonitor.Addr{MAC: testMAC1})
+	assert.Equal(t, "foo-laptop", name)
+	assert.Equal(t, DHCPNameSource, source)
+}
+
+func TestMacHostMap_Precedence(t *testing.T) {
+	precedence, err := ParseNamePrecedence("mdns, dhcp")
+	require.NoError(t, err)
+
+	hostNames := NewMacHostMap(precedence...)
+	hostNames.Set(hostmonitor.Addr{MAC: testMAC1}, DHCPNameSource, "foo-laptop")
+	assert.Equal(t, "foo-laptop", hostNames.Get(hostmonitor.Addr{MAC: testMAC1}))
+
+	assert.True(t, hostNames.Set(hostmonitor.Addr{MAC: testMAC1}, MDNSNameSource, "foo"))
+	assert.False(t, hostNames.Set(hostmonitor.Addr{MAC: testMAC1}, MDNSNameSource, "foo"))
+	name, source := hostNames.Lookup(hostmonitor.Addr{MAC: testMAC1})
+	assert.Equal(t, "foo", name)
+	assert.Equal(t, MDNSNameSource, source)
+
+	_, err = ParseNamePrecedence("dhcp,wins")
+	assert.Error(t, err)
+}
+
+func TestMacHostMap_VLANs(t *testing.T) {
+	hostNames := NewMacHostMap()
+	hostNames.Set(hostmonitor.Addr{MAC: testMAC1, VLAN: 10}, DHCPNameSource, "foo-laptop")
+	hostNames.Set(hostmonitor.Addr{MAC: testMAC1, VLAN: 20}, DHCPNameSource, "foo-guest")
+
+	assert.Equal(t, "foo-laptop", hostNames.Get(hostmonitor.Addr{MAC: testMAC1, VLAN: 10}))
+	assert.Equal(t, "foo-guest", hostNames.Get(hostmonitor.Addr{MAC: testMAC1, VLAN: 20}))
+	assert.Equal(t, "", hostNames.Get(hostmonitor.Addr{MAC: testMAC1}))
+}
+
+func TestParseReverseName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"10.1.168.192.in-addr.arpa", "192.168.1.10"},
+		{"10.1.168.192.in-addr.arpa.", "192.168.1.10"},
+		{"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa", "4321:0:1:2:3:4:567:89ab"},
+		{"1.168.192.in-addr.arpa", ""},
+		{"300.1.168.192.in-addr.arpa", ""},
+		{"foo.local", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ip, ok := parseReverseName(test.name)
+			if test.want == "" {
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			assert.Equal(t, netip.MustParseAddr(test.want), ip)
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+// router flag of neighbor advertisements
+const ndpRouterFlag = 0x80
+
+// ndpLayers are the layers UpdateHostsFromNDP looks at.
+var ndpLayers = []gopacket.LayerType{
+	layers.LayerTypeEthernet,
+	layers.LayerTypeIPv6,
+	layers.LayerTypeICMPv6,
+	layers.LayerTypeICMPv6NeighborSolicitation,
+	layers.LayerTypeICMPv6NeighborAdvertisement,
+	layers.LayerTypeICMPv6RouterAdvertisement,
+}
+
+// UpdateHostsFromNDP keeps the provided hosts up to date with the ipv6 addresses learned from neighbor discovery.
+// Solicitations and advertisements carry the link-layer address of the sender or target as an option, falling back to
+// the ethernet source when absent. Solicitations from the unspecified address are duplicate address detection probes
+// and are tracked in probes, routers advertising themselves are tracked in routers.
+func UpdateHostsFromNDP(hosts *hostmonitor.HostMap, probes *AddressProbes, routers *IPv6Routers) PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		ipv6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		if !ok || ipv6.HopLimit != 255 {
+			// nothing to do - neighbor discovery is never forwarded so anything else is invalid
+			return nil
+		}
+		eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		if !ok {
+			return nil
+		}
+
+		seen := packet.Metadata().Timestamp
+		srcIP, _ := netip.AddrFromSlice(ipv6.SrcIP)
+
+		var (
+			mac net.HardwareAddr
+			ip  netip.Addr
+		)
+		if layer, ok := packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation); ok {
+			target, _ := netip.AddrFromSlice(layer.TargetAddress)
+			if srcIP.IsUnspecified() {
+				// duplicate address detection, the host wants to use the target address
+				if other, ok := probes.Probe(newAddr(packet, eth.SrcMAC, target), seen); ok {
+					log.Printf("ndp probe from %s for ip=(%s) already probed by %s", eth.SrcMAC, target, other.MAC)
+				}
+				return nil
+			}
+
+			mac, ip = linkLayerOption(layer.Options, layers.ICMPv6OptSourceAddress, eth.SrcMAC), srcIP
+		}
+
+		if layer, ok := packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement); ok {
+			mac = linkLayerOption(layer.Options, layers.ICMPv6OptTargetAddress, eth.SrcMAC)
+			ip, _ = netip.AddrFromSlice(layer.TargetAddress)
+
+			if layer.Flags&ndpRouterFlag != 0 && routers.Seen(mac, ip, seen) {
+				log.Printf("ipv6 router %s(ip=%s), manufacturer=(%s)", mac, ip, hostmonitor.FindManufacturer(mac))
+			}
+		}
+
+		if layer, ok := packet.Layer(layers.LayerTypeICMPv6RouterAdvertisement).(*layers.ICMPv6RouterAdvertisement); ok {
+			mac, ip = linkLayerOption(layer.Options, layers.ICMPv6OptSourceAddress, eth.SrcMAC), srcIP
+
+			router := IPv6Router{
+				MAC:      mac,
+				IP:       ip,
+				Lifetime: time.Duration(layer.RouterLifetime) * time.Second,
+				Prefixes: prefixOptions(layer.Options),
+				LastSeen: seen,
+			}
+			if routers.Advertise(router) {
+				log.Printf("ipv6 router %s(ip=%s) advertising prefixes=(%v), manufacturer=(%s)",
+					mac, ip, router.Prefixes, hostmonitor.FindManufacturer(mac))
+			}
+		}
+
+		if !ip.IsValid() || ip.IsUnspecified() {
+			// not neighbor discovery
+			return nil
+		}
+
+		addr := newAddr(packet, mac, ip)
+		if prober, ok := probes.Resolve(addr); ok {
+			log.Printf("ndp from %s(ip=%s) defends address probed by %s", mac, ip, prober.MAC)
+		}
+
+		hosts.UpdateAddresses([]hostmonitor.Addr{addr})
+
+		return nil
+	}
+}
+
+// linkLayerOption returns the link-layer address in the option of the given type, or fallback if not present.
+func linkLayerOption(options layers.ICMPv6Options, optionType layers.ICMPv6Opt, fallback net.HardwareAddr) net.HardwareAddr {
+	for _, opt := range options {
+		if opt.Type == optionType && len(opt.Data) == 6 {
+			return append(net.HardwareAddr(nil), opt.Data...)
+		}
+	}
+
+	return fallback
+}
+
+// prefixOptions returns the prefixes in the prefix information options of a router advertisement.
+func prefixOptions(options layers.ICMPv6Options) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, opt := range options {
+		// length, flags, valid and preferred lifetimes, reserved then the prefix
+		if opt.Type != layers.ICMPv6OptPrefixInfo || len(opt.Data) < 30 {
+			continue
+		}
+
+		addr, _ := netip.AddrFromSlice(opt.Data[14:30])
+		if prefix, err := addr.Prefix(int(opt.Data[0])); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	return prefixes
+}
+
+// IPv6Router is a host that has advertised itself as an ipv6 router.
+type IPv6Router struct {
+	MAC net.HardwareAddr
+	IP  netip.Addr
+	// Lifetime is how long the router can be used as a default router, zero if it shouldn't be.
+	Lifetime time.Duration
+	Prefixes []netip.Prefix
+	LastSeen time.Time
+}
+
+// IPv6Routers keeps track of the hosts acting as ipv6 routers.
+type IPv6Routers struct {
+	routers map[string]*IPv6Router
+	mux     *sync.RWMutex
+}
+
+func NewIPv6Routers() *IPv6Routers {
+	return &IPv6Routers{
+		routers: make(map[string]*IPv6Router),
+		mux:     &sync.RWMutex{},
+	}
+}
+
+// Advertise records the router from its router advertisement, returning true if it wasn't known as a router before.
+func (r *IPv6Routers) Advertise(router IPv6Router) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	key := router.MAC.String()
+	_, ok := r.routers[key]
+	r.routers[key] = &router
+
+	return !ok
+}
+
+// Seen records a host flagging itself as a router in a neighbor advertisement, returning true if it wasn't known as a
+// router before. The lifetime and prefixes of a known router are left as advertised.
+func (r *IPv6Routers) Seen(mac net.HardwareAddr, ip netip.Addr, seen time.Time) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	key := mac.String()
+	existing, ok := r.routers[key]
+	if !ok {
+		r.routers[key] = &IPv6Router{MAC: mac, IP: ip, LastSeen: seen}
+		return true
+	}
+
+	existing.IP = ip
+	existing.LastSeen = seen
+	return false
+}
+
+// Routers returns the known routers ordered by MAC.
+func (r *IPv6Routers) Routers() []IPv6Router {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	routers := make([]IPv6Router, 0, len(r.routers))
+	for _, router := range r.routers {
+		routers = append(routers, *router)
+	}
+	sort.Slice(routers, func(i, j int) bool {
+		return routers[i].MAC.String() < routers[j].MAC.String()
+	})
+
+	return routers
+}
+
+// PrintRouters logs every known router.
+func (r *IPv6Routers) PrintRouters() {
+	for _, router := range r.Routers() {
+		log.Printf("ipv6 router %s(ip=%s) prefixes=(%v) lifetime=(%s) lastSeen=(%s), manufacturer=(%s)",
+			router.MAC, router.IP, router.Prefixes, router.Lifetime, router.LastSeen, hostmonitor.FindManufacturer(router.MAC))
+	}
+}
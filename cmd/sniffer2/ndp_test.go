@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ndpPacket(t testing.TB, ts time.Time, mac net.HardwareAddr, srcIP, dstIP string, typ uint8, msg gopacket.SerializableLayer) testPacket {
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   255,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      net.ParseIP(srcIP),
+		DstIP:      net.ParseIP(dstIP),
+	}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(typ, 0)}
+	require.NoError(t, icmp.SetNetworkLayerForChecksum(ip))
+
+	return testPacket{
+		ts: ts,
+		layers: []gopacket.SerializableLayer{
+			&layers.Ethernet{SrcMAC: mac, DstMAC: net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1}, EthernetType: layers.EthernetTypeIPv6},
+			ip, icmp, msg,
+		},
+	}
+}
+
+func TestUpdateHostsFromNDP(t *testing.T) {
+	hosts := hostmonitor.NewHostMap()
+	probes := NewAddressProbes()
+	routers := NewIPv6Routers()
+	handler := UpdateHostsFromNDP(hosts, probes, routers)
+
+	handle := func(p testPacket) {
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+
+	prefix := make([]byte, 30)
+	prefix[0] = 64
+	copy(prefix[14:], net.ParseIP("2001:db8::"))
+
+	// router advertising a prefix
+	handle(ndpPacket(t, testStart, gatewayMAC, "fe80::3c", "ff02::1", layers.ICMPv6TypeRouterAdvertisement,
+		&layers.ICMPv6RouterAdvertisement{
+			HopLimit:       64,
+			RouterLifetime: 1800,
+			Options: layers.ICMPv6Options{
+				{Type: layers.ICMPv6OptSourceAddress, Data: gatewayMAC},
+				{Type: layers.ICMPv6OptPrefixInfo, Data: prefix},
+			},
+		}))
+
+	// duplicate address detection doesn't add the host
+	handle(ndpPacket(t, testStart.Add(time.Second), testMAC1, "::", "ff02::1:ff00:1", layers.ICMPv6TypeNeighborSolicitation,
+		&layers.ICMPv6NeighborSolicitation{TargetAddress: net.ParseIP("2001:db8::1")}))
+	prober, ok := probes.Probing(hostmonitor.Addr{IP: netip.MustParseAddr("2001:db8::1")})
+	require.True(t, ok)
+	assert.Equal(t, testMAC1, prober.MAC)
+
+	// a solicitation maps the source link-layer option to the source address
+	handle(ndpPacket(t, testStart.Add(2*time.Second), testMAC1, "2001:db8::1", "ff02::1:ff00:2", layers.ICMPv6TypeNeighborSolicitation,
+		&layers.ICMPv6NeighborSolicitation{
+			TargetAddress: net.ParseIP("2001:db8::2"),
+			Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptSourceAddress, Data: testMAC1}},
+		}))
+	_, ok = probes.Probing(hostmonitor.Addr{IP: netip.MustParseAddr("2001:db8::1")})
+	assert.False(t, ok, "using the address resolves the probe")
+
+	// an advertisement maps the target link-layer option to the target address
+	handle(ndpPacket(t, testStart.Add(3*time.Second), gatewayMAC, "fe80::3c", "2001:db8::1", layers.ICMPv6TypeNeighborAdvertisement,
+		&layers.ICMPv6NeighborAdvertisement{
+			TargetAddress: net.ParseIP("2001:db8::2"),
+			Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: testMAC2}},
+		}))
+
+	changes := collectChanges(hosts)
+	require.Len(t, changes, 3)
+	assert.Equal(t, hostmonitor.Addr{MAC: gatewayMAC, IP: netip.MustParseAddr("fe80::3c")}, changes[0].Addr)
+	assert.Equal(t, hostmonitor.Addr{MAC: testMAC1, IP: netip.MustParseAddr("2001:db8::1")}, changes[1].Addr)
+	assert.Equal(t, hostmonitor.Addr{MAC: testMAC2, IP: netip.MustParseAddr("2001:db8::2")}, changes[2].Addr)
+
+	require.Len(t, routers.Routers(), 1)
+	router := routers.Routers()[0]
+	assert.Equal(t, gatewayMAC, router.MAC)
+	assert.Equal(t, 30*time.Minute, router.Lifetime)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8::/64")}, router.Prefixes)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+
+	"github.com/google/gopacket"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+const netbiosNSPort = 137
+
+// HostMap metadata keys for the windows workgroup or domain a host belongs to, as a string.
+const (
+	WorkgroupMetadataKey = "workgroup"
+	DomainMetadataKey    = "domain"
+)
+
+// name service packet fields
+const (
+	netbiosHeaderLen  = 12
+	netbiosNameLen    = 32 // a 16 byte name, half-ASCII encoded
+	netbiosTypeNB     = 0x0020
+	netbiosGroupFlag  = 0x8000
+	netbiosOpQuery    = 0
+	netbiosOpRegister = 5
+	netbiosOpRefresh  = 8
+	netbiosOpMulti    = 15 // multi-homed registration
+)
+
+// the last byte of a name identifies the service it's registered for
+const (
+	netbiosWorkstation       = 0x00
+	netbiosServer            = 0x20
+	netbiosDomainControllers = 0x1c
+)
+
+var errShortNetBIOS = errors.New("netbios packet too short")
+
+// UpdateHostNamesFromNetBIOS watches NetBIOS name service registrations and positive query responses for the names
+// windows hosts register, which they often don't send over DHCP. Unique workstation and server names are host names,
+// the group names are the workgroup or domain the host belongs to and are stored in the HostMap metadata.
+func UpdateHostNamesFromNetBIOS(hosts *hostmonitor.HostMap, hostNames *MacHostMap) PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		payload, eth, srcIP, ok := udpPayload(packet, netbiosNSPort)
+		if !ok {
+			// nothing to do - not a NetBIOS name service packet
+			return nil
+		}
+
+		names, err := parseNetBIOS(payload)
+		if err != nil {
+			// not worth failing the packet over, other handlers may still be interested
+			log.Printf("failed to parse netbios from %s: %s", eth.SrcMAC, err)
+			return nil
+		}
+
+		for _, name := range names {
+			owner, ok := ownerOf(hosts, packet, eth.SrcMAC, srcIP, name.IP)
+			if !ok {
+				continue
+			}
+			mac := owner.MAC
+
+			switch {
+			case !name.Group && (name.Suffix == netbiosWorkstation || name.Suffix == netbiosServer):
+				if hostNames.Set(owner, NetBIOSNameSource, name.Name) {
+					log.Printf("netbios from %s(ip=%s), hostname=(%s), manufacturer=(%s)",
+						mac, name.IP, name.Name, hostmonitor.FindManufacturer(mac))
+				}
+			case name.Group && name.Suffix == netbiosWorkstation:
+				hosts.SetMetadata(owner, WorkgroupMetadataKey, name.Name)
+			case name.Group && name.Suffix == netbiosDomainControllers:
+				hosts.SetMetadata(owner, DomainMetadataKey, name.Name)
+			}
+		}
+
+		return nil
+	}
+}
+
+// netbiosName is a name and the address it's registered to.
+type netbiosName struct {
+	Name   string
+	Suffix byte
+	Group  bool
+	IP     netip.Addr
+}
+
+// parseNetBIOS returns the names registered by a name service registration or refresh request, or resolved by a
+// positive query or registration response. Anything else has no names.
+func parseNetBIOS(data []byte) ([]netbiosName, error) {
+	if len(data) < netbiosHeaderLen {
+		return nil, errShortNetBIOS
+	}
+
+	flags := binary.BigEndian.Uint16(data[2:4])
+	response, opcode, rcode := flags&0x8000 != 0, (flags>>11)&0xf, flags&0xf
+	switch {
+	case !response && (opcode == netbiosOpRegister || opcode == netbiosOpRefresh || opcode == netbiosOpMulti):
+	case response && rcode == 0 && (opcode == netbiosOpQuery || opcode == netbiosOpRegister):
+	default:
+		return nil, nil
+	}
+
+	questions := int(binary.BigEndian.Uint16(data[4:6]))
+	records := int(binary.BigEndian.Uint16(data[6:8])) +
+		int(binary.BigEndian.Uint16(data[8:10])) +
+		int(binary.BigEndian.Uint16(data[10:12]))
+
+	offset := netbiosHeaderLen
+	for i := 0; i < questions; i++ {
+		_, _, next, err := readNetBIOSName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		// type and class
+		offset = next + 4
+	}
+
+	var names []netbiosName
+	for i := 0; i < records; i++ {
+		name, suffix, next, err := readNetBIOSName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		// type, class, ttl then the length of the data
+		if len(data) < next+10 {
+			return nil, errShortNetBIOS
+		}
+		rrType := binary.BigEndian.Uint16(data[next : next+2])
+		length := int(binary.BigEndian.Uint16(data[next+8 : next+10]))
+		offset = next + 10 + length
+		if len(data) < offset {
+			return nil, errShortNetBIOS
+		}
+		if rrType != netbiosTypeNB {
+			continue
+		}
+
+		// the data is a list of flags and ipv4 address pairs
+		for rdata := data[next+10 : offset]; len(rdata) >= 6; rdata = rdata[6:] {
+			names = append(names, netbiosName{
+				Name:   name,
+				Suffix: suffix,
+				Group:  binary.BigEndian.Uint16(rdata[0:2])&netbiosGroupFlag != 0,
+				IP:     netip.AddrFrom4([4]byte{rdata[2], rdata[3], rdata[4], rdata[5]}),
+			})
+		}
+	}
+
+	return names, nil
+}
+
+// readNetBIOSName reads the encoded name at offset, returning the name, its suffix and the offset following it. Names
+// are either a 32 byte label followed by the scope labels, or a pointer to a name earlier in the packet.
+func readNetBIOSName(data []byte, offset int) (string, byte, int, error) {
+	if len(data) < offset+1 {
+		return "", 0, 0, errShortNetBIOS
+	}
+
+	if data[offset]&0xc0 == 0xc0 {
+		if len(data) < offset+2 {
+			return "", 0, 0, errShortNetBIOS
+		}
+		pointer := int(binary.BigEndian.Uint16(data[offset:offset+2]) & 0x3fff)
+		if pointer >= offset || data[pointer]&0xc0 == 0xc0 {
+			return "", 0, 0, fmt.Errorf("invalid netbios name pointer %d", pointer)
+		}
+		name, suffix, _, err := readNetBIOSName(data, pointer)
+		return name, suffix, offset + 2, err
+	}
+
+	if data[offset] != netbiosNameLen {
+		return "", 0, 0, fmt.Errorf("invalid netbios name length %d", data[offset])
+	}
+	if len(data) < offset+1+netbiosNameLen {
+		return "", 0, 0, errShortNetBIOS
+	}
+
+	// every byte is split into two nibbles each added to 'A'
+	var decoded [netbiosNameLen / 2]byte
+	encoded := data[offset+1 : offset+1+netbiosNameLen]
+	for i := range decoded {
+		hi, lo := encoded[2*i]-'A', encoded[2*i+1]-'A'
+		if hi > 0xf || lo > 0xf {
+			return "", 0, 0, fmt.Errorf("invalid netbios name encoding %q", encoded)
+		}
+		decoded[i] = hi<<4 | lo
+	}
+
+	// skip the scope labels
+	offset += 1 + netbiosNameLen
+	for {
+		if len(data) < offset+1 {
+			return "", 0, 0, errShortNetBIOS
+		}
+		if data[offset] == 0 {
+			break
+		}
+		offset += 1 + int(data[offset])
+	}
+
+	name := strings.TrimRight(string(decoded[:15]), " ")
+	return name, decoded[15], offset + 1, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeNetBIOSName half-ASCII encodes the name padded to 15 characters followed by the suffix
+func encodeNetBIOSName(name string, suffix byte) []byte {
+	var raw [16]byte
+	copy(raw[:], name+"               ")
+	raw[15] = suffix
+
+	encoded := []byte{netbiosNameLen}
+	for _, b := range raw {
+		encoded = append(encoded, 'A'+b>>4, 'A'+b&0xf)
+	}
+	return append(encoded, 0)
+}
+
+// netbiosRecord builds an NB resource record, name is either an encoded name or a pointer
+func netbiosRecord(name []byte, group bool, ip string) []byte {
+	// type, class IN, ttl, length then flags
+	fields := make([]byte, 12)
+	binary.BigEndian.PutUint16(fields[0:2], netbiosTypeNB)
+	binary.BigEndian.PutUint16(fields[2:4], 1)
+	binary.BigEndian.PutUint32(fields[4:8], 300000)
+	binary.BigEndian.PutUint16(fields[8:10], 6)
+	if group {
+		binary.BigEndian.PutUint16(fields[10:12], netbiosGroupFlag)
+	}
+
+	record := append(append([]byte(nil), name...), fields...)
+	return append(record, net.ParseIP(ip).To4()...)
+}
+
+// netbiosRegistration builds a name registration request for the name, as broadcast by a host claiming it
+func netbiosRegistration(name string, suffix byte, group bool, ip string) []byte {
+	header := []byte{0x12, 0x34, netbiosOpRegister << 3, 0x10, 0, 1, 0, 0, 0, 0, 0, 1}
+	question := append(encodeNetBIOSName(name, suffix), 0, 0x20, 0, 1)
+	// the additional record points back to the name in the question
+	return append(append(header, question...), netbiosRecord([]byte{0xc0, netbiosHeaderLen}, group, ip)...)
+}
+
+func TestUpdateHostNamesFromNetBIOS(t *testing.T) {
+	hosts := hostmonitor.NewHostMap()
+	hostNames := NewMacHostMap()
+	handler := UpdateHostNamesFromNetBIOS(hosts, hostNames)
+
+	hosts.UpdateAddresses([]hostmonitor.Addr{
+		{MAC: testMAC2, IP: netip.MustParseAddr("192.168.1.11")},
+	})
+
+	handle := func(srcMAC net.HardwareAddr, srcIP string, payload []byte) {
+		p := udpPacket(t, testStart, srcMAC, layers.EthernetBroadcast, srcIP, "192.168.1.255", netbiosNSPort, netbiosNSPort, gopacket.Payload(payload))
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+
+	handle(testMAC1, "192.168.1.10", netbiosRegistration("DESKTOP-1234", netbiosWorkstation, false, "192.168.1.10"))
+	handle(testMAC1, "192.168.1.10", netbiosRegistration("WORKGROUP", netbiosWorkstation, true, "192.168.1.10"))
+	assert.Equal(t, "DESKTOP-1234", hostNames.Get(hostmonitor.Addr{MAC: testMAC1}))
+	workgroup, ok := hosts.Metadata(hostmonitor.Addr{MAC: testMAC1}, WorkgroupMetadataKey)
+	require.True(t, ok)
+	assert.Equal(t, "WORKGROUP", workgroup)
+
+	// a positive query response from a WINS server for another host
+	response := []byte{0x12, 0x35, 0x85, 0x00, 0, 0, 0, 1, 0, 0, 0, 0}
+	response = append(response, netbiosRecord(encodeNetBIOSName("LAPTOP", netbiosServer), false, "192.168.1.11")...)
+	handle(gatewayMAC, "192.168.1.1", response)
+	assert.Equal(t, "LAPTOP", hostNames.Get(hostmonitor.Addr{MAC: testMAC2}))
+	assert.Equal(t, "", hostNames.Get(hostmonitor.Addr{MAC: gatewayMAC}))
+
+	// truncated packets are ignored
+	handle(testMAC1, "192.168.1.10", netbiosRegistration("DESKTOP-5678", netbiosWorkstation, false, "192.168.1.10")[:40])
+	assert.Equal(t, "DESKTOP-1234", hostNames.Get(hostmonitor.Addr{MAC: testMAC1}))
+}
+
+func TestParseNetBIOS(t *testing.T) {
+	names, err := parseNetBIOS(netbiosRegistration("CORP", netbiosDomainControllers, true, "192.168.1.2"))
+	require.NoError(t, err)
+	assert.Equal(t, []netbiosName{
+		{Name: "CORP", Suffix: netbiosDomainControllers, Group: true, IP: netip.MustParseAddr("192.168.1.2")},
+	}, names)
+
+	// queries don't have any names
+	query := netbiosRegistration("CORP", netbiosDomainControllers, true, "192.168.1.2")
+	query[2] = netbiosOpQuery << 3
+	names, err = parseNetBIOS(query)
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	_, err = parseNetBIOS([]byte{0x12, 0x34})
+	assert.True(t, errors.Is(err, errShortNetBIOS))
+}
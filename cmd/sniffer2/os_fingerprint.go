@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+// OSMetadataKey is the HostMap metadata key the operating system guessed for a host is stored under, as an OSInfo.
+const OSMetadataKey = "os"
+
+// the kinds of fingerprints an operating system is guessed from
+const (
+	SYNSignalSource       = "syn"
+	TLSSignalSource       = "tls"
+	UserAgentSignalSource = "user-agent"
+)
+
+// how much each kind of fingerprint is trusted. User agents are the most specific but any app can send one, a SYN only
+// tells the TCP stack apart and a ttl alone barely that.
+const (
+	userAgentWeight = 0.8
+	tlsWeight       = 0.7
+	synWeight       = 0.6
+	synTTLWeight    = 0.25
+)
+
+// limits of putting ClientHellos split over several segments back together
+const (
+	maxPendingHellos   = 256
+	pendingHelloExpiry = 10 * time.Second
+)
+
+// osParents are the operating systems a more specific one is a kind of, a signal for the parent supports the child.
+var osParents = map[string]string{
+	"Android":  "Linux",
+	"ChromeOS": "Linux",
+	"macOS":    "Darwin",
+	"iOS":      "Darwin",
+}
+
+// OSSignal is the operating system a kind of fingerprint points to.
+type OSSignal struct {
+	Source string
+	OS     string
+	Weight float64
+}
+
+// OSInfo is what's known about the operating system of a host.
+type OSInfo struct {
+	// OS is the best guess of the operating system and Confidence how sure the guess is, from 0 to 1.
+	OS         string
+	Confidence float64
+
+	// the last fingerprint of each kind seen from the host
+	SYN       string
+	JA3       string
+	JA4       string
+	UserAgent string
+
+	// Signals are the operating systems the fingerprints point to, ordered by source.
+	Signals []OSSignal
+}
+
+func (i OSInfo) String() string {
+	return fmt.Sprintf("os=(%s) confidence=(%.2f) syn=(%s) ja3=(%s) ja4=(%s) userAgent=(%s)",
+		i.OS, i.Confidence, i.SYN, i.JA3, i.JA4, i.UserAgent)
+}
+
+// guess combines the signals. Every operating system a signal points to is scored by the signals supporting it, those
+// for it or one of its parents: the chance at least one of them is right, scaled by their share of the total weight so
+// conflicting signals lower the confidence.
+func (i *OSInfo) guess() {
+	var total float64
+	for _, signal := range i.Signals {
+		total += signal.Weight
+	}
+
+	i.OS, i.Confidence = "", 0
+	for _, candidate := range i.Signals {
+		var support, missed float64 = 0, 1
+		for _, signal := range i.Signals {
+			if isOSOrParent(signal.OS, candidate.OS) {
+				support += signal.Weight
+				missed *= 1 - signal.Weight
+			}
+		}
+
+		confidence := (1 - missed) * support / total
+		if confidence > i.Confidence || (confidence == i.Confidence && isOSOrParent(i.OS, candidate.OS)) {
+			i.OS, i.Confidence = candidate.OS, confidence
+		}
+	}
+}
+
+// isOSOrParent returns true if parent is os or one of the operating systems it's a kind of.
+func isOSOrParent(parent, os string) bool {
+	for ; os != ""; os = osParents[os] {
+		if os == parent {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingHello is the start of a ClientHello waiting for the rest of its record.
+type pendingHello struct {
+	data    []byte
+	nextSeq uint32
+	started time.Time
+}
+
+// OSFingerprinter guesses the operating system of hosts from the SYNs, TLS ClientHellos and HTTP requests they send,
+// and publishes the guess to the HostMap metadata.
+type OSFingerprinter struct {
+	hosts *hostmonitor.HostMap
+	syn   *SYNFingerprintDB
+	tls   *TLSFingerprintDB
+
+	infos   map[string]*OSInfo
+	pending map[string]*pendingHello
+	mux     *sync.Mutex
+}
+
+func NewOSFingerprinter(hosts *hostmonitor.HostMap, syn *SYNFingerprintDB, tls *TLSFingerprintDB) *OSFingerprinter {
+	return &OSFingerprinter{
+		hosts:   hosts,
+		syn:     syn,
+		tls:     tls,
+		infos:   make(map[string]*OSInfo),
+		pending: make(map[string]*pendingHello),
+		mux:     &sync.Mutex{},
+	}
+}
+
+// UpdateSYN records the SYN signature of the host, returning true if the guess changed.
+func (f *OSFingerprinter) UpdateSYN(addr hostmonitor.Addr, sig SYNSignature) bool {
+	os, exact := f.syn.Match(sig)
+	weight := synWeight
+	if !exact {
+		weight = synTTLWeight
+	}
+
+	return f.update(addr, OSSignal{Source: SYNSignalSource, OS: os, Weight: weight}, func(info *OSInfo) {
+		info.SYN = sig.String()
+	})
+}
+
+// UpdateTLS records the JA3 and JA4 fingerprints of the ClientHello sent by the host, returning true if the guess
+// changed.
+func (f *OSFingerprinter) UpdateTLS(addr hostmonitor.Addr, hello clientHello) bool {
+	_, ja3 := hello.JA3()
+	ja4 := hello.JA4()
+
+	signal := OSSignal{Source: TLSSignalSource, OS: f.tls.Match(ja3, ja4), Weight: tlsWeight}
+	return f.update(addr, signal, func(info *OSInfo) {
+		info.JA3, info.JA4 = ja3, ja4
+	})
+}
+
+// UpdateUserAgent records the User-Agent the host sent, returning true if the guess changed.
+func (f *OSFingerprinter) UpdateUserAgent(addr hostmonitor.Addr, userAgent string) bool {
+	signal := OSSignal{Source: UserAgentSignalSource, OS: userAgentOS(userAgent), Weight: userAgentWeight}
+	return f.update(addr, signal, func(info *OSInfo) {
+		info.UserAgent = userAgent
+	})
+}
+
+// Info returns what's known about the operating system of the host of addr, its MAC on its VLAN.
+func (f *OSFingerprinter) Info(addr hostmonitor.Addr) (OSInfo, bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	info, ok := f.infos[addr.HostKey()]
+	if !ok {
+		return OSInfo{}, false
+	}
+	return info.copy(), true
+}
+
+// update replaces the signal of the source, dropping it if it doesn't point to an operating system, and publishes the
+// info of the host.
+func (f *OSFingerprinter) update(addr hostmonitor.Addr, signal OSSignal, fingerprint func(info *OSInfo)) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	info, ok := f.infos[addr.HostKey()]
+	if !ok {
+		info = &OSInfo{}
+		f.infos[addr.HostKey()] = info
+	}
+	fingerprint(info)
+
+	signals := info.Signals[:0]
+	for _, existing := range info.Signals {
+		if existing.Source != signal.Source {
+			signals = append(signals, existing)
+		}
+	}
+	if signal.OS != "" {
+		signals = append(signals, signal)
+	}
+	sort.Slice(signals, func(i, j int) bool {
+		return signals[i].Source < signals[j].Source
+	})
+	info.Signals = signals
+
+	previous := info.OS
+	info.guess()
+	f.hosts.SetMetadata(addr, OSMetadataKey, info.copy())
+
+	return info.OS != previous
+}
+
+// clientHello returns the ClientHello the segment starts or completes, if any. The start of a ClientHello too big for
+// one segment is kept until the rest arrives.
+func (f *OSFingerprinter) clientHello(flow string, tcp *layers.TCP, seen time.Time) (clientHello, bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	payload := tcp.Payload
+	if pending, ok := f.pending[flow]; ok {
+		delete(f.pending, flow)
+		if pending.nextSeq == tcp.Seq && seen.Sub(pending.started) < pendingHelloExpiry {
+			payload = append(pending.data, payload...)
+		}
+	}
+	if !isClientHello(payload) {
+		return clientHello{}, false
+	}
+
+	hello, err := parseClientHello(payload)
+	if recordLen := tlsRecordLen(payload); len(payload) < recordLen && recordLen <= tlsRecordHeaderLen+tlsMaxRecordLen {
+		f.expirePending(seen)
+		if len(f.pending) < maxPendingHellos {
+			f.pending[flow] = &pendingHello{
+				data:    append([]byte(nil), payload...),
+				nextSeq: tcp.Seq + uint32(len(tcp.Payload)),
+				started: seen,
+			}
+		}
+		return clientHello{}, false
+	}
+
+	return hello, err == nil
+}
+
+// expirePending drops ClientHellos that weren't completed in time. The lock must be held.
+func (f *OSFingerprinter) expirePending(now time.Time) {
+	for flow, pending := range f.pending {
+		if now.Sub(pending.started) >= pendingHelloExpiry {
+			delete(f.pending, flow)
+		}
+	}
+}
+
+func (i *OSInfo) copy() OSInfo {
+	c := *i
+	c.Signals = append([]OSSignal(nil), i.Signals...)
+	return c
+}
+
+// osFingerprintLayers are the layers FingerprintOS looks at.
+var osFingerprintLayers = []gopacket.LayerType{
+	layers.LayerTypeEthernet,
+	layers.LayerTypeIPv4,
+	layers.LayerTypeIPv6,
+	layers.LayerTypeTCP,
+}
+
+// FingerprintOS guesses the operating system of hosts from the SYNs they open connections with, the JA3 and JA4
+// fingerprints of their TLS ClientHellos and the User-Agent of their HTTP requests. Only hosts already in the HostMap
+// are fingerprinted, so connections from outside the network aren't mistaken for the router. The default filter
+// captures the ClientHellos and requests in full, other segments only have their headers.
+func FingerprintOS(fingerprinter *OSFingerprinter) PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok {
+			// nothing to do - not a TCP segment
+			return nil
+		}
+		src, dst, ok := packetIPs(packet)
+		if !ok {
+			return nil
+		}
+		addr, ok := fingerprinter.hosts.FindByIP(newAddr(packet, nil, src))
+		if !ok {
+			return nil
+		}
+
+		var changed bool
+		switch {
+		case tcp.SYN && !tcp.ACK:
+			var ttl uint8
+			switch network := packet.NetworkLayer().(type) {
+			case *layers.IPv4:
+				ttl = network.TTL
+			case *layers.IPv6:
+				ttl = network.HopLimit
+			}
+			changed = fingerprinter.UpdateSYN(addr, synSignature(tcp, ttl))
+
+		case len(tcp.Payload) > 0:
+			flow := fmt.Sprintf("%s:%d>%s:%d", src, tcp.SrcPort, dst, tcp.DstPort)
+			if hello, ok := fingerprinter.clientHello(flow, tcp, packet.Metadata().Timestamp); ok {
+				changed = fingerprinter.UpdateTLS(addr, hello)
+			} else if userAgent, ok := httpUserAgent(tcp.Payload); ok {
+				changed = fingerprinter.UpdateUserAgent(addr, userAgent)
+			}
+		}
+
+		if changed {
+			info, _ := fingerprinter.Info(addr)
+			log.Printf("os of %s(ip=%s) guessed: %s signals=(%s)", addr.MAC, addr.IP, info, describeSignals(info.Signals))
+		}
+
+		return nil
+	}
+}
+
+// describeSignals formats the signals for logging, e.g. "syn:Linux,user-agent:Android".
+func describeSignals(signals []OSSignal) string {
+	described := make([]string, len(signals))
+	for i, signal := range signals {
+		described[i] = signal.Source + ":" + signal.OS
+	}
+	return strings.Join(described, ",")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tcpPacket builds an ethernet frame carrying a tcp segment from src to dst sent with the ttl
+func tcpPacket(t testing.TB, ts time.Time, srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP string, ttl uint8, tcp *layers.TCP, payload ...gopacket.SerializableLayer) testPacket {
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      ttl,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(srcIP).To4(),
+		DstIP:    net.ParseIP(dstIP).To4(),
+	}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+
+	return testPacket{ts: ts, layers: append([]gopacket.SerializableLayer{eth, ip, tcp}, payload...)}
+}
+
+func TestFingerprintOS(t *testing.T) {
+	hello := goClientHello(t)
+	parsed, err := parseClientHello(hello)
+	require.NoError(t, err)
+	tlsDB, err := ParseTLSFingerprints(strings.NewReader(parsed.JA4() + " | Android"))
+	require.NoError(t, err)
+
+	hosts := hostmonitor.NewHostMap()
+	hosts.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: netip.MustParseAddr("192.168.1.10")}})
+	fingerprinter := NewOSFingerprinter(hosts, DefaultSYNFingerprints(), tlsDB)
+	handler := FingerprintOS(fingerprinter)
+	handle := func(srcIP string, ttl uint8, tcp *layers.TCP, payload ...gopacket.SerializableLayer) {
+		p := tcpPacket(t, testStart, testMAC1, gatewayMAC, srcIP, "93.184.216.34", ttl, tcp, payload...)
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+	info := func() OSInfo {
+		value, ok := hosts.Metadata(hostmonitor.Addr{MAC: testMAC1}, OSMetadataKey)
+		require.True(t, ok)
+		return value.(OSInfo)
+	}
+
+	// hosts outside the network aren't fingerprinted
+	handle("93.184.216.35", 128, &layers.TCP{SrcPort: 50000, DstPort: 443, SYN: true, Window: 64240,
+		Options: synOptions(1460, "mss,nop,ws,nop,nop,sok")})
+	_, ok := hosts.Metadata(hostmonitor.Addr{MAC: testMAC1}, OSMetadataKey)
+	assert.False(t, ok)
+
+	handle("192.168.1.10", 64, &layers.TCP{SrcPort: 50000, DstPort: 443, SYN: true, Window: 64240,
+		Options: synOptions(1460, "mss,sok,ts,nop,ws")})
+	assert.Equal(t, "Linux", info().OS)
+	assert.Equal(t, "64:64240:mss,sok,ts,nop,ws", info().SYN)
+	assert.InDelta(t, synWeight, info().Confidence, 0.001)
+
+	handle("192.168.1.10", 64, &layers.TCP{SrcPort: 50001, DstPort: 80, ACK: true, PSH: true},
+		gopacket.Payload("GET / HTTP/1.1\r\nHost: example.com\r\nUser-Agent: Mozilla/5.0 (Linux; Android 14; Pixel 8)\r\n\r\n"))
+	assert.Equal(t, "Android", info().OS, "android is a linux")
+	assert.Equal(t, "Mozilla/5.0 (Linux; Android 14; Pixel 8)", info().UserAgent)
+	assert.InDelta(t, 1-(1-synWeight)*(1-userAgentWeight), info().Confidence, 0.001)
+
+	// a ClientHello split over two segments
+	handle("192.168.1.10", 64, &layers.TCP{SrcPort: 50002, DstPort: 443, ACK: true, Seq: 1000}, gopacket.Payload(hello[:100]))
+	assert.Empty(t, info().JA4)
+	handle("192.168.1.10", 64, &layers.TCP{SrcPort: 50002, DstPort: 443, ACK: true, Seq: 1100}, gopacket.Payload(hello[100:]))
+	assert.Equal(t, parsed.JA4(), info().JA4)
+	_, ja3 := parsed.JA3()
+	assert.Equal(t, ja3, info().JA3)
+	assert.Equal(t, []OSSignal{
+		{Source: SYNSignalSource, OS: "Linux", Weight: synWeight},
+		{Source: TLSSignalSource, OS: "Android", Weight: tlsWeight},
+		{Source: UserAgentSignalSource, OS: "Android", Weight: userAgentWeight},
+	}, info().Signals)
+}
+
+func TestFingerprintOS_SplitClientHelloCapture(t *testing.T) {
+	hello := goClientHello(t)
+	parsed, err := parseClientHello(hello)
+	require.NoError(t, err)
+
+	// captured with the default filter, the rest of the ClientHello isn't truncated to the headers
+	path := writeCapture(t, []testPacket{
+		tcpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "93.184.216.34", 64,
+			&layers.TCP{SrcPort: 50002, DstPort: 443, ACK: true, Seq: 1000}, gopacket.Payload(hello[:100])),
+		tcpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "93.184.216.34", 64,
+			&layers.TCP{SrcPort: 50002, DstPort: 443, ACK: true, Seq: 1100}, gopacket.Payload(hello[100:])),
+	})
+	filter, err := DefaultFilter()
+	require.NoError(t, err)
+	handle, linkType, closeFunc, err := NewReplayHandle(path, 0, filter)
+	require.NoError(t, err)
+	defer closeFunc()
+
+	hosts := hostmonitor.NewHostMap()
+	hosts.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: netip.MustParseAddr("192.168.1.10")}})
+	handler := FingerprintOS(NewOSFingerprinter(hosts, DefaultSYNFingerprints(), &TLSFingerprintDB{}))
+	decoder := NewLayerDecoder(linkType, osFingerprintLayers...)
+	err = readPackets(context.Background(), readFrames(context.Background(), handle), decoder.Handler(handler))
+	require.True(t, errors.Is(err, errPacketsClosed), "unexpected error: %v", err)
+
+	value, ok := hosts.Metadata(hostmonitor.Addr{MAC: testMAC1}, OSMetadataKey)
+	require.True(t, ok)
+	assert.Equal(t, parsed.JA4(), value.(OSInfo).JA4)
+}
+
+func TestOSInfo_Guess(t *testing.T) {
+	tests := []struct {
+		signals    []OSSignal
+		os         string
+		confidence float64
+	}{
+		{nil, "", 0},
+		{[]OSSignal{{Source: SYNSignalSource, OS: "Darwin", Weight: synWeight}}, "Darwin", synWeight},
+		{
+			[]OSSignal{
+				{Source: SYNSignalSource, OS: "Darwin", Weight: synWeight},
+				{Source: UserAgentSignalSource, OS: "iOS", Weight: userAgentWeight},
+			},
+			"iOS", 1 - (1-synWeight)*(1-userAgentWeight),
+		},
+		{
+			// conflicting signals lower the confidence
+			[]OSSignal{
+				{Source: SYNSignalSource, OS: "Linux", Weight: synWeight},
+				{Source: UserAgentSignalSource, OS: "Windows", Weight: userAgentWeight},
+			},
+			"Windows", userAgentWeight * userAgentWeight / (synWeight + userAgentWeight),
+		},
+	}
+	for _, test := range tests {
+		info := OSInfo{Signals: test.signals}
+		info.guess()
+		assert.Equal(t, test.os, info.OS)
+		assert.InDelta(t, test.confidence, info.Confidence, 0.001)
+	}
+}
+
+func TestDefaultFilter_TCPPayloads(t *testing.T) {
+	filter, err := DefaultFilter()
+	require.NoError(t, err)
+
+	headers := ethHeaderLen + 20 + transportHeaderLen
+	tests := []struct {
+		name     string
+		src, dst layers.TCPPort
+		payload  []byte
+		want     int
+	}{
+		{"syn", 50000, 443, nil, headers},
+		{"client hello", 50000, 443, goClientHello(t), snapLen},
+		{"http request", 50000, 80, []byte("POST /api HTTP/1.1\r\n\r\n"), snapLen},
+		{"sent to https", 50000, 443, make([]byte, 200), snapLen},
+		{"data", 50000, 8080, make([]byte, 200), headers},
+		{"received from https", 443, 50000, make([]byte, 200), headers},
+		{"short", 443, 50000, []byte{tlsRecordHandshake, 3}, headers},
+	}
+	for _, test := range tests {
+		tcp := &layers.TCP{SrcPort: test.src, DstPort: test.dst, SYN: test.payload == nil, ACK: test.payload != nil, Options: synOptions(1460, "nop,nop,ts")}
+		p := tcpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.10", "93.184.216.34", 64, tcp, gopacket.Payload(test.payload))
+		assert.Equal(t, test.want, runFilter(t, filter, serialize(t, p.layers...)), test.name)
+	}
+
+	// over ipv6 and with a vlan tag
+	eth := &layers.Ethernet{SrcMAC: testMAC1, DstMAC: gatewayMAC, EthernetType: layers.EthernetTypeIPv6}
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	tcp := &layers.TCP{SrcPort: 50000, DstPort: 80, ACK: true}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+	request := testPacket{layers: []gopacket.SerializableLayer{eth, ip, tcp, gopacket.Payload("GET / HTTP/1.1\r\n\r\n")}}
+	assert.Equal(t, snapLen, runFilter(t, filter, serialize(t, request.layers...)))
+	assert.Equal(t, snapLen, runFilter(t, filter, serialize(t, tagged(request, 10).layers...)))
+}
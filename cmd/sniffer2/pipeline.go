@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/stdr"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+// pipeline is everything tracked from a single packet source, an interface or a capture file. Every interface has its
+// own hosts so the same MAC on two segments is tracked separately, host names and fingerprints are shared.
+type pipeline struct {
+	iface    string
+	source   gopacket.PacketDataSource
+	linkType layers.LinkType
+
+	// keep track of MAC -> IP addresses
+	hosts *hostmonitor.HostMap
+	// keep track of DHCP leases, silent hosts stay online until their lease expires
+	leases *LeaseTable
+	// and the leases in the lease file, if watched for this interface
+	leaseFileSource *hostmonitor.LeaseFileSource
+
+	hostNames *MacHostMap
+	// keep track of the domains each host looks up
+	dnsLog *DNSLog
+	// keep track of the bytes and packets each host sends and receives
+	traffic *TrafficTable
+	// keep track of who each host talks to
+	flows *FlowTable
+	// keep track of the hosts advertising themselves as ipv6 routers
+	routers *IPv6Routers
+	// keep track of the devices nearby of a monitor mode capture, apart from the hosts
+	wireless *WirelessDevices
+	recorder *Recorder
+	// handlers of every packet, only the layers they look at are decoded
+	handlers *HandlerRegistry
+	// workers the handlers run on
+	workers WorkerPoolConfig
+	// clock follows the packets of a replayed capture, nil when capturing
+	clock *packetClock
+
+	notificationsDone chan struct{}
+}
+
+// fingerprintDBs are the databases hosts are fingerprinted with, shared by every pipeline.
+type fingerprintDBs struct {
+	dhcp *FingerprintDB
+	syn  *SYNFingerprintDB
+	tls  *TLSFingerprintDB
+}
+
+func newPipeline(iface string, source gopacket.PacketDataSource, linkType layers.LinkType, hostNames *MacHostMap,
+	fingerprints fingerprintDBs, flows *FlowTable, recorder *Recorder, options ...hostmonitor.HostMapOption) *pipeline {
+	p := &pipeline{
+		iface:             iface,
+		source:            source,
+		linkType:          linkType,
+		leases:            NewLeaseTable(),
+		traffic:           NewTrafficTable(),
+		hostNames:         hostNames,
+		flows:             flows,
+		routers:           NewIPv6Routers(),
+		wireless:          NewWirelessDevices(),
+		recorder:          recorder,
+		notificationsDone: make(chan struct{}),
+	}
+
+	hostMapOptions := []hostmonitor.HostMapOption{
+		hostmonitor.LoggerOption(stdr.New(log.New(os.Stdout, "", log.LstdFlags))),
+		hostmonitor.HostOfflineTimeoutOption(*offlineTime),
+		hostmonitor.DetectConflictsOption(true),
+		hostmonitor.ExpiryOption(p.expiry),
+	}
+	if iface != "" {
+		hostMapOptions = append(hostMapOptions, hostmonitor.InterfaceOption(iface))
+	}
+	p.hosts = hostmonitor.NewHostMap(append(hostMapOptions, options...)...)
+	p.dnsLog = NewDNSLog(p.hosts, strings.Split(*dnsWatch, ",")...)
+
+	// hosts probing for ipv4 and ipv6 addresses before using them
+	probes := NewAddressProbes()
+
+	var ssdpClient *http.Client
+	if *ssdpFetch {
+		ssdpClient = NewSSDPClient()
+	}
+
+	// every packet is passed to the handlers in the order they're registered
+	p.handlers = NewHandlerRegistry()
+	// a bug in one handler shouldn't stop the others or the capture
+	p.handlers.Use(RecoverPanics())
+	if recorder != nil {
+		// record first so the packet that triggers a change is part of the recording
+		p.handlers.Register("record", recorderLayers, recorder.Record())
+	}
+	p.handlers.Register("hosts", hostLayers, UpdateHosts(p.hosts, p.traffic))
+	p.handlers.Register("flows", flowLayers, TrackFlows(p.flows))
+	p.handlers.Register("arp", arpLayers, UpdateHostsFromARP(p.hosts, probes))
+	p.handlers.Register("ndp", ndpLayers, UpdateHostsFromNDP(p.hosts, probes, p.routers))
+	p.handlers.Register("dhcp", dhcpLayers, UpdateHostNames(p.hosts, hostNames, fingerprints.dhcp))
+	p.handlers.Register("leases", dhcpLayers, TrackLeases(p.hosts, p.leases))
+	p.handlers.Register("mdns", udpPayloadLayers, UpdateHostNamesFromMDNS(p.hosts, hostNames))
+	p.handlers.Register("mdns-services", udpPayloadLayers, UpdateServicesFromMDNS(NewServiceCatalog(p.hosts)))
+	p.handlers.Register("netbios", udpPayloadLayers, UpdateHostNamesFromNetBIOS(p.hosts, hostNames))
+	p.handlers.Register("llmnr", udpPayloadLayers, UpdateHostNamesFromLLMNR(p.hosts, hostNames))
+	p.handlers.Register("ssdp", udpPayloadLayers, UpdateDevicesFromSSDP(NewSSDPCatalog(p.hosts, ssdpClient)))
+	p.handlers.Register("dns", dnsLayers, LogDNSQueries(p.hosts, p.dnsLog))
+	p.handlers.Register("os-fingerprint", osFingerprintLayers,
+		FingerprintOS(NewOSFingerprinter(p.hosts, fingerprints.syn, fingerprints.tls)))
+	p.handlers.Register("wifi", wirelessLayers, TrackWirelessDevices(p.wireless))
+
+	// nearby devices are kept apart from the hosts of the LAN, a monitor mode capture only has 802.11 frames and an
+	// ethernet capture none
+	for _, name := range p.handlers.Names() {
+		if (name == "wifi") != isWirelessLinkType(linkType) {
+			_ = p.handlers.Disable(name)
+		}
+	}
+
+	go p.logNotifications()
+	return p
+}
+
+// expiry is the later of the expiry of the DHCP lease seen on the wire and the one in the lease file.
+func (p *pipeline) expiry(addr hostmonitor.Addr) time.Time {
+	expires := p.leases.Expiry(addr)
+	if p.leaseFileSource != nil {
+		if fileExpires := p.leaseFileSource.Expiry(addr); fileExpires.After(expires) {
+			expires = fileExpires
+		}
+	}
+	return expires
+}
+
+// logNotifications logs the changes of the hosts until the HostMap is closed, recording them if configured.
+func (p *pipeline) logNotifications() {
+	defer close(p.notificationsDone)
+	// notifications are emitted when a host changes
+	//  * new IP
+	//  * host comes online
+	//  * host goes offline
+	for notification := range p.hosts.Notifications() {
+		hostName, source := p.hostNames.Lookup(notification.Addr)
+		if hostName == "" {
+			// from the lease file
+			if value, ok := p.hosts.Metadata(notification.Addr, hostmonitor.HostNameMetadataKey); ok {
+				hostName, source = value.(string), "lease-file"
+			}
+		}
+		log.Printf("host '%s' changed: %s", describeName(hostName, source), notification)
+
+		if p.recorder != nil {
+			if path, err := p.recorder.Trigger(notification); err != nil {
+				log.Println("error recording change:", err)
+			} else if path != "" {
+				log.Printf("recorded packets of host '%s' to %s", hostName, path)
+			}
+		}
+	}
+}
+
+// run handles the packets of the source on the workers until it's exhausted or the context is done, then waits for
+// the packets already queued to be handled.
+func (p *pipeline) run(ctx context.Context) error {
+	handler, layerTypes := p.handlers.Handler(), p.handlers.Layers()
+	// every worker decodes with its own decoder, the decoded layers are reused
+	pool, err := NewWorkerPool(ctx, p.workers, func() frameHandler {
+		decoder := NewLayerDecoder(p.linkType, layerTypes...).Handler(handler)
+		if p.clock != nil {
+			// advanced by the worker as it handles each frame rather than when the frame is queued, which would put
+			// the clock ahead of the frames still waiting in the queues
+			return AdvanceClock(p.clock, decoder)
+		}
+		return decoder
+	})
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	return readPackets(ctx, readFrames(ctx, p.source), pool.Dispatch)
+}
+
+// printSummary logs everything the pipeline collected once its packets are exhausted, after the last changes.
+func (p *pipeline) printSummary() {
+	p.hosts.Close()
+	<-p.notificationsDone
+	p.hosts.PrintTable()
+	p.dnsLog.PrintTopDomains(topDomains)
+	p.traffic.PrintTopTalkers(*topTalkers)
+	p.flows.Flush()
+	p.routers.PrintRouters()
+	p.wireless.PrintDevices()
+	p.handlers.PrintStats()
+}
+
+// reportTraffic logs the top talkers every interval until the context is done.
+func (p *pipeline) reportTraffic(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.traffic.PrintTopTalkers(*topTalkers)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reportHandlerStats logs the stats of the handlers every interval until the context is done.
+func (p *pipeline) reportHandlerStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.handlers.PrintStats()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expire ends the flows that timed out and drops the expired leases every interval until the context is done, so they
+// go even when no more packets are seen.
+func (p *pipeline) expire(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.flows.Expire(now)
+			p.leases.Expire(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
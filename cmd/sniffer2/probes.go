@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+// probes that haven't been followed by the address being used are forgotten after this long
+const probeTimeout = time.Minute
+
+// AddressProbes tracks the addresses hosts are probing for before they claim them, through ARP probes for ipv4 and
+// duplicate address detection for ipv6. Each VLAN is its own network, probes for the same address on two of them are
+// unrelated.
+type AddressProbes struct {
+	probes map[probeKey]addressProbe
+	mux    *sync.Mutex
+}
+
+// probeKey is an address probed for on a VLAN
+type probeKey struct {
+	ip        netip.Addr
+	vlan      uint16
+	outerVLAN uint16
+}
+
+func probeKeyOf(addr hostmonitor.Addr) probeKey {
+	return probeKey{ip: addr.IP, vlan: addr.VLAN, outerVLAN: addr.OuterVLAN}
+}
+
+type addressProbe struct {
+	prober hostmonitor.Addr
+	seen   time.Time
+}
+
+func NewAddressProbes() *AddressProbes {
+	return &AddressProbes{
+		probes: make(map[probeKey]addressProbe),
+		mux:    &sync.Mutex{},
+	}
+}
+
+// Probe records that the host of addr is probing for the ip of addr. If another host is already probing for the same
+// ip it is returned.
+func (p *AddressProbes) Probe(addr hostmonitor.Addr, seen time.Time) (hostmonitor.Addr, bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for key, probe := range p.probes {
+		if seen.Sub(probe.seen) > probeTimeout {
+			delete(p.probes, key)
+		}
+	}
+
+	key := probeKeyOf(addr)
+	existing, ok := p.probes[key]
+	p.probes[key] = addressProbe{prober: addr, seen: seen}
+	if ok && existing.prober.HostKey() != addr.HostKey() {
+		return existing.prober, true
+	}
+
+	return hostmonitor.Addr{}, false
+}
+
+// Resolve clears the probe for the ip of addr once the host of addr uses it. If it isn't the host that probed for it,
+// the prober is returned.
+func (p *AddressProbes) Resolve(addr hostmonitor.Addr) (hostmonitor.Addr, bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	key := probeKeyOf(addr)
+	probe, ok := p.probes[key]
+	if !ok {
+		return hostmonitor.Addr{}, false
+	}
+
+	delete(p.probes, key)
+	if probe.prober.HostKey() == addr.HostKey() {
+		return hostmonitor.Addr{}, false
+	}
+
+	return probe.prober, true
+}
+
+// Probing returns the host probing for the ip of addr on its VLAN, if any.
+func (p *AddressProbes) Probing(addr hostmonitor.Addr) (hostmonitor.Addr, bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	probe, ok := p.probes[probeKeyOf(addr)]
+	return probe.prober, ok
+}
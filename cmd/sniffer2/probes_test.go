@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressProbes(t *testing.T) {
+	probes := NewAddressProbes()
+	ip := netip.MustParseAddr("192.168.1.2")
+
+	_, conflict := probes.Probe(hostmonitor.Addr{MAC: testMAC1, IP: ip}, testStart)
+	assert.False(t, conflict)
+
+	other, conflict := probes.Probe(hostmonitor.Addr{MAC: testMAC2, IP: ip}, testStart.Add(time.Second))
+	assert.True(t, conflict)
+	assert.Equal(t, testMAC1, other.MAC)
+
+	// the first host defends the address the second probed for
+	prober, defended := probes.Resolve(hostmonitor.Addr{MAC: testMAC1, IP: ip})
+	assert.True(t, defended)
+	assert.Equal(t, testMAC2, prober.MAC)
+
+	// old probes are forgotten
+	probes.Probe(hostmonitor.Addr{MAC: testMAC1, IP: ip}, testStart)
+	probes.Probe(hostmonitor.Addr{MAC: testMAC2, IP: netip.MustParseAddr("192.168.1.3")}, testStart.Add(2*probeTimeout))
+	_, ok := probes.Probing(hostmonitor.Addr{IP: ip})
+	assert.False(t, ok)
+}
+
+func TestAddressProbes_VLANs(t *testing.T) {
+	probes := NewAddressProbes()
+	ip := netip.MustParseAddr("192.168.1.2")
+
+	// the same address probed for on two vlans, and the same mac probing on both
+	_, conflict := probes.Probe(hostmonitor.Addr{MAC: testMAC1, IP: ip, VLAN: 10}, testStart)
+	assert.False(t, conflict)
+	_, conflict = probes.Probe(hostmonitor.Addr{MAC: testMAC2, IP: ip, VLAN: 20}, testStart)
+	assert.False(t, conflict, "each vlan is its own network")
+	_, conflict = probes.Probe(hostmonitor.Addr{MAC: testMAC2, IP: ip, VLAN: 10}, testStart)
+	assert.True(t, conflict)
+
+	// the address in use on vlan 20 doesn't resolve the probe on vlan 10
+	_, defended := probes.Resolve(hostmonitor.Addr{MAC: testMAC1, IP: ip, VLAN: 20})
+	assert.True(t, defended)
+	prober, ok := probes.Probing(hostmonitor.Addr{IP: ip, VLAN: 10})
+	assert.True(t, ok)
+	assert.Equal(t, testMAC2, prober.MAC)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+const recordingExt = ".pcapng"
+
+// RecorderConfig configures which changes trigger a recording and the limits applied to recordings.
+type RecorderConfig struct {
+	// Dir is the directory recordings are written to. It should be dedicated to recordings as old captures in it are
+	// removed when rotating.
+	Dir string
+	// Triggers are the change types that cause the packets of the changed host to be written to disk.
+	Triggers []hostmonitor.ChangeType
+
+	// PacketsPerHost is the number of recent packets kept for each host.
+	PacketsPerHost int
+	// MaxHosts is the number of hosts packets are kept for, those of the least recently seen host are dropped when
+	// exceeded.
+	MaxHosts int
+	// Window is how far back from the change a recording reaches.
+	Window time.Duration
+	// MaxFileBytes limits the amount of packet data written to a single recording, the oldest packets are left out.
+	MaxFileBytes int
+	// MaxFiles is the number of recordings kept in Dir, the oldest are removed once exceeded.
+	MaxFiles int
+}
+
+// Recorder keeps the most recent raw packets of each host so the packets leading up to a change can be written to a
+// pcapng file when the change is emitted. A MAC on each VLAN is a separate host.
+type Recorder struct {
+	config   RecorderConfig
+	triggers map[hostmonitor.ChangeType]bool
+	linkType layers.LinkType
+
+	rings map[ringKey]*list.Element
+	// rings of hosts from the most to the least recently seen
+	recent *list.List
+	mux    *sync.Mutex
+}
+
+// ringKey identifies a host the same as Addr.HostKey, a MAC on its VLAN, without formatting the MAC for every packet.
+type ringKey struct {
+	mac       string
+	vlan      uint16
+	outerVLAN uint16
+}
+
+func ringKeyOf(addr hostmonitor.Addr) ringKey {
+	return ringKey{mac: string(addr.MAC), vlan: addr.VLAN, outerVLAN: addr.OuterVLAN}
+}
+
+// hostRing is the buffer of a host in the recent list
+type hostRing struct {
+	key  ringKey
+	ring *packetRing
+}
+
+func NewRecorder(config RecorderConfig, linkType layers.LinkType) (*Recorder, error) {
+	if config.PacketsPerHost <= 0 {
+		return nil, fmt.Errorf("packets per host must be positive, got %d", config.PacketsPerHost)
+	}
+	if config.MaxHosts <= 0 {
+		return nil, fmt.Errorf("max hosts must be positive, got %d", config.MaxHosts)
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating recording directory: %w", err)
+	}
+
+	triggers := make(map[hostmonitor.ChangeType]bool, len(config.Triggers))
+	for _, ct := range config.Triggers {
+		triggers[ct] = true
+	}
+
+	return &Recorder{
+		config:   config,
+		triggers: triggers,
+		linkType: linkType,
+		rings:    make(map[ringKey]*list.Element),
+		recent:   list.New(),
+		mux:      &sync.Mutex{},
+	}, nil
+}
+
+// recorderLayers are the layers Recorder.Record looks at.
+var recorderLayers = []gopacket.LayerType{
+	layers.LayerTypeEthernet,
+}
+
+// Record keeps a copy of every packet in the buffers of its source and destination hosts, on the VLAN of the packet.
+func (r *Recorder) Record() PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		layer := packet.Layer(layers.LayerTypeEthernet)
+		eth, ok := layer.(*layers.Ethernet)
+		if !ok {
+			return nil
+		}
+
+		// the packet data may be reused once the handler returns
+		data := packet.Data()
+		recorded := &recordedPacket{
+			ci:   packet.Metadata().CaptureInfo,
+			data: append(make([]byte, 0, len(data)), data...),
+		}
+		// recordings only have a single interface
+		recorded.ci.InterfaceIndex = 0
+		recorded.ci.CaptureLength = len(data)
+		if recorded.ci.Length < len(data) {
+			recorded.ci.Length = len(data)
+		}
+
+		vlan, outer := packetVLANs(packet)
+
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		for _, mac := range [...]net.HardwareAddr{eth.SrcMAC, eth.DstMAC} {
+			if len(mac) == 0 || mac[0]&0x01 != 0 {
+				// broadcast and multicast don't identify a host
+				continue
+			}
+
+			key := ringKey{mac: string(mac), vlan: vlan, outerVLAN: outer}
+			elem, ok := r.rings[key]
+			if !ok {
+				if len(r.rings) >= r.config.MaxHosts {
+					r.remove(r.recent.Back())
+				}
+				elem = r.recent.PushFront(&hostRing{key: key, ring: newPacketRing(r.config.PacketsPerHost)})
+				r.rings[key] = elem
+			}
+			r.recent.MoveToFront(elem)
+			elem.Value.(*hostRing).ring.add(recorded)
+		}
+
+		return nil
+	}
+}
+
+// Trigger writes the buffered packets of the hosts involved in the change if the change type is configured. The path
+// of the recording is returned, or an empty string if nothing was written.
+func (r *Recorder) Trigger(change hostmonitor.Change) (string, error) {
+	if change.ChangeType == hostmonitor.OfflineChange {
+		// nothing more will be recorded for the host until it returns
+		defer r.forget(change.Addr)
+	}
+
+	if !r.triggers[change.ChangeType] {
+		return "", nil
+	}
+
+	keys := []ringKey{ringKeyOf(change.Addr)}
+	if change.PreviousAddr != nil && ringKeyOf(*change.PreviousAddr) != keys[0] {
+		keys = append(keys, ringKeyOf(*change.PreviousAddr))
+	}
+
+	packets := r.snapshot(keys, change.LastSeen)
+	if len(packets) == 0 {
+		return "", nil
+	}
+
+	name := fmt.Sprintf("%s-%s-%s",
+		change.LastSeen.UTC().Format("20060102T150405.000"),
+		strings.ReplaceAll(change.ChangeType.String(), " ", "-"),
+		strings.ReplaceAll(change.Addr.MAC.String(), ":", ""),
+	)
+	if change.Addr.Interface != "" {
+		// every interface has its own recorder writing to the same directory
+		name += "-" + change.Addr.Interface
+	}
+	name += recordingExt
+	path := filepath.Join(r.config.Dir, name)
+	if err := r.write(path, packets); err != nil {
+		return "", err
+	}
+
+	return path, r.rotate()
+}
+
+// snapshot collects the buffered packets of the hosts, applying the window back from the time of the change and the
+// size limit. Packets are returned in the order they were captured.
+func (r *Recorder) snapshot(keys []ringKey, changed time.Time) []*recordedPacket {
+	r.mux.Lock()
+	seen := make(map[*recordedPacket]bool)
+	var packets []*recordedPacket
+	for _, key := range keys {
+		elem, ok := r.rings[key]
+		if !ok {
+			continue
+		}
+
+		for _, p := range elem.Value.(*hostRing).ring.packets() {
+			// packets between the two hosts are in both buffers
+			if !seen[p] {
+				seen[p] = true
+				packets = append(packets, p)
+			}
+		}
+	}
+	r.mux.Unlock()
+
+	if len(packets) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(packets, func(i, j int) bool {
+		return packets[i].ci.Timestamp.Before(packets[j].ci.Timestamp)
+	})
+
+	// walk back from the newest packet until a limit is reached, packets handled after the change are kept
+	var size int
+	first := len(packets)
+	for first > 0 {
+		p := packets[first-1]
+		if r.config.Window > 0 && changed.Sub(p.ci.Timestamp) > r.config.Window {
+			break
+		}
+		if r.config.MaxFileBytes > 0 && size+len(p.data) > r.config.MaxFileBytes {
+			break
+		}
+
+		size += len(p.data)
+		first--
+	}
+
+	return packets[first:]
+}
+
+func (r *Recorder) forget(addr hostmonitor.Addr) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if elem, ok := r.rings[ringKeyOf(addr)]; ok {
+		r.remove(elem)
+	}
+}
+
+// remove drops the buffer of a host. The lock must be held.
+func (r *Recorder) remove(elem *list.Element) {
+	r.recent.Remove(elem)
+	delete(r.rings, elem.Value.(*hostRing).key)
+}
+
+func (r *Recorder) write(path string, packets []*recordedPacket) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating recording: %w", err)
+	}
+	defer f.Close()
+
+	w, err := pcapgo.NewNgWriter(f, r.linkType)
+	if err != nil {
+		return fmt.Errorf("writing pcapng header: %w", err)
+	}
+
+	for _, p := range packets {
+		if err := w.WritePacket(p.ci, p.data); err != nil {
+			return fmt.Errorf("writing packet: %w", err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("flushing recording: %w", err)
+	}
+
+	return f.Close()
+}
+
+// rotate removes the oldest recordings once there are more than the configured maximum.
+func (r *Recorder) rotate() error {
+	if r.config.MaxFiles <= 0 {
+		return nil
+	}
+
+	recordings, err := filepath.Glob(filepath.Join(r.config.Dir, "*"+recordingExt))
+	if err != nil {
+		return err
+	}
+
+	// names start with the timestamp of the change
+	sort.Strings(recordings)
+	for len(recordings) > r.config.MaxFiles {
+		if err := os.Remove(recordings[0]); err != nil {
+			return fmt.Errorf("removing old recording: %w", err)
+		}
+		recordings = recordings[1:]
+	}
+
+	return nil
+}
+
+type recordedPacket struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// packetRing is a fixed size buffer that overwrites the oldest packet once full.
+type packetRing struct {
+	buf   []*recordedPacket
+	next  int
+	count int
+}
+
+func newPacketRing(size int) *packetRing {
+	return &packetRing{buf: make([]*recordedPacket, size)}
+}
+
+func (r *packetRing) add(p *recordedPacket) {
+	r.buf[r.next] = p
+	r.next = (r.next + 1) % len(r.buf)
+	if r.count < len(r.buf) {
+		r.count++
+	}
+}
+
+// packets returns the buffered packets, oldest first.
+func (r *packetRing) packets() []*recordedPacket {
+	out := make([]*recordedPacket, 0, r.count)
+	start := (r.next - r.count + len(r.buf)) % len(r.buf)
+	for i := 0; i < r.count; i++ {
+		out = append(out, r.buf[(start+i)%len(r.buf)])
+	}
+	return out
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decode serializes the test packet and decodes it as if it was read from a capture
+func decode(t *testing.T, p testPacket) gopacket.Packet {
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, p.layers...))
+
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	packet.Metadata().Timestamp = p.ts
+	packet.Metadata().CaptureLength = len(buf.Bytes())
+	packet.Metadata().Length = len(buf.Bytes())
+	return packet
+}
+
+func readRecording(t *testing.T, path string) []gopacket.CaptureInfo {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+
+	var cis []gopacket.CaptureInfo
+	for {
+		_, ci, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		cis = append(cis, ci)
+	}
+	return cis
+}
+
+func TestRecorder(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRecorder(RecorderConfig{
+		Dir:            dir,
+		Triggers:       []hostmonitor.ChangeType{hostmonitor.OnlineChange, hostmonitor.IPConflictChange},
+		PacketsPerHost: 3,
+		MaxHosts:       16,
+		Window:         time.Minute,
+		MaxFiles:       2,
+	}, layers.LinkTypeEthernet)
+	require.NoError(t, err)
+
+	record := recorder.Record()
+	for i := 0; i < 5; i++ {
+		p := udpPacket(t, testStart.Add(time.Duration(i)*time.Second), testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 53)
+		require.NoError(t, record(context.Background(), decode(t, p)))
+	}
+	// outside the window of the next packet
+	p := udpPacket(t, testStart, testMAC2, gatewayMAC, "192.168.1.3", "8.8.8.8", 50000, 53)
+	require.NoError(t, record(context.Background(), decode(t, p)))
+	p = udpPacket(t, testStart.Add(5*time.Minute), testMAC2, gatewayMAC, "192.168.1.3", "8.8.8.8", 50000, 53)
+	require.NoError(t, record(context.Background(), decode(t, p)))
+
+	t.Run("not triggered", func(t *testing.T) {
+		path, err := recorder.Trigger(hostmonitor.Change{
+			ChangeType: hostmonitor.IPChange,
+			Addr:       hostmonitor.Addr{MAC: testMAC1},
+			LastSeen:   testStart,
+		})
+		require.NoError(t, err)
+		assert.Empty(t, path)
+	})
+
+	t.Run("ring buffer", func(t *testing.T) {
+		path, err := recorder.Trigger(hostmonitor.Change{
+			ChangeType: hostmonitor.OnlineChange,
+			Addr:       hostmonitor.Addr{MAC: testMAC1},
+			LastSeen:   testStart.Add(4 * time.Second),
+		})
+		require.NoError(t, err)
+		require.NotEmpty(t, path)
+
+		cis := readRecording(t, path)
+		require.Len(t, cis, 3, "only the most recent packets are kept")
+		assert.True(t, testStart.Add(2*time.Second).Equal(cis[0].Timestamp))
+		assert.True(t, testStart.Add(4*time.Second).Equal(cis[2].Timestamp))
+	})
+
+	t.Run("both hosts of a conflict", func(t *testing.T) {
+		path, err := recorder.Trigger(hostmonitor.Change{
+			ChangeType:   hostmonitor.IPConflictChange,
+			Addr:         hostmonitor.Addr{MAC: testMAC2},
+			PreviousAddr: &hostmonitor.Addr{MAC: testMAC1},
+			LastSeen:     testStart.Add(5 * time.Minute),
+		})
+		require.NoError(t, err)
+		require.NotEmpty(t, path)
+
+		// packets of the first host and the old packet of the second host are outside the window
+		cis := readRecording(t, path)
+		require.Len(t, cis, 1)
+		assert.True(t, testStart.Add(5*time.Minute).Equal(cis[0].Timestamp))
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		_, err := recorder.Trigger(hostmonitor.Change{
+			ChangeType: hostmonitor.OnlineChange,
+			Addr:       hostmonitor.Addr{MAC: testMAC2, Interface: "eth1"},
+			LastSeen:   testStart.Add(5*time.Minute + 30*time.Second),
+		})
+		require.NoError(t, err)
+
+		recordings, err := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+		require.NoError(t, err)
+		require.Len(t, recordings, 2)
+		assert.Contains(t, recordings[0], "ip-conflict")
+		assert.Contains(t, recordings[1], "online")
+		assert.True(t, strings.HasSuffix(recordings[1], "-eth1.pcapng"), "tagged with the interface")
+	})
+}
+
+func TestRecorder_Hosts(t *testing.T) {
+	recorder, err := NewRecorder(RecorderConfig{
+		Dir:            t.TempDir(),
+		Triggers:       []hostmonitor.ChangeType{hostmonitor.OnlineChange},
+		PacketsPerHost: 4,
+		MaxHosts:       2,
+		Window:         time.Minute,
+	}, layers.LinkTypeEthernet)
+	require.NoError(t, err)
+
+	record := recorder.Record()
+	handle := func(mac net.HardwareAddr, vlan uint16, ts time.Time) {
+		p := udpPacket(t, ts, mac, layers.EthernetBroadcast, "192.168.1.2", "192.168.1.255", 50000, 9)
+		if vlan != 0 {
+			p = tagged(p, vlan)
+		}
+		require.NoError(t, record(context.Background(), decode(t, p)))
+	}
+	trigger := func(addr hostmonitor.Addr, lastSeen time.Time) []gopacket.CaptureInfo {
+		path, err := recorder.Trigger(hostmonitor.Change{ChangeType: hostmonitor.OnlineChange, Addr: addr, LastSeen: lastSeen})
+		require.NoError(t, err)
+		if path == "" {
+			return nil
+		}
+		return readRecording(t, path)
+	}
+
+	// the same mac on two vlans
+	handle(testMAC1, 10, testStart)
+	handle(testMAC1, 20, testStart.Add(time.Second))
+	handle(testMAC1, 10, testStart.Add(2*time.Minute))
+
+	// the window reaches back from the change rather than the newest packet, packets handled since are kept
+	cis := trigger(hostmonitor.Addr{MAC: testMAC1, VLAN: 10}, testStart.Add(30*time.Second))
+	require.Len(t, cis, 2, "only the packets of the host on vlan 10")
+	assert.True(t, testStart.Equal(cis[0].Timestamp))
+	assert.True(t, testStart.Add(2*time.Minute).Equal(cis[1].Timestamp))
+
+	// a third host drops the packets of the least recently seen one
+	handle(testMAC2, 0, testStart.Add(3*time.Minute))
+	assert.Empty(t, trigger(hostmonitor.Addr{MAC: testMAC1, VLAN: 20}, testStart.Add(3*time.Minute)))
+	assert.Len(t, trigger(hostmonitor.Addr{MAC: testMAC1, VLAN: 10}, testStart.Add(3*time.Minute)), 1)
+	assert.Len(t, trigger(hostmonitor.Addr{MAC: testMAC2}, testStart.Add(3*time.Minute)), 1)
+
+	_, err = NewRecorder(RecorderConfig{Dir: t.TempDir(), PacketsPerHost: 4}, layers.LinkTypeEthernet)
+	assert.Error(t, err)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+)
+
+// pcapng files start with a section header block
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// NewReplayHandle opens a saved pcap or pcapng capture for reading. The format is detected from the file contents.
+// speed controls how fast packets are read: 0 reads as fast as possible, 1 replays in real time, 2 twice as fast, etc.
+// The filter is run over every packet the same way as a live capture, it's skipped if nil or the capture isn't of
+// ethernet frames, which are all the filter matches.
+func NewReplayHandle(path string, speed float64, filter []bpf.Instruction) (gopacket.PacketDataSource, layers.LinkType, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(len(pcapngMagic))
+	if err != nil {
+		f.Close()
+		return nil, 0, nil, fmt.Errorf("reading capture header: %w", err)
+	}
+
+	var (
+		source   gopacket.PacketDataSource
+		linkType layers.LinkType
+	)
+	if bytes.Equal(magic, pcapngMagic) {
+		ng, err := pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			f.Close()
+			return nil, 0, nil, fmt.Errorf("reading pcapng: %w", err)
+		}
+		source, linkType = ng, ng.LinkType()
+	} else {
+		reader, err := pcapgo.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, 0, nil, fmt.Errorf("reading pcap: %w", err)
+		}
+		source, linkType = reader, reader.LinkType()
+	}
+
+	if filter != nil && linkType == layers.LinkTypeEthernet {
+		vm, err := bpf.NewVM(filter)
+		if err != nil {
+			f.Close()
+			return nil, 0, nil, fmt.Errorf("loading filter: %w", err)
+		}
+		source = &filteredSource{source: source, vm: vm}
+	}
+
+	if speed > 0 {
+		source = &pacedSource{
+			source: source,
+			speed:  speed,
+			sleep:  time.Sleep,
+		}
+	}
+
+	return source, linkType, func() { _ = f.Close() }, nil
+}
+
+// filteredSource skips packets rejected by the filter and truncates the rest to the length it returns, as the kernel
+// does for live captures.
+type filteredSource struct {
+	source gopacket.PacketDataSource
+	vm     *bpf.VM
+}
+
+func (f *filteredSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := f.source.ReadPacketData()
+		if err != nil {
+			return data, ci, err
+		}
+
+		n, err := f.vm.Run(data)
+		if err != nil {
+			return nil, ci, fmt.Errorf("running filter: %w", err)
+		}
+		if n == 0 {
+			continue
+		}
+
+		if n < len(data) {
+			data = data[:n]
+			ci.CaptureLength = n
+		}
+		return data, ci, nil
+	}
+}
+
+// pacedSource delays reads from the underlying source so packets are returned at the rate they were captured, scaled
+// by speed.
+type pacedSource struct {
+	source gopacket.PacketDataSource
+	speed  float64
+	sleep  func(time.Duration)
+
+	first time.Time // timestamp of the first packet
+	start time.Time // wall time the first packet was read
+}
+
+func (p *pacedSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := p.source.ReadPacketData()
+	if err != nil {
+		return data, ci, err
+	}
+
+	if p.first.IsZero() {
+		p.first = ci.Timestamp
+		p.start = time.Now()
+		return data, ci, nil
+	}
+
+	offset := time.Duration(float64(ci.Timestamp.Sub(p.first)) / p.speed)
+	if wait := time.Until(p.start.Add(offset)); wait > 0 {
+		p.sleep(wait)
+	}
+
+	return data, ci, nil
+}
+
+// packetClock reports the timestamp of the most recently handled packet. It's used in place of the wall clock so the
+// HostMap follows the time of a replayed capture.
+type packetClock struct {
+	nanos int64
+}
+
+func (c *packetClock) Now() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.nanos))
+}
+
+// advance moves the clock forward to t, it never goes back to an earlier time.
+func (c *packetClock) advance(t time.Time) {
+	nanos := t.UnixNano()
+	for {
+		current := atomic.LoadInt64(&c.nanos)
+		if nanos <= current || atomic.CompareAndSwapInt64(&c.nanos, current, nanos) {
+			return
+		}
+	}
+}
+
+// AdvanceClock moves the clock forward to the timestamp of each frame before passing it to the next handler. Used by
+// each worker, the clock follows the latest frame handled by any of them: with more than one worker a frame may be
+// handled when the clock is already past it, and when depends on how the workers are scheduled.
+func AdvanceClock(clock *packetClock, next frameHandler) frameHandler {
+	return func(ctx context.Context, f frame) error {
+		if ts := f.ci.Timestamp; !ts.IsZero() {
+			clock.advance(ts)
+		}
+
+		return next(ctx, f)
+	}
+}
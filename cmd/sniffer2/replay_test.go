@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testMAC1   = net.HardwareAddr{0x1a, 0x1a, 0x1a, 0x1a, 0x1a, 0x1a}
+	testMAC2   = net.HardwareAddr{0x2a, 0x2a, 0x2a, 0x2a, 0x2a, 0x2a}
+	gatewayMAC = net.HardwareAddr{0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c}
+	testStart  = time.Date(2022, 6, 23, 19, 0, 0, 0, time.UTC)
+)
+
+type testPacket struct {
+	ts     time.Time
+	layers []gopacket.SerializableLayer
+}
+
+// udpPacket builds an ethernet frame carrying a udp datagram from src to dst
+func udpPacket(t testing.TB, ts time.Time, srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP string, srcPort, dstPort uint16, payload ...gopacket.SerializableLayer) testPacket {
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(srcIP).To4(),
+		DstIP:    net.ParseIP(dstIP).To4(),
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+
+	return testPacket{ts: ts, layers: append([]gopacket.SerializableLayer{eth, ip, udp}, payload...)}
+}
+
+// writeCapture writes the packets to a pcap file in a temporary directory, returning the path
+func writeCapture(t *testing.T, packets []testPacket) string {
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	w := pcapgo.NewWriter(f)
+	require.NoError(t, w.WriteFileHeader(snapLen, layers.LinkTypeEthernet))
+
+	for _, p := range packets {
+		buf := gopacket.NewSerializeBuffer()
+		require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, p.layers...))
+		data := buf.Bytes()
+		require.NoError(t, w.WritePacket(gopacket.CaptureInfo{Timestamp: p.ts, CaptureLength: len(data), Length: len(data)}, data))
+	}
+
+	return path
+}
+
+// replay reads the capture through handler decoding the layer types, returning once all packets are handled
+func replay(t *testing.T, path string, clock *packetClock, handler PacketHandler, layerTypes ...gopacket.LayerType) {
+	handle, linkType, closeFunc, err := NewReplayHandle(path, 0, nil)
+	require.NoError(t, err)
+	defer closeFunc()
+
+	decoder := NewLayerDecoder(linkType, layerTypes...)
+	err = readPackets(context.Background(), readFrames(context.Background(), handle), AdvanceClock(clock, decoder.Handler(handler)))
+	require.True(t, errors.Is(err, errPacketsClosed), "unexpected error: %v", err)
+}
+
+func collectChanges(hosts *hostmonitor.HostMap) []hostmonitor.Change {
+	hosts.Close()
+	var changes []hostmonitor.Change
+	for change := range hosts.Notifications() {
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func TestReplay(t *testing.T) {
+	dhcp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		ClientHWAddr: testMAC2,
+		Options: layers.DHCPOptions{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeRequest)}),
+			layers.NewDHCPOption(layers.DHCPOptHostname, []byte("foo")),
+		},
+	}
+
+	path := writeCapture(t, []testPacket{
+		udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 53),
+		udpPacket(t, testStart.Add(time.Second), testMAC2, layers.EthernetBroadcast, "0.0.0.0", "255.255.255.255", 68, 67, dhcp),
+		udpPacket(t, testStart.Add(2*time.Second), testMAC2, gatewayMAC, "192.168.1.3", "8.8.8.8", 50000, 53),
+		// first host has been silent for longer than the offline timeout
+		udpPacket(t, testStart.Add(10*time.Minute), testMAC2, gatewayMAC, "192.168.1.3", "8.8.8.8", 50000, 53),
+	})
+
+	clock := &packetClock{}
+	hosts := hostmonitor.NewHostMap(hostmonitor.ClockOption(clock.Now))
+	hostNames := NewMacHostMap()
+
+	updateHosts, updateHostNames := UpdateHosts(hosts, nil), UpdateHostNames(hosts, hostNames, DefaultFingerprints())
+	replay(t, path, clock, func(ctx context.Context, packet gopacket.Packet) error {
+		if err := updateHosts(ctx, packet); err != nil {
+			return err
+		}
+		return updateHostNames(ctx, packet)
+	}, layerSet(hostLayers, dhcpLayers)...)
+
+	assert.Equal(t, "foo", hostNames.Get(hostmonitor.Addr{MAC: testMAC2}))
+	assert.Equal(t, testStart.Add(10*time.Minute), clock.Now().UTC())
+
+	changes := collectChanges(hosts)
+	require.Len(t, changes, 3)
+
+	assert.Equal(t, hostmonitor.OnlineChange, changes[0].ChangeType)
+	assert.Equal(t, testMAC1, changes[0].Addr.MAC)
+	assert.True(t, testStart.Equal(changes[0].LastSeen))
+
+	assert.Equal(t, hostmonitor.OnlineChange, changes[1].ChangeType)
+	assert.Equal(t, testMAC2, changes[1].Addr.MAC)
+	assert.True(t, testStart.Add(2*time.Second).Equal(changes[1].LastSeen))
+
+	assert.Equal(t, hostmonitor.OfflineChange, changes[2].ChangeType)
+	assert.Equal(t, testMAC1, changes[2].Addr.MAC)
+	assert.True(t, testStart.Equal(changes[2].LastSeen))
+}
+
+func TestPacedSource(t *testing.T) {
+	path := writeCapture(t, []testPacket{
+		udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 53),
+		udpPacket(t, testStart.Add(time.Second), testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 53),
+	})
+
+	handle, _, closeFunc, err := NewReplayHandle(path, 4, nil)
+	require.NoError(t, err)
+	defer closeFunc()
+
+	var slept time.Duration
+	paced := handle.(*pacedSource)
+	paced.sleep = func(d time.Duration) { slept += d }
+
+	for i := 0; i < 2; i++ {
+		_, _, err := paced.ReadPacketData()
+		require.NoError(t, err)
+	}
+
+	// a second apart at four times speed
+	assert.InDelta(t, 250*time.Millisecond, slept, float64(50*time.Millisecond))
+}
+
+func TestAdvanceClock(t *testing.T) {
+	clock := &packetClock{}
+	var seen []time.Time
+	handler := AdvanceClock(clock, func(context.Context, frame) error {
+		seen = append(seen, clock.Now().UTC())
+		return nil
+	})
+
+	for _, offset := range []time.Duration{time.Second, 3 * time.Second, 2 * time.Second} {
+		require.NoError(t, handler(context.Background(), frame{ci: gopacket.CaptureInfo{Timestamp: testStart.Add(offset)}}))
+	}
+	// frames without a timestamp don't move it
+	require.NoError(t, handler(context.Background(), frame{}))
+
+	// a frame handled late by another worker doesn't turn it back
+	assert.Equal(t, []time.Time{testStart.Add(time.Second), testStart.Add(3 * time.Second), testStart.Add(3 * time.Second),
+		testStart.Add(3 * time.Second)}, seen)
+}
+
+// scriptedSource returns the errors in turn, nil errors return a packet
+type scriptedSource struct {
+	errs []error
+}
+
+func (s *scriptedSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(s.errs) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+	return []byte{1}, gopacket.CaptureInfo{CaptureLength: 1, Length: 1}, nil
+}
+
+func TestReadFrames(t *testing.T) {
+	source := &scriptedSource{errs: []error{
+		nil,
+		fmt.Errorf("reading: %w", os.ErrDeadlineExceeded),
+		syscall.EAGAIN,
+		// as pcapgo reports a read that was interrupted
+		fmt.Errorf("couldn't read packet data: %s", fmt.Errorf("couldn't read packet: %s", syscall.EINTR)),
+		nil,
+		fmt.Errorf("couldn't read packet data: %s", fmt.Errorf("couldn't read packet: %s", syscall.EBADF)),
+		nil,
+	}}
+
+	var frames int
+	for range readFrames(context.Background(), source) {
+		frames++
+	}
+	assert.Equal(t, 2, frames, "timeouts are retried, reading stops on any other error")
+}
+
+// endlessSource always returns a packet
+type endlessSource struct{}
+
+func (endlessSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return []byte{1}, gopacket.CaptureInfo{CaptureLength: 1, Length: 1}, nil
+}
+
+func TestReadFrames_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	frames := readFrames(ctx, endlessSource{})
+	<-frames
+
+	// sending the frames stops with the context even if nothing reads them anymore
+	cancel()
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for range frames {
+		}
+	}()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("frames still sent after the context was canceled")
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+// ServicesMetadataKey is the HostMap metadata key the services advertised by a host are stored under, as a []Service.
+const ServicesMetadataKey = "services"
+
+// the pointer record listing the service types on the network, rather than service instances
+const serviceTypesName = "_services._dns-sd._udp.local"
+
+// TXT keys devices commonly use for their model and firmware version
+var (
+	modelKeys    = []string{"model", "md", "ty", "usb_MDL", "am"}
+	firmwareKeys = []string{"fv", "firmware", "srcvers", "osxvers"}
+)
+
+// Service is a DNS-SD service instance advertised by a host, e.g. "Living Room._airplay._tcp.local".
+type Service struct {
+	// Instance is the full name of the service instance.
+	Instance string
+	// Type is the service type and protocol, e.g. "_airplay._tcp".
+	Type string
+	// Host and Port are where the service can be reached, from the SRV record.
+	Host string
+	Port uint16
+	// TXT holds the key/value pairs of the TXT record.
+	TXT map[string]string
+
+	Addr    hostmonitor.Addr
+	Expires time.Time
+}
+
+// Name returns the user friendly name of the instance, e.g. "Living Room".
+func (s Service) Name() string {
+	return strings.TrimSuffix(s.Instance, "."+s.Type+localDomain)
+}
+
+// Model returns the device model from the TXT record, if advertised.
+func (s Service) Model() string {
+	return firstTXT(s.TXT, modelKeys)
+}
+
+// Firmware returns the firmware version from the TXT record, if advertised.
+func (s Service) Firmware() string {
+	return firstTXT(s.TXT, firmwareKeys)
+}
+
+func (s Service) String() string {
+	str := fmt.Sprintf("%s (%s)", s.Name(), s.Type)
+	if s.Host != "" {
+		str += fmt.Sprintf(" host=(%s:%d)", s.Host, s.Port)
+	}
+	if model := s.Model(); model != "" {
+		str += fmt.Sprintf(" model=(%s)", model)
+	}
+	if firmware := s.Firmware(); firmware != "" {
+		str += fmt.Sprintf(" firmware=(%s)", firmware)
+	}
+	return str
+}
+
+func firstTXT(txt map[string]string, keys []string) string {
+	for _, key := range keys {
+		if value := txt[key]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// ServiceCatalog keeps track of the DNS-SD services advertised by each host. The services of a host are published to
+// the HostMap metadata and changes are emitted through its notifications when services appear or disappear.
+type ServiceCatalog struct {
+	hosts    *hostmonitor.HostMap
+	services map[string]map[string]*Service
+	mux      *sync.Mutex
+}
+
+func NewServiceCatalog(hosts *hostmonitor.HostMap) *ServiceCatalog {
+	return &ServiceCatalog{
+		hosts:    hosts,
+		services: make(map[string]map[string]*Service),
+		mux:      &sync.Mutex{},
+	}
+}
+
+// Update adds the service to the catalog or refreshes it if already known, returning true if it was added. A service
+// without an expiry only came with a TXT record, it refreshes a known service and is otherwise ignored.
+func (c *ServiceCatalog) Update(service Service) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	host := service.Addr.HostKey()
+	existing, ok := c.services[host][service.Instance]
+	if !ok && service.Expires.IsZero() {
+		return false
+	}
+
+	services, found := c.services[host]
+	if !found {
+		services = make(map[string]*Service)
+		c.services[host] = services
+	}
+
+	if ok {
+		// announcements don't always repeat every record
+		if service.Expires.IsZero() {
+			service.Expires = existing.Expires
+		}
+		if service.Host == "" {
+			service.Host, service.Port = existing.Host, existing.Port
+		}
+		if service.TXT == nil {
+			service.TXT = existing.TXT
+		}
+	}
+	services[service.Instance] = &service
+	c.publish(service.Addr)
+
+	if !ok {
+		c.hosts.Emit(hostmonitor.Change{
+			ChangeType: hostmonitor.ServiceAddedChange,
+			Addr:       service.Addr,
+			Online:     true,
+			Detail:     service.String(),
+		})
+	}
+	return !ok
+}
+
+// Remove removes the service instance advertised by the host of addr, its MAC on its VLAN, returning true if it was
+// known.
+func (c *ServiceCatalog) Remove(addr hostmonitor.Addr, instance string, seen time.Time) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	service, ok := c.services[addr.HostKey()][instance]
+	if !ok {
+		return false
+	}
+
+	c.remove(service, seen)
+	c.publish(addr)
+	return true
+}
+
+// Expire removes the services whose records have expired without being announced again.
+func (c *ServiceCatalog) Expire(now time.Time) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, services := range c.services {
+		var (
+			addr    hostmonitor.Addr
+			removed bool
+		)
+		for _, service := range services {
+			if now.Before(service.Expires) {
+				continue
+			}
+			addr, removed = service.Addr, true
+			c.remove(service, now)
+		}
+		if removed {
+			c.publish(addr)
+		}
+	}
+}
+
+// Services returns the services advertised by the host of addr, its MAC on its VLAN, ordered by instance name.
+func (c *ServiceCatalog) Services(addr hostmonitor.Addr) []Service {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.list(addr.HostKey())
+}
+
+// remove deletes the service and emits its removal. The lock must be held.
+func (c *ServiceCatalog) remove(service *Service, seen time.Time) {
+	delete(c.services[service.Addr.HostKey()], service.Instance)
+	c.hosts.Emit(hostmonitor.Change{
+		ChangeType: hostmonitor.ServiceRemovedChange,
+		Addr:       service.Addr,
+		Online:     true,
+		LastSeen:   seen,
+		Detail:     service.String(),
+	})
+}
+
+// publish copies the services of the host to the HostMap metadata. The lock must be held.
+func (c *ServiceCatalog) publish(addr hostmonitor.Addr) {
+	services := c.list(addr.HostKey())
+	if len(services) == 0 {
+		delete(c.services, addr.HostKey())
+		c.hosts.SetMetadata(addr, ServicesMetadataKey, nil)
+		return
+	}
+
+	c.hosts.SetMetadata(addr, ServicesMetadataKey, services)
+}
+
+// list returns a copy of the services of the host. The lock must be held.
+func (c *ServiceCatalog) list(host string) []Service {
+	services := make([]Service, 0, len(c.services[host]))
+	for _, service := range c.services[host] {
+		services = append(services, *service)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Instance < services[j].Instance
+	})
+
+	return services
+}
+
+// UpdateServicesFromMDNS builds the catalog of DNS-SD services hosts advertise over multicast DNS. An instance is
+// learned from the pointer record of its service type along with its SRV and TXT records, which are usually sent in the
+// same response. Records with a TTL of zero are goodbyes and remove the instance, instances that aren't announced
+// again before their records expire are removed too.
+func UpdateServicesFromMDNS(catalog *ServiceCatalog) PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		msg, eth, srcIP, ok := decodeDNS(packet, mdnsPort)
+		if !ok || !msg.QR {
+			// nothing to do - not an mDNS response
+			return nil
+		}
+
+		seen := packet.Metadata().Timestamp
+		addr := newAddr(packet, eth.SrcMAC, srcIP)
+
+		instances := make(map[string]*Service)
+		goodbyes := make(map[string]bool)
+		// instance returns the service being built for the instance name, or nil if it isn't the name of an instance
+		instance := func(name string) *Service {
+			serviceType, ok := parseInstanceName(name)
+			if !ok {
+				return nil
+			}
+			if service, ok := instances[name]; ok {
+				return service
+			}
+
+			service := &Service{Instance: name, Type: serviceType, Addr: addr}
+			instances[name] = service
+			return service
+		}
+		expires := func(service *Service, ttl uint32) {
+			if ttl == 0 {
+				goodbyes[service.Instance] = true
+				return
+			}
+			if expiry := seen.Add(time.Duration(ttl) * time.Second); expiry.After(service.Expires) {
+				service.Expires = expiry
+			}
+		}
+
+		for _, rr := range append(msg.Answers, msg.Additionals...) {
+			switch rr.Type {
+			case layers.DNSTypePTR:
+				if string(rr.Name) == serviceTypesName {
+					continue
+				}
+				if service := instance(string(rr.PTR)); service != nil {
+					expires(service, rr.TTL)
+				}
+			case layers.DNSTypeSRV:
+				if service := instance(string(rr.Name)); service != nil {
+					service.Host, service.Port = string(rr.SRV.Name), rr.SRV.Port
+					expires(service, rr.TTL)
+				}
+			case layers.DNSTypeTXT:
+				if service := instance(string(rr.Name)); service != nil {
+					service.TXT = parseTXT(rr.TXTs)
+				}
+			}
+		}
+
+		for name, service := range instances {
+			if goodbyes[name] {
+				if catalog.Remove(addr, name, seen) {
+					log.Printf("mdns service removed by %s(ip=%s): %s", addr.MAC, addr.IP, service)
+				}
+				continue
+			}
+			if catalog.Update(*service) {
+				log.Printf("mdns service from %s(ip=%s): %s", addr.MAC, addr.IP, service)
+			}
+		}
+
+		catalog.Expire(seen)
+		return nil
+	}
+}
+
+// parseInstanceName returns the service type of a service instance name, e.g. "_airplay._tcp" for
+// "Living Room._airplay._tcp.local".
+func parseInstanceName(name string) (string, bool) {
+	name = strings.TrimSuffix(name, ".")
+	if !strings.HasSuffix(name, localDomain) {
+		return "", false
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, localDomain), ".")
+	if len(labels) < 3 {
+		return "", false
+	}
+
+	service, proto := labels[len(labels)-2], labels[len(labels)-1]
+	if !strings.HasPrefix(service, "_") || (proto != "_tcp" && proto != "_udp") || labels[len(labels)-3] == "_sub" {
+		return "", false
+	}
+
+	return service + "." + proto, true
+}
+
+// parseTXT parses the key=value strings of a TXT record. Keys without a value are present with an empty value.
+func parseTXT(txt [][]byte) map[string]string {
+	values := make(map[string]string, len(txt))
+	for _, entry := range txt {
+		key, value, _ := strings.Cut(string(entry), "=")
+		if key == "" {
+			continue
+		}
+		if _, ok := values[key]; !ok {
+			// only the first occurrence of a key counts
+			values[key] = value
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateServicesFromMDNS(t *testing.T) {
+	hosts := hostmonitor.NewHostMap()
+	handler := UpdateServicesFromMDNS(NewServiceCatalog(hosts))
+
+	handle := func(ts time.Time, answers ...layers.DNSResourceRecord) {
+		p := udpPacket(t, ts, testMAC1, mdnsMAC, "192.168.1.10", "224.0.0.251", mdnsPort, mdnsPort,
+			&layers.DNS{QR: true, AA: true, Answers: answers})
+		require.NoError(t, handler(context.Background(), decode(t, p)))
+	}
+	services := func() []Service {
+		value, ok := hosts.Metadata(hostmonitor.Addr{MAC: testMAC1}, ServicesMetadataKey)
+		if !ok {
+			return nil
+		}
+		return value.([]Service)
+	}
+
+	const instance = "Living Room._airplay._tcp.local"
+	ptr := func(ttl uint32) layers.DNSResourceRecord {
+		return layers.DNSResourceRecord{Name: []byte("_airplay._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: ttl, PTR: []byte(instance)}
+	}
+
+	handle(testStart,
+		layers.DNSResourceRecord{Name: []byte(serviceTypesName), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: 4500, PTR: []byte("_airplay._tcp.local")},
+		ptr(4500),
+		layers.DNSResourceRecord{Name: []byte(instance), Type: layers.DNSTypeSRV, Class: layers.DNSClassIN, TTL: 120, SRV: layers.DNSSRV{Port: 7000, Name: []byte("foo.local")}},
+		layers.DNSResourceRecord{Name: []byte(instance), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN, TTL: 4500, TXTs: [][]byte{[]byte("model=AppleTV5,3"), []byte("srcvers=220.68")}},
+	)
+
+	require.Len(t, services(), 1)
+	service := services()[0]
+	assert.Equal(t, "Living Room", service.Name())
+	assert.Equal(t, "_airplay._tcp", service.Type)
+	assert.Equal(t, "foo.local", service.Host)
+	assert.Equal(t, uint16(7000), service.Port)
+	assert.Equal(t, "AppleTV5,3", service.Model())
+	assert.Equal(t, "220.68", service.Firmware())
+	assert.Equal(t, testStart.Add(4500*time.Second), service.Expires)
+
+	// a TXT update keeps the rest of the service
+	handle(testStart.Add(time.Minute),
+		layers.DNSResourceRecord{Name: []byte(instance), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN, TTL: 4500, TXTs: [][]byte{[]byte("model=AppleTV5,3"), []byte("srcvers=230.1")}},
+	)
+	require.Len(t, services(), 1)
+	assert.Equal(t, "230.1", services()[0].Firmware())
+	assert.Equal(t, uint16(7000), services()[0].Port)
+
+	// goodbye
+	handle(testStart.Add(2*time.Minute), ptr(0))
+	assert.Empty(t, services())
+
+	// announced again, then expires
+	handle(testStart.Add(3*time.Minute), ptr(120))
+	require.Len(t, services(), 1)
+	handle(testStart.Add(10 * time.Minute))
+	assert.Empty(t, services())
+
+	changes := collectChanges(hosts)
+	var types []hostmonitor.ChangeType
+	for _, change := range changes {
+		types = append(types, change.ChangeType)
+	}
+	assert.Equal(t, []hostmonitor.ChangeType{
+		hostmonitor.ServiceAddedChange,
+		hostmonitor.ServiceRemovedChange,
+		hostmonitor.ServiceAddedChange,
+		hostmonitor.ServiceRemovedChange,
+	}, types)
+	assert.Equal(t, "Living Room (_airplay._tcp) host=(foo.local:7000) model=(AppleTV5,3) firmware=(220.68)", changes[0].Detail)
+	assert.Equal(t, testStart.Add(10*time.Minute), changes[3].LastSeen)
+}
+
+func TestParseInstanceName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Living Room._airplay._tcp.local", "_airplay._tcp"},
+		{"Printer.with.dots._ipp._tcp.local.", "_ipp._tcp"},
+		{"_airplay._tcp.local", ""},
+		{"_printer._sub._http._tcp.local", ""},
+		{"foo.local", ""},
+		{"Living Room._airplay._tcp.example.com", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serviceType, ok := parseInstanceName(test.name)
+			assert.Equal(t, test.want != "", ok)
+			assert.Equal(t, test.want, serviceType)
+		})
+	}
+}
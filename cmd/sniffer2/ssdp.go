@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+const ssdpPort = 1900
+
+// SSDPMetadataKey is the HostMap metadata key the SSDP announcements of a host are stored under, as an SSDPInfo.
+const SSDPMetadataKey = "ssdp"
+
+// limits of fetching device descriptions
+const (
+	ssdpFetchTimeout        = 5 * time.Second
+	ssdpMaxDescriptionBytes = 1 << 20
+	// the most descriptions fetched at once, announcements of locations beyond it are fetched when next announced
+	ssdpMaxFetches = 4
+	// a location that failed isn't fetched again for the backoff, doubled after every failure up to the max
+	ssdpFetchBackoff    = time.Minute
+	ssdpMaxFetchBackoff = time.Hour
+	ssdpMaxRedirects    = 10
+)
+
+// SSDPInfo is what a host announces about itself over SSDP.
+type SSDPInfo struct {
+	// Server identifies the OS and UPnP stack of the host, e.g. "Linux/3.14 UPnP/1.0 Sonos/63.2".
+	Server string
+	// Location is the URL of the device description.
+	Location string
+	// Announcements maps the unique service names (USN) of the host to their device or service type, e.g.
+	// "urn:schemas-upnp-org:device:MediaRenderer:1".
+	Announcements map[string]string
+
+	// Description is fetched from the Location, if enabled.
+	Description *DeviceDescription
+}
+
+// Types returns the device and service types announced by the host, sorted.
+func (i SSDPInfo) Types() []string {
+	seen := make(map[string]bool)
+	var types []string
+	for _, nt := range i.Announcements {
+		if nt != "" && !seen[nt] {
+			seen[nt] = true
+			types = append(types, nt)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// USNs returns the unique service names announced by the host, sorted.
+func (i SSDPInfo) USNs() []string {
+	usns := make([]string, 0, len(i.Announcements))
+	for usn := range i.Announcements {
+		usns = append(usns, usn)
+	}
+	sort.Strings(usns)
+	return usns
+}
+
+// DeviceDescription is the root device of a UPnP device description.
+type DeviceDescription struct {
+	DeviceType   string `xml:"device>deviceType"`
+	FriendlyName string `xml:"device>friendlyName"`
+	Manufacturer string `xml:"device>manufacturer"`
+	ModelName    string `xml:"device>modelName"`
+	ModelNumber  string `xml:"device>modelNumber"`
+}
+
+func (d DeviceDescription) String() string {
+	return fmt.Sprintf("name=(%s) manufacturer=(%s) model=(%s %s)",
+		d.FriendlyName, d.Manufacturer, d.ModelName, d.ModelNumber)
+}
+
+// ssdpMessage is a NOTIFY or an M-SEARCH response.
+type ssdpMessage struct {
+	// Type is the NT of a NOTIFY or the ST of a response.
+	Type     string
+	USN      string
+	Server   string
+	Location string
+	// ByeBye is set for NOTIFY messages of a device leaving the network.
+	ByeBye bool
+}
+
+// SSDPCatalog keeps the SSDP announcements of each host in the HostMap metadata and fetches the device descriptions
+// they point to, if a client is given.
+type SSDPCatalog struct {
+	hosts  *hostmonitor.HostMap
+	client *http.Client
+
+	fetches map[string]*descriptionFetch
+	// holds a slot for every fetch in flight
+	slots chan struct{}
+	now   func() time.Time
+	mux   *sync.Mutex
+}
+
+// descriptionFetch is the state of fetching the description at a location.
+type descriptionFetch struct {
+	// in flight or fetched, a fetched location isn't fetched again
+	fetching, fetched bool
+	failures          int
+	// when the location can be fetched again after failing
+	retry time.Time
+}
+
+// due returns whether the location can be fetched at now.
+func (f *descriptionFetch) due(now time.Time) bool {
+	return !f.fetching && !f.fetched && !now.Before(f.retry)
+}
+
+// failed backs off fetching the location again.
+func (f *descriptionFetch) failed(now time.Time) {
+	backoff := ssdpFetchBackoff
+	for i := 0; i < f.failures && backoff < ssdpMaxFetchBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > ssdpMaxFetchBackoff {
+		backoff = ssdpMaxFetchBackoff
+	}
+	f.failures++
+	f.retry = now.Add(backoff)
+}
+
+// NewSSDPCatalog creates a catalog for the hosts. Device descriptions are only fetched if client isn't nil.
+func NewSSDPCatalog(hosts *hostmonitor.HostMap, client *http.Client) *SSDPCatalog {
+	return &SSDPCatalog{
+		hosts:   hosts,
+		client:  client,
+		fetches: make(map[string]*descriptionFetch),
+		slots:   make(chan struct{}, ssdpMaxFetches),
+		now:     time.Now,
+		mux:     &sync.Mutex{},
+	}
+}
+
+// NewSSDPClient returns a client for fetching device descriptions with a short timeout. Redirects are only followed
+// to the host the description was announced by.
+func NewSSDPClient() *http.Client {
+	return &http.Client{Timeout: ssdpFetchTimeout, CheckRedirect: checkSSDPRedirect}
+}
+
+// checkSSDPRedirect rejects redirects to anywhere but the host the first request was sent to, so descriptions are
+// only ever fetched from the host that announced them.
+func checkSSDPRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= ssdpMaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", ssdpMaxRedirects)
+	}
+	if req.URL.Scheme != "http" || req.URL.Host != via[0].URL.Host {
+		return fmt.Errorf("redirected away from %s to %s", via[0].URL.Host, req.URL.Redacted())
+	}
+	return nil
+}
+
+// Update records the message announced by the host of addr, its MAC on its VLAN, returning true if the USN is new.
+func (c *SSDPCatalog) Update(addr hostmonitor.Addr, msg ssdpMessage) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	info := c.info(addr)
+	_, known := info.Announcements[msg.USN]
+	if msg.ByeBye {
+		delete(info.Announcements, msg.USN)
+	} else {
+		if msg.Server != "" {
+			info.Server = msg.Server
+		}
+		if msg.Location != "" {
+			info.Location = msg.Location
+		}
+		info.Announcements[msg.USN] = msg.Type
+	}
+	c.hosts.SetMetadata(addr, SSDPMetadataKey, info)
+
+	if c.client != nil && msg.Location != "" && localURL(msg.Location, addr.IP) {
+		c.startFetch(addr, msg.Location)
+	}
+
+	return !known && !msg.ByeBye
+}
+
+// info returns a copy of the current info of the host, the metadata is shared so is never modified. The lock must be
+// held.
+func (c *SSDPCatalog) info(addr hostmonitor.Addr) SSDPInfo {
+	info := SSDPInfo{Announcements: make(map[string]string)}
+	if value, ok := c.hosts.Metadata(addr, SSDPMetadataKey); ok {
+		existing := value.(SSDPInfo)
+		info.Server, info.Location, info.Description = existing.Server, existing.Location, existing.Description
+		for usn, nt := range existing.Announcements {
+			info.Announcements[usn] = nt
+		}
+	}
+	return info
+}
+
+// startFetch fetches the description at location in the background, unless it was already fetched, failed recently or
+// too many fetches are in flight. The lock must be held.
+func (c *SSDPCatalog) startFetch(addr hostmonitor.Addr, location string) {
+	fetch, ok := c.fetches[location]
+	if !ok {
+		fetch = &descriptionFetch{}
+		c.fetches[location] = fetch
+	}
+	if !fetch.due(c.now()) {
+		return
+	}
+
+	select {
+	case c.slots <- struct{}{}:
+	default:
+		return
+	}
+	fetch.fetching = true
+	addr.MAC = append(net.HardwareAddr(nil), addr.MAC...)
+	go c.fetch(addr, location)
+}
+
+// fetch gets the device description at location and adds it to the info of the host.
+func (c *SSDPCatalog) fetch(addr hostmonitor.Addr, location string) {
+	description, err := fetchDeviceDescription(c.client, location)
+	<-c.slots
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	fetch := c.fetches[location]
+	fetch.fetching = false
+	if err != nil {
+		fetch.failed(c.now())
+		log.Printf("failed fetching ssdp device description of %s from %s: %s", addr.MAC, location, err)
+		return
+	}
+	fetch.fetched = true
+
+	info := c.info(addr)
+	info.Description = &description
+	c.hosts.SetMetadata(addr, SSDPMetadataKey, info)
+
+	log.Printf("ssdp device description of %s: %s", addr.MAC, description)
+}
+
+func fetchDeviceDescription(client *http.Client, location string) (DeviceDescription, error) {
+	resp, err := client.Get(location)
+	if err != nil {
+		return DeviceDescription{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return DeviceDescription{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var description DeviceDescription
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, ssdpMaxDescriptionBytes)).Decode(&description); err != nil {
+		return DeviceDescription{}, fmt.Errorf("decoding description: %w", err)
+	}
+	return description, nil
+}
+
+// localURL returns true if the url is served over http by the host that sent it, descriptions aren't fetched from
+// anywhere else.
+func localURL(location string, ip netip.Addr) bool {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "http" {
+		return false
+	}
+
+	host, err := netip.ParseAddr(u.Hostname())
+	return err == nil && host.Unmap() == ip
+}
+
+// UpdateDevicesFromSSDP watches the SSDP NOTIFY messages and M-SEARCH responses of UPnP devices, recording the server
+// string, device and service types and unique service names each host announces.
+func UpdateDevicesFromSSDP(catalog *SSDPCatalog) PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok || (udp.SrcPort != ssdpPort && udp.DstPort != ssdpPort) {
+			// nothing to do - not an SSDP packet
+			return nil
+		}
+
+		// notifications are sent to the port, search responses from it
+		eth, srcIP, ok := packetSource(packet)
+		if !ok {
+			return nil
+		}
+
+		msg, ok := parseSSDP(udp.Payload)
+		if !ok {
+			// a search request or not SSDP at all
+			return nil
+		}
+
+		if catalog.Update(newAddr(packet, eth.SrcMAC, srcIP), msg) {
+			log.Printf("ssdp from %s(ip=%s), server=(%s), type=(%s), usn=(%s)",
+				eth.SrcMAC, srcIP, msg.Server, msg.Type, msg.USN)
+		}
+
+		return nil
+	}
+}
+
+// parseSSDP parses a NOTIFY message or an M-SEARCH response, anything else isn't an announcement.
+func parseSSDP(payload []byte) (ssdpMessage, bool) {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(payload)))
+	startLine, err := reader.ReadLine()
+	if err != nil {
+		return ssdpMessage{}, false
+	}
+
+	var notify bool
+	switch {
+	case strings.HasPrefix(startLine, "NOTIFY * HTTP/1."):
+		notify = true
+	case strings.HasPrefix(startLine, "HTTP/1.") && strings.Contains(startLine, " 200"):
+	default:
+		return ssdpMessage{}, false
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return ssdpMessage{}, false
+	}
+
+	msg := ssdpMessage{
+		USN:      header.Get("USN"),
+		Server:   header.Get("Server"),
+		Location: header.Get("Location"),
+	}
+	if notify {
+		msg.Type = header.Get("NT")
+		msg.ByeBye = header.Get("NTS") == "ssdp:byebye"
+	} else {
+		msg.Type = header.Get("ST")
+	}
+
+	if msg.USN == "" {
+		return ssdpMessage{}, false
+	}
+	return msg, true
+}
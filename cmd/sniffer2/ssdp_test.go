@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	ssdpUSN    = "uuid:4d696e69-444c-164e-9d41-b827eb1a1a1a::urn:schemas-upnp-org:device:MediaRenderer:1"
+	ssdpServer = "Linux/4.9 UPnP/1.0 Sonos/63.2"
+)
+
+func ssdpNotify(nts, location string) gopacket.Payload {
+	return gopacket.Payload(strings.Join([]string{
+		"NOTIFY * HTTP/1.1",
+		"HOST: 239.255.255.250:1900",
+		"CACHE-CONTROL: max-age=1800",
+		"LOCATION: " + location,
+		"NT: urn:schemas-upnp-org:device:MediaRenderer:1",
+		"NTS: " + nts,
+		"SERVER: " + ssdpServer,
+		"USN: " + ssdpUSN,
+		"", "",
+	}, "\r\n"))
+}
+
+func TestParseSSDP(t *testing.T) {
+	msg, ok := parseSSDP(ssdpNotify("ssdp:alive", "http://192.168.1.10:1400/xml/device_description.xml"))
+	require.True(t, ok)
+	assert.Equal(t, ssdpMessage{
+		Type:     "urn:schemas-upnp-org:device:MediaRenderer:1",
+		USN:      ssdpUSN,
+		Server:   ssdpServer,
+		Location: "http://192.168.1.10:1400/xml/device_description.xml",
+	}, msg)
+
+	msg, ok = parseSSDP(ssdpNotify("ssdp:byebye", ""))
+	require.True(t, ok)
+	assert.True(t, msg.ByeBye)
+
+	// header names aren't case sensitive
+	msg, ok = parseSSDP([]byte("HTTP/1.1 200 OK\r\nst: upnp:rootdevice\r\nusn: uuid:1234::upnp:rootdevice\r\nServer: Roku/9.4 UPnP/1.0\r\n\r\n"))
+	require.True(t, ok)
+	assert.Equal(t, "upnp:rootdevice", msg.Type)
+	assert.Equal(t, "Roku/9.4 UPnP/1.0", msg.Server)
+
+	_, ok = parseSSDP([]byte("M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nST: ssdp:all\r\n\r\n"))
+	assert.False(t, ok, "search requests aren't announcements")
+}
+
+func TestUpdateDevicesFromSSDP(t *testing.T) {
+	hosts := hostmonitor.NewHostMap()
+	handler := UpdateDevicesFromSSDP(NewSSDPCatalog(hosts, nil))
+
+	notify := udpPacket(t, testStart, testMAC1, mdnsMAC, "192.168.1.10", "239.255.255.250", 50000, ssdpPort,
+		ssdpNotify("ssdp:alive", "http://192.168.1.10:1400/xml/device_description.xml"))
+	require.NoError(t, handler(context.Background(), decode(t, notify)))
+
+	response := udpPacket(t, testStart, testMAC1, testMAC2, "192.168.1.10", "192.168.1.11", ssdpPort, 50000,
+		gopacket.Payload("HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nUSN: uuid:4d696e69::upnp:rootdevice\r\n\r\n"))
+	require.NoError(t, handler(context.Background(), decode(t, response)))
+
+	value, ok := hosts.Metadata(hostmonitor.Addr{MAC: testMAC1}, SSDPMetadataKey)
+	require.True(t, ok)
+	info := value.(SSDPInfo)
+	assert.Equal(t, ssdpServer, info.Server)
+	assert.Equal(t, "http://192.168.1.10:1400/xml/device_description.xml", info.Location)
+	assert.Equal(t, []string{"upnp:rootdevice", "urn:schemas-upnp-org:device:MediaRenderer:1"}, info.Types())
+	assert.Equal(t, []string{ssdpUSN, "uuid:4d696e69::upnp:rootdevice"}, info.USNs())
+
+	byebye := udpPacket(t, testStart, testMAC1, mdnsMAC, "192.168.1.10", "239.255.255.250", 50000, ssdpPort,
+		ssdpNotify("ssdp:byebye", ""))
+	require.NoError(t, handler(context.Background(), decode(t, byebye)))
+
+	value, _ = hosts.Metadata(hostmonitor.Addr{MAC: testMAC1}, SSDPMetadataKey)
+	assert.Equal(t, []string{"uuid:4d696e69::upnp:rootdevice"}, value.(SSDPInfo).USNs())
+}
+
+func TestUpdateDevicesFromSSDP_Description(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:ZonePlayer:1</deviceType>
+    <friendlyName>Living Room</friendlyName>
+    <manufacturer>Sonos, Inc.</manufacturer>
+    <modelName>Sonos One</modelName>
+    <modelNumber>S18</modelNumber>
+  </device>
+</root>`)
+	}))
+	defer server.Close()
+
+	hosts := hostmonitor.NewHostMap()
+	handler := UpdateDevicesFromSSDP(NewSSDPCatalog(hosts, NewSSDPClient()))
+
+	// the server is on the loopback address, so only announcements from it are fetched
+	elsewhere := udpPacket(t, testStart, testMAC2, mdnsMAC, "192.168.1.11", "239.255.255.250", 50000, ssdpPort,
+		ssdpNotify("ssdp:alive", server.URL+"/description.xml"))
+	require.NoError(t, handler(context.Background(), decode(t, elsewhere)))
+
+	notify := udpPacket(t, testStart, testMAC1, mdnsMAC, "127.0.0.1", "239.255.255.250", 50000, ssdpPort,
+		ssdpNotify("ssdp:alive", server.URL+"/description.xml"))
+	require.NoError(t, handler(context.Background(), decode(t, notify)))
+
+	require.Eventually(t, func() bool {
+		value, _ := hosts.Metadata(hostmonitor.Addr{MAC: testMAC1}, SSDPMetadataKey)
+		return value.(SSDPInfo).Description != nil
+	}, time.Second, 10*time.Millisecond)
+
+	value, _ := hosts.Metadata(hostmonitor.Addr{MAC: testMAC1}, SSDPMetadataKey)
+	assert.Equal(t, DeviceDescription{
+		DeviceType:   "urn:schemas-upnp-org:device:ZonePlayer:1",
+		FriendlyName: "Living Room",
+		Manufacturer: "Sonos, Inc.",
+		ModelName:    "Sonos One",
+		ModelNumber:  "S18",
+	}, *value.(SSDPInfo).Description)
+
+	value, _ = hosts.Metadata(hostmonitor.Addr{MAC: testMAC2}, SSDPMetadataKey)
+	assert.Nil(t, value.(SSDPInfo).Description)
+}
+
+func TestSSDPCatalog_Fetch(t *testing.T) {
+	var mux sync.Mutex
+	hits := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		hits[r.URL.Path]++
+		mux.Unlock()
+
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/description.xml", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, "http://192.0.2.1/description.xml", http.StatusFound)
+		case "/description.xml":
+			fmt.Fprint(w, `<root><device><friendlyName>Living Room</friendlyName></device></root>`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	now := testStart
+	catalog := NewSSDPCatalog(hostmonitor.NewHostMap(), NewSSDPClient())
+	catalog.now = func() time.Time { return now }
+	ip := netip.MustParseAddr("127.0.0.1")
+	announce := func(path string) {
+		catalog.Update(hostmonitor.Addr{MAC: testMAC1, IP: ip}, ssdpMessage{Type: "upnp:rootdevice", USN: "uuid:" + path, Location: server.URL + path})
+	}
+	fetch := func(path string) descriptionFetch {
+		catalog.mux.Lock()
+		defer catalog.mux.Unlock()
+		return *catalog.fetches[server.URL+path]
+	}
+	hitCount := func(path string) int {
+		mux.Lock()
+		defer mux.Unlock()
+		return hits[path]
+	}
+	done := func(path string) func() bool {
+		return func() bool {
+			f := fetch(path)
+			return f.fetched || f.failures > 0
+		}
+	}
+
+	// a failed fetch is retried once the backoff passed, not on every announcement
+	announce("/broken")
+	require.Eventually(t, done("/broken"), time.Second, 10*time.Millisecond)
+	announce("/broken")
+	assert.False(t, fetch("/broken").fetching)
+	now = now.Add(ssdpFetchBackoff)
+	announce("/broken")
+	require.Eventually(t, func() bool { return fetch("/broken").failures == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, hitCount("/broken"))
+	assert.Equal(t, now.Add(2*ssdpFetchBackoff), fetch("/broken").retry, "backed off further")
+
+	// redirects are only followed on the announcing host
+	announce("/moved")
+	require.Eventually(t, done("/moved"), time.Second, 10*time.Millisecond)
+	assert.True(t, fetch("/moved").fetched)
+	announce("/elsewhere")
+	require.Eventually(t, done("/elsewhere"), time.Second, 10*time.Millisecond)
+	assert.False(t, fetch("/elsewhere").fetched)
+
+	// no more than the max in flight
+	for i := 0; i < ssdpMaxFetches; i++ {
+		catalog.slots <- struct{}{}
+	}
+	announce("/busy")
+	assert.False(t, fetch("/busy").fetching)
+	assert.Equal(t, 0, hitCount("/busy"))
+}
+
+func TestCheckSSDPRedirect(t *testing.T) {
+	request := func(location string) *http.Request {
+		req, err := http.NewRequest(http.MethodGet, location, nil)
+		require.NoError(t, err)
+		return req
+	}
+	via := []*http.Request{request("http://192.168.1.10:1400/xml/device_description.xml")}
+
+	assert.NoError(t, checkSSDPRedirect(request("http://192.168.1.10:1400/description.xml"), via))
+	assert.Error(t, checkSSDPRedirect(request("http://192.168.1.11:1400/description.xml"), via))
+	assert.Error(t, checkSSDPRedirect(request("https://192.168.1.10:1400/description.xml"), via))
+	assert.Error(t, checkSSDPRedirect(request("http://192.168.1.10:80/description.xml"), via))
+}
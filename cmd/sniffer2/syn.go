@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// The default database of TCP SYN fingerprints, see the file for the format.
+//
+//go:embed tcp-fingerprints.txt
+var defaultSYNFingerprintsFile []byte
+
+// SYNSignature describes the SYN a host opens connections with, which mostly depends on its TCP stack.
+type SYNSignature struct {
+	// TTL is the initial ttl, the observed one rounded up to the usual defaults.
+	TTL    uint8
+	Window uint16
+	MSS    uint16
+	// Options is the layout of the tcp options in the order sent, e.g. "mss,sok,ts,nop,ws".
+	Options string
+}
+
+// String formats the signature as "ttl:window:options", e.g. "64:64240:mss,sok,ts,nop,ws".
+func (s SYNSignature) String() string {
+	return fmt.Sprintf("%d:%d:%s", s.TTL, s.Window, s.Options)
+}
+
+// synSignature returns the signature of a SYN sent with the ttl.
+func synSignature(tcp *layers.TCP, ttl uint8) SYNSignature {
+	sig := SYNSignature{TTL: initialTTL(ttl), Window: tcp.Window}
+
+	options := make([]string, 0, len(tcp.Options))
+	for _, opt := range tcp.Options {
+		switch opt.OptionType {
+		case layers.TCPOptionKindMSS:
+			if len(opt.OptionData) == 2 {
+				sig.MSS = binary.BigEndian.Uint16(opt.OptionData)
+			}
+			options = append(options, "mss")
+		case layers.TCPOptionKindNop:
+			options = append(options, "nop")
+		case layers.TCPOptionKindWindowScale:
+			options = append(options, "ws")
+		case layers.TCPOptionKindSACKPermitted:
+			options = append(options, "sok")
+		case layers.TCPOptionKindSACK:
+			options = append(options, "sack")
+		case layers.TCPOptionKindTimestamps:
+			options = append(options, "ts")
+		case layers.TCPOptionKindEndList:
+			options = append(options, "eol")
+		default:
+			options = append(options, "?"+strconv.Itoa(int(opt.OptionType)))
+		}
+	}
+	sig.Options = strings.Join(options, ",")
+
+	return sig
+}
+
+// initialTTL rounds the ttl up to the default it most likely started from.
+func initialTTL(ttl uint8) uint8 {
+	for _, initial := range []uint8{32, 64, 128} {
+		if ttl <= initial {
+			return initial
+		}
+	}
+	return 255
+}
+
+type synEntry struct {
+	ttl uint8
+	// window is the window size, or a multiple of the mss if mss is set, or any if both are zero
+	window  uint16
+	mss     bool
+	options string
+	os      string
+}
+
+// matches returns the specificity of the match, or -1 if the entry doesn't match.
+func (e synEntry) matches(sig SYNSignature) int {
+	if e.ttl != sig.TTL {
+		return -1
+	}
+
+	score := 0
+	if e.options != fingerprintWildcard {
+		if e.options != sig.Options {
+			return -1
+		}
+		score += 2
+	}
+
+	switch {
+	case e.window == 0:
+	case e.mss && sig.MSS != 0 && uint32(sig.Window) == uint32(sig.MSS)*uint32(e.window):
+		score++
+	case !e.mss && sig.Window == e.window:
+		score++
+	default:
+		return -1
+	}
+
+	return score
+}
+
+// SYNFingerprintDB guesses the operating system of a host from the SYNs it sends.
+type SYNFingerprintDB struct {
+	entries []synEntry
+}
+
+// DefaultSYNFingerprints returns the database built into sniffer2.
+func DefaultSYNFingerprints() *SYNFingerprintDB {
+	db, err := ParseSYNFingerprints(bytes.NewReader(defaultSYNFingerprintsFile))
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// LoadSYNFingerprints loads a SYN fingerprint database from a file, or returns the default database if path is empty.
+func LoadSYNFingerprints(path string) (*SYNFingerprintDB, error) {
+	if path == "" {
+		return DefaultSYNFingerprints(), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseSYNFingerprints(f)
+}
+
+// ParseSYNFingerprints reads a SYN fingerprint database, one "ttl | window | options | os" entry per line.
+func ParseSYNFingerprints(r io.Reader) (*SYNFingerprintDB, error) {
+	db := &SYNFingerprintDB{}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(text, "|")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: expected 4 fields, got %d", line, len(fields))
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		ttl, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid ttl %q", line, fields[0])
+		}
+		entry := synEntry{ttl: uint8(ttl), options: fields[2], os: fields[3]}
+
+		if window := fields[1]; window != fingerprintWildcard {
+			if strings.HasPrefix(window, "mss*") {
+				window, entry.mss = strings.TrimPrefix(window, "mss*"), true
+			}
+			size, err := strconv.ParseUint(window, 10, 16)
+			if err != nil || size == 0 {
+				return nil, fmt.Errorf("line %d: invalid window %q", line, fields[1])
+			}
+			entry.window = uint16(size)
+		}
+		if entry.os == "" {
+			return nil, fmt.Errorf("line %d: missing os", line)
+		}
+
+		db.entries = append(db.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Match returns the operating system with the signature and whether the options matched too, rather than just the
+// ttl. The os is empty if the signature isn't in the database.
+func (db *SYNFingerprintDB) Match(sig SYNSignature) (string, bool) {
+	var (
+		best      synEntry
+		bestScore = -1
+	)
+	for _, entry := range db.entries {
+		if score := entry.matches(sig); score > bestScore {
+			best, bestScore = entry, score
+		}
+	}
+
+	return best.os, bestScore >= 2
+}
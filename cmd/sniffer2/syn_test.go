@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// synOptions builds the options of a SYN from a layout like "mss,sok,ts,nop,ws"
+func synOptions(mss uint16, layout string) []layers.TCPOption {
+	var options []layers.TCPOption
+	for _, kind := range strings.Split(layout, ",") {
+		switch kind {
+		case "mss":
+			options = append(options, layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{byte(mss >> 8), byte(mss)}})
+		case "nop":
+			options = append(options, layers.TCPOption{OptionType: layers.TCPOptionKindNop})
+		case "ws":
+			options = append(options, layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}})
+		case "sok":
+			options = append(options, layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2})
+		case "ts":
+			options = append(options, layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: make([]byte, 8)})
+		case "eol":
+			options = append(options, layers.TCPOption{OptionType: layers.TCPOptionKindEndList})
+		}
+	}
+	return options
+}
+
+func TestSYNSignature(t *testing.T) {
+	tcp := &layers.TCP{SYN: true, Window: 29200, Options: synOptions(1460, "mss,sok,ts,nop,ws")}
+
+	sig := synSignature(tcp, 63)
+	assert.Equal(t, SYNSignature{TTL: 64, Window: 29200, MSS: 1460, Options: "mss,sok,ts,nop,ws"}, sig)
+	assert.Equal(t, "64:29200:mss,sok,ts,nop,ws", sig.String())
+
+	assert.Equal(t, uint8(128), synSignature(tcp, 120).TTL)
+	assert.Equal(t, uint8(255), synSignature(tcp, 250).TTL)
+}
+
+func TestSYNFingerprintDB_Match(t *testing.T) {
+	db, err := ParseSYNFingerprints(strings.NewReader(`
+# comment
+64  | mss*20 | mss,sok,ts,nop,ws      | Linux 2
+64  | *      | mss,sok,ts,nop,ws      | Linux
+128 | 8192   | mss,nop,ws,nop,nop,sok | Windows 7
+128 | *      | *                      | Windows
+`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		sig   SYNSignature
+		os    string
+		exact bool
+	}{
+		{SYNSignature{TTL: 64, Window: 29200, MSS: 1460, Options: "mss,sok,ts,nop,ws"}, "Linux 2", true},
+		{SYNSignature{TTL: 64, Window: 65535, MSS: 1460, Options: "mss,sok,ts,nop,ws"}, "Linux", true},
+		{SYNSignature{TTL: 128, Window: 8192, MSS: 1460, Options: "mss,nop,ws,nop,nop,sok"}, "Windows 7", true},
+		{SYNSignature{TTL: 128, Window: 64240, MSS: 1460, Options: "mss,nop,ws,nop,nop,sok"}, "Windows", false},
+		{SYNSignature{TTL: 255, Window: 4128, MSS: 536, Options: "mss"}, "", false},
+	}
+	for _, test := range tests {
+		os, exact := db.Match(test.sig)
+		assert.Equal(t, test.os, os, test.sig)
+		assert.Equal(t, test.exact, exact, test.sig)
+	}
+}
+
+func TestParseSYNFingerprints_Errors(t *testing.T) {
+	for _, db := range []string{
+		"64 | * | Linux",
+		"256 | * | * | Linux",
+		"64 | mss*x | * | Linux",
+		"64 | 0 | * | Linux",
+		"64 | * | * | ",
+	} {
+		_, err := ParseSYNFingerprints(strings.NewReader(db))
+		assert.Error(t, err, db)
+	}
+}
+
+func TestDefaultSYNFingerprints(t *testing.T) {
+	db := DefaultSYNFingerprints()
+
+	os, exact := db.Match(SYNSignature{TTL: 64, Window: 64240, MSS: 1460, Options: "mss,sok,ts,nop,ws"})
+	assert.Equal(t, "Linux", os)
+	assert.True(t, exact)
+	os, _ = db.Match(SYNSignature{TTL: 128, Window: 64240, MSS: 1460, Options: "mss,nop,ws,nop,nop,sok"})
+	assert.Equal(t, "Windows", os)
+	os, _ = db.Match(SYNSignature{TTL: 64, Window: 65535, MSS: 1460, Options: "mss,nop,ws,nop,nop,ts,sok,eol"})
+	assert.Equal(t, "Darwin", os)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// tls record and handshake fields
+const (
+	tlsRecordHeaderLen = 5
+	tlsRecordHandshake = 0x16
+	tlsClientHello     = 0x01
+	// the largest record allowed by the spec
+	tlsMaxRecordLen = 1 << 14
+)
+
+// tls extensions used by the fingerprints
+const (
+	tlsExtServerName          = 0x0000
+	tlsExtSupportedGroups     = 0x000a
+	tlsExtPointFormats        = 0x000b
+	tlsExtSignatureAlgorithms = 0x000d
+	tlsExtALPN                = 0x0010
+	tlsExtSupportedVersions   = 0x002b
+)
+
+var (
+	errShortTLS          = errors.New("tls client hello too short")
+	errNotTLSClientHello = errors.New("not a tls client hello")
+)
+
+// clientHello holds the fields of a TLS ClientHello the JA3 and JA4 fingerprints are built from.
+type clientHello struct {
+	Version             uint16
+	Ciphers             []uint16
+	Extensions          []uint16
+	Groups              []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+	ServerName          string
+	ALPN                []string
+}
+
+// isClientHello returns true if the tcp payload starts with a record carrying a ClientHello, complete or not.
+func isClientHello(payload []byte) bool {
+	return len(payload) > tlsRecordHeaderLen && payload[0] == tlsRecordHandshake && payload[1] == 3 &&
+		payload[tlsRecordHeaderLen] == tlsClientHello
+}
+
+// tlsRecordLen returns the length of the record at the start of the payload, including its header.
+func tlsRecordLen(payload []byte) int {
+	if len(payload) < tlsRecordHeaderLen {
+		return 0
+	}
+	return tlsRecordHeaderLen + int(binary.BigEndian.Uint16(payload[3:5]))
+}
+
+// parseClientHello parses the ClientHello in the first record of the payload. Records split over several tcp segments
+// must be put back together first, errShortTLS is returned if the record isn't complete.
+func parseClientHello(payload []byte) (clientHello, error) {
+	if !isClientHello(payload) {
+		return clientHello{}, errNotTLSClientHello
+	}
+	if len(payload) < tlsRecordLen(payload) {
+		return clientHello{}, errShortTLS
+	}
+
+	r := &tlsReader{data: payload[tlsRecordHeaderLen:tlsRecordLen(payload)]}
+	r.u8() // handshake type
+	body := &tlsReader{data: r.bytes(int(r.u24()))}
+	if r.err != nil {
+		return clientHello{}, r.err
+	}
+
+	var hello clientHello
+	hello.Version = body.u16()
+	body.bytes(32) // random
+	body.vec8()    // session id
+	for ciphers := (&tlsReader{data: body.vec16()}); len(ciphers.data) > 0 && ciphers.err == nil; {
+		hello.Ciphers = append(hello.Ciphers, ciphers.u16())
+	}
+	body.vec8() // compression methods
+	if body.err != nil {
+		return clientHello{}, body.err
+	}
+	if len(body.data) == 0 {
+		// no extensions
+		return hello, nil
+	}
+
+	extensions := &tlsReader{data: body.vec16()}
+	for len(extensions.data) > 0 && extensions.err == nil {
+		extType := extensions.u16()
+		ext := &tlsReader{data: extensions.vec16()}
+		hello.Extensions = append(hello.Extensions, extType)
+
+		switch extType {
+		case tlsExtServerName:
+			list := &tlsReader{data: ext.vec16()}
+			for len(list.data) > 0 && list.err == nil {
+				nameType, name := list.u8(), list.vec16()
+				if nameType == 0 && hello.ServerName == "" {
+					hello.ServerName = string(name)
+				}
+			}
+		case tlsExtSupportedGroups:
+			hello.Groups = ext.u16s(ext.vec16())
+		case tlsExtPointFormats:
+			hello.PointFormats = append([]uint8(nil), ext.vec8()...)
+		case tlsExtSignatureAlgorithms:
+			hello.SignatureAlgorithms = ext.u16s(ext.vec16())
+		case tlsExtALPN:
+			list := &tlsReader{data: ext.vec16()}
+			for len(list.data) > 0 && list.err == nil {
+				hello.ALPN = append(hello.ALPN, string(list.vec8()))
+			}
+		case tlsExtSupportedVersions:
+			hello.SupportedVersions = ext.u16s(ext.vec8())
+		}
+	}
+	if extensions.err != nil {
+		return clientHello{}, extensions.err
+	}
+
+	return hello, nil
+}
+
+// JA3 returns the JA3 string of the ClientHello and its md5 hash, which is what's usually shared.
+func (h clientHello) JA3() (string, string) {
+	decimals := func(values []uint16) string {
+		var fields []string
+		for _, v := range values {
+			if !isGREASE(v) {
+				fields = append(fields, strconv.Itoa(int(v)))
+			}
+		}
+		return strings.Join(fields, "-")
+	}
+
+	formats := make([]uint16, len(h.PointFormats))
+	for i, format := range h.PointFormats {
+		formats[i] = uint16(format)
+	}
+
+	ja3 := fmt.Sprintf("%d,%s,%s,%s,%s", h.Version, decimals(h.Ciphers), decimals(h.Extensions), decimals(h.Groups),
+		decimals(formats))
+	sum := md5.Sum([]byte(ja3))
+	return ja3, hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, e.g. "t13d1516h2_8daaf6152771_e5627efa2ab1". Unlike JA3 the
+// ciphers and extensions are sorted, so it isn't affected by clients randomizing the order of their extensions.
+func (h clientHello) JA4() string {
+	ciphers := hexValues(h.Ciphers)
+	extensions := hexValues(h.Extensions)
+
+	version := h.Version
+	for _, v := range h.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.ALPN) > 0 && h.ALPN[0] != "" {
+		first := h.ALPN[0]
+		if isAlphanumeric(first[0]) && isAlphanumeric(first[len(first)-1]) {
+			alpn = first[:1] + first[len(first)-1:]
+		} else {
+			encoded := hex.EncodeToString([]byte(first))
+			alpn = encoded[:1] + encoded[len(encoded)-1:]
+		}
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", tlsVersionName(version), sni, minInt(len(ciphers), 99),
+		minInt(len(extensions), 99), alpn)
+
+	sort.Strings(ciphers)
+	b := truncatedHash(strings.Join(ciphers, ","), len(ciphers) == 0)
+
+	// the server name and alpn depend on the site being visited rather than the client
+	var hashed []uint16
+	for _, ext := range h.Extensions {
+		if ext != tlsExtServerName && ext != tlsExtALPN {
+			hashed = append(hashed, ext)
+		}
+	}
+	sorted := hexValues(hashed)
+	sort.Strings(sorted)
+	c := strings.Join(sorted, ",")
+	if algorithms := hexValues(h.SignatureAlgorithms); len(algorithms) > 0 {
+		c += "_" + strings.Join(algorithms, ",")
+	}
+
+	return a + "_" + b + "_" + truncatedHash(c, len(extensions) == 0)
+}
+
+// isGREASE returns true for the reserved values clients send to keep servers tolerant of unknown ones, which are
+// random and left out of fingerprints.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// hexValues formats the values that aren't GREASE as 4 digit hex strings.
+func hexValues(values []uint16) []string {
+	var formatted []string
+	for _, v := range values {
+		if !isGREASE(v) {
+			formatted = append(formatted, fmt.Sprintf("%04x", v))
+		}
+	}
+	return formatted
+}
+
+// truncatedHash returns the first 12 hex digits of the sha256 of s, or zeros if empty is set.
+func truncatedHash(s string, empty bool) string {
+	if empty {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// tlsReader reads the big endian fields of a handshake message. Reading past the end sets err and returns zeros.
+type tlsReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errShortTLS
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlsReader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *tlsReader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *tlsReader) u24() uint32 {
+	if b := r.bytes(3); b != nil {
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	}
+	return 0
+}
+
+// vec8 and vec16 read a vector prefixed by its length.
+func (r *tlsReader) vec8() []byte {
+	return r.bytes(int(r.u8()))
+}
+
+func (r *tlsReader) vec16() []byte {
+	return r.bytes(int(r.u16()))
+}
+
+// u16s splits the vector into its 16 bit values.
+func (r *tlsReader) u16s(vec []byte) []uint16 {
+	values := make([]uint16, 0, len(vec)/2)
+	for ; len(vec) >= 2; vec = vec[2:] {
+		values = append(values, binary.BigEndian.Uint16(vec))
+	}
+	return values
+}
+
+// TLSFingerprintDB maps the JA3 and JA4 fingerprints of known clients to their operating system.
+type TLSFingerprintDB struct {
+	entries map[string]string
+}
+
+// LoadTLSFingerprints loads a TLS fingerprint database from a file, or returns an empty database if path is empty.
+func LoadTLSFingerprints(path string) (*TLSFingerprintDB, error) {
+	if path == "" {
+		return &TLSFingerprintDB{}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseTLSFingerprints(f)
+}
+
+// ParseTLSFingerprints reads a TLS fingerprint database, one "ja3 or ja4 | os" entry per line. JA3 fingerprints are
+// given as their md5 hash.
+func ParseTLSFingerprints(r io.Reader) (*TLSFingerprintDB, error) {
+	db := &TLSFingerprintDB{entries: make(map[string]string)}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(text, "|")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected 2 fields, got %d", line, len(fields))
+		}
+
+		fingerprint, os := strings.ToLower(strings.TrimSpace(fields[0])), strings.TrimSpace(fields[1])
+		if fingerprint == "" || os == "" {
+			return nil, fmt.Errorf("line %d: missing fingerprint or os", line)
+		}
+		db.entries[fingerprint] = os
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Match returns the operating system of the client with the fingerprints, JA4 first, or an empty string if neither is
+// in the database.
+func (db *TLSFingerprintDB) Match(ja3, ja4 string) string {
+	if os, ok := db.entries[ja4]; ok {
+		return os
+	}
+	return db.entries[ja3]
+}
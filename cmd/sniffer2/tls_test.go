@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// vector prefixes the data with its length in size bytes
+func vector(size int, data ...[]byte) []byte {
+	var joined []byte
+	for _, d := range data {
+		joined = append(joined, d...)
+	}
+
+	b := make([]byte, size, size+len(joined))
+	switch size {
+	case 1:
+		b[0] = byte(len(joined))
+	case 2:
+		binary.BigEndian.PutUint16(b, uint16(len(joined)))
+	case 3:
+		b[0], b[1], b[2] = byte(len(joined)>>16), byte(len(joined)>>8), byte(len(joined))
+	}
+	return append(b, joined...)
+}
+
+func u16s(values ...uint16) []byte {
+	b := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(b[2*i:], v)
+	}
+	return b
+}
+
+func tlsExtension(extType uint16, data ...[]byte) []byte {
+	return append(u16s(extType), vector(2, data...)...)
+}
+
+// testClientHello builds a record carrying a ClientHello with the ciphers and extensions
+func testClientHello(ciphers []uint16, extensions ...[]byte) []byte {
+	body := append(u16s(0x0303), make([]byte, 32)...)
+	body = append(body, vector(1)...)
+	body = append(body, vector(2, u16s(ciphers...))...)
+	body = append(body, vector(1, []byte{0})...)
+	body = append(body, vector(2, extensions...)...)
+
+	handshake := append([]byte{tlsClientHello}, vector(3, body)...)
+	return append([]byte{tlsRecordHandshake}, append(u16s(0x0301), vector(2, handshake)...)...)
+}
+
+// goClientHello returns the ClientHello record crypto/tls sends
+func goClientHello(t testing.TB) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		_ = tls.Client(client, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}}).Handshake()
+	}()
+
+	header := make([]byte, tlsRecordHeaderLen)
+	_, err := io.ReadFull(server, header)
+	require.NoError(t, err)
+	record := make([]byte, tlsRecordLen(header)-tlsRecordHeaderLen)
+	_, err = io.ReadFull(server, record)
+	require.NoError(t, err)
+
+	return append(header, record...)
+}
+
+func TestParseClientHello(t *testing.T) {
+	record := testClientHello([]uint16{0x2a2a, 0x1301, 0x1302, 0xc02b},
+		tlsExtension(0x0a0a),
+		tlsExtension(tlsExtServerName, vector(2, []byte{0}, vector(2, []byte("example.com")))),
+		tlsExtension(tlsExtSupportedGroups, vector(2, u16s(0x1a1a, 0x001d, 0x0017))),
+		tlsExtension(tlsExtPointFormats, vector(1, []byte{0})),
+		tlsExtension(tlsExtSignatureAlgorithms, vector(2, u16s(0x0403, 0x0804))),
+		tlsExtension(tlsExtALPN, vector(2, vector(1, []byte("h2")), vector(1, []byte("http/1.1")))),
+		tlsExtension(tlsExtSupportedVersions, vector(1, u16s(0x2a2a, 0x0304, 0x0303))),
+	)
+
+	hello, err := parseClientHello(record)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", hello.ServerName)
+	assert.Equal(t, []string{"h2", "http/1.1"}, hello.ALPN)
+	assert.Equal(t, []uint16{0x0a0a, 0x0000, 0x000a, 0x000b, 0x000d, 0x0010, 0x002b}, hello.Extensions)
+
+	// grease values are left out
+	ja3, ja3Hash := hello.JA3()
+	assert.Equal(t, "771,4865-4866-49195,0-10-11-13-16-43,29-23,0", ja3)
+	sum := md5.Sum([]byte(ja3))
+	assert.Equal(t, hex.EncodeToString(sum[:]), ja3Hash)
+
+	// sorted, without the server name and alpn extensions
+	assert.Equal(t, "t13d0306h2_"+truncatedHash("1301,1302,c02b", false)+"_"+
+		truncatedHash("000a,000b,000d,002b_0403,0804", false), hello.JA4())
+
+	_, err = parseClientHello(record[:len(record)-1])
+	assert.Equal(t, errShortTLS, err)
+	_, err = parseClientHello([]byte("GET / HTTP/1.1\r\n"))
+	assert.Equal(t, errNotTLSClientHello, err)
+}
+
+func TestParseClientHello_Go(t *testing.T) {
+	hello, err := parseClientHello(goClientHello(t))
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", hello.ServerName)
+	assert.Contains(t, hello.SupportedVersions, uint16(0x0304))
+	assert.True(t, strings.HasPrefix(hello.JA4(), "t13d"), hello.JA4())
+	assert.True(t, strings.HasSuffix(strings.Split(hello.JA4(), "_")[0], "h2"), hello.JA4())
+
+	// without a server name or alpn
+	hello.ServerName, hello.ALPN = "", nil
+	assert.Equal(t, "t13i", hello.JA4()[:4])
+	assert.Equal(t, "00", strings.Split(hello.JA4(), "_")[0][8:])
+}
+
+func TestTLSFingerprintDB_Match(t *testing.T) {
+	db, err := ParseTLSFingerprints(strings.NewReader(`
+# comment
+t13d1516h2_8daaf6152771_e5627efa2ab1 | Windows
+773906B0EFDEFA24A7F2B8EB6985BF37     | macOS
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, "Windows", db.Match("773906b0efdefa24a7f2b8eb6985bf37", "t13d1516h2_8daaf6152771_e5627efa2ab1"))
+	assert.Equal(t, "macOS", db.Match("773906b0efdefa24a7f2b8eb6985bf37", "t13d1516h2_000000000000_000000000000"))
+	assert.Equal(t, "", db.Match("", ""))
+
+	_, err = ParseTLSFingerprints(strings.NewReader("t13d1516h2_8daaf6152771_e5627efa2ab1"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TrafficDirection is where the traffic of a host is going, on the local network or to and from the internet.
+type TrafficDirection int
+
+const (
+	LANTraffic TrafficDirection = iota
+	// InboundTraffic is received from the internet.
+	InboundTraffic
+	// OutboundTraffic is sent to the internet.
+	OutboundTraffic
+
+	trafficDirections = 3
+)
+
+func (d TrafficDirection) String() string {
+	switch d {
+	case LANTraffic:
+		return "lan"
+	case InboundTraffic:
+		return "in"
+	case OutboundTraffic:
+		return "out"
+	default:
+		return "unknown"
+	}
+}
+
+// the windows rates are kept over, made of buckets so adding a packet only touches the current one
+const (
+	trafficBucketLen = 10 * time.Second
+	trafficBuckets   = int(time.Hour / trafficBucketLen)
+	// hosts not seen for the longest window are dropped, all their rates are zero by then
+	trafficHostTimeout = time.Hour
+	// how often idle hosts are looked for, in packet time
+	trafficSweepInterval = time.Minute
+)
+
+// TrafficWindows are the windows rates are available for.
+var TrafficWindows = []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+
+// TrafficCounts are the bytes and packets of a host in each direction, indexed by TrafficDirection.
+type TrafficCounts struct {
+	Bytes   [trafficDirections]uint64
+	Packets [trafficDirections]uint64
+}
+
+// TotalBytes returns the bytes in every direction.
+func (c TrafficCounts) TotalBytes() uint64 {
+	var total uint64
+	for _, bytes := range c.Bytes {
+		total += bytes
+	}
+	return total
+}
+
+func (c TrafficCounts) add(other TrafficCounts) TrafficCounts {
+	for d := range c.Bytes {
+		c.Bytes[d] += other.Bytes[d]
+		c.Packets[d] += other.Packets[d]
+	}
+	return c
+}
+
+func (c TrafficCounts) String() string {
+	return fmt.Sprintf("lan=(%dB/%dpkts) in=(%dB/%dpkts) out=(%dB/%dpkts)",
+		c.Bytes[LANTraffic], c.Packets[LANTraffic],
+		c.Bytes[InboundTraffic], c.Packets[InboundTraffic],
+		c.Bytes[OutboundTraffic], c.Packets[OutboundTraffic])
+}
+
+// TrafficRate is the bytes and packets per second of a host in each direction over a window, indexed by
+// TrafficDirection.
+type TrafficRate struct {
+	Window           time.Duration
+	BytesPerSecond   [trafficDirections]float64
+	PacketsPerSecond [trafficDirections]float64
+}
+
+// TotalBytesPerSecond returns the bytes per second in every direction.
+func (r TrafficRate) TotalBytesPerSecond() float64 {
+	var total float64
+	for _, rate := range r.BytesPerSecond {
+		total += rate
+	}
+	return total
+}
+
+func (r TrafficRate) String() string {
+	return fmt.Sprintf("window=(%s) lan=(%.0fB/s) in=(%.0fB/s) out=(%.0fB/s)", r.Window,
+		r.BytesPerSecond[LANTraffic], r.BytesPerSecond[InboundTraffic], r.BytesPerSecond[OutboundTraffic])
+}
+
+// HostTraffic is the traffic of a host since it was first seen.
+type HostTraffic struct {
+	MAC   net.HardwareAddr
+	Total TrafficCounts
+	// Rates are over each of the TrafficWindows.
+	Rates []TrafficRate
+}
+
+type trafficBucket struct {
+	// index is the number of the bucket since the epoch, buckets are reused once the ring wraps around
+	index  int64
+	counts TrafficCounts
+}
+
+type hostTraffic struct {
+	mac      net.HardwareAddr
+	total    TrafficCounts
+	lastSeen time.Time
+	buckets  [trafficBuckets]trafficBucket
+}
+
+// window returns the counts of the buckets in the window ending with the bucket of now.
+func (h *hostTraffic) window(now time.Time, window time.Duration) TrafficCounts {
+	var counts TrafficCounts
+	last := now.UnixNano() / int64(trafficBucketLen)
+	for index := last - int64(window/trafficBucketLen) + 1; index <= last; index++ {
+		if bucket := &h.buckets[index%int64(trafficBuckets)]; bucket.index == index {
+			counts = counts.add(bucket.counts)
+		}
+	}
+	return counts
+}
+
+// TrafficTable counts the bytes and packets of each host. Rates are relative to the last packet counted rather than
+// the wall clock, so they're the same when replaying a capture. Hosts nothing was counted for in the last hour are
+// dropped.
+type TrafficTable struct {
+	hosts map[string]*hostTraffic
+	last  time.Time
+	// packet time idle hosts were last looked for to drop
+	lastSweep time.Time
+	mux       *sync.Mutex
+}
+
+func NewTrafficTable() *TrafficTable {
+	return &TrafficTable{
+		hosts: make(map[string]*hostTraffic),
+		mux:   &sync.Mutex{},
+	}
+}
+
+// Add counts a packet of length bytes seen at ts for the host with mac.
+func (t *TrafficTable) Add(mac net.HardwareAddr, direction TrafficDirection, length int, ts time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if ts.Sub(t.lastSweep) >= trafficSweepInterval {
+		t.expire(ts)
+		t.lastSweep = ts
+	}
+
+	// indexing with the raw bytes doesn't allocate
+	host, ok := t.hosts[string(mac)]
+	if !ok {
+		host = &hostTraffic{mac: append(net.HardwareAddr(nil), mac...)}
+		t.hosts[string(mac)] = host
+	}
+
+	index := ts.UnixNano() / int64(trafficBucketLen)
+	bucket := &host.buckets[index%int64(trafficBuckets)]
+	if bucket.index != index {
+		*bucket = trafficBucket{index: index}
+	}
+
+	for _, counts := range []*TrafficCounts{&host.total, &bucket.counts} {
+		counts.Bytes[direction] += uint64(length)
+		counts.Packets[direction]++
+	}
+	if ts.After(host.lastSeen) {
+		host.lastSeen = ts
+	}
+	if ts.After(t.last) {
+		t.last = ts
+	}
+}
+
+// expire drops the hosts nothing was counted for in the last hour. The lock must be held.
+func (t *TrafficTable) expire(now time.Time) {
+	for key, host := range t.hosts {
+		if now.Sub(host.lastSeen) > trafficHostTimeout {
+			delete(t.hosts, key)
+		}
+	}
+}
+
+// Traffic returns the traffic of the host with mac.
+func (t *TrafficTable) Traffic(mac net.HardwareAddr) (HostTraffic, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	host, ok := t.hosts[string(mac)]
+	if !ok {
+		return HostTraffic{}, false
+	}
+	return t.traffic(host), true
+}
+
+// TopTalkers returns the n hosts with the most bytes per second over the window, in the given directions or all of
+// them if none are given.
+func (t *TrafficTable) TopTalkers(n int, window time.Duration, directions ...TrafficDirection) []HostTraffic {
+	if len(directions) == 0 {
+		directions = []TrafficDirection{LANTraffic, InboundTraffic, OutboundTraffic}
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	type talker struct {
+		host  *hostTraffic
+		bytes uint64
+	}
+	talkers := make([]talker, 0, len(t.hosts))
+	for _, host := range t.hosts {
+		counts := host.window(t.last, window)
+		var bytes uint64
+		for _, direction := range directions {
+			bytes += counts.Bytes[direction]
+		}
+		if bytes > 0 {
+			talkers = append(talkers, talker{host: host, bytes: bytes})
+		}
+	}
+	sort.Slice(talkers, func(i, j int) bool {
+		if talkers[i].bytes != talkers[j].bytes {
+			return talkers[i].bytes > talkers[j].bytes
+		}
+		return talkers[i].host.mac.String() < talkers[j].host.mac.String()
+	})
+	if n > 0 && len(talkers) > n {
+		talkers = talkers[:n]
+	}
+
+	top := make([]HostTraffic, len(talkers))
+	for i, talker := range talkers {
+		top[i] = t.traffic(talker.host)
+	}
+	return top
+}
+
+// PrintTopTalkers logs the n hosts with the most traffic over each of the TrafficWindows.
+func (t *TrafficTable) PrintTopTalkers(n int) {
+	for _, window := range TrafficWindows {
+		for _, host := range t.TopTalkers(n, window) {
+			for _, rate := range host.Rates {
+				if rate.Window == window {
+					log.Printf("top talker %s: %s total=(%s)", host.MAC, rate, host.Total)
+				}
+			}
+		}
+	}
+}
+
+// traffic copies the traffic of the host. The lock must be held.
+func (t *TrafficTable) traffic(host *hostTraffic) HostTraffic {
+	traffic := HostTraffic{
+		MAC:   append(net.HardwareAddr(nil), host.mac...),
+		Total: host.total,
+		Rates: make([]TrafficRate, len(TrafficWindows)),
+	}
+	for i, window := range TrafficWindows {
+		counts := host.window(t.last, window)
+		rate := TrafficRate{Window: window}
+		for d := range counts.Bytes {
+			rate.BytesPerSecond[d] = float64(counts.Bytes[d]) / window.Seconds()
+			rate.PacketsPerSecond[d] = float64(counts.Packets[d]) / window.Seconds()
+		}
+		traffic.Rates[i] = rate
+	}
+
+	return traffic
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrafficTable(t *testing.T) {
+	traffic := NewTrafficTable()
+	traffic.Add(testMAC1, OutboundTraffic, 1000, testStart)
+	traffic.Add(testMAC1, InboundTraffic, 3000, testStart.Add(30*time.Second))
+	traffic.Add(testMAC2, LANTraffic, 600, testStart.Add(2*time.Minute))
+
+	host, ok := traffic.Traffic(testMAC1)
+	require.True(t, ok)
+	assert.Equal(t, testMAC1, host.MAC)
+	assert.Equal(t, uint64(1000), host.Total.Bytes[OutboundTraffic])
+	assert.Equal(t, uint64(3000), host.Total.Bytes[InboundTraffic])
+	assert.Equal(t, uint64(1), host.Total.Packets[InboundTraffic])
+	assert.Equal(t, uint64(4000), host.Total.TotalBytes())
+
+	// rates are relative to the last packet, two minutes after the first host was last seen
+	require.Len(t, host.Rates, len(TrafficWindows))
+	assert.Equal(t, time.Minute, host.Rates[0].Window)
+	assert.Equal(t, 0.0, host.Rates[0].TotalBytesPerSecond())
+	assert.InDelta(t, 3000.0/300, host.Rates[1].BytesPerSecond[InboundTraffic], 0.001)
+	assert.InDelta(t, 1000.0/300, host.Rates[1].BytesPerSecond[OutboundTraffic], 0.001)
+	assert.InDelta(t, 4000.0/3600, host.Rates[2].TotalBytesPerSecond(), 0.001)
+
+	top := traffic.TopTalkers(5, time.Minute)
+	require.Len(t, top, 1)
+	assert.Equal(t, testMAC2, top[0].MAC)
+
+	top = traffic.TopTalkers(5, time.Hour)
+	require.Len(t, top, 2)
+	assert.Equal(t, testMAC1, top[0].MAC)
+	assert.Equal(t, testMAC2, top[1].MAC)
+	assert.Len(t, traffic.TopTalkers(1, time.Hour), 1)
+
+	top = traffic.TopTalkers(5, time.Hour, LANTraffic)
+	require.Len(t, top, 1)
+	assert.Equal(t, testMAC2, top[0].MAC)
+
+	_, ok = traffic.Traffic(gatewayMAC)
+	assert.False(t, ok)
+}
+
+func TestTrafficTable_Wraps(t *testing.T) {
+	traffic := NewTrafficTable()
+	traffic.Add(testMAC1, OutboundTraffic, 1000, testStart)
+	// the bucket of the first packet is reused an hour later
+	traffic.Add(testMAC1, OutboundTraffic, 500, testStart.Add(time.Hour))
+
+	host, _ := traffic.Traffic(testMAC1)
+	assert.Equal(t, uint64(1500), host.Total.Bytes[OutboundTraffic])
+	assert.InDelta(t, 500.0/3600, host.Rates[2].BytesPerSecond[OutboundTraffic], 0.001)
+}
+
+func TestTrafficTable_Expire(t *testing.T) {
+	traffic := NewTrafficTable()
+	traffic.Add(testMAC1, OutboundTraffic, 1000, testStart)
+	traffic.Add(testMAC2, OutboundTraffic, 1000, testStart.Add(30*time.Minute))
+
+	// an hour after it was last seen the first host is dropped
+	traffic.Add(testMAC2, OutboundTraffic, 1000, testStart.Add(time.Hour+time.Minute))
+	_, ok := traffic.Traffic(testMAC1)
+	assert.False(t, ok)
+	host, ok := traffic.Traffic(testMAC2)
+	require.True(t, ok)
+	assert.Equal(t, uint64(2000), host.Total.Bytes[OutboundTraffic])
+}
+
+func udp6Packet(t testing.TB, ts time.Time, srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP string) testPacket {
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv6}
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP(srcIP), DstIP: net.ParseIP(dstIP)}
+	udp := &layers.UDP{SrcPort: 50000, DstPort: 443}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+
+	return testPacket{ts: ts, layers: []gopacket.SerializableLayer{eth, ip, udp}}
+}
+
+func TestUpdateHosts_TrafficIPv6(t *testing.T) {
+	traffic := NewTrafficTable()
+	handler := UpdateHosts(hostmonitor.NewHostMap(), traffic)
+
+	packets := []testPacket{
+		// unique local and link-local addresses are on the LAN
+		udp6Packet(t, testStart, testMAC1, testMAC2, "fd00::2", "fd00::3"),
+		udp6Packet(t, testStart, testMAC1, testMAC2, "fe80::2", "fe80::3"),
+		udp6Packet(t, testStart, testMAC1, gatewayMAC, "fd00::2", "2001:db8::1"),
+		udp6Packet(t, testStart, gatewayMAC, testMAC1, "2001:db8::1", "fd00::2"),
+		// a global address of a host on the LAN, the router sends the reply
+		udp6Packet(t, testStart, testMAC2, gatewayMAC, "2001:db8:1::3", "2001:db8::1"),
+		udp6Packet(t, testStart, gatewayMAC, testMAC2, "2001:db8::1", "2001:db8:1::3"),
+		// frames that aren't ip are counted too
+		arpPacket(testStart, layers.ARPRequest, testMAC1, "192.168.1.2", "192.168.1.3"),
+	}
+	var lengths []uint64
+	for _, p := range packets {
+		packet := decode(t, p)
+		lengths = append(lengths, uint64(packet.Metadata().Length))
+		require.NoError(t, handler(context.Background(), packet))
+	}
+
+	host, ok := traffic.Traffic(testMAC1)
+	require.True(t, ok)
+	assert.Equal(t, [3]uint64{lengths[0] + lengths[1] + lengths[6], lengths[3], lengths[2]}, host.Total.Bytes)
+
+	host, ok = traffic.Traffic(testMAC2)
+	require.True(t, ok)
+	assert.Equal(t, [3]uint64{lengths[0] + lengths[1], lengths[5], lengths[4]}, host.Total.Bytes)
+
+	host, ok = traffic.Traffic(gatewayMAC)
+	require.True(t, ok, "the router can't be told apart from a host with a global address")
+	assert.Equal(t, [3]uint64{0, lengths[4], lengths[5]}, host.Total.Bytes)
+}
+
+func TestUpdateHosts_Traffic(t *testing.T) {
+	hosts := hostmonitor.NewHostMap()
+	traffic := NewTrafficTable()
+	handler := UpdateHosts(hosts, traffic)
+
+	packets := []testPacket{
+		udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 53),
+		udpPacket(t, testStart, gatewayMAC, testMAC1, "8.8.8.8", "192.168.1.2", 53, 50000),
+		udpPacket(t, testStart, testMAC1, testMAC2, "192.168.1.2", "192.168.1.3", 50000, 8080),
+		// broadcasts only count for the sender
+		udpPacket(t, testStart, testMAC2, layers.EthernetBroadcast, "192.168.1.3", "192.168.1.255", 137, 137),
+	}
+	var lengths []uint64
+	for _, p := range packets {
+		packet := decode(t, p)
+		lengths = append(lengths, uint64(packet.Metadata().Length))
+		require.NoError(t, handler(context.Background(), packet))
+	}
+
+	host, ok := traffic.Traffic(testMAC1)
+	require.True(t, ok)
+	assert.Equal(t, [3]uint64{lengths[2], lengths[1], lengths[0]}, host.Total.Bytes)
+	assert.Equal(t, [3]uint64{1, 1, 1}, host.Total.Packets)
+
+	host, ok = traffic.Traffic(testMAC2)
+	require.True(t, ok)
+	assert.Equal(t, [3]uint64{lengths[2] + lengths[3], 0, 0}, host.Total.Bytes)
+
+	_, ok = traffic.Traffic(gatewayMAC)
+	assert.False(t, ok, "the gateway isn't on the private network")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// the request methods the default filter captures http requests by, padded to 4 bytes
+var httpMethods = []string{"GET ", "POST", "HEAD", "PUT "}
+
+// user agent tokens and the operating system they belong to, in the order checked. Apple's mobile user agents also
+// claim to be "like Mac OS X", and android ones to be linux, so the more specific come first.
+var userAgentTokens = []struct {
+	token, os string
+}{
+	{"Windows Phone", "Windows Phone"},
+	{"Windows NT", "Windows"},
+	{"Microsoft-CryptoAPI", "Windows"},
+	{"Microsoft-Delivery-Optimization", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"Macintosh", "macOS"},
+	{"Mac OS X", "macOS"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Darwin/", "Darwin"},
+	{"FreeBSD", "FreeBSD"},
+	{"Ubuntu", "Linux"},
+	{"Linux", "Linux"},
+}
+
+// httpUserAgent returns the User-Agent of the http request at the start of the tcp payload.
+func httpUserAgent(payload []byte) (string, bool) {
+	end := bytes.Index(payload, []byte("\r\n"))
+	if end < 0 || !isHTTPRequestLine(string(payload[:end])) {
+		return "", false
+	}
+
+	for lines := payload[end+2:]; len(lines) > 0; {
+		end := bytes.Index(lines, []byte("\r\n"))
+		if end <= 0 {
+			// the end of the headers, or the rest of them didn't fit in the segment
+			break
+		}
+
+		name, value, ok := strings.Cut(string(lines[:end]), ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "User-Agent") {
+			value = strings.TrimSpace(value)
+			return value, value != ""
+		}
+		lines = lines[end+2:]
+	}
+
+	return "", false
+}
+
+// isHTTPRequestLine returns true for lines like "GET / HTTP/1.1".
+func isHTTPRequestLine(line string) bool {
+	method, rest, ok := strings.Cut(line, " ")
+	if !ok || method == "" || strings.ToUpper(method) != method {
+		return false
+	}
+	return strings.HasSuffix(rest, " HTTP/1.1") || strings.HasSuffix(rest, " HTTP/1.0")
+}
+
+// userAgentOS returns the operating system a user agent claims to run on, or an empty string if it doesn't say.
+func userAgentOS(userAgent string) string {
+	for _, t := range userAgentTokens {
+		if strings.Contains(userAgent, t.token) {
+			return t.os
+		}
+	}
+	return ""
+}
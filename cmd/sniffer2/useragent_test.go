@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPUserAgent(t *testing.T) {
+	userAgent, ok := httpUserAgent([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\nuser-agent: curl/8.5.0 \r\nAccept: */*\r\n\r\n"))
+	assert.True(t, ok)
+	assert.Equal(t, "curl/8.5.0", userAgent)
+
+	for _, payload := range []string{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\nUser-Agent: body\r\n",
+		"HTTP/1.1 200 OK\r\nUser-Agent: response\r\n\r\n",
+		"get / HTTP/1.1\r\nUser-Agent: lower case\r\n\r\n",
+		"GET / HTTP/1.1",
+	} {
+		_, ok := httpUserAgent([]byte(payload))
+		assert.False(t, ok, payload)
+	}
+}
+
+func TestUserAgentOS(t *testing.T) {
+	tests := map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36":       "Windows",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15": "macOS",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148":         "iOS",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36": "Android",
+		"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36":        "ChromeOS",
+		"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0":                                        "Linux",
+		"Microsoft-CryptoAPI/10.0":                          "Windows",
+		"com.apple.trustd/3.0 CFNetwork/1474 Darwin/23.0.0": "Darwin",
+		"curl/8.5.0": "",
+	}
+	for userAgent, os := range tests {
+		assert.Equal(t, os, userAgentOS(userAgent), userAgent)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+)
+
+// packetVLANs returns the VLAN ID of the innermost 802.1Q tag of the packet and, for QinQ frames, the ID of the
+// outermost tag. Both are zero if the packet is untagged. A tag stripped by the kernel is the outermost one.
+func packetVLANs(packet gopacket.Packet) (vlan, outer uint16) {
+	var first, last uint16
+	tags := 0
+	if id, ok := ancillaryVLAN(packet.Metadata().AncillaryData); ok {
+		first, last = id, id
+		tags++
+	}
+	for _, layer := range packet.Layers() {
+		if dot1q, ok := layer.(*layers.Dot1Q); ok {
+			if tags == 0 {
+				first = dot1q.VLANIdentifier
+			}
+			last = dot1q.VLANIdentifier
+			tags++
+		}
+	}
+
+	if tags > 1 {
+		return last, first
+	}
+	return last, 0
+}
+
+// ancillaryVLAN returns the VLAN ID of the tag the kernel stripped from a frame read from a linux packet socket, which
+// pcapgo passes as the TCI in the ancillary data of the frame.
+func ancillaryVLAN(data []interface{}) (uint16, bool) {
+	for _, v := range data {
+		if tci, ok := v.(int); ok {
+			return uint16(tci) & 0x0fff, true
+		}
+	}
+	return 0, false
+}
+
+// newAddr returns the address of a host seen in the packet, on the VLAN of the packet.
+func newAddr(packet gopacket.Packet, mac net.HardwareAddr, ip netip.Addr) hostmonitor.Addr {
+	vlan, outer := packetVLANs(packet)
+	return hostmonitor.Addr{
+		MAC:       mac,
+		IP:        ip,
+		VLAN:      vlan,
+		OuterVLAN: outer,
+	}
+}
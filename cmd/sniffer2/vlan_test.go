@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/bpf"
+)
+
+// tagged inserts 802.1Q tags for the vlans, outermost first, after the ethernet layer of the packet
+func tagged(p testPacket, vlans ...uint16) testPacket {
+	eth := *p.layers[0].(*layers.Ethernet)
+	etherType := eth.EthernetType
+
+	tags := make([]gopacket.SerializableLayer, len(vlans))
+	for i, vlan := range vlans {
+		next := layers.EthernetTypeDot1Q
+		if i == len(vlans)-1 {
+			next = etherType
+		}
+		tags[i] = &layers.Dot1Q{VLANIdentifier: vlan, Type: next}
+	}
+	eth.EthernetType = layers.EthernetTypeDot1Q
+	if len(vlans) > 1 {
+		eth.EthernetType = layers.EthernetTypeQinQ
+	}
+
+	packetLayers := append([]gopacket.SerializableLayer{&eth}, tags...)
+	return testPacket{ts: p.ts, layers: append(packetLayers, p.layers[1:]...)}
+}
+
+func TestPacketVLANs(t *testing.T) {
+	p := udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 53)
+
+	vlan, outer := packetVLANs(decode(t, p))
+	assert.Equal(t, uint16(0), vlan)
+	assert.Equal(t, uint16(0), outer)
+
+	vlan, outer = packetVLANs(decode(t, tagged(p, 10)))
+	assert.Equal(t, uint16(10), vlan)
+	assert.Equal(t, uint16(0), outer)
+
+	vlan, outer = packetVLANs(decode(t, tagged(p, 100, 10)))
+	assert.Equal(t, uint16(10), vlan)
+	assert.Equal(t, uint16(100), outer)
+}
+
+func TestPacketVLANs_Stripped(t *testing.T) {
+	p := udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 53)
+	decoder := NewLayerDecoder(layers.LinkTypeEthernet, layers.LayerTypeIPv4, layers.LayerTypeUDP)
+
+	// read from a packet socket, the kernel stripped the tag and pcapgo passes its TCI along with priority bits set
+	packet := decoder.Decode(frame{
+		data: serialize(t, p.layers...),
+		ci:   gopacket.CaptureInfo{Timestamp: testStart, AncillaryData: []interface{}{0xa00a}},
+	})
+	addr := newAddr(packet, testMAC1, netip.MustParseAddr("192.168.1.2"))
+	assert.Equal(t, uint16(10), addr.VLAN)
+	assert.Equal(t, uint16(0), addr.OuterVLAN)
+
+	// only the outer tag of a QinQ frame is stripped
+	packet = decoder.Decode(frame{
+		data: serialize(t, tagged(p, 10).layers...),
+		ci:   gopacket.CaptureInfo{Timestamp: testStart, AncillaryData: []interface{}{100}},
+	})
+	addr = newAddr(packet, testMAC1, netip.MustParseAddr("192.168.1.2"))
+	assert.Equal(t, uint16(10), addr.VLAN)
+	assert.Equal(t, uint16(100), addr.OuterVLAN)
+}
+
+func TestUpdateHosts_VLANs(t *testing.T) {
+	hosts := hostmonitor.NewHostMap()
+	handler := UpdateHosts(hosts, nil)
+
+	// the same mac on two vlans of a trunk port
+	p := udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 53)
+	require.NoError(t, handler(context.Background(), decode(t, tagged(p, 10))))
+	require.NoError(t, handler(context.Background(), decode(t, tagged(p, 100, 20))))
+
+	changes := collectChanges(hosts)
+	require.Len(t, changes, 2)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[0].ChangeType)
+	assert.Equal(t, uint16(10), changes[0].Addr.VLAN)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[1].ChangeType, "not an ip change of the host on vlan 10")
+	assert.Equal(t, uint16(20), changes[1].Addr.VLAN)
+	assert.Equal(t, uint16(100), changes[1].Addr.OuterVLAN)
+}
+
+func TestDefaultFilter_VLANs(t *testing.T) {
+	dhcp := udpPacket(t, testStart, testMAC1, gatewayMAC, "0.0.0.0", "255.255.255.255", 68, 67)
+	quic := udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 443)
+	serialized := func(p testPacket) []byte {
+		return serialize(t, p.layers...)
+	}
+
+	filter, err := DefaultFilter()
+	require.NoError(t, err)
+	assert.Equal(t, snapLen, runFilter(t, filter, serialized(tagged(dhcp, 10))))
+	assert.Equal(t, ethHeaderLen+vlanTagLen+20+transportHeaderLen, runFilter(t, filter, serialized(tagged(quic, 10))))
+	assert.Equal(t, ethHeaderLen+2*vlanTagLen+20+transportHeaderLen, runFilter(t, filter, serialized(tagged(quic, 100, 10))))
+
+	// only vlan 10, either as the only tag or one of two
+	filter, err = DefaultFilter(10)
+	require.NoError(t, err)
+	assert.Equal(t, snapLen, runFilter(t, filter, serialized(tagged(dhcp, 10))))
+	assert.Equal(t, snapLen, runFilter(t, filter, serialized(tagged(dhcp, 100, 10))))
+	assert.Equal(t, 0, runFilter(t, filter, serialized(tagged(dhcp, 20))))
+	assert.Equal(t, 0, runFilter(t, filter, serialized(dhcp)))
+
+	// untagged frames too
+	filter, err = DefaultFilter(0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, snapLen, runFilter(t, filter, serialized(dhcp)))
+	assert.Equal(t, 0, runFilter(t, filter, serialized(tagged(dhcp, 20))))
+
+	// negated expressions don't match frames with more tags
+	filter, err = CompileFilter("not ip")
+	require.NoError(t, err)
+	assert.Equal(t, 0, runFilter(t, filter, serialized(tagged(dhcp, 10))))
+	assert.Equal(t, 0, runFilter(t, filter, serialized(tagged(dhcp, 100, 10))))
+}
+
+// runStrippedFilter runs the filter on a frame read from a linux packet socket, the ancillary loads of the vlan tag
+// stripped from the frame are replaced by the values the kernel would load
+func runStrippedFilter(t *testing.T, filter []bpf.Instruction, data []byte, vlan int) int {
+	replaced := make([]bpf.Instruction, len(filter))
+	for i, inst := range filter {
+		replaced[i] = inst
+		if ext, ok := inst.(bpf.LoadExtension); ok {
+			switch ext.Num {
+			case bpf.ExtVLANTag:
+				replaced[i] = bpf.LoadConstant{Dst: bpf.RegA, Val: uint32(vlan)}
+			case bpf.ExtVLANTagPresent:
+				present := uint32(0)
+				if vlan >= 0 {
+					present = 1
+				}
+				replaced[i] = bpf.LoadConstant{Dst: bpf.RegA, Val: present}
+			}
+		}
+	}
+	return runFilter(t, replaced, data)
+}
+
+func TestBuildFilter_StrippedVLANs(t *testing.T) {
+	dhcp := udpPacket(t, testStart, testMAC1, gatewayMAC, "0.0.0.0", "255.255.255.255", 68, 67)
+	quic := udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 443)
+	serialized := func(p testPacket) []byte {
+		return serialize(t, p.layers...)
+	}
+	const untagged = -1
+
+	// without vlans the program is the same, the stripped tag doesn't move the offsets
+	filter, err := BuildFilter("", strippedVLANTags)
+	require.NoError(t, err)
+	inline, err := BuildFilter("", inlineVLANTags)
+	require.NoError(t, err)
+	assert.Equal(t, inline, filter)
+
+	// only vlan 10, either as the stripped tag or the tag left in a QinQ frame
+	filter, err = BuildFilter("", strippedVLANTags, 10)
+	require.NoError(t, err)
+	assert.Equal(t, snapLen, runStrippedFilter(t, filter, serialized(dhcp), 10))
+	assert.Equal(t, snapLen, runStrippedFilter(t, filter, serialized(dhcp), 0x200a), "priority bits are ignored")
+	assert.Equal(t, ethHeaderLen+20+transportHeaderLen, runStrippedFilter(t, filter, serialized(quic), 10))
+	assert.Equal(t, snapLen, runStrippedFilter(t, filter, serialized(tagged(dhcp, 10)), 100))
+	assert.Equal(t, snapLen, runStrippedFilter(t, filter, serialized(tagged(dhcp, 20)), 10))
+	assert.Equal(t, 0, runStrippedFilter(t, filter, serialized(dhcp), 20))
+	assert.Equal(t, 0, runStrippedFilter(t, filter, serialized(tagged(dhcp, 20)), 100))
+	assert.Equal(t, 0, runStrippedFilter(t, filter, serialized(dhcp), untagged))
+
+	// untagged frames too
+	filter, err = BuildFilter("udp", strippedVLANTags, 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, snapLen, runStrippedFilter(t, filter, serialized(dhcp), untagged))
+	assert.Equal(t, snapLen, runStrippedFilter(t, filter, serialized(dhcp), 10))
+	assert.Equal(t, 0, runStrippedFilter(t, filter, serialized(dhcp), 20))
+}
+
+func TestParseVLANs(t *testing.T) {
+	vlans, err := parseVLANs("0, 10,4094")
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{0, 10, 4094}, vlans)
+
+	_, err = parseVLANs("4096")
+	assert.Error(t, err)
+}
+
+func TestVLANScoping(t *testing.T) {
+	// the same ip on two vlans, each with its own network
+	hosts := hostmonitor.NewHostMap()
+	hosts.UpdateAddresses([]hostmonitor.Addr{
+		{MAC: testMAC1, IP: netip.MustParseAddr("192.168.1.10"), VLAN: 10},
+		{MAC: testMAC2, IP: netip.MustParseAddr("192.168.1.10"), VLAN: 20},
+	})
+
+	// a response forwarded by the router is attributed to the host with the ip on the vlan of the frame
+	dnsLog := NewDNSLog(hosts)
+	handler := LogDNSQueries(hosts, dnsLog)
+	p := udpPacket(t, testStart, gatewayMAC, gatewayMAC, "192.168.1.1", "192.168.1.10", dnsPort, 50000,
+		dnsResponse(1, "example.com", "93.184.216.34"))
+	require.NoError(t, handler(context.Background(), decode(t, tagged(p, 20))))
+	assert.Len(t, dnsLog.TopDomains(hostmonitor.Addr{MAC: testMAC2, VLAN: 20}, 0), 1)
+	assert.Empty(t, dnsLog.TopDomains(hostmonitor.Addr{MAC: testMAC1, VLAN: 10}, 0))
+
+	// a mac leases an address on each vlan
+	leases := NewLeaseTable()
+	leases.Bind(Lease{MAC: testMAC1, IP: netip.MustParseAddr("192.168.1.10"), VLAN: 10, Expires: testStart.Add(time.Hour)})
+	leases.Bind(Lease{MAC: testMAC1, IP: netip.MustParseAddr("10.0.20.5"), VLAN: 20, Expires: testStart.Add(time.Hour)})
+	lease, ok := leases.Lease(hostmonitor.Addr{MAC: testMAC1, VLAN: 10})
+	require.True(t, ok)
+	assert.Equal(t, netip.MustParseAddr("192.168.1.10"), lease.IP)
+	assert.Len(t, leases.Leases(), 2)
+	assert.True(t, leases.Expiry(hostmonitor.Addr{MAC: testMAC1, IP: netip.MustParseAddr("192.168.1.10"), VLAN: 20}).IsZero())
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// how long a nearby device is remembered after it was last seen, phones probe with a new random MAC every few
+	// minutes so most are never seen again
+	wirelessDeviceTimeout = 30 * time.Minute
+	// how often forgotten devices are looked for, in packet time
+	wirelessSweepInterval = time.Minute
+	// the most SSIDs kept per device
+	maxWirelessSSIDs = 32
+
+	// the information element of the network name
+	dot11SSIDElement = 0
+)
+
+// isWirelessLinkType returns whether frames of the link type are 802.11 frames of a monitor mode capture.
+func isWirelessLinkType(linkType layers.LinkType) bool {
+	return linkType == layers.LinkTypeIEEE80211Radio || linkType == layers.LinkTypeIEEE802_11
+}
+
+// WirelessDevice is a device seen nearby over 802.11 in monitor mode, whether or not it's associated to our network.
+type WirelessDevice struct {
+	MAC       net.HardwareAddr
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Signal is the strength of the last frame the device sent in dBm, 0 if the capture doesn't report it.
+	Signal int8
+	// MaxSignal is the strongest frame the device sent, the closest it came.
+	MaxSignal int8
+	// SSIDs are the networks the device probed for or associated to, in the order first seen.
+	SSIDs []string
+	// BSSID is the access point the device last associated to or sent data to, nil if it hasn't.
+	BSSID net.HardwareAddr
+
+	ProbeRequests uint64
+	Associations  uint64
+	DataFrames    uint64
+}
+
+// Randomized returns whether the MAC is locally administered, as the random MACs phones probe with are.
+func (d WirelessDevice) Randomized() bool {
+	return len(d.MAC) > 0 && d.MAC[0]&0x02 != 0
+}
+
+func (d WirelessDevice) String() string {
+	return fmt.Sprintf("mac=(%s) randomized=(%t) signal=(%ddBm) max-signal=(%ddBm) ssids=(%s) bssid=(%s) probes=(%d) associations=(%d) data=(%d) last-seen=(%s)",
+		d.MAC, d.Randomized(), d.Signal, d.MaxSignal, strings.Join(d.SSIDs, ","), d.BSSID, d.ProbeRequests,
+		d.Associations, d.DataFrames, d.LastSeen)
+}
+
+func (d *WirelessDevice) copy() WirelessDevice {
+	c := *d
+	c.SSIDs = append([]string(nil), d.SSIDs...)
+	return c
+}
+
+// addSSID adds the SSID unless it's already known, returning whether it was added.
+func (d *WirelessDevice) addSSID(ssid []byte) bool {
+	// an empty SSID is a wildcard probe for any network
+	if len(ssid) == 0 || len(d.SSIDs) >= maxWirelessSSIDs {
+		return false
+	}
+	for _, known := range d.SSIDs {
+		if known == string(ssid) {
+			return false
+		}
+	}
+	d.SSIDs = append(d.SSIDs, string(ssid))
+	return true
+}
+
+// WirelessDevices keeps track of the devices seen nearby over 802.11. They're kept apart from the hosts of the LAN,
+// most of them are never on our network. Devices not seen for a while are forgotten.
+type WirelessDevices struct {
+	devices map[string]*WirelessDevice
+	// packet time devices were last looked for to forget
+	lastSweep time.Time
+	mux       *sync.Mutex
+}
+
+func NewWirelessDevices() *WirelessDevices {
+	return &WirelessDevices{
+		devices: make(map[string]*WirelessDevice),
+		mux:     &sync.Mutex{},
+	}
+}
+
+// wirelessFrame is what a frame tells about the device that sent it
+type wirelessFrame struct {
+	mac    net.HardwareAddr
+	ts     time.Time
+	signal int8
+	dot11  layers.Dot11Type
+	ssid   []byte
+	bssid  net.HardwareAddr
+}
+
+// add updates the device that sent the frame, returning a copy of it and whether the frame told something new about
+// it: a new SSID or access point.
+func (w *WirelessDevices) add(frame wirelessFrame) (WirelessDevice, bool) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if frame.ts.Sub(w.lastSweep) >= wirelessSweepInterval {
+		w.expire(frame.ts)
+		w.lastSweep = frame.ts
+	}
+
+	// indexing with the raw bytes doesn't allocate
+	device, ok := w.devices[string(frame.mac)]
+	if !ok {
+		device = &WirelessDevice{MAC: append(net.HardwareAddr(nil), frame.mac...), FirstSeen: frame.ts}
+		w.devices[string(frame.mac)] = device
+	}
+	if frame.ts.After(device.LastSeen) {
+		device.LastSeen = frame.ts
+	}
+	if frame.signal != 0 {
+		device.Signal = frame.signal
+		if device.MaxSignal == 0 || frame.signal > device.MaxSignal {
+			device.MaxSignal = frame.signal
+		}
+	}
+
+	changed := device.addSSID(frame.ssid)
+	if frame.bssid != nil && !bytes.Equal(frame.bssid, device.BSSID) {
+		device.BSSID = append(net.HardwareAddr(nil), frame.bssid...)
+		changed = true
+	}
+	switch frame.dot11.MainType() {
+	case layers.Dot11TypeData:
+		device.DataFrames++
+	case layers.Dot11TypeMgmt:
+		if frame.dot11 == layers.Dot11TypeMgmtProbeReq {
+			device.ProbeRequests++
+		} else {
+			device.Associations++
+		}
+	}
+
+	return device.copy(), changed
+}
+
+// expire forgets the devices not seen since the timeout before now. The lock must be held.
+func (w *WirelessDevices) expire(now time.Time) {
+	for key, device := range w.devices {
+		if now.Sub(device.LastSeen) >= wirelessDeviceTimeout {
+			delete(w.devices, key)
+		}
+	}
+}
+
+// Device returns the device with mac.
+func (w *WirelessDevices) Device(mac net.HardwareAddr) (WirelessDevice, bool) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	device, ok := w.devices[string(mac)]
+	if !ok {
+		return WirelessDevice{}, false
+	}
+	return device.copy(), true
+}
+
+// Devices returns the devices ordered by the strongest signal they were seen with, the closest first.
+func (w *WirelessDevices) Devices() []WirelessDevice {
+	w.mux.Lock()
+	devices := make([]WirelessDevice, 0, len(w.devices))
+	for _, device := range w.devices {
+		devices = append(devices, device.copy())
+	}
+	w.mux.Unlock()
+
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].MaxSignal != devices[j].MaxSignal {
+			return devices[i].MaxSignal > devices[j].MaxSignal
+		}
+		return bytes.Compare(devices[i].MAC, devices[j].MAC) < 0
+	})
+	return devices
+}
+
+// PrintDevices logs every device, the closest first.
+func (w *WirelessDevices) PrintDevices() {
+	for _, device := range w.Devices() {
+		log.Printf("wifi device %s", device)
+	}
+}
+
+// wirelessLayers are the layers TrackWirelessDevices looks at.
+var wirelessLayers = []gopacket.LayerType{
+	layers.LayerTypeRadioTap,
+	layers.LayerTypeDot11,
+}
+
+// TrackWirelessDevices keeps track of the devices sending probe requests, association requests and data frames to an
+// access point, with the signal strength reported by radiotap and the SSIDs they're looking for. Frames sent by
+// access points aren't tracked.
+func TrackWirelessDevices(devices *WirelessDevices) PacketHandler {
+	return func(_ context.Context, packet gopacket.Packet) error {
+		dot11, ok := packet.Layer(layers.LayerTypeDot11).(*layers.Dot11)
+		if !ok {
+			// nothing to do - not an 802.11 frame
+			return nil
+		}
+
+		frame := wirelessFrame{dot11: dot11.Type, ts: packet.Metadata().Timestamp}
+		switch dot11.Type {
+		case layers.Dot11TypeMgmtProbeReq:
+			frame.mac = dot11.Address2
+			frame.ssid = dot11SSID(dot11.Payload)
+		case layers.Dot11TypeMgmtAssociationReq, layers.Dot11TypeMgmtReassociationReq:
+			// capabilities and listen interval, then the current access point when reassociating
+			fixed := 4
+			if dot11.Type == layers.Dot11TypeMgmtReassociationReq {
+				fixed += 6
+			}
+			if len(dot11.Payload) < fixed {
+				return nil
+			}
+			frame.mac, frame.bssid = dot11.Address2, dot11.Address3
+			frame.ssid = dot11SSID(dot11.Payload[fixed:])
+		default:
+			// only frames from a station to the access point, the rest are sent by the access point
+			if dot11.Type.MainType() != layers.Dot11TypeData || !dot11.Flags.ToDS() || dot11.Flags.FromDS() {
+				return nil
+			}
+			frame.mac, frame.bssid = dot11.Address2, dot11.Address1
+		}
+		if len(frame.mac) != 6 || frame.mac[0]&0x01 != 0 {
+			// not sent by a single device
+			return nil
+		}
+
+		if radioTap, ok := packet.Layer(layers.LayerTypeRadioTap).(*layers.RadioTap); ok && radioTap.Present.DBMAntennaSignal() {
+			frame.signal = radioTap.DBMAntennaSignal
+		}
+
+		device, changed := devices.add(frame)
+		if changed {
+			log.Printf("wifi device %s(randomized=%t) seen: signal=(%ddBm) ssids=(%s) bssid=(%s)", device.MAC,
+				device.Randomized(), device.Signal, strings.Join(device.SSIDs, ","), device.BSSID)
+		}
+
+		return nil
+	}
+}
+
+// dot11SSID returns the SSID among the information elements of a management frame, nil if there's none.
+func dot11SSID(elements []byte) []byte {
+	for len(elements) >= 2 {
+		id, length := elements[0], int(elements[1])
+		if len(elements) < 2+length {
+			return nil
+		}
+		if id == dot11SSIDElement {
+			return elements[2 : 2+length]
+		}
+		elements = elements[2+length:]
+	}
+	return nil
+}
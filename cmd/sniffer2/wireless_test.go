@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	// phones probe with random, locally administered MACs
+	testPhoneMAC  = net.HardwareAddr{0xda, 0xa1, 0x19, 0x00, 0x00, 0x01}
+	testLaptopMAC = net.HardwareAddr{0x3c, 0x22, 0xfb, 0x00, 0x00, 0x02}
+	testAPMAC     = net.HardwareAddr{0x50, 0xc7, 0xbf, 0x00, 0x00, 0x03}
+	testAP2MAC    = net.HardwareAddr{0x50, 0xc7, 0xbf, 0x00, 0x00, 0x04}
+)
+
+// frame control of the 802.11 frames, the subtype and type followed by the flags
+const (
+	dot11ProbeReq     = 0x40
+	dot11AssocReq     = 0x00
+	dot11ReassocReq   = 0x20
+	dot11ProbeResp    = 0x50
+	dot11QoSData      = 0x88
+	dot11FlagToDS     = 0x01
+	dot11FlagFromDS   = 0x02
+	dot11SSIDWildcard = ""
+)
+
+// wifiFrame returns a radiotap header reporting the signal followed by an 802.11 frame without FCS
+func wifiFrame(frameControl, flags byte, addr1, addr2, addr3 net.HardwareAddr, signal int8, body []byte) []byte {
+	// version, padding, length, present flags and dbm antenna signal, then the fields
+	data := []byte{0, 0, 10, 0, 0x22, 0, 0, 0, 0, byte(signal)}
+	data = append(data, frameControl, flags, 0, 0)
+	data = append(data, addr1...)
+	data = append(data, addr2...)
+	data = append(data, addr3...)
+	data = append(data, 0, 0)
+	return append(data, body...)
+}
+
+// ssidElement returns the information element of the SSID
+func ssidElement(ssid string) []byte {
+	return append([]byte{dot11SSIDElement, byte(len(ssid))}, ssid...)
+}
+
+func probeRequest(mac net.HardwareAddr, signal int8, ssid string) []byte {
+	// followed by the supported rates
+	body := append(ssidElement(ssid), 1, 4, 0x02, 0x04, 0x0b, 0x16)
+	return wifiFrame(dot11ProbeReq, 0, layers.EthernetBroadcast, mac, layers.EthernetBroadcast, signal, body)
+}
+
+func associationRequest(mac, bssid net.HardwareAddr, signal int8, ssid string) []byte {
+	// capabilities and listen interval
+	body := append([]byte{0x31, 0x04, 0x0a, 0x00}, ssidElement(ssid)...)
+	return wifiFrame(dot11AssocReq, 0, bssid, mac, bssid, signal, body)
+}
+
+func reassociationRequest(mac, bssid, current net.HardwareAddr, signal int8, ssid string) []byte {
+	// capabilities, listen interval and the current access point
+	body := append(append([]byte{0x31, 0x04, 0x0a, 0x00}, current...), ssidElement(ssid)...)
+	return wifiFrame(dot11ReassocReq, 0, bssid, mac, bssid, signal, body)
+}
+
+func wifiData(flags byte, addr1, addr2, addr3 net.HardwareAddr, signal int8) []byte {
+	// qos control and an encrypted payload
+	return wifiFrame(dot11QoSData, flags, addr1, addr2, addr3, signal, []byte{0, 0, 0xde, 0xad, 0xbe, 0xef})
+}
+
+// writeWifiCapture writes the frames to a radiotap capture, one a second from testStart
+func writeWifiCapture(t *testing.T, frames ...[]byte) string {
+	path := filepath.Join(t.TempDir(), "wifi.pcap")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	w := pcapgo.NewWriter(f)
+	require.NoError(t, w.WriteFileHeader(snapLen, layers.LinkTypeIEEE80211Radio))
+	for i, data := range frames {
+		ci := gopacket.CaptureInfo{Timestamp: testStart.Add(time.Duration(i) * time.Second), CaptureLength: len(data), Length: len(data)}
+		require.NoError(t, w.WritePacket(ci, data))
+	}
+
+	return path
+}
+
+func TestTrackWirelessDevices(t *testing.T) {
+	devices := NewWirelessDevices()
+	handler := NewLayerDecoder(layers.LinkTypeIEEE80211Radio, wirelessLayers...).Handler(TrackWirelessDevices(devices))
+	handle := func(i int, data []byte) {
+		ts := testStart.Add(time.Duration(i) * time.Second)
+		require.NoError(t, handler(context.Background(), frame{data: data, ci: gopacket.CaptureInfo{Timestamp: ts}}))
+	}
+
+	handle(0, probeRequest(testPhoneMAC, -70, dot11SSIDWildcard))
+	handle(1, probeRequest(testPhoneMAC, -60, "home"))
+	handle(2, probeRequest(testPhoneMAC, -65, "cafe"))
+	handle(3, probeRequest(testPhoneMAC, -65, "home"))
+	handle(4, associationRequest(testLaptopMAC, testAPMAC, -40, "home"))
+	handle(5, wifiData(dot11FlagToDS, testAPMAC, testLaptopMAC, layers.EthernetBroadcast, -42))
+	// sent by the access point
+	handle(6, wifiData(dot11FlagFromDS, testLaptopMAC, testAPMAC, testAPMAC, -30))
+	handle(7, wifiFrame(dot11ProbeResp, 0, testPhoneMAC, testAPMAC, testAPMAC, -30, make([]byte, 12)))
+	handle(8, reassociationRequest(testLaptopMAC, testAP2MAC, testAPMAC, -50, "home-5g"))
+
+	phone, ok := devices.Device(testPhoneMAC)
+	require.True(t, ok)
+	assert.True(t, phone.Randomized())
+	assert.Equal(t, []string{"home", "cafe"}, phone.SSIDs, "wildcard probes have no SSID")
+	assert.Equal(t, int8(-65), phone.Signal)
+	assert.Equal(t, int8(-60), phone.MaxSignal)
+	assert.Equal(t, uint64(4), phone.ProbeRequests)
+	assert.Nil(t, phone.BSSID)
+	assert.Equal(t, testStart, phone.FirstSeen)
+	assert.Equal(t, testStart.Add(3*time.Second), phone.LastSeen)
+
+	laptop, ok := devices.Device(testLaptopMAC)
+	require.True(t, ok)
+	assert.False(t, laptop.Randomized())
+	assert.Equal(t, []string{"home", "home-5g"}, laptop.SSIDs)
+	assert.Equal(t, testAP2MAC, laptop.BSSID, "roamed to the second access point")
+	assert.Equal(t, uint64(2), laptop.Associations)
+	assert.Equal(t, uint64(1), laptop.DataFrames)
+	assert.Equal(t, int8(-50), laptop.Signal)
+	assert.Equal(t, int8(-40), laptop.MaxSignal)
+
+	_, ok = devices.Device(testAPMAC)
+	assert.False(t, ok, "frames of the access point aren't tracked")
+
+	// the closest first
+	all := devices.Devices()
+	require.Len(t, all, 2)
+	assert.Equal(t, testLaptopMAC, all[0].MAC)
+	assert.Equal(t, testPhoneMAC, all[1].MAC)
+}
+
+func TestWirelessDevices_Expire(t *testing.T) {
+	devices := NewWirelessDevices()
+	devices.add(wirelessFrame{mac: testPhoneMAC, ts: testStart, dot11: layers.Dot11TypeMgmtProbeReq})
+	devices.add(wirelessFrame{mac: testLaptopMAC, ts: testStart.Add(wirelessDeviceTimeout - time.Minute), dot11: layers.Dot11TypeMgmtProbeReq})
+	devices.add(wirelessFrame{mac: testLaptopMAC, ts: testStart.Add(wirelessDeviceTimeout), dot11: layers.Dot11TypeMgmtProbeReq})
+
+	_, ok := devices.Device(testPhoneMAC)
+	assert.False(t, ok)
+	_, ok = devices.Device(testLaptopMAC)
+	assert.True(t, ok)
+}
+
+func TestDot11SSID(t *testing.T) {
+	assert.Equal(t, []byte("home"), dot11SSID(append([]byte{1, 1, 0x82}, ssidElement("home")...)))
+	assert.Nil(t, dot11SSID([]byte{1, 1, 0x82}))
+	assert.Nil(t, dot11SSID([]byte{dot11SSIDElement, 8, 'h'}), "truncated")
+}
+
+func TestPipeline_Wireless(t *testing.T) {
+	path := writeWifiCapture(t,
+		probeRequest(testPhoneMAC, -60, "home"),
+		associationRequest(testLaptopMAC, testAPMAC, -40, "home"),
+		wifiData(dot11FlagToDS, testAPMAC, testLaptopMAC, layers.EthernetBroadcast, -42),
+	)
+	// the ethernet filter doesn't apply to 802.11 frames
+	filter, err := DefaultFilter()
+	require.NoError(t, err)
+	handle, linkType, closeFunc, err := NewReplayHandle(path, 0, filter)
+	require.NoError(t, err)
+	defer closeFunc()
+	require.Equal(t, layers.LinkTypeIEEE80211Radio, linkType)
+
+	flows, err := NewFlowTable(FlowTableConfig{MaxFlows: 16, IdleTimeout: time.Minute})
+	require.NoError(t, err)
+	p := newPipeline("", handle, linkType, NewMacHostMap(),
+		fingerprintDBs{dhcp: DefaultFingerprints(), syn: DefaultSYNFingerprints(), tls: &TLSFingerprintDB{}}, flows, nil)
+	p.workers = WorkerPoolConfig{Workers: 2, QueueLen: 4, Block: true, LinkType: linkType}
+	assert.Equal(t, wirelessLayers, p.handlers.Layers())
+
+	err = p.run(context.Background())
+	require.True(t, errors.Is(err, errPacketsClosed), "unexpected error: %v", err)
+	p.hosts.Close()
+	<-p.notificationsDone
+
+	assert.Len(t, p.wireless.Devices(), 2)
+	// nearby devices aren't hosts of the LAN
+	assert.Empty(t, p.traffic.TopTalkers(5, time.Hour))
+	assert.Equal(t, 0, flows.Len())
+	stats := p.handlers.Stats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, "wifi", stats[0].Name)
+	assert.Equal(t, uint64(3), stats[0].Packets)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// how often dropped packets are logged while queues are full
+const dropLogInterval = 10 * time.Second
+
+// WorkerPoolConfig configures the workers packets are handled on.
+type WorkerPoolConfig struct {
+	// Workers is the number of goroutines handling packets.
+	Workers int
+	// QueueLen is the number of packets queued for each worker.
+	QueueLen int
+	// Block waits for room in a full queue instead of dropping the packet, for sources that can wait like capture
+	// files.
+	Block bool
+	// LinkType is the link type of the frames, frames are only sharded by host on ethernet.
+	LinkType layers.LinkType
+}
+
+// WorkerPool handles packets on several goroutines. Packets are sharded by the MAC of the host on the private network
+// they belong to, so the packets of a host are handled in order by the same worker.
+type WorkerPool struct {
+	config WorkerPoolConfig
+
+	queues  []chan frame
+	dropped []uint64
+	// when drops were last logged, in unix nanos
+	lastDropLog int64
+	wg          *sync.WaitGroup
+}
+
+// NewWorkerPool starts the workers, each passes the frames queued for it to its own handler from newHandler with ctx
+// until the pool is closed.
+func NewWorkerPool(ctx context.Context, config WorkerPoolConfig, newHandler func() frameHandler) (*WorkerPool, error) {
+	if config.Workers <= 0 {
+		return nil, fmt.Errorf("workers must be positive, got %d", config.Workers)
+	}
+	if config.QueueLen <= 0 {
+		return nil, fmt.Errorf("queue length must be positive, got %d", config.QueueLen)
+	}
+
+	pool := &WorkerPool{
+		config:  config,
+		queues:  make([]chan frame, config.Workers),
+		dropped: make([]uint64, config.Workers),
+		wg:      &sync.WaitGroup{},
+	}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan frame, config.QueueLen)
+		pool.wg.Add(1)
+		go pool.work(ctx, pool.queues[i], newHandler())
+	}
+
+	return pool, nil
+}
+
+func (w *WorkerPool) work(ctx context.Context, queue <-chan frame, handler frameHandler) {
+	defer w.wg.Done()
+	// queued packets are still handled after the context is done, until the queue is closed
+	for f := range queue {
+		if err := handler(ctx, f); err != nil {
+			log.Println("error handling packet:", err)
+		}
+	}
+}
+
+// Dispatch queues the frame for the worker of its host, it's a frameHandler. The frame is dropped if the queue is
+// full, unless the pool blocks.
+func (w *WorkerPool) Dispatch(ctx context.Context, f frame) error {
+	shard := w.shard(f)
+	if w.config.Block {
+		select {
+		case w.queues[shard] <- f:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	select {
+	case w.queues[shard] <- f:
+	default:
+		dropped := atomic.AddUint64(&w.dropped[shard], 1)
+		now := time.Now().UnixNano()
+		if last := atomic.LoadInt64(&w.lastDropLog); now-last >= int64(dropLogInterval) &&
+			atomic.CompareAndSwapInt64(&w.lastDropLog, last, now) {
+			log.Printf("worker %d queue full, dropped %d packets so far", shard, dropped)
+		}
+	}
+	return nil
+}
+
+// shard returns the worker of the frame
+func (w *WorkerPool) shard(f frame) int {
+	if len(w.queues) == 1 || w.config.LinkType != layers.LinkTypeEthernet {
+		return 0
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write(shardMAC(f.data))
+	return int(h.Sum32() % uint32(len(w.queues)))
+}
+
+// shardMAC returns the MAC of the host on the private network an ethernet frame belongs to: the sender, unless the
+// frame is coming in from outside the network or is a DNS response, which belongs to the client it's sent to so it's
+// handled after the query even when a local resolver answers. Frames are sharded before they're decoded, so only the
+// headers needed are read from the raw frame.
+func shardMAC(data []byte) []byte {
+	if len(data) < ethHeaderLen {
+		return nil
+	}
+	dst, src := data[0:6], data[6:12]
+
+	offset := 12
+	etherType := layers.EthernetType(binary.BigEndian.Uint16(data[offset:]))
+	for tags := 0; tags < maxVLANTags && (etherType == layers.EthernetTypeDot1Q || etherType == layers.EthernetTypeQinQ); tags++ {
+		offset += vlanTagLen
+		if len(data) < offset+2 {
+			return src
+		}
+		etherType = layers.EthernetType(binary.BigEndian.Uint16(data[offset:]))
+	}
+	ip := data[offset+2:]
+
+	var (
+		srcIP, dstIP netip.Addr
+		proto        uint8
+		transport    []byte
+	)
+	switch {
+	case etherType == layers.EthernetTypeIPv4 && len(ip) >= 20:
+		srcIP, dstIP = netip.AddrFrom4(*(*[4]byte)(ip[12:16])), netip.AddrFrom4(*(*[4]byte)(ip[16:20]))
+		// only the first fragment carries the transport header
+		if headerLen := int(ip[0]&0x0f) * 4; binary.BigEndian.Uint16(ip[6:])&0x1fff == 0 && len(ip) >= headerLen {
+			proto, transport = ip[9], ip[headerLen:]
+		}
+	case etherType == layers.EthernetTypeIPv6 && len(ip) >= 40:
+		srcIP, dstIP = netip.AddrFrom16(*(*[16]byte)(ip[8:24])), netip.AddrFrom16(*(*[16]byte)(ip[24:40]))
+		proto, transport = ip[6], ip[ipv6HeaderLen:]
+	default:
+		return src
+	}
+
+	if !isLocalAddr(srcIP) && isLocalAddr(dstIP) {
+		return dst
+	}
+	if proto == protoUDP && len(transport) >= 2 && binary.BigEndian.Uint16(transport) == dnsPort && dst[0]&0x01 == 0 {
+		return dst
+	}
+	return src
+}
+
+// Dropped returns the number of packets dropped because the queue of their worker was full.
+func (w *WorkerPool) Dropped() uint64 {
+	var dropped uint64
+	for i := range w.dropped {
+		dropped += atomic.LoadUint64(&w.dropped[i])
+	}
+	return dropped
+}
+
+// Close stops queueing packets and waits for the workers to handle the packets already queued. Dispatch must not be
+// called once closed.
+func (w *WorkerPool) Close() {
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.wg.Wait()
+
+	if dropped := w.Dropped(); dropped > 0 {
+		log.Printf("dropped %d packets with full worker queues", dropped)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFrame serializes the packet into a frame as read from a packet source
+func testFrame(t testing.TB, p testPacket) frame {
+	data := serialize(t, p.layers...)
+	return frame{data: data, ci: gopacket.CaptureInfo{Timestamp: p.ts, CaptureLength: len(data), Length: len(data)}}
+}
+
+// handleFrames returns a worker handler that passes every frame to handle
+func handleFrames(handle func(f frame)) func() frameHandler {
+	return func() frameHandler {
+		return func(_ context.Context, f frame) error {
+			handle(f)
+			return nil
+		}
+	}
+}
+
+func TestWorkerPool_OrdersPerHost(t *testing.T) {
+	var mux sync.Mutex
+	handled := make(map[string][]time.Time)
+	config := WorkerPoolConfig{Workers: 4, QueueLen: 64, Block: true, LinkType: layers.LinkTypeEthernet}
+	pool, err := NewWorkerPool(context.Background(), config, handleFrames(func(f frame) {
+		mux.Lock()
+		defer mux.Unlock()
+		mac := net.HardwareAddr(shardMAC(f.data)).String()
+		handled[mac] = append(handled[mac], f.ci.Timestamp)
+	}))
+	require.NoError(t, err)
+
+	var packets []testPacket
+	for i := 0; i < 50; i++ {
+		ts := testStart.Add(time.Duration(i) * time.Millisecond)
+		packets = append(packets,
+			udpPacket(t, ts, testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 53),
+			// replies belong to the host they're sent to
+			udpPacket(t, ts, gatewayMAC, testMAC2, "8.8.8.8", "192.168.1.3", 53, 50000),
+		)
+	}
+	for _, p := range packets {
+		require.NoError(t, pool.Dispatch(context.Background(), testFrame(t, p)))
+	}
+	pool.Close()
+
+	assert.Len(t, handled, 2)
+	assert.Contains(t, handled, testMAC1.String())
+	assert.Contains(t, handled, testMAC2.String())
+	for mac, seen := range handled {
+		assert.Len(t, seen, 50, mac)
+		for i := 1; i < len(seen); i++ {
+			assert.True(t, seen[i].After(seen[i-1]), "packets of %s out of order", mac)
+		}
+	}
+	assert.Equal(t, uint64(0), pool.Dropped())
+}
+
+func TestWorkerPool_Drops(t *testing.T) {
+	release := make(chan struct{})
+	var mux sync.Mutex
+	handled := 0
+	pool, err := NewWorkerPool(context.Background(), WorkerPoolConfig{Workers: 1, QueueLen: 2}, handleFrames(func(frame) {
+		<-release
+		mux.Lock()
+		defer mux.Unlock()
+		handled++
+	}))
+	require.NoError(t, err)
+
+	packet := testFrame(t, udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 53))
+	// the first packet is taken by the worker, the next two fill the queue
+	require.NoError(t, pool.Dispatch(context.Background(), packet))
+	require.Eventually(t, func() bool { return len(pool.queues[0]) == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, pool.Dispatch(context.Background(), packet))
+	}
+	assert.Equal(t, uint64(3), pool.Dropped())
+
+	close(release)
+	pool.Close()
+	assert.Equal(t, 3, handled, "queued packets are drained")
+}
+
+func TestWorkerPool_BlockCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	pool, err := NewWorkerPool(ctx, WorkerPoolConfig{Workers: 1, QueueLen: 1, Block: true}, handleFrames(func(frame) {
+		<-release
+	}))
+	require.NoError(t, err)
+
+	packet := testFrame(t, udpPacket(t, testStart, testMAC1, gatewayMAC, "192.168.1.2", "8.8.8.8", 50000, 53))
+	require.NoError(t, pool.Dispatch(ctx, packet))
+	require.Eventually(t, func() bool { return len(pool.queues[0]) == 0 }, time.Second, time.Millisecond)
+	require.NoError(t, pool.Dispatch(ctx, packet))
+
+	// the queue is full, waiting for room stops with the context
+	cancel()
+	assert.True(t, errors.Is(pool.Dispatch(ctx, packet), context.Canceled))
+	close(release)
+	pool.Close()
+}
+
+func TestNewWorkerPool_Errors(t *testing.T) {
+	_, err := NewWorkerPool(context.Background(), WorkerPoolConfig{Workers: 0, QueueLen: 1}, nil)
+	assert.Error(t, err)
+	_, err = NewWorkerPool(context.Background(), WorkerPoolConfig{Workers: 1, QueueLen: 0}, nil)
+	assert.Error(t, err)
+}
+
+func TestPipeline_Workers(t *testing.T) {
+	var packets []testPacket
+	for i := 0; i < 20; i++ {
+		ts := testStart.Add(time.Duration(i) * time.Second)
+		mac := net.HardwareAddr{0x0a, 0, 0, 0, 0, byte(i % 5)}
+		ip := net.IPv4(192, 168, 1, byte(10+i%5)).String()
+		packets = append(packets,
+			udpPacket(t, ts, mac, gatewayMAC, ip, "8.8.8.8", 50000, 53),
+			udpPacket(t, ts, gatewayMAC, mac, "8.8.8.8", ip, 53, 50000),
+		)
+	}
+
+	handle, linkType, closeFunc, err := NewReplayHandle(writeCapture(t, packets), 0, nil)
+	require.NoError(t, err)
+	defer closeFunc()
+
+	clock := &packetClock{}
+	flows, err := NewFlowTable(FlowTableConfig{MaxFlows: 16, IdleTimeout: time.Minute})
+	require.NoError(t, err)
+	p := newPipeline("", handle, linkType, NewMacHostMap(),
+		fingerprintDBs{dhcp: DefaultFingerprints(), syn: DefaultSYNFingerprints(), tls: &TLSFingerprintDB{}},
+		flows, nil, hostmonitor.ClockOption(clock.Now))
+	p.workers = WorkerPoolConfig{Workers: 4, QueueLen: 4, Block: true, LinkType: linkType}
+	p.clock = clock
+
+	err = p.run(context.Background())
+	require.True(t, errors.Is(err, errPacketsClosed), "unexpected error: %v", err)
+	p.hosts.Close()
+	<-p.notificationsDone
+	assert.Equal(t, testStart.Add(19*time.Second), clock.Now().UTC())
+	assert.Equal(t, 5, flows.Len())
+
+	for i := 0; i < 5; i++ {
+		mac := net.HardwareAddr{0x0a, 0, 0, 0, 0, byte(i)}
+		traffic, ok := p.traffic.Traffic(mac)
+		require.True(t, ok, mac)
+		assert.Equal(t, uint64(4), traffic.Total.Packets[OutboundTraffic], mac)
+		assert.Equal(t, uint64(4), traffic.Total.Packets[InboundTraffic], mac)
+	}
+}
@@ -1,10 +1,13 @@
 package hostmonitor
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/netip"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,10 +20,28 @@ type HostMap struct {
 
 	hosts     map[string][]*member
 	hostsLock *sync.Mutex
+	closed    bool
+	// the keys of the hosts actively using each ip, in the order they claimed it
+	byIP map[ipKey][]string
+
+	// metadata learned about each host, kept when the host goes offline
+	metadata map[string]map[string]interface{}
 
 	// configurable
-	offlineTimeout time.Duration
-	logger         logr.Logger
+	offlineTimeout  time.Duration
+	logger          logr.Logger
+	now             func() time.Time
+	detectConflicts bool
+	expires         func(addr Addr) time.Time
+	iface           string
+
+	// hosts are probed before they're reported offline if a prober is configured
+	prober        Prober
+	probeInterval time.Duration
+	nextProbe     time.Time
+	probeLock     *sync.Mutex
+	probeCtx      context.Context
+	cancelProbes  context.CancelFunc
 }
 
 func NewHostMap(options ...HostMapOption) *HostMap {
@@ -28,10 +49,15 @@ func NewHostMap(options ...HostMapOption) *HostMap {
 		changes:   make(chan Change, 128),
 		hosts:     make(map[string][]*member),
 		hostsLock: &sync.Mutex{},
+		byIP:      make(map[ipKey][]string),
+		metadata:  make(map[string]map[string]interface{}),
 
 		offlineTimeout: 5 * time.Minute,
 		logger:         stdr.New(log.Default()),
+		now:            time.Now,
+		probeLock:      &sync.Mutex{},
 	}
+	h.probeCtx, h.cancelProbes = context.WithCancel(context.Background())
 
 	for _, option := range options {
 		option.apply(h)
@@ -41,12 +67,16 @@ func NewHostMap(options ...HostMapOption) *HostMap {
 }
 
 func (h *HostMap) update(addr Addr, emitChanges bool) bool {
-	mac := addr.MAC.String()
-	if mac == "" {
+	if len(addr.MAC) == 0 {
 		return false
 	}
+	// the same mac on different vlans is a different host
+	mac := addr.HostKey()
+	if h.iface != "" {
+		addr.Interface = h.iface
+	}
 
-	now := time.Now()
+	now := h.now()
 
 	h.hostsLock.Lock()
 	existing, ok := h.hosts[mac]
@@ -60,6 +90,7 @@ func (h *HostMap) update(addr Addr, emitChanges bool) bool {
 				lastSeen: now,
 			},
 		}
+		h.indexIP(addr.ipKey(), mac)
 
 		if emitChanges {
 			h.sendChange(Change{
@@ -69,6 +100,7 @@ func (h *HostMap) update(addr Addr, emitChanges bool) bool {
 				PreviousAddr: nil,
 				LastSeen:     now,
 			})
+			h.checkConflict(mac, addr, now)
 		}
 
 		return true
@@ -83,7 +115,9 @@ func (h *HostMap) update(addr Addr, emitChanges bool) bool {
 			m.lastSeen = now
 			m.active = true
 			found = true
-		} else {
+			h.indexIP(m.addr.ipKey(), mac)
+		} else if addr.IP.Is4() && m.addr.IP.Is4() {
+			// a host has a single ipv4 address at a time, but can use many ipv6 addresses at once
 			if m.active {
 				// this is the previous active addr for the mac
 				// shallow copy
@@ -92,6 +126,7 @@ func (h *HostMap) update(addr Addr, emitChanges bool) bool {
 			}
 			// not the current ip for the mac (anymore)
 			m.active = false
+			h.unindexIP(m.addr.ipKey(), mac)
 		}
 	}
 
@@ -107,36 +142,93 @@ func (h *HostMap) update(addr Addr, emitChanges bool) bool {
 			active:   true,
 			lastSeen: now,
 		})
+		h.indexIP(addr.ipKey(), mac)
 	}
 
 	if emitChanges {
+		changeType := IPChange
+		if addr.IP.Is6() {
+			// ipv6 addresses don't replace each other, the host only gained one
+			changeType = AddressAddedChange
+		}
 		// emit a change regardless if we've seen the ip already for this mac - the device switched back
 		h.sendChange(Change{
-			ChangeType:   IPChange,
+			ChangeType:   changeType,
 			Addr:         addr,
 			Online:       true,
 			PreviousAddr: previousAddr,
 			LastSeen:     now,
 		})
+		h.checkConflict(mac, addr, now)
 	}
 	return true
 }
 
+// conflictWindow is how recently another host must have been seen with an ip for a claim of it to be a conflict, an ip
+// the DHCP server handed out again after the previous host left is not one.
+const conflictWindow = time.Minute
+
+// checkConflict emits an IPConflictChange if another host was seen using the ip the host with the given mac just
+// claimed within the conflictWindow. The lock must be held.
+func (h *HostMap) checkConflict(mac string, addr Addr, now time.Time) {
+	if !h.detectConflicts {
+		return
+	}
+
+	for _, key := range h.byIP[addr.ipKey()] {
+		if key == mac {
+			continue
+		}
+
+		for _, m := range h.hosts[key] {
+			if !m.active || m.addr.ipKey() != addr.ipKey() || now.Sub(m.lastSeen) > conflictWindow {
+				continue
+			}
+
+			// shallow copy
+			other := new(Addr)
+			*other = m.addr
+			h.sendChange(Change{
+				ChangeType:   IPConflictChange,
+				Addr:         addr,
+				Online:       true,
+				PreviousAddr: other,
+				LastSeen:     now,
+			})
+		}
+	}
+}
+
 func (h *HostMap) reap() bool {
 	h.hostsLock.Lock()
 	defer h.hostsLock.Unlock()
 
 	var changed bool
-	now := time.Now()
+	now := h.now()
 
 	for key, members := range h.hosts {
 		var newMembers []*member
 		for _, m := range members {
-			if now.Sub(m.lastSeen) < 5*time.Minute {
+			if now.Sub(m.lastSeen) < h.offlineTimeout {
+				newMembers = append(newMembers, m)
+				continue
+			}
+			if h.expires != nil && now.Before(h.expires(m.addr)) {
+				// silent, but the address hasn't expired yet
+				newMembers = append(newMembers, m)
+				continue
+			}
+			if h.prober != nil {
+				// offline only if it doesn't reply
+				if !m.probing {
+					m.probing = true
+					go h.probe(key, m)
+				}
 				newMembers = append(newMembers, m)
 				continue
 			}
 			changed = true
+			h.unindexIP(m.addr.ipKey(), key)
 
 			h.sendChange(Change{
 				ChangeType:   OfflineChange,
@@ -159,7 +251,84 @@ func (h *HostMap) reap() bool {
 	return changed
 }
 
+// probe checks the member is still on the network, it's kept if it replies and removed otherwise.
+func (h *HostMap) probe(key string, m *member) {
+	replied, err := h.waitAndProbe(m.addr)
+	if err != nil && !errors.Is(err, ErrProbeNotSupported) && !errors.Is(err, context.Canceled) {
+		h.logger.Error(err, "failed probing host", "addr", m.addr)
+	}
+
+	h.hostsLock.Lock()
+	defer h.hostsLock.Unlock()
+
+	m.probing = false
+	members := h.hosts[key]
+	index := -1
+	for i, existing := range members {
+		if existing == m {
+			index = i
+		}
+	}
+	if index < 0 {
+		// removed while being probed
+		return
+	}
+
+	now := h.now()
+	if replied {
+		m.lastSeen = now
+		return
+	}
+	if now.Sub(m.lastSeen) < h.offlineTimeout {
+		// seen while being probed
+		return
+	}
+
+	h.sendChange(Change{
+		ChangeType:   OfflineChange,
+		Addr:         m.addr,
+		Online:       false,
+		PreviousAddr: nil,
+		LastSeen:     m.lastSeen,
+		Detail:       "no reply to probe",
+	})
+	h.unindexIP(m.addr.ipKey(), key)
+
+	newMembers := append(members[:index:index], members[index+1:]...)
+	if len(newMembers) == 0 {
+		delete(h.hosts, key)
+		return
+	}
+	h.hosts[key] = newMembers
+}
+
+// waitAndProbe probes the address once the probe interval has passed on the clock since the previous probe.
+func (h *HostMap) waitAndProbe(addr Addr) (bool, error) {
+	h.probeLock.Lock()
+	now := h.now()
+	at := h.nextProbe
+	if at.Before(now) {
+		at = now
+	}
+	h.nextProbe = at.Add(h.probeInterval)
+	h.probeLock.Unlock()
+
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-h.probeCtx.Done():
+		return false, h.probeCtx.Err()
+	}
+
+	return h.prober.Probe(h.probeCtx, addr)
+}
+
 func (h *HostMap) sendChange(change Change) {
+	if h.closed {
+		return
+	}
+
 	select {
 	case h.changes <- change:
 	default:
@@ -167,10 +336,12 @@ func (h *HostMap) sendChange(change Change) {
 	}
 }
 
-// Reset clears all the currently tracked hosts.
+// Reset clears all the currently tracked hosts and their metadata.
 func (h *HostMap) Reset() {
 	h.hostsLock.Lock()
 	h.hosts = make(map[string][]*member)
+	h.byIP = make(map[ipKey][]string)
+	h.metadata = make(map[string]map[string]interface{})
 	h.hostsLock.Unlock()
 }
 
@@ -192,11 +363,149 @@ func (h *HostMap) UpdateAddresses(addrs []Addr) bool {
 	}
 
 	// reap old entries if expired
-	changed = changed || h.reap()
+	changed = h.reap() || changed
+
+	return changed
+}
+
+// MarkOffline immediately removes the address of a host, emitting an OfflineChange, e.g. when the host has released
+// it. If the ip isn't valid every address of the host is removed. Returns true if the address was being tracked.
+func (h *HostMap) MarkOffline(addr Addr) bool {
+	h.hostsLock.Lock()
+	defer h.hostsLock.Unlock()
+
+	key := addr.HostKey()
+	members, ok := h.hosts[key]
+	if !ok {
+		return false
+	}
+
+	var (
+		newMembers []*member
+		changed    bool
+	)
+	for _, m := range members {
+		if addr.IP.IsValid() && m.addr.IP != addr.IP {
+			newMembers = append(newMembers, m)
+			continue
+		}
+		changed = true
+		h.unindexIP(m.addr.ipKey(), key)
+
+		h.sendChange(Change{
+			ChangeType:   OfflineChange,
+			Addr:         m.addr,
+			Online:       false,
+			PreviousAddr: nil,
+			LastSeen:     m.lastSeen,
+		})
+	}
+
+	if len(newMembers) == 0 {
+		delete(h.hosts, key)
+	} else {
+		h.hosts[key] = newMembers
+	}
 
 	return changed
 }
 
+// FindByIP returns the address of the host actively using the ip of addr on the VLAN of addr, if any, the MAC of addr
+// isn't looked at. If several hosts are, the one that claimed it last is returned.
+func (h *HostMap) FindByIP(addr Addr) (Addr, bool) {
+	h.hostsLock.Lock()
+	defer h.hostsLock.Unlock()
+
+	key := addr.ipKey()
+	keys := h.byIP[key]
+	for i := len(keys) - 1; i >= 0; i-- {
+		for _, m := range h.hosts[keys[i]] {
+			if m.active && m.addr.ipKey() == key {
+				return m.addr, true
+			}
+		}
+	}
+
+	return Addr{}, false
+}
+
+// indexIP records that the host with key is actively using ip. The lock must be held.
+func (h *HostMap) indexIP(ip ipKey, key string) {
+	keys := h.byIP[ip]
+	for i, existing := range keys {
+		if existing == key {
+			// claimed again, now the latest
+			keys = append(keys[:i:i], keys[i+1:]...)
+			break
+		}
+	}
+	h.byIP[ip] = append(keys, key)
+}
+
+// unindexIP records that the host with key no longer uses ip. The lock must be held.
+func (h *HostMap) unindexIP(ip ipKey, key string) {
+	keys := h.byIP[ip]
+	for i, existing := range keys {
+		if existing == key {
+			keys = append(keys[:i:i], keys[i+1:]...)
+			break
+		}
+	}
+	if len(keys) == 0 {
+		delete(h.byIP, ip)
+		return
+	}
+	h.byIP[ip] = keys
+}
+
+// SetMetadata stores a value describing the host of addr under key, replacing any previous value. The host is the MAC
+// of addr on its VLAN, the ip isn't looked at. A nil value deletes the key. Metadata is kept when the host goes offline
+// so it's still known if the host comes back.
+func (h *HostMap) SetMetadata(addr Addr, key string, value interface{}) {
+	h.hostsLock.Lock()
+	defer h.hostsLock.Unlock()
+
+	host := addr.HostKey()
+	metadata, ok := h.metadata[host]
+	if value == nil {
+		delete(metadata, key)
+		if ok && len(metadata) == 0 {
+			delete(h.metadata, host)
+		}
+		return
+	}
+
+	if !ok {
+		metadata = make(map[string]interface{})
+		h.metadata[host] = metadata
+	}
+	metadata[key] = value
+}
+
+// Metadata returns the value stored under key for the host of addr, the MAC of addr on its VLAN.
+func (h *HostMap) Metadata(addr Addr, key string) (interface{}, bool) {
+	h.hostsLock.Lock()
+	defer h.hostsLock.Unlock()
+
+	value, ok := h.metadata[addr.HostKey()][key]
+	return value, ok
+}
+
+// Emit sends a change through the notification channel. It's used by sources of information about hosts that are
+// tracked outside the HostMap, e.g. the services a host advertises.
+func (h *HostMap) Emit(change Change) {
+	h.hostsLock.Lock()
+	defer h.hostsLock.Unlock()
+
+	if change.LastSeen.IsZero() {
+		change.LastSeen = h.now()
+	}
+	if h.iface != "" && change.Addr.Interface == "" {
+		change.Addr.Interface = h.iface
+	}
+	h.sendChange(change)
+}
+
 func (h *HostMap) PrintTable() {
 	h.hostsLock.Lock()
 	defer h.hostsLock.Unlock()
@@ -213,15 +522,75 @@ func (h *HostMap) Notifications() <-chan Change {
 	return h.changes
 }
 
+// Close closes the notification channel and stops any probes. Changes already queued can still be read, changes
+// emitted after closing are discarded.
+func (h *HostMap) Close() {
+	h.cancelProbes()
+
+	h.hostsLock.Lock()
+	defer h.hostsLock.Unlock()
+	if h.closed {
+		return
+	}
+
+	h.closed = true
+	close(h.changes)
+}
+
 // From https://github.com/irai/packet/blob/3d13deba3c30b27bbb6da8ec122a96e45fe92a27/addr.go#L12-L16
 type Addr struct {
 	MAC  net.HardwareAddr
 	IP   netip.Addr
 	Port uint16
+
+	// Interface is the name of the network interface the host was seen on, if known.
+	Interface string
+	// VLAN is the 802.1Q VLAN ID the host was seen on, zero if untagged. OuterVLAN is the service VLAN ID of QinQ
+	// (802.1ad) frames, VLAN is then the customer VLAN ID.
+	VLAN      uint16
+	OuterVLAN uint16
 }
 
 func (addr Addr) String() string {
-	return fmt.Sprintf("mac=(%s) ip=(%s) port=(%d)", addr.MAC, addr.IP, addr.Port)
+	s := fmt.Sprintf("mac=(%s) ip=(%s) port=(%d)", addr.MAC, addr.IP, addr.Port)
+	if addr.Interface != "" {
+		s += fmt.Sprintf(" iface=(%s)", addr.Interface)
+	}
+	if vlan := addr.vlanString(); vlan != "" {
+		s += fmt.Sprintf(" vlan=(%s)", vlan)
+	}
+	return s
+}
+
+// vlanString formats the vlan ids as "outer.inner" for QinQ, or is empty if untagged.
+func (addr Addr) vlanString() string {
+	switch {
+	case addr.OuterVLAN != 0:
+		return fmt.Sprintf("%d.%d", addr.OuterVLAN, addr.VLAN)
+	case addr.VLAN != 0:
+		return fmt.Sprintf("%d", addr.VLAN)
+	default:
+		return ""
+	}
+}
+
+// HostKey identifies the host of the address, a mac on each vlan is a separate host.
+func (addr Addr) HostKey() string {
+	if vlan := addr.vlanString(); vlan != "" {
+		return addr.MAC.String() + "@" + vlan
+	}
+	return addr.MAC.String()
+}
+
+// ipKey identifies the ip of the address, the same ip on each vlan belongs to a different network.
+type ipKey struct {
+	ip        netip.Addr
+	vlan      uint16
+	outerVLAN uint16
+}
+
+func (addr Addr) ipKey() ipKey {
+	return ipKey{ip: addr.IP, vlan: addr.VLAN, outerVLAN: addr.OuterVLAN}
 }
 
 type ChangeType int
@@ -231,8 +600,25 @@ const (
 	IPChange
 	OnlineChange
 	OfflineChange
+	// IPConflictChange is emitted when a host claims an ip that is in use by another host, the other host is reported
+	// as the PreviousAddr.
+	IPConflictChange
+	// ServiceAddedChange and ServiceRemovedChange are emitted when a host starts or stops advertising a service, the
+	// service is described by the Detail.
+	ServiceAddedChange
+	ServiceRemovedChange
+	// WatchedDomainChange is emitted when a host looks up a domain on a watch list, the domain is described by the
+	// Detail.
+	WatchedDomainChange
+	// AddressAddedChange is emitted when a host starts using another ipv6 address alongside the ones it has.
+	AddressAddedChange
 )
 
+var changeTypes = []ChangeType{
+	IPChange, OnlineChange, OfflineChange, IPConflictChange, ServiceAddedChange, ServiceRemovedChange, WatchedDomainChange,
+	AddressAddedChange,
+}
+
 func (ct ChangeType) String() string {
 	switch ct {
 	case IPChange:
@@ -241,11 +627,34 @@ func (ct ChangeType) String() string {
 		return "online"
 	case OfflineChange:
 		return "offline"
+	case IPConflictChange:
+		return "ip conflict"
+	case ServiceAddedChange:
+		return "service added"
+	case ServiceRemovedChange:
+		return "service removed"
+	case WatchedDomainChange:
+		return "watched domain"
+	case AddressAddedChange:
+		return "address added"
 	default:
 		return "unknown"
 	}
 }
 
+// ParseChangeType returns the ChangeType with the given name, as returned by String. Dashes may be used in place of
+// spaces, e.g. "ip-change".
+func ParseChangeType(name string) (ChangeType, error) {
+	name = strings.ReplaceAll(strings.TrimSpace(name), "-", " ")
+	for _, ct := range changeTypes {
+		if strings.EqualFold(ct.String(), name) {
+			return ct, nil
+		}
+	}
+
+	return UnknownChange, fmt.Errorf("unknown change type %q", name)
+}
+
 type Change struct {
 	ChangeType ChangeType
 	Addr       Addr
@@ -253,17 +662,25 @@ type Change struct {
 
 	PreviousAddr *Addr
 	LastSeen     time.Time
+
+	// Detail describes what changed when it isn't the address, e.g. the service that was added.
+	Detail string
 }
 
 func (c Change) String() string {
-	return fmt.Sprintf("change=(%s) online=(%v) addr=(%s) previousAddr=(%s) lastSeen=(%s)",
+	s := fmt.Sprintf("change=(%s) online=(%v) addr=(%s) previousAddr=(%s) lastSeen=(%s)",
 		c.ChangeType, c.Online, c.Addr, c.PreviousAddr, c.LastSeen)
+	if c.Detail != "" {
+		s += fmt.Sprintf(" detail=(%s)", c.Detail)
+	}
+	return s
 }
 
 type member struct {
 	addr     Addr
 	active   bool
 	lastSeen time.Time
+	probing  bool
 }
 
 func (m member) String() string {
@@ -29,3 +29,46 @@ func LoggerOption(logger logr.Logger) HostMapOption {
 		hostMap.logger = logger
 	})
 }
+
+// ClockOption configures the source of the current time. By default the wall clock is used, but when replaying a
+// capture the time should be driven by the packet timestamps instead.
+func ClockOption(now func() time.Time) HostMapOption {
+	return optionFunc(func(hostMap *HostMap) {
+		hostMap.now = now
+	})
+}
+
+// DetectConflictsOption enables emitting an IPConflictChange when a host claims an ip that is actively used by another
+// host.
+func DetectConflictsOption(detect bool) HostMapOption {
+	return optionFunc(func(hostMap *HostMap) {
+		hostMap.detectConflicts = detect
+	})
+}
+
+// ExpiryOption configures a source of expiry times for addresses, e.g. the end of a DHCP lease. A silent host isn't
+// considered offline until both the offline timeout has elapsed and its address has expired. A zero time means the
+// address has no expiry.
+func ExpiryOption(expires func(addr Addr) time.Time) HostMapOption {
+	return optionFunc(func(hostMap *HostMap) {
+		hostMap.expires = expires
+	})
+}
+
+// ProberOption configures a prober to check silent hosts are really gone before they're reported offline, e.g. phones
+// that stop sending traffic while they sleep. A host that replies is kept online, one that doesn't goes offline. Probes
+// are started at most once per interval, a zero interval doesn't limit them.
+func ProberOption(prober Prober, interval time.Duration) HostMapOption {
+	return optionFunc(func(hostMap *HostMap) {
+		hostMap.prober = prober
+		hostMap.probeInterval = interval
+	})
+}
+
+// InterfaceOption tags the addresses of every host in the map, and the changes emitted for them, with the name of the
+// network interface they're seen on. Use a HostMap per interface so the same MAC on two segments is tracked separately.
+func InterfaceOption(iface string) HostMapOption {
+	return optionFunc(func(hostMap *HostMap) {
+		hostMap.iface = iface
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"net"
 	"net/netip"
+	"sync"
 	"testing"
 	"time"
 
@@ -508,3 +509,556 @@ func TestHostMap_UpdateAddresses(t *testing.T) {
 		})
 	}
 }
+
+func TestHostMap_ClockOption(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+	testMAC2 := mustMAC(t, "2B:2B:2B:2B:2B:2B")
+
+	now := time.Date(2022, 6, 23, 19, 0, 0, 0, time.UTC)
+	hm := hostmonitor.NewHostMap(hostmonitor.ClockOption(func() time.Time { return now }))
+
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")}})
+	changes, err := drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, now, changes[0].LastSeen)
+
+	// the first host goes offline once the clock passes the offline timeout
+	lastSeen := now
+	now = now.Add(10 * time.Minute)
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC2, IP: mustIP(t, "192.168.1.3")}})
+
+	changes, err = drain(hm.Notifications(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[0].ChangeType)
+	assert.Equal(t, hostmonitor.OfflineChange, changes[1].ChangeType)
+	assert.Equal(t, testMAC1, changes[1].Addr.MAC)
+	assert.Equal(t, lastSeen, changes[1].LastSeen)
+}
+
+func TestHostMap_DetectConflicts(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+	testMAC2 := mustMAC(t, "2B:2B:2B:2B:2B:2B")
+
+	hm := hostmonitor.NewHostMap(hostmonitor.DetectConflictsOption(true))
+	hm.UpdateAddresses([]hostmonitor.Addr{
+		{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")},
+		{MAC: testMAC2, IP: mustIP(t, "192.168.1.2")},
+	})
+
+	changes, err := drain(hm.Notifications(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[0].ChangeType)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[1].ChangeType)
+
+	conflict := changes[2]
+	assert.Equal(t, hostmonitor.IPConflictChange, conflict.ChangeType)
+	assert.Equal(t, testMAC2, conflict.Addr.MAC)
+	require.NotNil(t, conflict.PreviousAddr)
+	assert.Equal(t, testMAC1, conflict.PreviousAddr.MAC)
+}
+
+func TestHostMap_DetectConflicts_Reassigned(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+	testMAC2 := mustMAC(t, "2B:2B:2B:2B:2B:2B")
+	testMAC3 := mustMAC(t, "3C:3C:3C:3C:3C:3C")
+
+	now := time.Date(2022, 6, 23, 19, 0, 0, 0, time.UTC)
+	hm := hostmonitor.NewHostMap(
+		hostmonitor.DetectConflictsOption(true),
+		hostmonitor.ClockOption(func() time.Time { return now }),
+	)
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")}})
+
+	// the first host left and the DHCP server handed its ip to another before it went offline
+	now = now.Add(2 * time.Minute)
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC2, IP: mustIP(t, "192.168.1.2")}})
+
+	changes, err := drain(hm.Notifications(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[0].ChangeType)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[1].ChangeType)
+	_, err = drain(hm.Notifications(), 1)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "not a conflict")
+
+	// a third host claims it while the second is still using it, only the second conflicts
+	now = now.Add(10 * time.Second)
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC3, IP: mustIP(t, "192.168.1.2")}})
+
+	changes, err = drain(hm.Notifications(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[0].ChangeType)
+	assert.Equal(t, hostmonitor.IPConflictChange, changes[1].ChangeType)
+	assert.Equal(t, testMAC3, changes[1].Addr.MAC)
+	require.NotNil(t, changes[1].PreviousAddr)
+	assert.Equal(t, testMAC2, changes[1].PreviousAddr.MAC)
+	_, err = drain(hm.Notifications(), 1)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestParseChangeType(t *testing.T) {
+	for _, name := range []string{"ip change", "ip-change", "IP-Change"} {
+		ct, err := hostmonitor.ParseChangeType(name)
+		require.NoError(t, err)
+		assert.Equal(t, hostmonitor.IPChange, ct)
+	}
+
+	_, err := hostmonitor.ParseChangeType("bogus")
+	assert.Error(t, err)
+}
+
+func TestHostMap_UpdateAddressesIPv6(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+	hm := hostmonitor.NewHostMap()
+
+	hm.UpdateAddresses([]hostmonitor.Addr{
+		{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")},
+		{MAC: testMAC1, IP: mustIP(t, "fe80::1")},
+		{MAC: testMAC1, IP: mustIP(t, "2001:db8::1")},
+		// none of these replace each other
+		{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")},
+		{MAC: testMAC1, IP: mustIP(t, "fe80::1")},
+	})
+
+	changes, err := drain(hm.Notifications(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[0].ChangeType)
+	for _, change := range changes[1:] {
+		assert.Equal(t, hostmonitor.AddressAddedChange, change.ChangeType, "ipv6 addresses are added alongside")
+		assert.Nil(t, change.PreviousAddr)
+	}
+
+	_, err = drain(hm.Notifications(), 1)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestHostMap_FindByIP(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+	hm := hostmonitor.NewHostMap()
+
+	hm.UpdateAddresses([]hostmonitor.Addr{
+		{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")},
+		{MAC: testMAC1, IP: mustIP(t, "192.168.1.3")},
+	})
+
+	addr, ok := hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.1.3")})
+	require.True(t, ok)
+	assert.Equal(t, testMAC1, addr.MAC)
+
+	// no longer used by the host
+	_, ok = hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.1.2")})
+	assert.False(t, ok)
+}
+
+func TestHostMap_FindByIP_Index(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+	testMAC2 := mustMAC(t, "2A:2A:2A:2A:2A:2A")
+	now := time.Now()
+	hm := hostmonitor.NewHostMap(
+		hostmonitor.ClockOption(func() time.Time { return now }),
+		hostmonitor.HostOfflineTimeoutOption(time.Minute),
+	)
+
+	// both claim the ip, the latest is found
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")}})
+	now = now.Add(30 * time.Second)
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC2, IP: mustIP(t, "192.168.1.2")}})
+	addr, ok := hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.1.2")})
+	require.True(t, ok)
+	assert.Equal(t, testMAC2, addr.MAC)
+
+	// the first one is still using it once the second one is gone
+	hm.MarkOffline(hostmonitor.Addr{MAC: testMAC2})
+	addr, ok = hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.1.2")})
+	require.True(t, ok)
+	assert.Equal(t, testMAC1, addr.MAC)
+
+	// reaped
+	now = now.Add(time.Minute)
+	hm.UpdateAddresses(nil)
+	_, ok = hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.1.2")})
+	assert.False(t, ok)
+
+	// switched back to an earlier address
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")}})
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: mustIP(t, "192.168.1.3")}})
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")}})
+	_, ok = hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.1.2")})
+	assert.True(t, ok)
+	_, ok = hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.1.3")})
+	assert.False(t, ok)
+
+	hm.Reset()
+	_, ok = hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.1.2")})
+	assert.False(t, ok)
+}
+
+func TestHostMap_Metadata(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+
+	now := time.Date(2022, 6, 23, 19, 0, 0, 0, time.UTC)
+	hm := hostmonitor.NewHostMap(hostmonitor.ClockOption(func() time.Time { return now }))
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")}})
+	hm.SetMetadata(hostmonitor.Addr{MAC: testMAC1}, "model", "AppleTV5,3")
+
+	// metadata is kept when the host goes offline
+	now = now.Add(10 * time.Minute)
+	hm.UpdateAddresses(nil)
+	value, ok := hm.Metadata(hostmonitor.Addr{MAC: testMAC1}, "model")
+	require.True(t, ok)
+	assert.Equal(t, "AppleTV5,3", value)
+
+	hm.SetMetadata(hostmonitor.Addr{MAC: testMAC1}, "model", nil)
+	_, ok = hm.Metadata(hostmonitor.Addr{MAC: testMAC1}, "model")
+	assert.False(t, ok)
+}
+
+func TestHostMap_Emit(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+
+	now := time.Date(2022, 6, 23, 19, 0, 0, 0, time.UTC)
+	hm := hostmonitor.NewHostMap(hostmonitor.ClockOption(func() time.Time { return now }))
+	hm.Emit(hostmonitor.Change{
+		ChangeType: hostmonitor.ServiceAddedChange,
+		Addr:       hostmonitor.Addr{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")},
+		Online:     true,
+		Detail:     "Living Room (_airplay._tcp)",
+	})
+
+	changes, err := drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, now, changes[0].LastSeen, "defaults to the current time")
+	assert.Contains(t, changes[0].String(), "change=(service added)")
+	assert.Contains(t, changes[0].String(), "detail=(Living Room (_airplay._tcp))")
+
+	hm.Close()
+	hm.Emit(hostmonitor.Change{ChangeType: hostmonitor.ServiceRemovedChange})
+}
+
+func TestHostMap_MarkOffline(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+	hm := hostmonitor.NewHostMap()
+
+	hm.UpdateAddresses([]hostmonitor.Addr{
+		{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")},
+		{MAC: testMAC1, IP: mustIP(t, "fe80::1")},
+	})
+	_, err := drain(hm.Notifications(), 2)
+	require.NoError(t, err)
+
+	require.True(t, hm.MarkOffline(hostmonitor.Addr{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")}))
+	changes, err := drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OfflineChange, changes[0].ChangeType)
+	assert.Equal(t, mustIP(t, "192.168.1.2"), changes[0].Addr.IP)
+
+	_, ok := hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "fe80::1")})
+	assert.True(t, ok, "other addresses are kept")
+
+	// every remaining address
+	require.True(t, hm.MarkOffline(hostmonitor.Addr{MAC: testMAC1}))
+	require.False(t, hm.MarkOffline(hostmonitor.Addr{MAC: testMAC1}))
+	changes, err = drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, mustIP(t, "fe80::1"), changes[0].Addr.IP)
+}
+
+func TestHostMap_ExpiryOption(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+	testMAC2 := mustMAC(t, "2B:2B:2B:2B:2B:2B")
+
+	now := time.Date(2022, 6, 23, 19, 0, 0, 0, time.UTC)
+	leaseEnd := now.Add(time.Hour)
+	hm := hostmonitor.NewHostMap(
+		hostmonitor.ClockOption(func() time.Time { return now }),
+		hostmonitor.ExpiryOption(func(addr hostmonitor.Addr) time.Time {
+			if addr.MAC.String() == testMAC1.String() {
+				return leaseEnd
+			}
+			return time.Time{}
+		}),
+	)
+
+	hm.UpdateAddresses([]hostmonitor.Addr{
+		{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")},
+		{MAC: testMAC2, IP: mustIP(t, "192.168.1.3")},
+	})
+	_, err := drain(hm.Notifications(), 2)
+	require.NoError(t, err)
+
+	// only the host without a lease goes offline
+	now = now.Add(10 * time.Minute)
+	hm.UpdateAddresses(nil)
+	changes, err := drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OfflineChange, changes[0].ChangeType)
+	assert.Equal(t, testMAC2, changes[0].Addr.MAC)
+
+	now = leaseEnd
+	hm.UpdateAddresses(nil)
+	changes, err = drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OfflineChange, changes[0].ChangeType)
+	assert.Equal(t, testMAC1, changes[0].Addr.MAC)
+}
+
+func TestHostMap_OfflineTimeoutOption(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+
+	now := time.Date(2022, 6, 23, 19, 0, 0, 0, time.UTC)
+	hm := hostmonitor.NewHostMap(
+		hostmonitor.ClockOption(func() time.Time { return now }),
+		hostmonitor.HostOfflineTimeoutOption(time.Minute),
+	)
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")}})
+	_, err := drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+
+	now = now.Add(2 * time.Minute)
+	hm.UpdateAddresses(nil)
+	changes, err := drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OfflineChange, changes[0].ChangeType)
+}
+
+func TestHostMap_ProberOption(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+	testMAC2 := mustMAC(t, "2B:2B:2B:2B:2B:2B")
+
+	// the fake network, probes run in the background so the clock and replies are shared
+	var (
+		mux     sync.Mutex
+		now     = time.Date(2022, 6, 23, 19, 0, 0, 0, time.UTC)
+		replies = map[string]bool{testMAC1.String(): true}
+		probed  []time.Time
+	)
+	clock := func() time.Time {
+		mux.Lock()
+		defer mux.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mux.Lock()
+		defer mux.Unlock()
+		now = now.Add(d)
+	}
+	prober := hostmonitor.ProberFunc(func(_ context.Context, addr hostmonitor.Addr) (bool, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		probed = append(probed, time.Now())
+		return replies[addr.MAC.String()], nil
+	})
+
+	hm := hostmonitor.NewHostMap(
+		hostmonitor.ClockOption(clock),
+		hostmonitor.ProberOption(prober, 20*time.Millisecond),
+	)
+	defer hm.Close()
+
+	hm.UpdateAddresses([]hostmonitor.Addr{
+		{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")},
+		{MAC: testMAC2, IP: mustIP(t, "192.168.1.3")},
+	})
+	_, err := drain(hm.Notifications(), 2)
+	require.NoError(t, err)
+
+	// only the host that doesn't reply goes offline
+	advance(10 * time.Minute)
+	hm.UpdateAddresses(nil)
+	changes, err := drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OfflineChange, changes[0].ChangeType)
+	assert.Equal(t, testMAC2, changes[0].Addr.MAC)
+	assert.Equal(t, "no reply to probe", changes[0].Detail)
+
+	_, ok := hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.1.2")})
+	assert.True(t, ok, "host replied to the probe")
+
+	require.Eventually(t, func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return len(probed) == 2
+	}, time.Second, 5*time.Millisecond)
+
+	mux.Lock()
+	assert.True(t, probed[1].Sub(probed[0]) >= 20*time.Millisecond, "probes are rate limited")
+	replies[testMAC1.String()] = false
+	mux.Unlock()
+
+	// reaped until the previous probe has finished and the new one fails
+	require.Eventually(t, func() bool {
+		advance(10 * time.Minute)
+		hm.UpdateAddresses(nil)
+		_, ok := hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.1.2")})
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+	changes, err = drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OfflineChange, changes[0].ChangeType)
+	assert.Equal(t, testMAC1, changes[0].Addr.MAC)
+}
+
+func TestHostMap_ProberOption_Clock(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+
+	var (
+		mux    sync.Mutex
+		now    = time.Date(2022, 6, 23, 19, 0, 0, 0, time.UTC)
+		probed int
+	)
+	clock := func() time.Time {
+		mux.Lock()
+		defer mux.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mux.Lock()
+		defer mux.Unlock()
+		now = now.Add(d)
+	}
+	prober := hostmonitor.ProberFunc(func(context.Context, hostmonitor.Addr) (bool, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		probed++
+		return true, nil
+	})
+	probes := func() int {
+		mux.Lock()
+		defer mux.Unlock()
+		return probed
+	}
+
+	hm := hostmonitor.NewHostMap(
+		hostmonitor.ClockOption(clock),
+		hostmonitor.HostOfflineTimeoutOption(time.Minute),
+		hostmonitor.ProberOption(prober, time.Hour),
+	)
+	defer hm.Close()
+
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")}})
+	_, err := drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+
+	advance(2 * time.Minute)
+	hm.UpdateAddresses(nil)
+	require.Eventually(t, func() bool { return probes() == 1 }, time.Second, 5*time.Millisecond)
+
+	// the probe interval has passed on the clock, as it does when replaying a capture
+	advance(2 * time.Hour)
+	require.Eventually(t, func() bool {
+		hm.UpdateAddresses(nil)
+		return probes() == 2
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestMultiProber(t *testing.T) {
+	addr := hostmonitor.Addr{MAC: mustMAC(t, "1A:1A:1A:1A:1A:1A"), IP: mustIP(t, "fe80::1")}
+	unsupported := hostmonitor.ProberFunc(func(context.Context, hostmonitor.Addr) (bool, error) {
+		return false, hostmonitor.ErrProbeNotSupported
+	})
+	silent := hostmonitor.ProberFunc(func(context.Context, hostmonitor.Addr) (bool, error) {
+		return false, nil
+	})
+	replies := hostmonitor.ProberFunc(func(context.Context, hostmonitor.Addr) (bool, error) {
+		return true, nil
+	})
+	failing := hostmonitor.ProberFunc(func(context.Context, hostmonitor.Addr) (bool, error) {
+		return false, errors.New("network is down")
+	})
+
+	replied, err := hostmonitor.MultiProber(unsupported, replies).Probe(context.Background(), addr)
+	assert.NoError(t, err)
+	assert.True(t, replied)
+
+	replied, err = hostmonitor.MultiProber(failing, silent).Probe(context.Background(), addr)
+	assert.NoError(t, err)
+	assert.False(t, replied)
+
+	_, err = hostmonitor.MultiProber(unsupported, unsupported).Probe(context.Background(), addr)
+	assert.True(t, errors.Is(err, hostmonitor.ErrProbeNotSupported))
+
+	_, err = hostmonitor.MultiProber(unsupported, failing).Probe(context.Background(), addr)
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, hostmonitor.ErrProbeNotSupported))
+}
+
+func TestHostMap_InterfaceOption(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+
+	lan := hostmonitor.NewHostMap(hostmonitor.InterfaceOption("eth0"))
+	guest := hostmonitor.NewHostMap(hostmonitor.InterfaceOption("eth1"))
+
+	// the same mac on two segments
+	lan.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: mustIP(t, "192.168.1.2")}})
+	guest.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC1, IP: mustIP(t, "192.168.2.2")}})
+
+	changes, err := drain(lan.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "eth0", changes[0].Addr.Interface)
+	assert.Contains(t, changes[0].String(), "iface=(eth0)")
+
+	changes, err = drain(guest.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "eth1", changes[0].Addr.Interface)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[0].ChangeType, "not an ip change of the host on eth0")
+
+	addr, ok := lan.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.1.2")})
+	require.True(t, ok)
+	assert.Equal(t, "eth0", addr.Interface)
+
+	guest.Emit(hostmonitor.Change{ChangeType: hostmonitor.ServiceAddedChange, Addr: hostmonitor.Addr{MAC: testMAC1}})
+	changes, err = drain(guest.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "eth1", changes[0].Addr.Interface)
+}
+
+func TestHostMap_VLANs(t *testing.T) {
+	testMAC1 := mustMAC(t, "1A:1A:1A:1A:1A:1A")
+	testMAC2 := mustMAC(t, "2B:2B:2B:2B:2B:2B")
+
+	hm := hostmonitor.NewHostMap(hostmonitor.DetectConflictsOption(true))
+
+	// the same mac on two vlans is two hosts rather than an ip change
+	hm.UpdateAddresses([]hostmonitor.Addr{
+		{MAC: testMAC1, IP: mustIP(t, "192.168.10.2"), VLAN: 10},
+		{MAC: testMAC1, IP: mustIP(t, "192.168.20.2"), VLAN: 20, OuterVLAN: 100},
+	})
+	changes, err := drain(hm.Notifications(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[0].ChangeType)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[1].ChangeType)
+	assert.Contains(t, changes[1].Addr.String(), "vlan=(100.20)")
+
+	// the same ip on another vlan isn't a conflict
+	hm.UpdateAddresses([]hostmonitor.Addr{{MAC: testMAC2, IP: mustIP(t, "192.168.10.2"), VLAN: 30}})
+	changes, err = drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[0].ChangeType)
+	_, err = drain(hm.Notifications(), 1)
+	assert.Error(t, err, "no conflict")
+
+	assert.True(t, hm.MarkOffline(hostmonitor.Addr{MAC: testMAC1, VLAN: 10}))
+	changes, err = drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(10), changes[0].Addr.VLAN)
+	assert.False(t, hm.MarkOffline(hostmonitor.Addr{MAC: testMAC1, VLAN: 10}))
+
+	_, ok := hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.20.2"), VLAN: 20, OuterVLAN: 100})
+	assert.True(t, ok, "host on the other vlan is still online")
+	_, ok = hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.20.2"), VLAN: 20})
+	assert.False(t, ok, "looked up on the vlan of the address")
+
+	// the same ip on two vlans is found on each
+	addr, ok := hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.10.2"), VLAN: 30})
+	require.True(t, ok)
+	assert.Equal(t, testMAC2, addr.MAC)
+	_, ok = hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.10.2"), VLAN: 10})
+	assert.False(t, ok, "gone offline")
+
+	// metadata of a mac on each vlan is kept apart
+	hm.SetMetadata(hostmonitor.Addr{MAC: testMAC1, VLAN: 10}, "model", "AppleTV5,3")
+	_, ok = hm.Metadata(hostmonitor.Addr{MAC: testMAC1, VLAN: 20, OuterVLAN: 100}, "model")
+	assert.False(t, ok)
+	value, ok := hm.Metadata(hostmonitor.Addr{MAC: testMAC1, VLAN: 10, IP: mustIP(t, "192.168.10.2")}, "model")
+	require.True(t, ok)
+	assert.Equal(t, "AppleTV5,3", value)
+}
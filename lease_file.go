@@ -0,0 +1,467 @@
+package hostmonitor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostNameMetadataKey is the HostMap metadata key the host name of a host is stored under, as a string.
+const HostNameMetadataKey = "hostname"
+
+type LeaseFileFormat int
+
+const (
+	// DnsmasqLeaseFormat is the format of the dnsmasq.leases file, one lease per line.
+	DnsmasqLeaseFormat LeaseFileFormat = iota
+	// DhcpdLeaseFormat is the format of the ISC dhcpd.leases file, a journal of lease declarations.
+	DhcpdLeaseFormat
+)
+
+func (f LeaseFileFormat) String() string {
+	switch f {
+	case DnsmasqLeaseFormat:
+		return "dnsmasq"
+	case DhcpdLeaseFormat:
+		return "dhcpd"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLeaseFileFormat returns the LeaseFileFormat with the given name, as returned by String.
+func ParseLeaseFileFormat(name string) (LeaseFileFormat, error) {
+	for _, format := range []LeaseFileFormat{DnsmasqLeaseFormat, DhcpdLeaseFormat} {
+		if strings.EqualFold(format.String(), strings.TrimSpace(name)) {
+			return format, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown lease file format %q", name)
+}
+
+// FileLease is an active lease read from the lease file of a DHCP server.
+type FileLease struct {
+	Addr     Addr
+	HostName string
+	// Expires is when the lease ends, the zero time if it never does.
+	Expires time.Time
+}
+
+// ParseLeases reads the active leases from a lease file of the given format.
+func ParseLeases(r io.Reader, format LeaseFileFormat) ([]FileLease, error) {
+	switch format {
+	case DnsmasqLeaseFormat:
+		return ParseDnsmasqLeases(r)
+	case DhcpdLeaseFormat:
+		return ParseDhcpdLeases(r)
+	default:
+		return nil, fmt.Errorf("unknown lease file format %d", format)
+	}
+}
+
+// ParseDnsmasqLeases reads the leases in a dnsmasq.leases file. Each line is the expiry as a unix timestamp (0 for
+// infinite), the MAC, the ip, the host name and the client id, with * for an unknown host name or client id. DHCPv6
+// leases have an IAID in place of the MAC and are skipped.
+func ParseDnsmasqLeases(r io.Reader) ([]FileLease, error) {
+	var leases []FileLease
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: expected at least 4 fields, got %d", line, len(fields))
+		}
+
+		mac, err := net.ParseMAC(fields[1])
+		if err != nil {
+			// dhcpv6 lease
+			continue
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %q", line, fields[0])
+		}
+		ip, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		lease := FileLease{
+			Addr: Addr{
+				MAC: mac,
+				IP:  ip,
+			},
+		}
+		if fields[3] != "*" {
+			lease.HostName = fields[3]
+		}
+		if expiry != 0 {
+			lease.Expires = time.Unix(expiry, 0)
+		}
+		leases = append(leases, lease)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return leases, nil
+}
+
+// ParseDhcpdLeases reads the active leases in an ISC dhcpd.leases file. The file is a journal, a lease is declared
+// again every time it changes so the last declaration for an ip wins. Leases in any binding state other than active
+// are skipped.
+func ParseDhcpdLeases(r io.Reader) ([]FileLease, error) {
+	tokens, err := tokenizeDhcpd(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		order  []netip.Addr
+		leases = make(map[netip.Addr]*dhcpdLease)
+	)
+	for i := 0; i < len(tokens); {
+		statement, next, err := readDhcpdStatement(tokens, i)
+		if err != nil {
+			return nil, err
+		}
+		i = next
+
+		if len(statement.args) != 2 || statement.args[0] != "lease" || statement.block == nil {
+			// not a lease declaration, e.g. a host declaration or the server duid
+			continue
+		}
+
+		ip, err := netip.ParseAddr(statement.args[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid lease address %q: %w", statement.args[1], err)
+		}
+
+		lease, err := parseDhcpdLease(statement.block)
+		if err != nil {
+			return nil, fmt.Errorf("lease %s: %w", ip, err)
+		}
+		if _, ok := leases[ip]; !ok {
+			order = append(order, ip)
+		}
+		leases[ip] = lease
+	}
+
+	var active []FileLease
+	for _, ip := range order {
+		lease := leases[ip]
+		if lease.state != "active" || lease.mac == nil {
+			continue
+		}
+
+		active = append(active, FileLease{
+			Addr: Addr{
+				MAC: lease.mac,
+				IP:  ip,
+			},
+			HostName: lease.hostName,
+			Expires:  lease.ends,
+		})
+	}
+
+	return active, nil
+}
+
+type dhcpdLease struct {
+	state    string
+	mac      net.HardwareAddr
+	hostName string
+	ends     time.Time
+}
+
+func parseDhcpdLease(statements []dhcpdStatement) (*dhcpdLease, error) {
+	lease := &dhcpdLease{}
+	for _, statement := range statements {
+		args := statement.args
+		switch {
+		case len(args) == 3 && args[0] == "binding" && args[1] == "state":
+			lease.state = args[2]
+		case len(args) == 3 && args[0] == "hardware" && args[1] == "ethernet":
+			mac, err := net.ParseMAC(args[2])
+			if err != nil {
+				return nil, err
+			}
+			lease.mac = mac
+		case len(args) == 2 && args[0] == "client-hostname":
+			lease.hostName = args[1]
+		case len(args) >= 2 && args[0] == "ends":
+			ends, err := parseDhcpdTime(args[1:])
+			if err != nil {
+				return nil, err
+			}
+			lease.ends = ends
+		}
+	}
+
+	return lease, nil
+}
+
+// parseDhcpdTime parses the time of a lease statement: "never", "epoch <seconds>" or "<weekday> <date> <time>" in UTC.
+func parseDhcpdTime(args []string) (time.Time, error) {
+	switch {
+	case len(args) == 1 && args[0] == "never":
+		return time.Time{}, nil
+	case len(args) == 2 && args[0] == "epoch":
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid epoch %q", args[1])
+		}
+		return time.Unix(seconds, 0), nil
+	case len(args) == 3:
+		return time.Parse("2006/01/02 15:04:05", args[1]+" "+args[2])
+	default:
+		return time.Time{}, fmt.Errorf("invalid time %q", strings.Join(args, " "))
+	}
+}
+
+// dhcpdStatement is a statement terminated by a semicolon, or a declaration followed by a block of statements.
+type dhcpdStatement struct {
+	args  []string
+	block []dhcpdStatement
+}
+
+func readDhcpdStatement(tokens []string, i int) (dhcpdStatement, int, error) {
+	var statement dhcpdStatement
+	for ; i < len(tokens); i++ {
+		switch tokens[i] {
+		case ";":
+			return statement, i + 1, nil
+		case "{":
+			i++
+			statement.block = []dhcpdStatement{}
+			for i < len(tokens) && tokens[i] != "}" {
+				inner, next, err := readDhcpdStatement(tokens, i)
+				if err != nil {
+					return statement, 0, err
+				}
+				statement.block = append(statement.block, inner)
+				i = next
+			}
+			if i == len(tokens) {
+				return statement, 0, fmt.Errorf("unterminated block %q", strings.Join(statement.args, " "))
+			}
+			return statement, i + 1, nil
+		case "}":
+			return statement, 0, fmt.Errorf("unexpected }")
+		default:
+			statement.args = append(statement.args, tokens[i])
+		}
+	}
+
+	if len(statement.args) > 0 {
+		return statement, 0, fmt.Errorf("unterminated statement %q", strings.Join(statement.args, " "))
+	}
+	return statement, i, nil
+}
+
+// tokenizeDhcpd splits a dhcpd.leases file into words, quoted strings (without the quotes) and the {, } and ;
+// punctuation, dropping comments.
+func tokenizeDhcpd(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []string
+	for i := 0; i < len(data); {
+		switch c := data[i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			var value strings.Builder
+			for i++; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				value.WriteByte(data[i])
+			}
+			if i == len(data) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, value.String())
+			i++
+		default:
+			start := i
+			for i < len(data) && !strings.ContainsRune(" \t\r\n{};\"#", rune(data[i])) {
+				i++
+			}
+			tokens = append(tokens, string(data[start:i]))
+		}
+	}
+
+	return tokens, nil
+}
+
+// LeaseFileSource keeps a HostMap up to date with the leases in the lease file of a DHCP server running on the same
+// machine. The file is reloaded whenever it changes. The leases already in the file when it's first loaded are only
+// known, their hosts come online once seen on the network. New and renewed leases update the hosts, as the host must
+// have talked to the server, and leases that are removed or released take the address offline. The host name of each
+// lease is stored in the HostMap metadata.
+type LeaseFileSource struct {
+	path   string
+	format LeaseFileFormat
+	hosts  *HostMap
+	// only the leases of addresses in one of the prefixes are tracked, all of them if empty
+	prefixes []netip.Prefix
+	// whether the file was loaded before, the leases found in it at first may be long stale
+	loaded bool
+
+	leases map[leaseKey]FileLease
+	mux    *sync.RWMutex
+}
+
+// leaseKey identifies a lease by the MAC and IP of the client only, the addresses of the HostMap also carry the
+// interface and VLAN the host was seen on
+type leaseKey struct {
+	mac string
+	ip  netip.Addr
+}
+
+func leaseKeyOf(addr Addr) leaseKey {
+	return leaseKey{mac: string(addr.MAC), ip: addr.IP}
+}
+
+// leaseNeverExpires is the expiry of infinite leases
+var leaseNeverExpires = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// NewLeaseFileSource returns a source of the leases in the file for the hosts. When a DHCP server serves several
+// networks from the same file, the prefixes restrict the source to the leases of the network the hosts are on, e.g.
+// the subnets of the interface they're captured from.
+func NewLeaseFileSource(path string, format LeaseFileFormat, hosts *HostMap, prefixes ...netip.Prefix) *LeaseFileSource {
+	return &LeaseFileSource{
+		path:     path,
+		format:   format,
+		hosts:    hosts,
+		prefixes: prefixes,
+		leases:   make(map[leaseKey]FileLease),
+		mux:      &sync.RWMutex{},
+	}
+}
+
+// serves returns whether the lease of the ip is tracked by the source.
+func (s *LeaseFileSource) serves(ip netip.Addr) bool {
+	if len(s.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run reloads the lease file each time it changes until the context is done. The file should be loaded with Load
+// first, Run only picks up the changes that follow.
+func (s *LeaseFileSource) Run(ctx context.Context) error {
+	return watchFile(ctx, s.path, func() {
+		if err := s.Load(); err != nil {
+			s.hosts.logger.Error(err, "failed reloading lease file", "path", s.path)
+		}
+	})
+}
+
+// Load reads the lease file and updates the hosts with what changed since it was last loaded.
+func (s *LeaseFileSource) Load() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	leases, err := ParseLeases(f, s.format)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", filepath.Base(s.path), err)
+	}
+
+	s.update(leases)
+	return nil
+}
+
+func (s *LeaseFileSource) update(all []FileLease) {
+	var leases []FileLease
+	for _, lease := range all {
+		if s.serves(lease.Addr.IP) {
+			leases = append(leases, lease)
+		}
+	}
+
+	s.mux.Lock()
+	previous := s.leases
+	s.leases = make(map[leaseKey]FileLease, len(leases))
+
+	var (
+		updated []Addr
+		removed []Addr
+	)
+	for _, lease := range leases {
+		key := leaseKeyOf(lease.Addr)
+		s.leases[key] = lease
+
+		if existing, ok := previous[key]; s.loaded && (!ok || !existing.Expires.Equal(lease.Expires)) {
+			updated = append(updated, lease.Addr)
+		}
+	}
+	s.loaded = true
+	for key, lease := range previous {
+		if _, ok := s.leases[key]; !ok {
+			removed = append(removed, lease.Addr)
+		}
+	}
+	s.mux.Unlock()
+
+	for _, lease := range leases {
+		if lease.HostName != "" {
+			s.hosts.SetMetadata(lease.Addr, HostNameMetadataKey, lease.HostName)
+		}
+	}
+	for _, addr := range removed {
+		s.hosts.MarkOffline(addr)
+	}
+	if len(updated) > 0 {
+		s.hosts.UpdateAddresses(updated)
+	}
+}
+
+// Expiry returns when the lease for the MAC and IP of the address expires, far in the future if it never does, or the
+// zero time if there isn't one. It can be used with ExpiryOption so silent hosts stay online until their lease runs
+// out.
+func (s *LeaseFileSource) Expiry(addr Addr) time.Time {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	lease, ok := s.leases[leaseKeyOf(addr)]
+	if !ok {
+		return time.Time{}
+	}
+	if lease.Expires.IsZero() {
+		return leaseNeverExpires
+	}
+	return lease.Expires
+}
@@ -0,0 +1,176 @@
+package hostmonitor_test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseLeaseFile(t *testing.T, path string, format hostmonitor.LeaseFileFormat) []hostmonitor.FileLease {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	leases, err := hostmonitor.ParseLeases(f, format)
+	require.NoError(t, err)
+	return leases
+}
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	leases := parseLeaseFile(t, "testdata/dnsmasq.leases", hostmonitor.DnsmasqLeaseFormat)
+	require.Len(t, leases, 2, "ipv6 leases are skipped")
+
+	assert.Equal(t, mustMAC(t, "1a:1a:1a:1a:1a:1a"), leases[0].Addr.MAC)
+	assert.Equal(t, mustIP(t, "192.168.1.10"), leases[0].Addr.IP)
+	assert.Equal(t, "laptop", leases[0].HostName)
+	assert.Equal(t, time.Unix(1656014400, 0), leases[0].Expires)
+
+	assert.Equal(t, mustIP(t, "192.168.1.11"), leases[1].Addr.IP)
+	assert.Equal(t, "", leases[1].HostName)
+	assert.True(t, leases[1].Expires.IsZero(), "infinite lease")
+
+	_, err := hostmonitor.ParseDnsmasqLeases(strings.NewReader("soon 1a:1a:1a:1a:1a:1a 192.168.1.10 laptop *\n"))
+	assert.Error(t, err)
+}
+
+func TestParseDhcpdLeases(t *testing.T) {
+	leases := parseLeaseFile(t, "testdata/dhcpd.leases", hostmonitor.DhcpdLeaseFormat)
+	require.Len(t, leases, 2, "freed leases and host declarations are skipped")
+
+	// renewed, the last declaration wins
+	assert.Equal(t, mustMAC(t, "1a:1a:1a:1a:1a:1a"), leases[0].Addr.MAC)
+	assert.Equal(t, mustIP(t, "192.168.1.10"), leases[0].Addr.IP)
+	assert.Equal(t, "laptop", leases[0].HostName)
+	assert.Equal(t, time.Date(2022, 6, 23, 19, 30, 0, 0, time.UTC), leases[0].Expires)
+
+	assert.Equal(t, mustIP(t, "192.168.1.11"), leases[1].Addr.IP)
+	assert.True(t, leases[1].Expires.IsZero(), "never ends")
+
+	for _, invalid := range []string{
+		"lease 192.168.1.10 {\n  binding state active;\n",
+		"lease 192.168.1.10 {\n  ends 4 2022/06/23;\n}\n",
+		"lease 192.168.1.10 {\n  client-hostname \"laptop;\n}\n",
+		"lease bogus {\n}\n",
+	} {
+		_, err := hostmonitor.ParseDhcpdLeases(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestLeaseFileSource_Load(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	write := func(contents string) {
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+	}
+
+	hm := hostmonitor.NewHostMap()
+	source := hostmonitor.NewLeaseFileSource(path, hostmonitor.DnsmasqLeaseFormat, hm)
+
+	write("1656014400 1a:1a:1a:1a:1a:1a 192.168.1.10 laptop *\n1656014400 2b:2b:2b:2b:2b:2b 192.168.1.11 * *\n")
+	require.NoError(t, source.Load())
+
+	// the leases of the first load may be stale, their hosts haven't been seen
+	_, err := drain(hm.Notifications(), 1)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	_, ok := hm.FindByIP(hostmonitor.Addr{IP: mustIP(t, "192.168.1.10")})
+	assert.False(t, ok)
+
+	// both leases were renewed
+	write("1656018000 1a:1a:1a:1a:1a:1a 192.168.1.10 laptop *\n1656018000 2b:2b:2b:2b:2b:2b 192.168.1.11 * *\n")
+	require.NoError(t, source.Load())
+
+	changes, err := drain(hm.Notifications(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[0].ChangeType)
+	assert.Equal(t, hostmonitor.OnlineChange, changes[1].ChangeType)
+
+	hostName, ok := hm.Metadata(hostmonitor.Addr{MAC: mustMAC(t, "1a:1a:1a:1a:1a:1a")}, hostmonitor.HostNameMetadataKey)
+	require.True(t, ok)
+	assert.Equal(t, "laptop", hostName)
+	assert.Equal(t, time.Unix(1656018000, 0), source.Expiry(hostmonitor.Addr{MAC: mustMAC(t, "1a:1a:1a:1a:1a:1a"), IP: mustIP(t, "192.168.1.10")}))
+	// the addresses of a live capture carry the interface and VLAN too
+	assert.Equal(t, time.Unix(1656018000, 0), source.Expiry(hostmonitor.Addr{
+		MAC: mustMAC(t, "1a:1a:1a:1a:1a:1a"), IP: mustIP(t, "192.168.1.10"), Interface: "eth0", VLAN: 10,
+	}))
+	assert.True(t, source.Expiry(hostmonitor.Addr{MAC: mustMAC(t, "1a:1a:1a:1a:1a:1a"), IP: mustIP(t, "192.168.1.99")}).IsZero())
+
+	// the second lease was released
+	write("1656018000 1a:1a:1a:1a:1a:1a 192.168.1.10 laptop *\n")
+	require.NoError(t, source.Load())
+
+	changes, err = drain(hm.Notifications(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, hostmonitor.OfflineChange, changes[0].ChangeType)
+	assert.Equal(t, mustIP(t, "192.168.1.11"), changes[0].Addr.IP)
+
+	// an infinite lease never expires
+	write("0 1a:1a:1a:1a:1a:1a 192.168.1.10 laptop *\n")
+	require.NoError(t, source.Load())
+	expires := source.Expiry(hostmonitor.Addr{MAC: mustMAC(t, "1a:1a:1a:1a:1a:1a"), IP: mustIP(t, "192.168.1.10")})
+	assert.True(t, expires.After(time.Now().AddDate(100, 0, 0)))
+}
+
+func TestLeaseFileSource_Prefixes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	require.NoError(t, os.WriteFile(path, []byte("1656014400 1a:1a:1a:1a:1a:1a 192.168.1.10 laptop *\n"+
+		"1656014400 2b:2b:2b:2b:2b:2b 192.168.2.10 camera *\n"), 0o644))
+
+	// the server hands out leases on two networks, only those of the hosts' network are tracked
+	hm := hostmonitor.NewHostMap()
+	source := hostmonitor.NewLeaseFileSource(path, hostmonitor.DnsmasqLeaseFormat, hm, netip.MustParsePrefix("192.168.2.0/24"))
+	require.NoError(t, source.Load())
+
+	assert.Equal(t, time.Unix(1656014400, 0), source.Expiry(hostmonitor.Addr{MAC: mustMAC(t, "2b:2b:2b:2b:2b:2b"), IP: mustIP(t, "192.168.2.10")}))
+	assert.True(t, source.Expiry(hostmonitor.Addr{MAC: mustMAC(t, "1a:1a:1a:1a:1a:1a"), IP: mustIP(t, "192.168.1.10")}).IsZero())
+	_, ok := hm.Metadata(hostmonitor.Addr{MAC: mustMAC(t, "1a:1a:1a:1a:1a:1a")}, hostmonitor.HostNameMetadataKey)
+	assert.False(t, ok)
+	_, ok = hm.Metadata(hostmonitor.Addr{MAC: mustMAC(t, "2b:2b:2b:2b:2b:2b")}, hostmonitor.HostNameMetadataKey)
+	assert.True(t, ok)
+}
+
+func TestLeaseFileSource_Run(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("watching files isn't supported on", runtime.GOOS)
+	}
+
+	path := filepath.Join(t.TempDir(), "dhcpd.leases")
+	require.NoError(t, os.WriteFile(path, nil, 0o644))
+
+	hm := hostmonitor.NewHostMap()
+	source := hostmonitor.NewLeaseFileSource(path, hostmonitor.DhcpdLeaseFormat, hm)
+	require.NoError(t, source.Load())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- source.Run(ctx)
+	}()
+
+	// replaced the way dhcpd does
+	time.Sleep(100 * time.Millisecond)
+	replacement := path + "~"
+	require.NoError(t, os.WriteFile(replacement, []byte("lease 192.168.1.10 {\n  binding state active;\n  hardware ethernet 1a:1a:1a:1a:1a:1a;\n}\n"), 0o644))
+	require.NoError(t, os.Rename(replacement, path))
+
+	ch := hm.Notifications()
+	select {
+	case change := <-ch:
+		assert.Equal(t, hostmonitor.OnlineChange, change.ChangeType)
+		assert.Equal(t, mustIP(t, "192.168.1.10"), change.Addr.IP)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease file change not noticed")
+	}
+
+	cancel()
+	assert.True(t, errors.Is(<-done, context.Canceled))
+}
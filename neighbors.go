@@ -0,0 +1,192 @@
+package hostmonitor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// the kernel's ARP table
+const procNetARP = "/proc/net/arp"
+
+// flag of complete /proc/net/arp entries, see ATF_COM in linux/if_arp.h
+const arpCompleteFlag = 0x2
+
+// Neighbor is an entry in the neighbor table of an interface.
+type Neighbor struct {
+	Addr      Addr
+	Interface string
+	// State is the state of the entry as reported by ip neigh, e.g. REACHABLE or STALE, or empty if not known.
+	State string
+}
+
+// LoadARPTable reads the complete entries of the kernel's ARP table from /proc/net/arp, limited to the given
+// interfaces if any.
+func LoadARPTable(ifaces ...string) ([]Neighbor, error) {
+	f, err := os.Open(procNetARP)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	neighbors, err := ParseProcNetARP(f)
+	if err != nil {
+		return nil, err
+	}
+	return filterNeighbors(neighbors, ifaces), nil
+}
+
+// LoadIPNeighbors reads the resolved entries of the kernel's neighbor table, both ARP and NDP, from the output of
+// `ip neigh show`, limited to the given interfaces if any.
+func LoadIPNeighbors(ifaces ...string) ([]Neighbor, error) {
+	out, err := exec.Command("ip", "neigh", "show").Output()
+	if err != nil {
+		return nil, fmt.Errorf("running ip neigh: %w", err)
+	}
+
+	neighbors, err := ParseIPNeigh(bytes.NewReader(out))
+	if err != nil {
+		return nil, err
+	}
+	return filterNeighbors(neighbors, ifaces), nil
+}
+
+// ParseProcNetARP parses the complete entries of /proc/net/arp, incomplete entries don't have a MAC yet.
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.1.1      0x1         0x2         3c:3c:3c:3c:3c:3c     *        eth0
+func ParseProcNetARP(r io.Reader) ([]Neighbor, error) {
+	var neighbors []Neighbor
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if line == 1 || len(fields) == 0 {
+			// header
+			continue
+		}
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("line %d: expected 6 fields, got %d", line, len(fields))
+		}
+
+		flags, err := strconv.ParseUint(strings.TrimPrefix(fields[2], "0x"), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid flags %q", line, fields[2])
+		}
+		if flags&arpCompleteFlag == 0 {
+			continue
+		}
+
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		neighbors = append(neighbors, Neighbor{
+			Addr: Addr{
+				MAC: mac,
+				IP:  ip,
+			},
+			Interface: fields[5],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return neighbors, nil
+}
+
+// ParseIPNeigh parses the output of `ip neigh show`, skipping entries without a link-layer address such as FAILED
+// and INCOMPLETE ones.
+//
+//	192.168.1.1 dev eth0 lladdr 3c:3c:3c:3c:3c:3c REACHABLE
+//	fe80::3c dev eth0 lladdr 3c:3c:3c:3c:3c:3c router STALE
+func ParseIPNeigh(r io.Reader) ([]Neighbor, error) {
+	var neighbors []Neighbor
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		neighbor := Neighbor{Addr: Addr{IP: ip}}
+		for i := 1; i < len(fields); i++ {
+			switch fields[i] {
+			case "dev", "lladdr", "proto", "vlan", "nud":
+				if i+1 == len(fields) {
+					return nil, fmt.Errorf("line %d: missing value for %s", line, fields[i])
+				}
+				i++
+				switch fields[i-1] {
+				case "dev":
+					neighbor.Interface = fields[i]
+				case "lladdr":
+					if neighbor.Addr.MAC, err = net.ParseMAC(fields[i]); err != nil {
+						return nil, fmt.Errorf("line %d: %w", line, err)
+					}
+				}
+			case "router", "proxy", "extern_learn", "offload":
+				// flags
+			default:
+				// the states come last, there can be more than one, e.g. "STALE PERMANENT"
+				neighbor.State = strings.Join(fields[i:], " ")
+				i = len(fields)
+			}
+		}
+
+		if len(neighbor.Addr.MAC) == 0 {
+			continue
+		}
+		neighbors = append(neighbors, neighbor)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return neighbors, nil
+}
+
+func filterNeighbors(neighbors []Neighbor, ifaces []string) []Neighbor {
+	if len(ifaces) == 0 {
+		return neighbors
+	}
+
+	var filtered []Neighbor
+	for _, neighbor := range neighbors {
+		for _, iface := range ifaces {
+			if neighbor.Interface == iface {
+				filtered = append(filtered, neighbor)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// NeighborAddrs returns the addresses of the neighbors.
+func NeighborAddrs(neighbors []Neighbor) []Addr {
+	addrs := make([]Addr, len(neighbors))
+	for i, neighbor := range neighbors {
+		addrs[i] = neighbor.Addr
+	}
+	return addrs
+}
@@ -0,0 +1,56 @@
+package hostmonitor_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	hostmonitor "github.com/rickbau5/host-monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcNetARP(t *testing.T) {
+	f, err := os.Open("testdata/proc_net_arp")
+	require.NoError(t, err)
+	defer f.Close()
+
+	neighbors, err := hostmonitor.ParseProcNetARP(f)
+	require.NoError(t, err)
+	require.Len(t, neighbors, 3, "incomplete entries are skipped")
+
+	assert.Equal(t, hostmonitor.Neighbor{
+		Addr:      hostmonitor.Addr{MAC: mustMAC(t, "3c:3c:3c:3c:3c:3c"), IP: mustIP(t, "192.168.1.1")},
+		Interface: "eth0",
+	}, neighbors[0])
+	assert.Equal(t, "wlan0", neighbors[2].Interface)
+	assert.Equal(t, mustIP(t, "10.0.0.5"), neighbors[2].Addr.IP)
+
+	_, err = hostmonitor.ParseProcNetARP(strings.NewReader("header\n192.168.1.1 0x1 0x2 3c:3c:3c:3c:3c:3c eth0\n"))
+	assert.Error(t, err)
+}
+
+func TestParseIPNeigh(t *testing.T) {
+	f, err := os.Open("testdata/ip_neigh")
+	require.NoError(t, err)
+	defer f.Close()
+
+	neighbors, err := hostmonitor.ParseIPNeigh(f)
+	require.NoError(t, err)
+	require.Len(t, neighbors, 5, "entries without a link-layer address are skipped")
+
+	assert.Equal(t, hostmonitor.Neighbor{
+		Addr:      hostmonitor.Addr{MAC: mustMAC(t, "3c:3c:3c:3c:3c:3c"), IP: mustIP(t, "192.168.1.1")},
+		Interface: "eth0",
+		State:     "REACHABLE",
+	}, neighbors[0])
+	assert.Equal(t, "wlan0", neighbors[2].Interface)
+	assert.Equal(t, "PERMANENT", neighbors[2].State)
+
+	router := neighbors[3]
+	assert.Equal(t, mustIP(t, "fe80::3c"), router.Addr.IP)
+	assert.Equal(t, "STALE", router.State)
+
+	_, err = hostmonitor.ParseIPNeigh(strings.NewReader("192.168.1.1 dev eth0 lladdr bogus REACHABLE\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package hostmonitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// DefaultProbeTimeout is how long a probe waits for a reply unless configured otherwise.
+const DefaultProbeTimeout = time.Second
+
+// ErrProbeNotSupported is returned by a Prober that can't probe an address, e.g. ARP for an ipv6 address. The host goes
+// offline as if it wasn't probed.
+var ErrProbeNotSupported = errors.New("probe not supported for address")
+
+// Prober checks that a host is still on the network before it's reported offline, see ProberOption.
+type Prober interface {
+	// Probe returns true if the host replied.
+	Probe(ctx context.Context, addr Addr) (bool, error)
+}
+
+// ProberFunc is a function used as a Prober.
+type ProberFunc func(ctx context.Context, addr Addr) (bool, error)
+
+func (f ProberFunc) Probe(ctx context.Context, addr Addr) (bool, error) {
+	return f(ctx, addr)
+}
+
+// MultiProber probes with each prober in turn until one gets a reply. An error is only returned if every prober failed.
+func MultiProber(probers ...Prober) Prober {
+	return ProberFunc(func(ctx context.Context, addr Addr) (bool, error) {
+		var errs []error
+		for _, prober := range probers {
+			replied, err := prober.Probe(ctx, addr)
+			if replied {
+				return true, nil
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return false, ctx.Err()
+				}
+				errs = append(errs, err)
+			}
+		}
+
+		if len(errs) < len(probers) {
+			// probed, but no reply
+			return false, nil
+		}
+		for _, err := range errs {
+			if !errors.Is(err, ErrProbeNotSupported) {
+				return false, fmt.Errorf("all probes failed: %w", err)
+			}
+		}
+		return false, ErrProbeNotSupported
+	})
+}
+
+// NewProber creates a prober for the hosts on iface from a list of methods: arp for ARP requests and icmp for ICMP
+// echo requests. Probes are sent in the order given.
+func NewProber(iface string, methods ...string) (Prober, error) {
+	var probers []Prober
+	for _, method := range methods {
+		switch strings.ToLower(strings.TrimSpace(method)) {
+		case "arp":
+			prober, err := NewARPProber(iface, DefaultProbeTimeout)
+			if err != nil {
+				return nil, err
+			}
+			probers = append(probers, prober)
+		case "icmp":
+			probers = append(probers, &ICMPProber{Timeout: DefaultProbeTimeout})
+		default:
+			return nil, fmt.Errorf("unknown probe method %q", method)
+		}
+	}
+
+	if len(probers) == 1 {
+		return probers[0], nil
+	}
+	return MultiProber(probers...), nil
+}
+
+// ICMPProber probes hosts with an ICMP echo request. Unless Privileged is set the unprivileged datagram sockets are
+// used, on linux the group of the process must be allowed by the net.ipv4.ping_group_range sysctl.
+type ICMPProber struct {
+	Timeout    time.Duration
+	Privileged bool
+
+	seq uint16
+	mux sync.Mutex
+}
+
+func (p *ICMPProber) Probe(ctx context.Context, addr Addr) (bool, error) {
+	network, listen, proto, echoType, replyType := "udp4", "0.0.0.0", 1, icmp.Type(ipv4.ICMPTypeEcho), icmp.Type(ipv4.ICMPTypeEchoReply)
+	if addr.IP.Is6() && !addr.IP.Is4In6() {
+		network, listen, proto, echoType, replyType = "udp6", "::", 58, ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	if p.Privileged {
+		network = strings.Replace(network, "udp4", "ip4:icmp", 1)
+		network = strings.Replace(network, "udp6", "ip6:ipv6-icmp", 1)
+	}
+
+	conn, err := icmp.ListenPacket(network, listen)
+	if err != nil {
+		return false, fmt.Errorf("listening for icmp: %w", err)
+	}
+	defer conn.Close()
+
+	p.mux.Lock()
+	p.seq++
+	seq := int(p.seq)
+	p.mux.Unlock()
+
+	request, err := (&icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{
+			ID:   os.Getpid() & 0xffff,
+			Seq:  seq,
+			Data: []byte("host-monitor"),
+		},
+	}).Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+
+	ip := addr.IP.Unmap()
+	var dst net.Addr = &net.UDPAddr{IP: ip.AsSlice(), Zone: ip.Zone()}
+	if p.Privileged {
+		dst = &net.IPAddr{IP: ip.AsSlice(), Zone: ip.Zone()}
+	}
+	if _, err := conn.WriteTo(request, dst); err != nil {
+		return false, fmt.Errorf("sending icmp echo: %w", err)
+	}
+
+	deadline := probeDeadline(ctx, p.Timeout)
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return false, ctx.Err()
+			}
+			return false, fmt.Errorf("reading icmp echo reply: %w", err)
+		}
+
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		// the kernel rewrites the id of unprivileged echo requests so only the sequence is checked
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == seq && peerIP(peer).Equal(ip.AsSlice()) {
+			return true, nil
+		}
+	}
+}
+
+func peerIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
+
+// probeDeadline returns when a probe started now gives up, the earlier of the timeout and the deadline of the context.
+func probeDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	return deadline
+}
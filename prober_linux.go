@@ -0,0 +1,174 @@
+//go:build linux
+// +build linux
+
+package hostmonitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+// how often a blocked read wakes up to check the context
+const arpReadInterval = 100 * time.Millisecond
+
+// ARPProber probes hosts with an ARP request sent to their MAC from its own raw socket on the interface, so it works
+// alongside a capture. Only ipv4 addresses can be probed.
+type ARPProber struct {
+	Timeout time.Duration
+
+	fd      int
+	ifindex int
+	mac     net.HardwareAddr
+	ip      netip.Addr
+
+	// one probe at a time, replies are read from the same socket
+	mux *sync.Mutex
+}
+
+func NewARPProber(iface string, timeout time.Duration) (*ARPProber, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("finding interface %s: %w", iface, err)
+	}
+
+	ip, err := interfaceIPv4(netIface)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return nil, fmt.Errorf("opening arp socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: netIface.Index}); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("binding arp socket to %s: %w", iface, err)
+	}
+
+	return &ARPProber{
+		Timeout: timeout,
+		fd:      fd,
+		ifindex: netIface.Index,
+		mac:     netIface.HardwareAddr,
+		ip:      ip,
+		mux:     &sync.Mutex{},
+	}, nil
+}
+
+func (p *ARPProber) Probe(ctx context.Context, addr Addr) (bool, error) {
+	target := addr.IP.Unmap()
+	if !target.Is4() {
+		return false, ErrProbeNotSupported
+	}
+
+	dst := addr.MAC
+	if len(dst) != 6 {
+		dst = layers.EthernetBroadcast
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{
+			SrcMAC:       p.mac,
+			DstMAC:       dst,
+			EthernetType: layers.EthernetTypeARP,
+		},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   p.mac,
+			SourceProtAddress: p.ip.AsSlice(),
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    target.AsSlice(),
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	to := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  p.ifindex,
+		Halen:    6,
+	}
+	copy(to.Addr[:], dst)
+	if err := unix.Sendto(p.fd, buf.Bytes(), 0, to); err != nil {
+		return false, fmt.Errorf("sending arp request: %w", err)
+	}
+
+	deadline := probeDeadline(ctx, p.Timeout)
+	frame := make([]byte, 128)
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return false, ctx.Err()
+		}
+		if wait > arpReadInterval {
+			wait = arpReadInterval
+		}
+		tv := unix.NsecToTimeval(wait.Nanoseconds())
+		if err := unix.SetsockoptTimeval(p.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return false, err
+		}
+
+		n, _, err := unix.Recvfrom(p.fd, frame, 0)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("reading arp reply: %w", err)
+		}
+
+		packet := gopacket.NewPacket(frame[:n], layers.LayerTypeEthernet, gopacket.NoCopy)
+		arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+		if !ok || arp.Operation != layers.ARPReply {
+			continue
+		}
+		if sender, ok := netip.AddrFromSlice(arp.SourceProtAddress); ok && sender == target {
+			return true, nil
+		}
+	}
+}
+
+// Close closes the socket of the prober.
+func (p *ARPProber) Close() error {
+	return unix.Close(p.fd)
+}
+
+func interfaceIPv4(iface *net.Interface) (netip.Addr, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("listing addresses of %s: %w", iface.Name, err)
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip, ok := netip.AddrFromSlice(ipNet.IP.To4()); ok {
+			return ip, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("interface %s has no ipv4 address to send arp requests from", iface.Name)
+}
+
+// htons converts to network byte order, the protocol of packet sockets is expected in it
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package hostmonitor
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ARPProber probes hosts with ARP requests, which is only supported on linux.
+type ARPProber struct{}
+
+func NewARPProber(iface string, timeout time.Duration) (*ARPProber, error) {
+	return nil, errors.New("arp probing is only supported on linux")
+}
+
+func (p *ARPProber) Probe(ctx context.Context, addr Addr) (bool, error) {
+	return false, ErrProbeNotSupported
+}
+
+// Close closes the socket of the prober.
+func (p *ARPProber) Close() error {
+	return nil
+}
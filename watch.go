@@ -0,0 +1,39 @@
+package hostmonitor
+
+import (
+	"context"
+	"time"
+)
+
+// files are usually written in several steps, wait for them to settle before reporting a change
+const watchSettleTime = 100 * time.Millisecond
+
+// settle calls changed once the events for a file have stopped arriving for watchSettleTime, until the context is
+// done or the events are closed.
+func settle(ctx context.Context, events <-chan struct{}, changed func()) error {
+	timer := time.NewTimer(watchSettleTime)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-events:
+			if !ok {
+				return nil
+			}
+			timer.Reset(watchSettleTime)
+		case <-timer.C:
+			changed()
+		}
+	}
+}
+
+// notify sends an event without blocking, one pending event is as good as many.
+func notify(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,129 @@
+//go:build darwin
+// +build darwin
+
+package hostmonitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// how often the kqueue wait returns to check the context
+const kqueueWaitTimeout = 250 * time.Millisecond
+
+// watchFile calls changed whenever the file at path changes, until the context is done. The file is watched with
+// kqueue, when it's deleted or replaced the directory is watched until it's back.
+func watchFile(ctx context.Context, path string, changed func()) error {
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return fmt.Errorf("kqueue: %w", err)
+	}
+	defer unix.Close(kq)
+
+	events := make(chan struct{}, 1)
+	watchErr := make(chan error, 1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		defer close(events)
+		watchErr <- watchKqueue(ctx, kq, path, events)
+	}()
+
+	err = settle(ctx, events, changed)
+	if err == nil {
+		err = <-watchErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func watchKqueue(ctx context.Context, kq int, path string, events chan<- struct{}) error {
+	for ctx.Err() == nil {
+		fd, err := unix.Open(path, unix.O_EVTONLY, 0)
+		if errors.Is(err, unix.ENOENT) {
+			// replaced, wait for it to come back
+			if err := waitForFile(ctx, kq, path); err != nil {
+				return err
+			}
+			notify(events)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("opening %s: %w", path, err)
+		}
+
+		err = waitForChanges(ctx, kq, fd, events)
+		unix.Close(fd)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitForChanges sends an event for every write to the file until it's deleted or renamed.
+func waitForChanges(ctx context.Context, kq, fd int, events chan<- struct{}) error {
+	fflags := uint32(unix.NOTE_WRITE | unix.NOTE_EXTEND | unix.NOTE_ATTRIB | unix.NOTE_DELETE | unix.NOTE_RENAME | unix.NOTE_REVOKE)
+	return waitKqueue(ctx, kq, fd, fflags, func(event unix.Kevent_t) bool {
+		notify(events)
+		return event.Fflags&(unix.NOTE_DELETE|unix.NOTE_RENAME|unix.NOTE_REVOKE) != 0
+	})
+}
+
+// waitForFile waits for a write to the directory of path until the file exists again.
+func waitForFile(ctx context.Context, kq int, path string) error {
+	dir, err := unix.Open(filepath.Dir(path), unix.O_EVTONLY, 0)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", filepath.Dir(path), err)
+	}
+	defer unix.Close(dir)
+
+	exists := func() bool {
+		var stat unix.Stat_t
+		return unix.Stat(path, &stat) == nil
+	}
+	if exists() {
+		return nil
+	}
+
+	return waitKqueue(ctx, kq, dir, unix.NOTE_WRITE, func(unix.Kevent_t) bool {
+		return exists()
+	})
+}
+
+// waitKqueue registers for the vnode events of fd and calls handle for each until it returns true or the context is
+// done.
+func waitKqueue(ctx context.Context, kq, fd int, fflags uint32, handle func(unix.Kevent_t) bool) error {
+	var change unix.Kevent_t
+	unix.SetKevent(&change, fd, unix.EVFILT_VNODE, unix.EV_ADD|unix.EV_CLEAR)
+	change.Fflags = fflags
+	if _, err := unix.Kevent(kq, []unix.Kevent_t{change}, nil, nil); err != nil {
+		return fmt.Errorf("registering kevent: %w", err)
+	}
+
+	timeout := unix.NsecToTimespec(int64(kqueueWaitTimeout))
+	received := make([]unix.Kevent_t, 1)
+	for ctx.Err() == nil {
+		n, err := unix.Kevent(kq, nil, received, &timeout)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("waiting for kevent: %w", err)
+		}
+		if n == 1 && int(received[0].Ident) == fd && handle(received[0]) {
+			return nil
+		}
+	}
+
+	return nil
+}
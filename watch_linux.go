@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package hostmonitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchFile calls changed whenever the file at path changes, until the context is done. The directory is watched with
+// inotify rather than the file itself so the file being replaced, as dhcpd does, is noticed too.
+func watchFile(ctx context.Context, path string, changed func()) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("inotify init: %w", err)
+	}
+	// non-blocking so reads go through the runtime poller and closing unblocks them
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+
+	dir, name := filepath.Dir(path), filepath.Base(path)
+	mask := uint32(unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_DELETE)
+	if _, err := unix.InotifyAddWatch(fd, dir, mask); err != nil {
+		return fmt.Errorf("watching %s: %w", dir, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := make(chan struct{}, 1)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(events)
+		readErr <- readInotify(f, name, events)
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = f.Close()
+	}()
+
+	err = settle(ctx, events, changed)
+	if err == nil {
+		// the events were closed, the reader failed
+		err = <-readErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// readInotify sends an event for every inotify event for the file name until the inotify file is closed.
+func readInotify(f *os.File, name string, events chan<- struct{}) error {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("reading inotify events: %w", err)
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			// the name is padded with nulls
+			if end := indexNull(nameBytes); string(nameBytes[:end]) == name {
+				notify(events)
+			}
+		}
+	}
+}
+
+func indexNull(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
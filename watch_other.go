@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package hostmonitor
+
+import (
+	"context"
+	"errors"
+)
+
+// watchFile isn't supported on this platform.
+func watchFile(ctx context.Context, path string, changed func()) error {
+	return errors.New("watching files is only supported on linux and macOS")
+}